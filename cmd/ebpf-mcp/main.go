@@ -41,6 +41,7 @@ func main() {
 		"ebpf-mcp",
 		"0.1.0",
 		server.WithToolCapabilities(false),
+		server.WithLogging(),
 		server.WithRecovery(),
 	)
 
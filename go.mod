@@ -7,6 +7,7 @@ toolchain go1.23.10
 require (
 	github.com/cilium/ebpf v0.18.0
 	github.com/mark3labs/mcp-go v0.0.0
+	github.com/ulikunitz/xz v0.5.15
 	golang.org/x/sys v0.30.0
 )
 
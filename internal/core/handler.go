@@ -34,9 +34,9 @@ func HandleMCP(w http.ResponseWriter, r *http.Request) {
 	case "tools/list":
 		json.NewEncoder(w).Encode(tools.List(req.ID))
 	case "tools/call":
-		json.NewEncoder(w).Encode(tools.Call(req))
+		json.NewEncoder(w).Encode(tools.Call(r.Context(), req))
 	case "tools/execute":
-		json.NewEncoder(w).Encode(tools.Call(req))
+		json.NewEncoder(w).Encode(tools.Call(r.Context(), req))
 	default:
 		json.NewEncoder(w).Encode(types.NewErrorResponseWithCode(req.ID, -32601, "Method not found"))
 	}
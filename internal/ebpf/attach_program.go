@@ -3,8 +3,14 @@ package ebpf
 
 import (
 	"fmt"
+	"log"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/btf"
 	"github.com/cilium/ebpf/link"
 )
 
@@ -17,155 +23,458 @@ type AttachProgramArgs struct {
 }
 
 type AttachProgramResult struct {
-	Success     bool   `json:"success"`
-	ToolVersion string `json:"tool_version"`
-	LinkID      int    `json:"link_id,omitempty"`
-	PinPath     string `json:"pin_path,omitempty"`
-	Message     string `json:"message,omitempty"`
-	Error       string `json:"error,omitempty"`
+	Success     bool          `json:"success"`
+	ToolVersion string        `json:"tool_version"`
+	LinkID      int           `json:"link_id,omitempty"`
+	Handle      string        `json:"handle,omitempty"`
+	PinPath     string        `json:"pin_path,omitempty"`
+	LinkInfo    *AttachedLink `json:"link_info,omitempty"`
+	// ExtraLinks are the links to the further locations of a USDT probe.
+	ExtraLinks []*AttachedLink `json:"extra_links,omitempty"`
+	USDT       *USDTProbe      `json:"usdt,omitempty"`
+	Message    string          `json:"message,omitempty"`
+	Error      string          `json:"error,omitempty"`
 }
 
-func AttachProgram(args *AttachProgramArgs) (*AttachProgramResult, error) {
-	// For now, return a mock response since actual attachment requires root privileges
-	// and proper eBPF program loading infrastructure
+// AttachedLink is the kernel's view of a freshly created link.
+type AttachedLink struct {
+	ID         int    `json:"id"`
+	ProgramID  int    `json:"program_id"`
+	Type       string `json:"type"`
+	AttachType string `json:"attach_type"`
+	Target     string `json:"target"`
+	Handle     string `json:"handle,omitempty"`
+	PinPath    string `json:"pin_path,omitempty"`
+}
 
-	result := &AttachProgramResult{
-		Success:     true,
-		ToolVersion: "v1",
-		LinkID:      args.ProgramID + 1000, // Mock link ID
-		Message:     fmt.Sprintf("Program %d attached as %s", args.ProgramID, args.AttachType),
-	}
+const cgroupRoot = "/sys/fs/cgroup"
 
-	// If pin_path is provided, simulate pinning
-	if args.PinPath != "" {
-		result.PinPath = args.PinPath
-		result.Message += fmt.Sprintf(" and pinned to %s", args.PinPath)
-	}
+// cgroupAttachTypes maps the values accepted in options.attach_type to
+// kernel attach types for cgroup programs.
+var cgroupAttachTypes = map[string]ebpf.AttachType{
+	"ingress":      ebpf.AttachCGroupInetIngress,
+	"egress":       ebpf.AttachCGroupInetEgress,
+	"sock_create":  ebpf.AttachCGroupInetSockCreate,
+	"sock_release": ebpf.AttachCgroupInetSockRelease,
+	"sock_ops":     ebpf.AttachCGroupSockOps,
+	"device":       ebpf.AttachCGroupDevice,
+	"bind4":        ebpf.AttachCGroupInet4Bind,
+	"bind6":        ebpf.AttachCGroupInet6Bind,
+	"connect4":     ebpf.AttachCGroupInet4Connect,
+	"connect6":     ebpf.AttachCGroupInet6Connect,
+	"post_bind4":   ebpf.AttachCGroupInet4PostBind,
+	"post_bind6":   ebpf.AttachCGroupInet6PostBind,
+	"sendmsg4":     ebpf.AttachCGroupUDP4Sendmsg,
+	"sendmsg6":     ebpf.AttachCGroupUDP6Sendmsg,
+	"recvmsg4":     ebpf.AttachCGroupUDP4Recvmsg,
+	"recvmsg6":     ebpf.AttachCGroupUDP6Recvmsg,
+	"getpeername4": ebpf.AttachCgroupInet4GetPeername,
+	"getpeername6": ebpf.AttachCgroupInet6GetPeername,
+	"getsockname4": ebpf.AttachCgroupInet4GetSockname,
+	"getsockname6": ebpf.AttachCgroupInet6GetSockname,
+	"sysctl":       ebpf.AttachCGroupSysctl,
+	"getsockopt":   ebpf.AttachCGroupGetsockopt,
+	"setsockopt":   ebpf.AttachCGroupSetsockopt,
+}
 
-	// Add target information if provided
-	if args.Target != "" {
-		result.Message += fmt.Sprintf(" on target %s", args.Target)
-	}
+// defaultCgroupAttachTypes is used when options.attach_type is not given and
+// the program type only has one sensible hook.
+var defaultCgroupAttachTypes = map[ebpf.ProgramType]ebpf.AttachType{
+	ebpf.CGroupSKB:    ebpf.AttachCGroupInetIngress,
+	ebpf.CGroupSock:   ebpf.AttachCGroupInetSockCreate,
+	ebpf.SockOps:      ebpf.AttachCGroupSockOps,
+	ebpf.CGroupDevice: ebpf.AttachCGroupDevice,
+	ebpf.CGroupSysctl: ebpf.AttachCGroupSysctl,
+}
 
-	return result, nil
+var xdpModes = map[string]link.XDPAttachFlags{
+	"generic": link.XDPGenericMode,
+	"skb":     link.XDPGenericMode,
+	"driver":  link.XDPDriverMode,
+	"native":  link.XDPDriverMode,
+	"offload": link.XDPOffloadMode,
+	"hw":      link.XDPOffloadMode,
+}
+
+var linkTypeNames = map[link.Type]string{
+	link.RawTracepointType: "raw_tracepoint",
+	link.TracingType:       "tracing",
+	link.CgroupType:        "cgroup",
+	link.IterType:          "iter",
+	link.NetNsType:         "netns",
+	link.XDPType:           "xdp",
+	link.PerfEventType:     "perf_event",
+	link.KprobeMultiType:   "kprobe_multi",
+	link.TCXType:           "tcx",
+	link.UprobeMultiType:   "uprobe_multi",
+	link.NetfilterType:     "netfilter",
+	link.NetkitType:        "netkit",
+}
+
+func linkTypeName(t link.Type) string {
+	if name, ok := linkTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", t)
 }
 
-// AttachProgramActual would be the real implementation
-func AttachProgramActual(args *AttachProgramArgs) (*AttachProgramResult, error) {
-	// This is what the actual implementation would look like
-	// when you have proper eBPF programs loaded
+func attachFailure(err error) (*AttachProgramResult, error) {
+	return &AttachProgramResult{
+		Success:     false,
+		ToolVersion: "v1",
+		Error:       err.Error(),
+	}, err
+}
 
-	// Get the program by ID (this would require maintaining a registry)
-	var prog *ebpf.Program
-	// prog = getProgramByID(args.ProgramID)
+// AttachProgram attaches a program held by (or opened through) the registry
+// to a kernel hook and registers the resulting link.
+func AttachProgram(args *AttachProgramArgs) (*AttachProgramResult, error) {
+	if args == nil {
+		return attachFailure(fmt.Errorf("args cannot be nil"))
+	}
 
-	if prog == nil {
-		return &AttachProgramResult{
-			Success:     false,
-			ToolVersion: "v1",
-			Error:       fmt.Sprintf("program with ID %d not found", args.ProgramID),
-		}, fmt.Errorf("program not found")
+	// Resolve the program through the registry; programs loaded elsewhere
+	// are opened by kernel ID.
+	prog, progHandle, err := objects.OpenProgram(args.ProgramID)
+	if err != nil {
+		return attachFailure(fmt.Errorf("program with ID %d not found: %w", args.ProgramID, err))
 	}
+	defer objects.Release(progHandle)
+
+	log.Printf("[DEBUG] Attaching program %d (%s) as %s", args.ProgramID, prog, args.AttachType)
 
 	var l link.Link
-	var err error
+	var target string
+	// USDT probes compiled into several places need a link for each.
+	var extra []link.Link
+	var usdt *USDTProbe
 
 	switch args.AttachType {
 	case "xdp":
-		if args.Target == "" {
-			return &AttachProgramResult{
-				Success:     false,
-				ToolVersion: "v1",
-				Error:       "target interface required for XDP attachment",
-			}, fmt.Errorf("target required for XDP")
+		l, target, err = attachXDP(prog, args)
+	case "kprobe", "kretprobe":
+		l, target, err = attachKprobe(prog, args)
+	case "uprobe", "uretprobe":
+		l, target, err = attachUprobe(prog, args)
+	case "usdt":
+		var links []link.Link
+		links, target, usdt, err = attachUSDT(prog, args)
+		if err == nil {
+			l, extra = links[0], links[1:]
+		}
+	case "tracepoint":
+		l, target, err = attachTracepoint(prog, args)
+	case "raw_tracepoint":
+		l, target, err = attachRawTracepoint(prog, args)
+	case "fentry", "fexit", "fmod_ret", "tp_btf", "lsm", "iter":
+		l, target, err = attachBTF(prog, args)
+	case "cgroup":
+		l, target, err = attachCgroup(prog, args)
+	default:
+		err = fmt.Errorf("unsupported attach type: %s", args.AttachType)
+	}
+	if err != nil {
+		return attachFailure(err)
+	}
+
+	links := append([]link.Link{l}, extra...)
+	closeAll := func() {
+		for _, l := range links {
+			l.Close()
+		}
+	}
+
+	// Get link info
+	infos := make([]*link.Info, len(links))
+	for i, l := range links {
+		infos[i], err = l.Info()
+		if err != nil {
+			closeAll()
+			return attachFailure(fmt.Errorf("failed to get link info: %w", err))
 		}
-		// l, err = link.AttachXDP(link.XDPOptions{
-		// 	Program:   prog,
-		// 	Interface: args.Target,
-		// })
-
-	case "kprobe":
-		if args.Target == "" {
-			return &AttachProgramResult{
-				Success:     false,
-				ToolVersion: "v1",
-				Error:       "target function required for kprobe attachment",
-			}, fmt.Errorf("target required for kprobe")
+	}
+
+	// Pin the link if requested; further links get numbered paths.
+	pinPaths := make([]string, len(links))
+	if args.PinPath != "" {
+		for i, l := range links {
+			pinPaths[i] = args.PinPath
+			if i > 0 {
+				pinPaths[i] = fmt.Sprintf("%s_%d", args.PinPath, i)
+			}
+			if err := l.Pin(pinPaths[i]); err != nil {
+				for _, l := range links[:i] {
+					l.Unpin()
+				}
+				closeAll()
+				return attachFailure(fmt.Errorf("failed to pin link: %w", err))
+			}
 		}
-		// l, err = link.Kprobe(args.Target, prog, nil)
-
-	case "kretprobe":
-		if args.Target == "" {
-			return &AttachProgramResult{
-				Success:     false,
-				ToolVersion: "v1",
-				Error:       "target function required for kretprobe attachment",
-			}, fmt.Errorf("target required for kretprobe")
+	}
+
+	result := &AttachProgramResult{
+		Success:     true,
+		ToolVersion: "v1",
+		PinPath:     args.PinPath,
+		USDT:        usdt,
+		Message:     fmt.Sprintf("Successfully attached program %d as %s on %s", args.ProgramID, args.AttachType, target),
+	}
+	for i, l := range links {
+		info := infos[i]
+		handle := objects.AddLink(l, int(info.ID), target, progHandle, pinPaths[i])
+		attached := &AttachedLink{
+			ID:         int(info.ID),
+			ProgramID:  int(info.Program),
+			Type:       linkTypeName(info.Type),
+			AttachType: args.AttachType,
+			Target:     target,
+		}
+		if i == 0 {
+			result.LinkID, result.Handle, result.LinkInfo = attached.ID, handle, attached
+			continue
 		}
-		// l, err = link.Kretprobe(args.Target, prog, nil)
+		attached.Handle, attached.PinPath = handle, pinPaths[i]
+		result.ExtraLinks = append(result.ExtraLinks, attached)
+	}
+	if len(links) > 1 {
+		result.Message += fmt.Sprintf(" (%d locations)", len(links))
+	}
+	return result, nil
+}
 
-	case "tracepoint":
-		if args.Target == "" {
-			return &AttachProgramResult{
-				Success:     false,
-				ToolVersion: "v1",
-				Error:       "target tracepoint required for tracepoint attachment",
-			}, fmt.Errorf("target required for tracepoint")
+func attachXDP(prog *ebpf.Program, args *AttachProgramArgs) (link.Link, string, error) {
+	if args.Target == "" {
+		return nil, "", fmt.Errorf("target interface required for XDP attachment")
+	}
+
+	iface, err := resolveInterface(args.Target)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var flags link.XDPAttachFlags
+	if v, ok := args.Options["flags"].(float64); ok {
+		flags = link.XDPAttachFlags(v)
+	}
+	if mode, ok := args.Options["mode"].(string); ok && mode != "" {
+		f, ok := xdpModes[strings.ToLower(mode)]
+		if !ok {
+			return nil, "", fmt.Errorf("unknown XDP mode %q (expected generic, driver or offload)", mode)
 		}
-		// Parse tracepoint format: "group:name"
-		// l, err = link.Tracepoint(link.TracepointOptions{
-		// 	Program: prog,
-		// 	Group:   group,
-		// 	Name:    name,
-		// })
+		flags |= f
+	}
 
-	default:
-		return &AttachProgramResult{
-			Success:     false,
-			ToolVersion: "v1",
-			Error:       fmt.Sprintf("unsupported attach type: %s", args.AttachType),
-		}, fmt.Errorf("unsupported attach type: %s", args.AttachType)
+	modeBits := flags & (link.XDPGenericMode | link.XDPDriverMode | link.XDPOffloadMode)
+	if modeBits&(modeBits-1) != 0 {
+		return nil, "", fmt.Errorf("only one XDP mode may be set, got flags 0x%x", uint32(flags))
 	}
 
+	l, err := link.AttachXDP(link.XDPOptions{
+		Program:   prog,
+		Interface: iface.Index,
+		Flags:     flags,
+	})
 	if err != nil {
-		return &AttachProgramResult{
-			Success:     false,
-			ToolVersion: "v1",
-			Error:       err.Error(),
-		}, err
+		return nil, "", fmt.Errorf("attach XDP to %s: %w", iface.Name, err)
 	}
+	return l, iface.Name, nil
+}
 
-	// Pin the link if requested
-	if args.PinPath != "" {
-		err = l.Pin(args.PinPath)
+// resolveInterface accepts an interface name or index.
+func resolveInterface(target string) (*net.Interface, error) {
+	if idx, err := strconv.Atoi(target); err == nil {
+		iface, err := net.InterfaceByIndex(idx)
 		if err != nil {
-			l.Close()
-			return &AttachProgramResult{
-				Success:     false,
-				ToolVersion: "v1",
-				Error:       fmt.Sprintf("failed to pin link: %v", err),
-			}, err
+			return nil, fmt.Errorf("interface index %d: %w", idx, err)
 		}
+		return iface, nil
 	}
 
-	// Get link info
-	linkInfo, err := l.Info()
+	iface, err := net.InterfaceByName(target)
+	if err != nil {
+		return nil, fmt.Errorf("interface %q: %w", target, err)
+	}
+	return iface, nil
+}
+
+func attachKprobe(prog *ebpf.Program, args *AttachProgramArgs) (link.Link, string, error) {
+	if args.Target == "" {
+		return nil, "", fmt.Errorf("target function required for %s attachment", args.AttachType)
+	}
+
+	exists, err := kernelSymbolExists(args.Target)
 	if err != nil {
-		l.Close()
-		return &AttachProgramResult{
-			Success:     false,
-			ToolVersion: "v1",
-			Error:       fmt.Sprintf("failed to get link info: %v", err),
-		}, err
+		log.Printf("[WARN] Cannot validate kernel symbol %s: %v", args.Target, err)
+	} else if !exists {
+		return nil, "", fmt.Errorf("kernel function %q not found in %s", args.Target, kallsymsPath)
 	}
 
-	linkID := linkInfo.ID
+	opts := &link.KprobeOptions{}
+	if v, ok := args.Options["offset"].(float64); ok {
+		opts.Offset = uint64(v)
+	}
+	if v, ok := args.Options["cookie"].(float64); ok {
+		opts.Cookie = uint64(v)
+	}
 
-	return &AttachProgramResult{
-		Success:     true,
-		ToolVersion: "v1",
-		LinkID:      int(linkID),
-		PinPath:     args.PinPath,
-		Message:     fmt.Sprintf("Successfully attached program %d as %s", args.ProgramID, args.AttachType),
-	}, nil
+	var l link.Link
+	if args.AttachType == "kretprobe" {
+		if v, ok := args.Options["max_active"].(float64); ok {
+			opts.RetprobeMaxActive = int(v)
+		}
+		l, err = link.Kretprobe(args.Target, prog, opts)
+	} else {
+		l, err = link.Kprobe(args.Target, prog, opts)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("attach %s to %s: %w", args.AttachType, args.Target, err)
+	}
+	return l, args.Target, nil
+}
+
+// parseTracepoint splits "group:name" (or "group/name") into its parts.
+func parseTracepoint(target string) (string, string, error) {
+	sep := strings.IndexAny(target, ":/")
+	if sep <= 0 || sep == len(target)-1 {
+		return "", "", fmt.Errorf("tracepoint must be in group:name format, got %q", target)
+	}
+	return target[:sep], target[sep+1:], nil
+}
+
+func attachTracepoint(prog *ebpf.Program, args *AttachProgramArgs) (link.Link, string, error) {
+	if args.Target == "" {
+		return nil, "", fmt.Errorf("target tracepoint required for tracepoint attachment")
+	}
+
+	group, name, err := parseTracepoint(args.Target)
+	if err != nil {
+		return nil, "", err
+	}
+
+	l, err := link.Tracepoint(group, name, prog, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("attach tracepoint %s:%s: %w", group, name, err)
+	}
+	return l, group + ":" + name, nil
+}
+
+func attachCgroup(prog *ebpf.Program, args *AttachProgramArgs) (link.Link, string, error) {
+	if args.Target == "" {
+		return nil, "", fmt.Errorf("target cgroup path required for cgroup attachment")
+	}
+
+	path := args.Target
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(cgroupRoot, path)
+	}
+
+	attachType, ok := defaultCgroupAttachTypes[prog.Type()]
+	hook := "default"
+	if name, set := args.Options["attach_type"].(string); set && name != "" {
+		attachType, ok = cgroupAttachTypes[name]
+		if !ok {
+			return nil, "", fmt.Errorf("unknown cgroup attach_type %q", name)
+		}
+		hook = name
+	}
+	if !ok {
+		return nil, "", fmt.Errorf("options.attach_type is required for %s programs", prog.Type())
+	}
+
+	l, err := link.AttachCgroup(link.CgroupOptions{
+		Path:    path,
+		Attach:  attachType,
+		Program: prog,
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("attach %s hook to cgroup %s: %w", hook, path, err)
+	}
+	return l, path, nil
+}
+
+func attachRawTracepoint(prog *ebpf.Program, args *AttachProgramArgs) (link.Link, string, error) {
+	if args.Target == "" {
+		return nil, "", fmt.Errorf("target tracepoint required for raw_tracepoint attachment")
+	}
+
+	// Raw tracepoints are named without their group.
+	name := args.Target
+	if _, n, err := parseTracepoint(name); err == nil {
+		name = n
+	}
+
+	l, err := link.AttachRawTracepoint(link.RawTracepointOptions{Name: name, Program: prog})
+	if err != nil {
+		return nil, "", fmt.Errorf("attach raw_tracepoint %s: %w", name, err)
+	}
+	return l, name, nil
+}
+
+// attachBTF attaches programs whose target was resolved against BTF when
+// they were loaded. The target can't be changed here, so a target given
+// is only checked against the program's.
+func attachBTF(prog *ebpf.Program, args *AttachProgramArgs) (link.Link, string, error) {
+	kind, ok := btfProgramKinds[strings.ToUpper(args.AttachType)]
+	if !ok || prog.Type() != kind.progType {
+		return nil, "", fmt.Errorf("%s programs can't be attached as %s: load the program with program_type %s and attach_to set to the target",
+			prog.Type(), args.AttachType, strings.ToUpper(args.AttachType))
+	}
+
+	// Check the target before attaching, so a program loaded against
+	// another hook never runs there.
+	target := args.Target
+	name, module := progBTFTarget(prog)
+	switch {
+	case name != "" && args.Target != "" && args.Target != name:
+		return nil, "", fmt.Errorf("program was loaded against %s %q, not %q: reload it with attach_to set to the target", args.AttachType, name, args.Target)
+	case name == "" && args.Target != "":
+		return nil, "", fmt.Errorf("the kernel doesn't report what the program was loaded against, so target %q can't be checked: leave target out", args.Target)
+	case name != "":
+		target = name
+		if module != "" {
+			target += " [" + module + "]"
+		}
+	default:
+		target = prog.String()
+	}
+	cookie := uint64(intOption(args.Options, "cookie"))
+
+	var l link.Link
+	var err error
+	switch args.AttachType {
+	case "lsm":
+		l, err = link.AttachLSM(link.LSMOptions{Program: prog, Cookie: cookie})
+	case "iter":
+		opts := link.IterOptions{Program: prog}
+		if id := intOption(args.Options, "map_id"); id != 0 {
+			m, handle, merr := objects.OpenMap(id)
+			if merr != nil {
+				return nil, "", fmt.Errorf("map with ID %d not found: %w", id, merr)
+			}
+			defer objects.Release(handle)
+			opts.Map = m
+		}
+		l, err = link.AttachIter(opts)
+	default:
+		l, err = link.AttachTracing(link.TracingOptions{Program: prog, AttachType: kind.attachType, Cookie: cookie})
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("attach %s: %w", args.AttachType, err)
+	}
+	return l, target, nil
+}
+
+// progBTFTarget names the target a program was loaded against, or returns
+// "" on kernels that don't report it.
+func progBTFTarget(prog *ebpf.Program) (string, string) {
+	info, err := rawProgAttachInfoFromFD(prog.FD())
+	if err != nil || info.AttachBTFID == 0 {
+		return "", ""
+	}
+	name, module, err := btfTargetName(btf.ID(info.AttachBTFObjID), btf.TypeID(info.AttachBTFID))
+	if err != nil {
+		log.Printf("[DEBUG] Cannot name BTF target %d/%d: %v", info.AttachBTFObjID, info.AttachBTFID, err)
+		return "", ""
+	}
+	return name, module
 }
@@ -0,0 +1,450 @@
+// internal/ebpf/attachments.go
+package ebpf
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"syscall"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"golang.org/x/sys/unix"
+)
+
+// Attachment is a program attached without a BPF link: with BPF_PROG_ATTACH
+// to a cgroup or tcx hook, or through netlink to XDP or a tc classifier.
+// Link enumeration doesn't see these, yet they keep the program loaded.
+type Attachment struct {
+	ProgramID int    `json:"program_id"`
+	Hook      string `json:"hook"`
+	Target    string `json:"target"`
+
+	detach func() error
+}
+
+func (a Attachment) String() string {
+	return fmt.Sprintf("program %d on %s %s", a.ProgramID, a.Hook, a.Target)
+}
+
+// Attributes of tc filters missing from x/sys/unix.
+const (
+	tcaKind    = 1
+	tcaOptions = 2
+	tcaBPFID   = 11
+
+	// tcHClsactIngress and tcHClsactEgress are the parents of filters on
+	// the clsact qdisc (ffff:fff2 and ffff:fff3); the legacy ingress qdisc
+	// accepts the first too.
+	tcHClsactIngress = 0xfffffff2
+	tcHClsactEgress  = 0xfffffff3
+
+	sizeofTcMsg = 20
+)
+
+// linkAttachKey identifies a hook a link attaches a program to.
+type linkAttachKey struct {
+	program ebpf.ProgramID
+	attach  ebpf.AttachType
+	target  uint64
+}
+
+// nonLinkAttachments returns where target programs are attached without a
+// link. Only the hooks the target's program types can attach to are looked
+// at, and only in the server's network namespace. Hooks that can't be
+// queried, e.g. on kernels predating them, are skipped.
+func nonLinkAttachments(t *unloadTarget) ([]Attachment, error) {
+	types := make(map[ebpf.ProgramType]bool)
+	for _, p := range t.programs {
+		types[p.progType] = true
+	}
+	cgroup := types[ebpf.CGroupSKB] || types[ebpf.CGroupSock] || types[ebpf.SockOps] ||
+		types[ebpf.CGroupDevice] || types[ebpf.CGroupSockAddr] || types[ebpf.CGroupSysctl] ||
+		types[ebpf.CGroupSockopt]
+	if !cgroup && !types[ebpf.SchedCLS] && !types[ebpf.XDP] {
+		return nil, nil
+	}
+
+	links, err := linkAttachKeys(t)
+	if err != nil {
+		return nil, err
+	}
+
+	var found []Attachment
+	if cgroup {
+		found = append(found, cgroupAttachments(t, links)...)
+	}
+	if types[ebpf.SchedCLS] {
+		found = append(found, tcxAttachments(t, links)...)
+		tc, err := tcAttachments(t)
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, tc...)
+	}
+	if types[ebpf.XDP] {
+		xdp, err := xdpAttachments(t, links)
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, xdp...)
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].ProgramID != found[j].ProgramID {
+			return found[i].ProgramID < found[j].ProgramID
+		}
+		return found[i].Target < found[j].Target
+	})
+	return found, nil
+}
+
+// linkAttachKeys returns the cgroup, tcx and XDP hooks links attach target
+// programs to, so attachments found by querying the hooks can be told apart
+// from links on kernels that don't report link IDs.
+func linkAttachKeys(t *unloadTarget) (map[linkAttachKey]bool, error) {
+	keys := make(map[linkAttachKey]bool)
+	it := new(link.Iterator)
+	defer it.Close()
+	for it.Next() {
+		info, err := it.Link.Info()
+		if err != nil {
+			continue
+		}
+		if _, ok := t.programs[int(info.Program)]; !ok {
+			continue
+		}
+		key := linkAttachKey{program: info.Program}
+		switch {
+		case info.Cgroup() != nil:
+			cg := info.Cgroup()
+			key.attach, key.target = ebpf.AttachType(cg.AttachType), cg.CgroupId
+		case info.TCX() != nil:
+			tcx := info.TCX()
+			key.attach, key.target = ebpf.AttachType(tcx.AttachType), uint64(tcx.Ifindex)
+		case info.XDP() != nil:
+			key.attach, key.target = ebpf.AttachXDP, uint64(info.XDP().Ifindex)
+		default:
+			continue
+		}
+		keys[key] = true
+	}
+	if err := it.Err(); err != nil {
+		return nil, fmt.Errorf("enumerate links: %w", err)
+	}
+	return keys, nil
+}
+
+// queryAttached returns the target programs attached to a hook without a
+// link.
+func queryAttached(t *unloadTarget, links map[linkAttachKey]bool, target int, attach ebpf.AttachType, id uint64) []ebpf.ProgramID {
+	res, err := link.QueryPrograms(link.QueryOptions{Target: target, Attach: attach})
+	if err != nil {
+		return nil
+	}
+	var ids []ebpf.ProgramID
+	for _, p := range res.Programs {
+		if _, ok := t.programs[int(p.ID)]; !ok {
+			continue
+		}
+		if _, ok := p.LinkID(); ok || links[linkAttachKey{p.ID, attach, id}] {
+			continue
+		}
+		ids = append(ids, p.ID)
+	}
+	return ids
+}
+
+// cgroupAttachments walks the cgroup v2 hierarchy for target programs
+// attached with BPF_PROG_ATTACH.
+func cgroupAttachments(t *unloadTarget, links map[linkAttachKey]bool) []Attachment {
+	paths, err := cgroupPaths()
+	if err != nil {
+		return nil
+	}
+
+	var found []Attachment
+	for cgid, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		for name, attach := range cgroupAttachTypes {
+			for _, id := range queryAttached(t, links, int(f.Fd()), attach, cgid) {
+				found = append(found, Attachment{
+					ProgramID: int(id),
+					Hook:      "cgroup",
+					Target:    path + "/" + name,
+					detach: func() error {
+						cg, err := os.Open(path)
+						if err != nil {
+							return err
+						}
+						defer cg.Close()
+						return detachProgram(id, int(cg.Fd()), attach)
+					},
+				})
+			}
+		}
+		f.Close()
+	}
+	return found
+}
+
+// tcxAttachments looks for target programs attached to tcx hooks with
+// BPF_PROG_ATTACH.
+func tcxAttachments(t *unloadTarget, links map[linkAttachKey]bool) []Attachment {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+
+	var found []Attachment
+	for _, iface := range ifaces {
+		for name, attach := range map[string]ebpf.AttachType{"ingress": ebpf.AttachTCXIngress, "egress": ebpf.AttachTCXEgress} {
+			for _, id := range queryAttached(t, links, iface.Index, attach, uint64(iface.Index)) {
+				found = append(found, Attachment{
+					ProgramID: int(id),
+					Hook:      "tcx",
+					Target:    iface.Name + "/" + name,
+					detach:    func() error { return detachProgram(id, iface.Index, attach) },
+				})
+			}
+		}
+	}
+	return found
+}
+
+// detachProgram undoes a BPF_PROG_ATTACH of program id.
+func detachProgram(id ebpf.ProgramID, target int, attach ebpf.AttachType) error {
+	prog, err := ebpf.NewProgramFromID(id)
+	if err != nil {
+		return err
+	}
+	defer prog.Close()
+	return link.RawDetachProgram(link.RawDetachProgramOptions{
+		Target:  target,
+		Program: prog,
+		Attach:  attach,
+	})
+}
+
+// xdpAttachments looks for target programs attached to XDP through netlink.
+func xdpAttachments(t *unloadTarget, links map[linkAttachKey]bool) ([]Attachment, error) {
+	req := make([]byte, unix.SizeofIfInfomsg)
+	msgs, err := netlinkRequest(unix.RTM_GETLINK, unix.NLM_F_DUMP, req)
+	if err != nil {
+		return nil, fmt.Errorf("list interfaces: %w", err)
+	}
+
+	modes := []struct {
+		attr  uint16
+		flags uint32
+		name  string
+	}{
+		{unix.IFLA_XDP_SKB_PROG_ID, unix.XDP_FLAGS_SKB_MODE, "generic"},
+		{unix.IFLA_XDP_DRV_PROG_ID, unix.XDP_FLAGS_DRV_MODE, "driver"},
+		{unix.IFLA_XDP_HW_PROG_ID, unix.XDP_FLAGS_HW_MODE, "offload"},
+	}
+
+	var found []Attachment
+	for _, m := range msgs {
+		if m.Header.Type != unix.RTM_NEWLINK || len(m.Data) < unix.SizeofIfInfomsg {
+			continue
+		}
+		ifindex := int32(binary.NativeEndian.Uint32(m.Data[4:8]))
+		xdp, ok := netlinkAttrs(m.Data[unix.SizeofIfInfomsg:])[unix.IFLA_XDP]
+		if !ok {
+			continue
+		}
+		attrs := netlinkAttrs(xdp)
+		for _, mode := range modes {
+			v, ok := attrs[mode.attr]
+			if !ok || len(v) < 4 {
+				continue
+			}
+			id := ebpf.ProgramID(binary.NativeEndian.Uint32(v))
+			if _, ok := t.programs[int(id)]; !ok {
+				continue
+			}
+			if links[linkAttachKey{id, ebpf.AttachXDP, uint64(ifindex)}] {
+				continue
+			}
+			found = append(found, Attachment{
+				ProgramID: int(id),
+				Hook:      "xdp",
+				Target:    interfaceName(uint32(ifindex)) + "/" + mode.name,
+				detach:    func() error { return detachXDP(ifindex, id, mode.flags) },
+			})
+		}
+	}
+	return found, nil
+}
+
+// detachXDP removes program id from an interface, unless another program
+// replaced it in the meantime.
+func detachXDP(ifindex int32, id ebpf.ProgramID, flags uint32) error {
+	prog, err := ebpf.NewProgramFromID(id)
+	if err != nil {
+		return err
+	}
+	defer prog.Close()
+
+	// A file descriptor of -1 detaches; XDP_FLAGS_REPLACE makes the kernel
+	// check the program still attached is the expected one.
+	xdp := netlinkAttr(unix.IFLA_XDP_FD, binary.NativeEndian.AppendUint32(nil, ^uint32(0)))
+	xdp = append(xdp, netlinkAttr(unix.IFLA_XDP_FLAGS, binary.NativeEndian.AppendUint32(nil, flags|unix.XDP_FLAGS_REPLACE))...)
+	xdp = append(xdp, netlinkAttr(unix.IFLA_XDP_EXPECTED_FD, binary.NativeEndian.AppendUint32(nil, uint32(prog.FD())))...)
+
+	req := make([]byte, unix.SizeofIfInfomsg)
+	binary.NativeEndian.PutUint32(req[4:8], uint32(ifindex))
+	req = append(req, netlinkAttr(unix.IFLA_XDP|unix.NLA_F_NESTED, xdp)...)
+	_, err = netlinkRequest(unix.RTM_SETLINK, unix.NLM_F_ACK, req)
+	return err
+}
+
+// tcAttachments looks for target programs run by cls_bpf filters on the
+// clsact and ingress qdiscs.
+func tcAttachments(t *unloadTarget) ([]Attachment, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("list interfaces: %w", err)
+	}
+
+	var found []Attachment
+	for _, iface := range ifaces {
+		for _, parent := range []uint32{tcHClsactIngress, tcHClsactEgress} {
+			req := make([]byte, sizeofTcMsg)
+			binary.NativeEndian.PutUint32(req[4:8], uint32(iface.Index))
+			binary.NativeEndian.PutUint32(req[12:16], parent)
+			msgs, err := netlinkRequest(unix.RTM_GETTFILTER, unix.NLM_F_DUMP, req)
+			if err != nil {
+				// No clsact or ingress qdisc on this interface.
+				continue
+			}
+			for _, m := range msgs {
+				if m.Header.Type != unix.RTM_NEWTFILTER || len(m.Data) < sizeofTcMsg {
+					continue
+				}
+				attrs := netlinkAttrs(m.Data[sizeofTcMsg:])
+				if kind := attrs[tcaKind]; string(kind) != "bpf\x00" {
+					continue
+				}
+				v, ok := netlinkAttrs(attrs[tcaOptions])[tcaBPFID]
+				if !ok || len(v) < 4 {
+					continue
+				}
+				id := int(binary.NativeEndian.Uint32(v))
+				if _, ok := t.programs[id]; !ok {
+					continue
+				}
+
+				filter := append([]byte(nil), m.Data[:sizeofTcMsg]...)
+				handle := binary.NativeEndian.Uint32(filter[8:12])
+				prio := binary.NativeEndian.Uint32(filter[16:20]) >> 16
+				direction := "ingress"
+				if parent == tcHClsactEgress {
+					direction = "egress"
+				}
+				found = append(found, Attachment{
+					ProgramID: id,
+					Hook:      "tc",
+					Target:    fmt.Sprintf("%s/%s prio %d handle 0x%x", iface.Name, direction, prio, handle),
+					detach: func() error {
+						req := append(filter, netlinkAttr(tcaKind, []byte("bpf\x00"))...)
+						_, err := netlinkRequest(unix.RTM_DELTFILTER, unix.NLM_F_ACK, req)
+						return err
+					},
+				})
+			}
+		}
+	}
+	return found, nil
+}
+
+// netlinkRequest sends a route netlink request with body following the
+// message header. It returns the messages of a dump, or waits for the
+// acknowledgement of a request carrying NLM_F_ACK.
+func netlinkRequest(typ, flags uint16, body []byte) ([]syscall.NetlinkMessage, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("netlink socket: %w", err)
+	}
+	defer unix.Close(fd)
+
+	req := make([]byte, unix.NLMSG_HDRLEN, unix.NLMSG_HDRLEN+len(body))
+	binary.NativeEndian.PutUint32(req[0:4], uint32(unix.NLMSG_HDRLEN+len(body)))
+	binary.NativeEndian.PutUint16(req[4:6], typ)
+	binary.NativeEndian.PutUint16(req[6:8], unix.NLM_F_REQUEST|flags)
+	binary.NativeEndian.PutUint32(req[8:12], 1)
+	req = append(req, body...)
+	if err := unix.Sendto(fd, req, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, fmt.Errorf("netlink send: %w", err)
+	}
+
+	var msgs []syscall.NetlinkMessage
+	for {
+		// Parsed messages point into buf, so each read gets its own.
+		buf := make([]byte, 1<<16)
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return nil, fmt.Errorf("netlink receive: %w", err)
+		}
+		replies, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, fmt.Errorf("netlink receive: %w", err)
+		}
+		for _, m := range replies {
+			switch m.Header.Type {
+			case unix.NLMSG_DONE:
+				return msgs, nil
+			case unix.NLMSG_ERROR:
+				if len(m.Data) < 4 {
+					return nil, errors.New("netlink: short error message")
+				}
+				if errno := -int32(binary.NativeEndian.Uint32(m.Data)); errno != 0 {
+					return nil, syscall.Errno(errno)
+				}
+				// An acknowledgement.
+				return msgs, nil
+			default:
+				msgs = append(msgs, m)
+			}
+		}
+	}
+}
+
+// netlinkAttr encodes a netlink attribute, padded to four bytes.
+func netlinkAttr(typ uint16, data []byte) []byte {
+	b := make([]byte, unix.SizeofRtAttr, unix.SizeofRtAttr+len(data)+3)
+	binary.NativeEndian.PutUint16(b[0:2], uint16(unix.SizeofRtAttr+len(data)))
+	binary.NativeEndian.PutUint16(b[2:4], typ)
+	b = append(b, data...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// netlinkAttrs decodes a run of netlink attributes by type, ignoring the
+// nested and byte order flags.
+func netlinkAttrs(b []byte) map[uint16][]byte {
+	attrs := make(map[uint16][]byte)
+	for len(b) >= unix.SizeofRtAttr {
+		n := int(binary.NativeEndian.Uint16(b[0:2]))
+		if n < unix.SizeofRtAttr || n > len(b) {
+			break
+		}
+		typ := binary.NativeEndian.Uint16(b[2:4]) &^ (unix.NLA_F_NESTED | unix.NLA_F_NET_BYTEORDER)
+		attrs[typ] = b[unix.SizeofRtAttr:n]
+		n = (n + 3) &^ 3
+		if n > len(b) {
+			break
+		}
+		b = b[n:]
+	}
+	return attrs
+}
@@ -0,0 +1,553 @@
+// internal/ebpf/btf_codec.go
+package ebpf
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"runtime"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/btf"
+	"golang.org/x/sys/unix"
+)
+
+// mapBTF holds the BTF types describing a map's keys and values.
+type mapBTF struct {
+	Key   btf.Type
+	Value btf.Type
+}
+
+// rawMapInfo mirrors struct bpf_map_info up to the fields we need. cilium's
+// MapInfo doesn't expose the BTF key and value type IDs.
+type rawMapInfo struct {
+	Type                  uint32
+	ID                    uint32
+	KeySize               uint32
+	ValueSize             uint32
+	MaxEntries            uint32
+	MapFlags              uint32
+	Name                  [unix.BPF_OBJ_NAME_LEN]byte
+	Ifindex               uint32
+	BTFVmlinuxValueTypeID uint32
+	NetnsDev              uint64
+	NetnsIno              uint64
+	BTFID                 uint32
+	BTFKeyTypeID          uint32
+	BTFValueTypeID        uint32
+	BTFVmlinuxID          uint32
+	MapExtra              uint64
+}
+
+func rawMapInfoFromFD(fd int) (*rawMapInfo, error) {
+	var info rawMapInfo
+	if err := objGetInfo(fd, unsafe.Pointer(&info), unsafe.Sizeof(info)); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// rawProgAttachInfo is the tail of struct bpf_prog_info naming the BTF
+// target of a program. Kernels before 5.19 leave it zero.
+type rawProgAttachInfo struct {
+	_              [220]byte
+	AttachBTFObjID uint32
+	AttachBTFID    uint32
+	_              [4]byte
+}
+
+func rawProgAttachInfoFromFD(fd int) (*rawProgAttachInfo, error) {
+	var info rawProgAttachInfo
+	if err := objGetInfo(fd, unsafe.Pointer(&info), unsafe.Sizeof(info)); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// objGetInfo fills info with BPF_OBJ_GET_INFO_BY_FD. The buffer is kept in
+// attr as a pointer rather than an integer, so that the garbage collector
+// keeps it alive and adjusts it if the stack moves before the syscall.
+// Nothing may follow it: a trailing zero-size field makes Go pad the
+// struct to 24 bytes, and the kernel then fails the call with EINVAL.
+func objGetInfo(fd int, info unsafe.Pointer, size uintptr) error {
+	const bpfObjGetInfoByFD = 15
+
+	attr := struct {
+		bpfFD   uint32
+		infoLen uint32
+		info    unsafe.Pointer
+	}{
+		bpfFD:   uint32(fd),
+		infoLen: uint32(size),
+		info:    info,
+	}
+	_, _, errno := unix.Syscall(unix.SYS_BPF, bpfObjGetInfoByFD, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+	runtime.KeepAlive(&attr)
+	runtime.KeepAlive(info)
+	if errno != 0 {
+		return fmt.Errorf("BPF_OBJ_GET_INFO_BY_FD: %w", errno)
+	}
+	return nil
+}
+
+// loadMapBTF returns the key and value types of a map created with BTF.
+// Maps without BTF return nil and no error.
+func loadMapBTF(m *ebpf.Map) (*mapBTF, error) {
+	raw, err := rawMapInfoFromFD(m.FD())
+	if err != nil {
+		return nil, err
+	}
+	if raw.BTFID == 0 || raw.BTFValueTypeID == 0 {
+		return nil, nil
+	}
+
+	spec, err := loadBTFByID(btf.ID(raw.BTFID))
+	if err != nil {
+		return nil, fmt.Errorf("map BTF %d: %w", raw.BTFID, err)
+	}
+
+	types := &mapBTF{}
+	// Key type 0 means the key has no BTF, e.g. for arrays created
+	// without it; keep the value type anyway.
+	if raw.BTFKeyTypeID != 0 {
+		if types.Key, err = spec.TypeByID(btf.TypeID(raw.BTFKeyTypeID)); err != nil {
+			return nil, fmt.Errorf("key type: %w", err)
+		}
+	}
+	if types.Value, err = spec.TypeByID(btf.TypeID(raw.BTFValueTypeID)); err != nil {
+		return nil, fmt.Errorf("value type: %w", err)
+	}
+	return types, nil
+}
+
+// loadBTFByID returns the BTF object with the given kernel ID. Module BTF is
+// split BTF and is resolved against the kernel's.
+func loadBTFByID(id btf.ID) (*btf.Spec, error) {
+	handle, err := btf.NewHandleFromID(id)
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Close()
+
+	var base *btf.Spec
+	if info, err := handle.Info(); err == nil && info.IsModule() {
+		if base, err = btf.LoadKernelSpec(); err != nil {
+			return nil, fmt.Errorf("kernel BTF: %w", err)
+		}
+	}
+	return handle.Spec(base)
+}
+
+// btfTypeName returns a C-like name for typ, e.g. "struct event" or "__u32".
+func btfTypeName(typ btf.Type) string {
+	if typ == nil {
+		return ""
+	}
+	switch t := typ.(type) {
+	case *btf.Struct:
+		return "struct " + t.Name
+	case *btf.Union:
+		return "union " + t.Name
+	case *btf.Enum:
+		return "enum " + t.Name
+	case *btf.Pointer:
+		return btfTypeName(t.Target) + " *"
+	case *btf.Array:
+		return fmt.Sprintf("%s[%d]", btfTypeName(t.Type), t.Nelems)
+	case *btf.Const:
+		return "const " + btfTypeName(t.Type)
+	case *btf.Volatile:
+		return "volatile " + btfTypeName(t.Type)
+	}
+	if name := typ.TypeName(); name != "" {
+		return name
+	}
+	return fmt.Sprintf("%T", typ)
+}
+
+var errShortBuffer = errors.New("buffer too short for type")
+
+// decodeBTF turns raw bytes into a JSON friendly value following typ:
+// structs become objects, arrays become lists (or strings for char arrays),
+// enums become their value name and integers become numbers.
+func decodeBTF(typ btf.Type, buf []byte) (interface{}, error) {
+	typ = btf.UnderlyingType(typ)
+
+	size, err := btf.Sizeof(typ)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) < size {
+		return nil, fmt.Errorf("%s: %w", btfTypeName(typ), errShortBuffer)
+	}
+
+	switch t := typ.(type) {
+	case *btf.Int:
+		return decodeInt(t, buf[:t.Size]), nil
+
+	case *btf.Enum:
+		v := readUint(buf[:t.Size])
+		for _, val := range t.Values {
+			if val.Value == v {
+				return val.Name, nil
+			}
+		}
+		if t.Signed {
+			return signExtend(v, t.Size), nil
+		}
+		return v, nil
+
+	case *btf.Float:
+		switch t.Size {
+		case 4:
+			return math.Float32frombits(binary.NativeEndian.Uint32(buf)), nil
+		case 8:
+			return math.Float64frombits(binary.NativeEndian.Uint64(buf)), nil
+		}
+		return nil, fmt.Errorf("unsupported float size %d", t.Size)
+
+	case *btf.Pointer:
+		return fmt.Sprintf("0x%x", readUint(buf[:size])), nil
+
+	case *btf.Array:
+		if isCharType(t.Type) {
+			s := string(buf[:t.Nelems])
+			if i := strings.IndexByte(s, 0); i >= 0 {
+				s = s[:i]
+			}
+			return s, nil
+		}
+		elemSize, err := btf.Sizeof(t.Type)
+		if err != nil {
+			return nil, err
+		}
+		out := make([]interface{}, t.Nelems)
+		for i := range out {
+			if out[i], err = decodeBTF(t.Type, buf[i*elemSize:]); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+
+	case *btf.Struct:
+		return decodeMembers(t.Members, buf)
+
+	case *btf.Union:
+		return decodeMembers(t.Members, buf)
+	}
+
+	return nil, fmt.Errorf("decoding %s is not supported", btfTypeName(typ))
+}
+
+func decodeMembers(members []btf.Member, buf []byte) (map[string]interface{}, error) {
+	out := make(map[string]interface{}, len(members))
+	for i, m := range members {
+		name := m.Name
+		if name == "" {
+			name = fmt.Sprintf("anon%d", i)
+		}
+
+		off := int(m.Offset.Bytes())
+		if m.BitfieldSize > 0 {
+			out[name] = readBitfield(buf, m.Offset, m.BitfieldSize)
+			continue
+		}
+		v, err := decodeBTF(m.Type, buf[off:])
+		if err != nil {
+			return nil, fmt.Errorf("member %s: %w", name, err)
+		}
+		// Flatten anonymous structs and unions like C does.
+		if nested, ok := v.(map[string]interface{}); ok && m.Name == "" {
+			for k, nv := range nested {
+				out[k] = nv
+			}
+			continue
+		}
+		out[name] = v
+	}
+	return out, nil
+}
+
+func decodeInt(t *btf.Int, buf []byte) interface{} {
+	v := readUint(buf)
+	switch {
+	case t.Encoding == btf.Bool:
+		return v != 0
+	case t.Encoding == btf.Signed:
+		return signExtend(v, t.Size)
+	}
+	return v
+}
+
+func isCharType(typ btf.Type) bool {
+	i, ok := btf.UnderlyingType(typ).(*btf.Int)
+	return ok && i.Size == 1 && (i.Encoding == btf.Char || strings.Contains(i.Name, "char"))
+}
+
+func readUint(buf []byte) uint64 {
+	switch len(buf) {
+	case 1:
+		return uint64(buf[0])
+	case 2:
+		return uint64(binary.NativeEndian.Uint16(buf))
+	case 4:
+		return uint64(binary.NativeEndian.Uint32(buf))
+	case 8:
+		return binary.NativeEndian.Uint64(buf)
+	}
+	// 128-bit and other odd sizes: keep the low 64 bits.
+	var v uint64
+	for i := 0; i < len(buf) && i < 8; i++ {
+		v |= uint64(buf[i]) << (8 * i)
+	}
+	return v
+}
+
+func signExtend(v uint64, size uint32) int64 {
+	shift := 64 - 8*size
+	if size >= 8 {
+		return int64(v)
+	}
+	return int64(v<<shift) >> shift
+}
+
+// readBitfield extracts a bitfield member. Offsets are in bits from the
+// start of the enclosing struct. This assumes a little-endian host.
+func readBitfield(buf []byte, offset btf.Bits, size btf.Bits) uint64 {
+	var v uint64
+	for i := btf.Bits(0); i < size; i++ {
+		bit := offset + i
+		if int(bit/8) >= len(buf) {
+			break
+		}
+		if buf[bit/8]&(1<<(bit%8)) != 0 {
+			v |= 1 << i
+		}
+	}
+	return v
+}
+
+// encodeBTF is the inverse of decodeBTF: it lays out a JSON value in the
+// memory representation of typ. Struct members missing from an object are
+// zeroed; unknown members are an error so typos don't go unnoticed.
+func encodeBTF(typ btf.Type, v interface{}) ([]byte, error) {
+	typ = btf.UnderlyingType(typ)
+	size, err := btf.Sizeof(typ)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	if err := encodeInto(typ, v, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func encodeInto(typ btf.Type, v interface{}, buf []byte) error {
+	typ = btf.UnderlyingType(typ)
+
+	switch t := typ.(type) {
+	case *btf.Int:
+		n, err := jsonInt(v, t.Encoding == btf.Signed)
+		if err != nil {
+			return fmt.Errorf("%s: %w", btfTypeName(t), err)
+		}
+		if t.Size < 8 && t.Encoding != btf.Signed && n>>(8*t.Size) != 0 {
+			return fmt.Errorf("%s: %d out of range", btfTypeName(t), n)
+		}
+		writeUint(buf[:t.Size], n)
+		return nil
+
+	case *btf.Enum:
+		if name, ok := v.(string); ok {
+			for _, val := range t.Values {
+				if val.Name == name {
+					writeUint(buf[:t.Size], val.Value)
+					return nil
+				}
+			}
+		}
+		n, err := jsonInt(v, t.Signed)
+		if err != nil {
+			return fmt.Errorf("enum %s: expected a value name or number: %w", t.Name, err)
+		}
+		writeUint(buf[:t.Size], n)
+		return nil
+
+	case *btf.Float:
+		f, ok := v.(float64)
+		if !ok {
+			return fmt.Errorf("%s: expected a number, got %T", t.Name, v)
+		}
+		switch t.Size {
+		case 4:
+			binary.NativeEndian.PutUint32(buf, math.Float32bits(float32(f)))
+		case 8:
+			binary.NativeEndian.PutUint64(buf, math.Float64bits(f))
+		default:
+			return fmt.Errorf("unsupported float size %d", t.Size)
+		}
+		return nil
+
+	case *btf.Pointer:
+		n, err := jsonInt(v, false)
+		if err != nil {
+			return fmt.Errorf("pointer: %w", err)
+		}
+		writeUint(buf[:8], n)
+		return nil
+
+	case *btf.Array:
+		if s, ok := v.(string); ok && isCharType(t.Type) {
+			if len(s) > int(t.Nelems) {
+				return fmt.Errorf("string %q longer than %d bytes", s, t.Nelems)
+			}
+			copy(buf, s)
+			return nil
+		}
+		list, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected an array, got %T", btfTypeName(t), v)
+		}
+		if len(list) > int(t.Nelems) {
+			return fmt.Errorf("%s: got %d elements", btfTypeName(t), len(list))
+		}
+		elemSize, err := btf.Sizeof(t.Type)
+		if err != nil {
+			return err
+		}
+		for i, elem := range list {
+			if err := encodeInto(t.Type, elem, buf[i*elemSize:]); err != nil {
+				return fmt.Errorf("element %d: %w", i, err)
+			}
+		}
+		return nil
+
+	case *btf.Struct:
+		return encodeMembers(btfTypeName(t), t.Members, v, buf)
+
+	case *btf.Union:
+		return encodeMembers(btfTypeName(t), t.Members, v, buf)
+	}
+
+	return fmt.Errorf("encoding %s is not supported", btfTypeName(typ))
+}
+
+func encodeMembers(name string, members []btf.Member, v interface{}, buf []byte) error {
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%s: expected an object, got %T", name, v)
+	}
+
+	// Members of anonymous structs and unions are addressed directly, the
+	// way decodeMembers flattens them.
+	type slot struct {
+		member btf.Member
+		base   btf.Bits
+	}
+	slots := make(map[string]slot)
+	var collect func(ms []btf.Member, base btf.Bits)
+	collect = func(ms []btf.Member, base btf.Bits) {
+		for i, m := range ms {
+			if m.Name == "" {
+				switch inner := btf.UnderlyingType(m.Type).(type) {
+				case *btf.Struct:
+					collect(inner.Members, base+m.Offset)
+					continue
+				case *btf.Union:
+					collect(inner.Members, base+m.Offset)
+					continue
+				}
+				m.Name = fmt.Sprintf("anon%d", i)
+			}
+			slots[m.Name] = slot{m, base}
+		}
+	}
+	collect(members, 0)
+
+	for key, val := range obj {
+		s, ok := slots[key]
+		if !ok {
+			return fmt.Errorf("%s has no member %q", name, key)
+		}
+		offset := s.base + s.member.Offset
+		if s.member.BitfieldSize > 0 {
+			n, err := jsonInt(val, false)
+			if err != nil {
+				return fmt.Errorf("member %s: %w", key, err)
+			}
+			writeBitfield(buf, offset, s.member.BitfieldSize, n)
+			continue
+		}
+		if err := encodeInto(s.member.Type, val, buf[offset.Bytes():]); err != nil {
+			return fmt.Errorf("member %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// jsonInt accepts JSON numbers, booleans and strings holding decimal or
+// 0x-prefixed integers, which lets callers pass 64-bit values that don't
+// survive a float64 round trip.
+func jsonInt(v interface{}, signed bool) (uint64, error) {
+	switch n := v.(type) {
+	case float64:
+		if n != math.Trunc(n) {
+			return 0, fmt.Errorf("%v is not an integer", n)
+		}
+		if n < 0 {
+			if !signed {
+				return 0, fmt.Errorf("%v is negative", n)
+			}
+			return uint64(int64(n)), nil
+		}
+		return uint64(n), nil
+	case bool:
+		if n {
+			return 1, nil
+		}
+		return 0, nil
+	case string:
+		if signed && strings.HasPrefix(n, "-") {
+			i, err := strconv.ParseInt(n, 0, 64)
+			return uint64(i), err
+		}
+		return strconv.ParseUint(n, 0, 64)
+	}
+	return 0, fmt.Errorf("expected an integer, got %T", v)
+}
+
+func writeUint(buf []byte, v uint64) {
+	switch len(buf) {
+	case 1:
+		buf[0] = byte(v)
+	case 2:
+		binary.NativeEndian.PutUint16(buf, uint16(v))
+	case 4:
+		binary.NativeEndian.PutUint32(buf, uint32(v))
+	case 8:
+		binary.NativeEndian.PutUint64(buf, v)
+	default:
+		for i := 0; i < len(buf) && i < 8; i++ {
+			buf[i] = byte(v >> (8 * i))
+		}
+	}
+}
+
+func writeBitfield(buf []byte, offset btf.Bits, size btf.Bits, v uint64) {
+	for i := btf.Bits(0); i < size; i++ {
+		bit := offset + i
+		if int(bit/8) >= len(buf) {
+			return
+		}
+		if v&(1<<i) != 0 {
+			buf[bit/8] |= 1 << (bit % 8)
+		} else {
+			buf[bit/8] &^= 1 << (bit % 8)
+		}
+	}
+}
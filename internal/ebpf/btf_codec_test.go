@@ -0,0 +1,236 @@
+package ebpf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/btf"
+)
+
+var (
+	testU8  = &btf.Int{Name: "__u8", Size: 1}
+	testU16 = &btf.Int{Name: "__u16", Size: 2}
+	testU32 = &btf.Int{Name: "__u32", Size: 4}
+	testS16 = &btf.Int{Name: "__s16", Size: 2, Encoding: btf.Signed}
+	testU64 = &btf.Int{Name: "__u64", Size: 8}
+)
+
+// fromJSON returns v as encoding/json decodes it, the form tools hand
+// values to encodeBTF in.
+func fromJSON(t *testing.T, s string) interface{} {
+	t.Helper()
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestBTFRoundTrip(t *testing.T) {
+	bitfields := &btf.Struct{Name: "flags", Size: 4, Members: []btf.Member{
+		{Name: "a", Type: testU32, Offset: 0, BitfieldSize: 3},
+		{Name: "b", Type: testU32, Offset: 3, BitfieldSize: 5},
+		{Name: "c", Type: testU8, Offset: 8},
+		{Name: "d", Type: testU16, Offset: 17, BitfieldSize: 15},
+	}}
+	point := &btf.Struct{Name: "point", Size: 4, Members: []btf.Member{
+		{Name: "x", Type: testS16, Offset: 0},
+		{Name: "y", Type: testS16, Offset: 16},
+	}}
+	signedEnum := &btf.Enum{Name: "level", Size: 2, Signed: true, Values: []btf.EnumValue{
+		{Name: "LOW", Value: uint64(0xffff)},
+		{Name: "HIGH", Value: 1},
+	}}
+	float := &btf.Float{Name: "double", Size: 8}
+
+	tests := []struct {
+		name string
+		typ  btf.Type
+		in   string
+		want interface{}
+	}{
+		{"u32", testU32, `4294967295`, uint64(4294967295)},
+		{"s16", testS16, `-2`, int64(-2)},
+		{"u64 as string", testU64, `"0xffffffffffffffff"`, uint64(1<<64 - 1)},
+		{"typedef", &btf.Typedef{Name: "pid_t", Type: testU32}, `7`, uint64(7)},
+		{"bool", &btf.Int{Name: "bool", Size: 1, Encoding: btf.Bool}, `true`, true},
+		{"double", float, `1.5`, 1.5},
+		{"pointer", &btf.Pointer{Target: testU8}, `"0x1000"`, "0x1000"},
+
+		{"struct", testEventType(),
+			`{"pid": 42, "ret": -2, "comm": "nginx", "ok": true, "state": "SLEEPING", "args": {"fd": -1}, "big": "0x8000000000000000", "flags": 16}`,
+			map[string]interface{}{
+				"pid": uint64(42), "ret": int64(-2), "comm": "nginx", "ok": true, "state": "SLEEPING",
+				"args": map[string]interface{}{"fd": int64(-1)}, "big": uint64(1 << 63), "flags": uint64(16),
+			}},
+		{"struct with members missing", testEventType(), `{"pid": 1}`,
+			map[string]interface{}{
+				"pid": uint64(1), "ret": int64(0), "comm": "", "ok": false, "state": "RUNNING",
+				"args": map[string]interface{}{"fd": int64(0)}, "big": uint64(0), "flags": uint64(0),
+			}},
+		{"bitfields", bitfields, `{"a": 5, "b": 31, "c": 255, "d": 32767}`,
+			map[string]interface{}{"a": uint64(5), "b": uint64(31), "c": uint64(255), "d": uint64(32767)}},
+
+		{"enum by name", testEventType().Members[4].Type, `"SLEEPING"`, "SLEEPING"},
+		{"enum by value", testEventType().Members[4].Type, `1`, "SLEEPING"},
+		{"enum value without a name", testEventType().Members[4].Type, `9`, uint64(9)},
+		{"signed enum", signedEnum, `"LOW"`, "LOW"},
+		{"signed enum value without a name", signedEnum, `-3`, int64(-3)},
+
+		{"array", &btf.Array{Type: testU32, Index: testU32, Nelems: 3}, `[1, 2, 3]`,
+			[]interface{}{uint64(1), uint64(2), uint64(3)}},
+		{"short array", &btf.Array{Type: testU32, Index: testU32, Nelems: 3}, `[1]`,
+			[]interface{}{uint64(1), uint64(0), uint64(0)}},
+		{"array of structs", &btf.Array{Type: point, Index: testU32, Nelems: 2}, `[{"x": 1, "y": -1}, {"x": -2}]`,
+			[]interface{}{
+				map[string]interface{}{"x": int64(1), "y": int64(-1)},
+				map[string]interface{}{"x": int64(-2), "y": int64(0)},
+			}},
+		{"2d array", &btf.Array{Type: &btf.Array{Type: testU8, Index: testU32, Nelems: 2}, Index: testU32, Nelems: 2}, `[[1, 2], [3, 4]]`,
+			[]interface{}{[]interface{}{uint64(1), uint64(2)}, []interface{}{uint64(3), uint64(4)}}},
+		{"char array", &btf.Array{Type: &btf.Int{Name: "char", Size: 1, Encoding: btf.Char}, Index: testU32, Nelems: 4}, `"abcd"`, "abcd"},
+		{"unsigned char array", &btf.Array{Type: &btf.Int{Name: "unsigned char", Size: 1}, Index: testU32, Nelems: 8}, `"ab"`, "ab"},
+	}
+
+	for _, tt := range tests {
+		buf, err := encodeBTF(tt.typ, fromJSON(t, tt.in))
+		if err != nil {
+			t.Errorf("%s: encode: %v", tt.name, err)
+			continue
+		}
+		size, _ := btf.Sizeof(tt.typ)
+		if len(buf) != size {
+			t.Errorf("%s: encoded %d bytes, want %d", tt.name, len(buf), size)
+		}
+		got, err := decodeBTF(tt.typ, buf)
+		if err != nil {
+			t.Errorf("%s: decode: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %#v, want %#v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEncodeBTFLayout(t *testing.T) {
+	buf, err := encodeBTF(testEventType(), fromJSON(t, `{"pid": 258, "ret": -1, "comm": "ab", "state": "SLEEPING", "args": {"fd": 3}, "flags": 7}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make([]byte, 64)
+	binary.NativeEndian.PutUint32(want[0:], 258)
+	binary.NativeEndian.PutUint32(want[4:], 0xffffffff)
+	copy(want[8:], "ab")
+	binary.NativeEndian.PutUint32(want[28:], 1)
+	binary.NativeEndian.PutUint64(want[32:], 3)
+	binary.NativeEndian.PutUint32(want[48:], 7)
+	if !bytes.Equal(buf, want) {
+		t.Errorf("got  %s\nwant %s", hex.EncodeToString(buf), hex.EncodeToString(want))
+	}
+}
+
+func TestEncodeBTFErrors(t *testing.T) {
+	array := &btf.Array{Type: testU32, Index: testU32, Nelems: 2}
+	chars := &btf.Array{Type: &btf.Int{Name: "char", Size: 1, Encoding: btf.Char}, Index: testU32, Nelems: 4}
+	tests := []struct {
+		name string
+		typ  btf.Type
+		in   string
+		want string
+	}{
+		{"out of range", testU8, `256`, "256 out of range"},
+		{"negative unsigned", testU32, `-1`, "-1 is negative"},
+		{"not an integer", testU32, `1.5`, "1.5 is not an integer"},
+		{"not a number", testU32, `{}`, "expected an integer"},
+		{"bad string", testU64, `"nope"`, "invalid syntax"},
+		{"unknown member", testEventType(), `{"pid": 1, "nope": 2}`, `struct event has no member "nope"`},
+		{"bad member", testEventType(), `{"args": {"fd": "x"}}`, "member args: member fd"},
+		{"not an object", testEventType(), `[1]`, "expected an object"},
+		{"not an array", array, `1`, "expected an array"},
+		{"too many elements", array, `[1, 2, 3]`, "got 3 elements"},
+		{"bad element", array, `[1, -1]`, "element 1"},
+		{"string too long", chars, `"abcde"`, "longer than 4 bytes"},
+		{"unknown enum value", testEventType().Members[4].Type, `"STOPPED"`, "expected a value name or number"},
+		{"float as string", &btf.Float{Name: "double", Size: 8}, `"1.5"`, "expected a number"},
+	}
+	for _, tt := range tests {
+		_, err := encodeBTF(tt.typ, fromJSON(t, tt.in))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want an error containing %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestDecodeBTFShortBuffer(t *testing.T) {
+	if _, err := decodeBTF(testEventType(), make([]byte, 63)); err == nil {
+		t.Error("decoded 63 bytes as a 64 byte struct")
+	}
+	if _, err := decodeBTF(testU32, []byte{1, 2}); err == nil {
+		t.Error("decoded 2 bytes as __u32")
+	}
+	// Longer buffers, like padded perf samples, decode their prefix.
+	v, err := decodeBTF(testU16, []byte{1, 0, 0xff, 0xff})
+	if err != nil || v != uint64(1) {
+		t.Errorf("got %v, %v", v, err)
+	}
+}
+
+func TestNewMapEntryPerCPU(t *testing.T) {
+	point := &btf.Struct{Name: "point", Size: 4, Members: []btf.Member{
+		{Name: "x", Type: testS16, Offset: 0},
+		{Name: "y", Type: testS16, Offset: 16},
+	}}
+	om := &openedMap{
+		info: &ebpf.MapInfo{Type: ebpf.PerCPUArray, KeySize: 4, ValueSize: 4},
+		btf:  &mapBTF{Key: testU32, Value: point},
+	}
+
+	key := []byte{1, 0, 0, 0}
+	values := [][]byte{{1, 0, 2, 0}, {3, 0}, {0xff, 0xff, 0, 0}}
+	e := om.newMapEntry(key, values)
+
+	if e.Key != "01000000" || e.DecodedKey != uint64(1) || e.Value != "" || e.DecodedValue != nil {
+		t.Errorf("entry = %+v", e)
+	}
+	if want := []string{"01000200", "0300", "ffff0000"}; !reflect.DeepEqual(e.Values, want) {
+		t.Errorf("Values = %v, want %v", e.Values, want)
+	}
+	// The value of the second CPU doesn't decode; its slot stays nil so the
+	// third CPU's value isn't reported as the second's.
+	want := []interface{}{
+		map[string]interface{}{"x": int64(1), "y": int64(2)},
+		nil,
+		map[string]interface{}{"x": int64(-1), "y": int64(0)},
+	}
+	if !reflect.DeepEqual(e.DecodedValues, want) {
+		t.Errorf("DecodedValues = %#v, want %#v", e.DecodedValues, want)
+	}
+
+	// Without any decoded value, or without BTF, there are none.
+	if e := om.newMapEntry(key, [][]byte{{1}, {2}}); e.DecodedValues != nil || len(e.Values) != 2 {
+		t.Errorf("undecodable entry = %+v", e)
+	}
+	om.btf = nil
+	if e := om.newMapEntry(key, values); e.DecodedValues != nil || e.DecodedKey != nil || len(e.Values) != 3 {
+		t.Errorf("entry without BTF = %+v", e)
+	}
+}
+
+func TestNewMapEntry(t *testing.T) {
+	om := &openedMap{
+		info: &ebpf.MapInfo{Type: ebpf.Hash, KeySize: 4, ValueSize: 8},
+		btf:  &mapBTF{Key: testU32, Value: testU64},
+	}
+	e := om.newMapEntry([]byte{2, 0, 0, 0}, [][]byte{{5, 0, 0, 0, 0, 0, 0, 0}})
+	want := MapEntry{Key: "02000000", Value: "0500000000000000", DecodedKey: uint64(2), DecodedValue: uint64(5)}
+	if !reflect.DeepEqual(e, want) {
+		t.Errorf("got %+v, want %+v", e, want)
+	}
+}
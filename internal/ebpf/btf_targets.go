@@ -0,0 +1,183 @@
+package ebpf
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/btf"
+)
+
+// btfProgramKind is a program type whose hook is fixed at load time, by
+// naming a kernel function, LSM hook, tracepoint or iterator in BTF.
+type btfProgramKind struct {
+	name       string
+	progType   ebpf.ProgramType
+	attachType ebpf.AttachType
+	// prefix and typ are how the kernel names the target in BTF.
+	prefix string
+	typ    btf.Type
+}
+
+// btfProgramKinds maps the program_type values of load_program to kinds.
+// raw_tracepoint has no BTF target, it is attached by name.
+var btfProgramKinds = map[string]btfProgramKind{
+	"FENTRY":         {"fentry", ebpf.Tracing, ebpf.AttachTraceFEntry, "", (*btf.Func)(nil)},
+	"FEXIT":          {"fexit", ebpf.Tracing, ebpf.AttachTraceFExit, "", (*btf.Func)(nil)},
+	"FMOD_RET":       {"fmod_ret", ebpf.Tracing, ebpf.AttachModifyReturn, "", (*btf.Func)(nil)},
+	"LSM":            {"lsm", ebpf.LSM, ebpf.AttachLSMMac, "bpf_lsm_", (*btf.Func)(nil)},
+	"TP_BTF":         {"tp_btf", ebpf.Tracing, ebpf.AttachTraceRawTp, "btf_trace_", (*btf.Typedef)(nil)},
+	"ITER":           {"iter", ebpf.Tracing, ebpf.AttachTraceIter, "bpf_iter_", (*btf.Func)(nil)},
+	"RAW_TRACEPOINT": {"raw_tracepoint", ebpf.RawTracepoint, ebpf.AttachNone, "", nil},
+}
+
+// btfKindOf returns the kind of a program, if it has a BTF target.
+func btfKindOf(progType ebpf.ProgramType, attachType ebpf.AttachType) (btfProgramKind, bool) {
+	for _, k := range btfProgramKinds {
+		if k.typ != nil && k.progType == progType && k.attachType == attachType {
+			return k, true
+		}
+	}
+	return btfProgramKind{}, false
+}
+
+// BTFTarget is the kernel object a program was loaded against.
+type BTFTarget struct {
+	Program string `json:"program"`
+	Kind    string `json:"kind"`
+	Name    string `json:"name"`
+	// Module is empty for targets in vmlinux.
+	Module string `json:"module,omitempty"`
+}
+
+// applyProgramType sets the program type asked for in load_program on the
+// programs of spec, or the one named by section, along with attach_to.
+// Objects declare the type with section names like "fentry/do_unlinkat",
+// so only the BTF based types are applied; others are left to the object.
+func applyProgramType(spec *ebpf.CollectionSpec, programType, section, attachTo string) error {
+	kind, ok := btfProgramKinds[strings.ToUpper(programType)]
+	if !ok {
+		return nil
+	}
+
+	matched := false
+	for name, p := range spec.Programs {
+		if section != "" && p.SectionName != section && name != section {
+			continue
+		}
+		matched = true
+		p.Type, p.AttachType = kind.progType, kind.attachType
+		if attachTo != "" {
+			p.AttachTo = attachTo
+		}
+	}
+	if !matched {
+		return fmt.Errorf("no program in section %q", section)
+	}
+	return nil
+}
+
+// resolveBTFTargets looks up the target of every program with one, in
+// vmlinux and then in module BTF, so that a missing function or hook is
+// reported by name rather than by the verifier.
+func resolveBTFTargets(spec *ebpf.CollectionSpec) ([]BTFTarget, error) {
+	var targets []BTFTarget
+	var kernel *btf.Spec
+	for name, p := range spec.Programs {
+		kind, ok := btfKindOf(p.Type, p.AttachType)
+		if !ok {
+			continue
+		}
+		if p.AttachTo == "" {
+			return nil, fmt.Errorf("%s program %s has no target: set attach_to or use a section such as %s/<target>", kind.name, name, kind.name)
+		}
+		// Targets in other BPF programs are resolved by the library.
+		if p.AttachTarget != nil {
+			continue
+		}
+		if kernel == nil {
+			var err error
+			if kernel, err = btf.LoadKernelSpec(); err != nil {
+				return nil, fmt.Errorf("kernel BTF, required by %s programs: %w", kind.name, err)
+			}
+		}
+		module, err := findBTFTarget(kernel, kind, p.AttachTo)
+		if errors.Is(err, btf.ErrNotFound) {
+			return nil, fmt.Errorf("%s target %q of program %s not found in vmlinux or module BTF", kind.name, p.AttachTo, name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("resolve %s target %q: %w", kind.name, p.AttachTo, err)
+		}
+		targets = append(targets, BTFTarget{Program: name, Kind: kind.name, Name: p.AttachTo, Module: module})
+	}
+	return targets, nil
+}
+
+// findBTFTarget returns the module defining a target, or "" for vmlinux.
+// Modules are searched in the order they were loaded, like the kernel does.
+func findBTFTarget(kernel *btf.Spec, kind btfProgramKind, target string) (string, error) {
+	typ := kind.typ
+	err := kernel.TypeByName(kind.prefix+target, &typ)
+	if !errors.Is(err, btf.ErrNotFound) {
+		return "", err
+	}
+
+	it := new(btf.HandleIterator)
+	defer it.Handle.Close()
+	for it.Next() {
+		info, err := it.Handle.Info()
+		if err != nil || !info.IsModule() {
+			continue
+		}
+		spec, err := it.Handle.Spec(kernel)
+		if err != nil {
+			continue
+		}
+		if err := spec.TypeByName(kind.prefix+target, &typ); err == nil {
+			return info.Name, nil
+		}
+	}
+	if err := it.Err(); err != nil {
+		return "", fmt.Errorf("iterate module BTF: %w", err)
+	}
+	return "", btf.ErrNotFound
+}
+
+// btfTargetName names the target of a tracing or LSM link from the BTF
+// object and type the kernel reports for it, stripping the prefixes the
+// kernel adds to LSM hooks, iterators and tracepoints.
+func btfTargetName(objID btf.ID, typeID btf.TypeID) (string, string, error) {
+	var spec *btf.Spec
+	var module string
+	var err error
+	if objID == 0 {
+		spec, err = btf.LoadKernelSpec()
+	} else {
+		handle, herr := btf.NewHandleFromID(objID)
+		if herr != nil {
+			return "", "", herr
+		}
+		if info, ierr := handle.Info(); ierr == nil && info.IsModule() {
+			module = info.Name
+		}
+		handle.Close()
+		spec, err = loadBTFByID(objID)
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	typ, err := spec.TypeByID(typeID)
+	if err != nil {
+		return "", "", err
+	}
+	name := typ.TypeName()
+	for _, k := range btfProgramKinds {
+		if k.prefix != "" && strings.HasPrefix(name, k.prefix) {
+			name = strings.TrimPrefix(name, k.prefix)
+			break
+		}
+	}
+	return name, module, nil
+}
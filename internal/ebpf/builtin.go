@@ -0,0 +1,518 @@
+// internal/ebpf/builtin.go
+package ebpf
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/btf"
+)
+
+// Builtin programs are tracing programs shipped inside the server, for
+// users who can't write and compile BPF C. They are assembled at load time
+// rather than compiled ahead of time: tracepoint offsets come from the
+// tracepoint's format file and kernel struct offsets from kernel BTF, which
+// gives the same portability CO-RE relocations would.
+
+// builtinEventsMap is the name of the ringbuf a builtin submits records to.
+const builtinEventsMap = "events"
+
+// builtinEventsSize sizes the events ringbuf of every builtin.
+const builtinEventsSize = 1 << 20
+
+// builtinHook is a program of a builtin and where it is meant to attach.
+type builtinHook struct {
+	Program    string `json:"program"`
+	AttachType string `json:"attach_type"`
+	Target     string `json:"target"`
+}
+
+// builtinProgram describes a builtin and builds its collection.
+type builtinProgram struct {
+	name        string
+	description string
+	hooks       []builtinHook
+	// event is the layout of the records in the events ringbuf, if the
+	// builtin has one.
+	event *btf.Struct
+	// spec assembles the collection for the running kernel.
+	spec func() (*ebpf.CollectionSpec, error)
+}
+
+var builtinPrograms = map[string]*builtinProgram{}
+
+func registerBuiltin(b *builtinProgram) {
+	builtinPrograms[b.name] = b
+}
+
+func lookupBuiltin(name string) (*builtinProgram, error) {
+	b, ok := builtinPrograms[name]
+	if !ok {
+		names := make([]string, 0, len(builtinPrograms))
+		for n := range builtinPrograms {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown builtin program %q; available: %s", name, strings.Join(names, ", "))
+	}
+	return b, nil
+}
+
+// BuiltinField is a member of a builtin's event or map layout.
+type BuiltinField struct {
+	Name   string `json:"name,omitempty"`
+	Type   string `json:"type"`
+	Offset int    `json:"offset"`
+	Size   int    `json:"size"`
+	Values string `json:"values,omitempty"`
+}
+
+// BuiltinMap describes a map of a builtin.
+type BuiltinMap struct {
+	Name        string         `json:"name"`
+	Type        string         `json:"type"`
+	Key         []BuiltinField `json:"key,omitempty"`
+	Value       []BuiltinField `json:"value,omitempty"`
+	EventType   string         `json:"event_type,omitempty"`
+	EventFields []BuiltinField `json:"event_fields,omitempty"`
+}
+
+// BuiltinInfo is a catalog entry.
+type BuiltinInfo struct {
+	Name        string        `json:"name"`
+	Description string        `json:"description"`
+	Programs    []builtinHook `json:"programs"`
+	Maps        []BuiltinMap  `json:"maps"`
+	Available   bool          `json:"available"`
+	Reason      string        `json:"unavailable_reason,omitempty"`
+}
+
+type BuiltinCatalogResult struct {
+	Success     bool          `json:"success"`
+	ToolVersion string        `json:"tool_version"`
+	Programs    []BuiltinInfo `json:"programs"`
+	Error       string        `json:"error,omitempty"`
+}
+
+// ListBuiltinPrograms describes every builtin. Each is assembled for the
+// running kernel, so missing tracepoints or BTF show up as unavailable.
+func ListBuiltinPrograms() (*BuiltinCatalogResult, error) {
+	names := make([]string, 0, len(builtinPrograms))
+	for name := range builtinPrograms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result := &BuiltinCatalogResult{Success: true, ToolVersion: "v1", Programs: []BuiltinInfo{}}
+	for _, name := range names {
+		b := builtinPrograms[name]
+		info := BuiltinInfo{
+			Name:        b.name,
+			Description: b.description,
+			Programs:    b.hooks,
+			Maps:        []BuiltinMap{},
+			Available:   true,
+		}
+
+		spec, err := b.spec()
+		if err != nil {
+			info.Available = false
+			info.Reason = err.Error()
+		} else {
+			mapNames := make([]string, 0, len(spec.Maps))
+			for n := range spec.Maps {
+				mapNames = append(mapNames, n)
+			}
+			sort.Strings(mapNames)
+			for _, n := range mapNames {
+				ms := spec.Maps[n]
+				m := BuiltinMap{
+					Name:  n,
+					Type:  ms.Type.String(),
+					Key:   layoutFields(ms.Key),
+					Value: layoutFields(ms.Value),
+				}
+				if n == builtinEventsMap && b.event != nil {
+					m.EventType = btfTypeName(b.event)
+					m.EventFields = layoutFields(b.event)
+				}
+				info.Maps = append(info.Maps, m)
+			}
+		}
+		result.Programs = append(result.Programs, info)
+	}
+	return result, nil
+}
+
+// layoutFields lists the members of a struct type, or describes a scalar
+// type as a single unnamed field.
+func layoutFields(typ btf.Type) []BuiltinField {
+	if typ == nil {
+		return nil
+	}
+	st, ok := btf.UnderlyingType(typ).(*btf.Struct)
+	if !ok {
+		size, _ := btf.Sizeof(typ)
+		return []BuiltinField{{Type: btfTypeName(typ), Size: size}}
+	}
+
+	fields := make([]BuiltinField, 0, len(st.Members))
+	for _, m := range st.Members {
+		size, _ := btf.Sizeof(m.Type)
+		f := BuiltinField{
+			Name:   m.Name,
+			Type:   btfTypeName(m.Type),
+			Offset: int(m.Offset.Bytes()),
+			Size:   size,
+		}
+		if enum, ok := btf.UnderlyingType(m.Type).(*btf.Enum); ok {
+			f.Values = enumNames(enum)
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// builtinEventTypes remembers the record type of the events ringbuf of
+// each loaded builtin by map ID. Ringbufs carry no BTF of their own, so
+// this is what lets stream_events decode them without a struct_type.
+// Entries are dropped when the registry releases the map.
+var builtinEventTypes = struct {
+	sync.Mutex
+	byMap map[int]btf.Type
+}{byMap: make(map[int]btf.Type)}
+
+func registerBuiltinEventType(m *ebpf.Map, typ btf.Type) {
+	info, err := m.Info()
+	if err != nil {
+		return
+	}
+	id, ok := info.ID()
+	if !ok {
+		return
+	}
+	builtinEventTypes.Lock()
+	defer builtinEventTypes.Unlock()
+	builtinEventTypes.byMap[int(id)] = typ
+}
+
+// builtinEventType returns the record type of a builtin's events map, if
+// mapID is one.
+func builtinEventType(mapID int) (btf.Type, bool) {
+	builtinEventTypes.Lock()
+	defer builtinEventTypes.Unlock()
+	typ, ok := builtinEventTypes.byMap[mapID]
+	return typ, ok
+}
+
+func forgetBuiltinEventType(mapID int) {
+	builtinEventTypes.Lock()
+	defer builtinEventTypes.Unlock()
+	delete(builtinEventTypes.byMap, mapID)
+}
+
+// Scalar types builtin layouts are made of.
+var (
+	btfU8   = &btf.Int{Name: "__u8", Size: 1}
+	btfU16  = &btf.Int{Name: "__u16", Size: 2}
+	btfU32  = &btf.Int{Name: "__u32", Size: 4}
+	btfS32  = &btf.Int{Name: "__s32", Size: 4, Encoding: btf.Signed}
+	btfU64  = &btf.Int{Name: "__u64", Size: 8}
+	btfChar = &btf.Int{Name: "char", Size: 1, Encoding: btf.Char}
+)
+
+func btfArray(elem btf.Type, n uint32) *btf.Array {
+	return &btf.Array{Index: btfU32, Type: elem, Nelems: n}
+}
+
+// structField is a member of a struct built with newStruct.
+type structField struct {
+	name string
+	typ  btf.Type
+}
+
+// newStruct lays out fields in order with natural alignment, like a C
+// compiler would.
+func newStruct(name string, fields ...structField) *btf.Struct {
+	st := &btf.Struct{Name: name}
+	offset, align := 0, 1
+	for _, f := range fields {
+		size, err := btf.Sizeof(f.typ)
+		if err != nil {
+			panic(fmt.Sprintf("struct %s: member %s: %v", name, f.name, err))
+		}
+		a := alignOf(f.typ)
+		offset = (offset + a - 1) / a * a
+		st.Members = append(st.Members, btf.Member{Name: f.name, Type: f.typ, Offset: btf.Bits(offset * 8)})
+		offset += size
+		align = max(align, a)
+	}
+	st.Size = uint32((offset + align - 1) / align * align)
+	return st
+}
+
+// alignOf is the natural alignment of the types builtin layouts use.
+func alignOf(typ btf.Type) int {
+	switch t := btf.UnderlyingType(typ).(type) {
+	case *btf.Array:
+		return alignOf(t.Type)
+	case *btf.Struct:
+		align := 1
+		for _, m := range t.Members {
+			align = max(align, alignOf(m.Type))
+		}
+		return align
+	}
+	size, _ := btf.Sizeof(typ)
+	return max(size, 1)
+}
+
+// offsetOf returns the byte offset of a member of a struct built with
+// newStruct. Asking for a missing member is a programming error.
+func offsetOf(st *btf.Struct, name string) int16 {
+	for _, m := range st.Members {
+		if m.Name == name {
+			return int16(m.Offset.Bytes())
+		}
+	}
+	panic(fmt.Sprintf("struct %s has no member %s", st.Name, name))
+}
+
+// kernelOffsets resolves member offsets of kernel structs through kernel
+// BTF, looking inside anonymous members.
+type kernelOffsets struct {
+	spec *btf.Spec
+}
+
+func loadKernelOffsets() (*kernelOffsets, error) {
+	spec, err := btf.LoadKernelSpec()
+	if err != nil {
+		return nil, fmt.Errorf("kernel BTF is required: %w", err)
+	}
+	return &kernelOffsets{spec: spec}, nil
+}
+
+func (k *kernelOffsets) offset(structName, member string) (int32, error) {
+	var st *btf.Struct
+	if err := k.spec.TypeByName(structName, &st); err != nil {
+		return 0, fmt.Errorf("struct %s: %w", structName, err)
+	}
+	off, ok := memberOffset(st.Members, member)
+	if !ok {
+		return 0, fmt.Errorf("struct %s has no member %s", structName, member)
+	}
+	return int32(off), nil
+}
+
+func memberOffset(members []btf.Member, name string) (uint32, bool) {
+	for _, m := range members {
+		if m.Name == name {
+			return m.Offset.Bytes(), true
+		}
+		if m.Name == "" {
+			if nested, ok := compositeMembers(m.Type); ok {
+				if off, ok := memberOffset(nested, name); ok {
+					return m.Offset.Bytes() + off, true
+				}
+			}
+		}
+	}
+	return 0, false
+}
+
+// Builtin programs keep the context in R6 and the reserved record in R9,
+// and end at the "out" label.
+
+// reserveRecord reserves size bytes in the events ringbuf and jumps to out
+// if it is full.
+func reserveRecord(size uint32) asm.Instructions {
+	return asm.Instructions{
+		asm.LoadMapPtr(asm.R1, 0).WithReference(builtinEventsMap),
+		asm.Mov.Imm(asm.R2, int32(size)),
+		asm.Mov.Imm(asm.R3, 0),
+		asm.FnRingbufReserve.Call(),
+		asm.JEq.Imm(asm.R0, 0, "out"),
+		asm.Mov.Reg(asm.R9, asm.R0),
+	}
+}
+
+func submitRecord() asm.Instructions {
+	return asm.Instructions{
+		asm.Mov.Reg(asm.R1, asm.R9),
+		asm.Mov.Imm(asm.R2, 0),
+		asm.FnRingbufSubmit.Call(),
+	}
+}
+
+func programExit() asm.Instructions {
+	return asm.Instructions{
+		asm.Mov.Imm(asm.R0, 0).WithSymbol("out"),
+		asm.Return(),
+	}
+}
+
+// storePidTgid writes the current tgid and pid (thread ID) to the record.
+func storePidTgid(pidOff, tidOff int16) asm.Instructions {
+	return asm.Instructions{
+		asm.FnGetCurrentPidTgid.Call(),
+		asm.StoreMem(asm.R9, tidOff, asm.R0, asm.Word),
+		asm.RSh.Imm(asm.R0, 32),
+		asm.StoreMem(asm.R9, pidOff, asm.R0, asm.Word),
+	}
+}
+
+func storeUID(off int16) asm.Instructions {
+	return asm.Instructions{
+		asm.FnGetCurrentUidGid.Call(),
+		asm.StoreMem(asm.R9, off, asm.R0, asm.Word),
+	}
+}
+
+func storeComm(off int16) asm.Instructions {
+	return asm.Instructions{
+		asm.Mov.Reg(asm.R1, asm.R9),
+		asm.Add.Imm(asm.R1, int32(off)),
+		asm.Mov.Imm(asm.R2, taskCommLen),
+		asm.FnGetCurrentComm.Call(),
+	}
+}
+
+// copyCtxField copies a tracepoint field into the record, converting
+// between sizes of 1, 2, 4 and 8 bytes.
+func copyCtxField(f tracepointField, recOff int16, size asm.Size) asm.Instructions {
+	return asm.Instructions{
+		asm.LoadMem(asm.R1, asm.R6, int16(f.Offset), sizeOf(f.Size)),
+		asm.StoreMem(asm.R9, recOff, asm.R1, size),
+	}
+}
+
+// copyCtxBytes copies a fixed size array field into the record, in the
+// largest accesses aligned on both sides.
+func copyCtxBytes(f tracepointField, recOff int16) asm.Instructions {
+	var insns asm.Instructions
+	for done := 0; done < f.Size; {
+		n := 8
+		for n > f.Size-done || (f.Offset+done)%n != 0 || (int(recOff)+done)%n != 0 {
+			n /= 2
+		}
+		insns = append(insns,
+			asm.LoadMem(asm.R1, asm.R6, int16(f.Offset+done), sizeOf(n)),
+			asm.StoreMem(asm.R9, recOff+int16(done), asm.R1, sizeOf(n)),
+		)
+		done += n
+	}
+	return insns
+}
+
+// copyCtxString copies a __data_loc string field into the record.
+func copyCtxString(f tracepointField, recOff int16, size int32) asm.Instructions {
+	return asm.Instructions{
+		asm.LoadMem(asm.R3, asm.R6, int16(f.Offset), asm.Word),
+		asm.And.Imm(asm.R3, 0xffff),
+		asm.Add.Reg(asm.R3, asm.R6),
+		asm.Mov.Reg(asm.R1, asm.R9),
+		asm.Add.Imm(asm.R1, int32(recOff)),
+		asm.Mov.Imm(asm.R2, size),
+		asm.FnProbeReadKernelStr.Call(),
+	}
+}
+
+func sizeOf(n int) asm.Size {
+	switch n {
+	case 1:
+		return asm.Byte
+	case 2:
+		return asm.Half
+	case 4:
+		return asm.Word
+	}
+	return asm.DWord
+}
+
+// log2Slot sets dst to floor(log2(src)), or 0 for src 0, clobbering src
+// and R2. Slot n of a histogram covers [2^n, 2^(n+1)).
+func log2Slot(dst, src asm.Register, label string) asm.Instructions {
+	insns := asm.Instructions{asm.Mov.Imm(dst, 0)}
+	for _, shift := range []int32{32, 16, 8, 4, 2, 1} {
+		skip := fmt.Sprintf("%s_%d", label, shift)
+		insns = append(insns,
+			asm.Mov.Reg(asm.R2, src),
+			asm.RSh.Imm(asm.R2, shift),
+			asm.JEq.Imm(asm.R2, 0, skip),
+			asm.Mov.Reg(src, asm.R2),
+			asm.Add.Imm(dst, shift),
+			asm.Mov.Imm(asm.R2, 0).WithSymbol(skip),
+		)
+	}
+	return insns
+}
+
+// builtinCollectionSpec assembles a builtin for the running kernel.
+func builtinCollectionSpec(name string) (*builtinProgram, *ebpf.CollectionSpec, error) {
+	b, err := lookupBuiltin(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	spec, err := b.spec()
+	if err != nil {
+		return nil, nil, fmt.Errorf("builtin %s: %w", name, err)
+	}
+	return b, spec, nil
+}
+
+// eventsMapSpec is the ringbuf every builtin with events submits to.
+func eventsMapSpec() *ebpf.MapSpec {
+	return &ebpf.MapSpec{
+		Name:       builtinEventsMap,
+		Type:       ebpf.RingBuf,
+		MaxEntries: builtinEventsSize,
+	}
+}
+
+func tracepointProgram(name string, insns asm.Instructions) *ebpf.ProgramSpec {
+	return &ebpf.ProgramSpec{
+		Name:         name,
+		Type:         ebpf.TracePoint,
+		License:      "GPL",
+		Instructions: insns,
+	}
+}
+
+// builtinLoadResult describes a loaded builtin and remembers the type of
+// its events for stream_events. ProgramID is the first program to attach.
+func builtinLoadResult(b *builtinProgram, coll *ebpf.Collection, maps []MapInfo) (*LoadProgramResult, error) {
+	if events, ok := coll.Maps[builtinEventsMap]; ok && b.event != nil {
+		registerBuiltinEventType(events, b.event)
+	}
+
+	result := &LoadProgramResult{Success: true, ToolVersion: "1.0.0", Maps: maps}
+	for _, hook := range b.hooks {
+		prog, ok := coll.Programs[hook.Program]
+		if !ok {
+			continue
+		}
+		info, err := prog.Info()
+		if err != nil {
+			continue
+		}
+		id, _ := info.ID()
+		handle, _ := objects.HandleFor(KindProgram, int(id))
+		if result.ProgramID == 0 {
+			result.ProgramFD = prog.FD()
+			result.ProgramID = int(id)
+			result.Handle = handle
+		}
+		result.Programs = append(result.Programs, LoadedProgramInfo{
+			Name:       hook.Program,
+			ID:         int(id),
+			Handle:     handle,
+			AttachType: hook.AttachType,
+			Target:     hook.Target,
+		})
+	}
+	return result, nil
+}
@@ -0,0 +1,583 @@
+// internal/ebpf/builtin_programs.go
+package ebpf
+
+import (
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/btf"
+)
+
+const (
+	builtinPathLen = 256
+	// builtinTrackedEntries sizes the maps correlating entry and exit
+	// events.
+	builtinTrackedEntries = 10240
+)
+
+func init() {
+	registerBuiltin(execsnoopBuiltin)
+	registerBuiltin(opensnoopBuiltin)
+	registerBuiltin(tcpstatesBuiltin)
+	registerBuiltin(oomkillBuiltin)
+	registerBuiltin(biolatencyBuiltin)
+}
+
+var execEvent = newStruct("exec_event",
+	structField{"pid", btfU32},
+	structField{"tid", btfU32},
+	structField{"ppid", btfU32},
+	structField{"uid", btfU32},
+	structField{"comm", btfArray(btfChar, taskCommLen)},
+	structField{"filename", btfArray(btfChar, builtinPathLen)},
+)
+
+var execsnoopBuiltin = &builtinProgram{
+	name:        "execsnoop",
+	description: "Process executions: pid, parent pid, uid, the calling command and the file being executed, on execve entry.",
+	hooks: []builtinHook{
+		{Program: "execsnoop", AttachType: "tracepoint", Target: "syscalls:sys_enter_execve"},
+	},
+	event: execEvent,
+	spec: func() (*ebpf.CollectionSpec, error) {
+		tf, err := loadTracepointFormat("syscalls", "sys_enter_execve")
+		if err != nil {
+			return nil, err
+		}
+		filename, err := tf.field("filename", 8)
+		if err != nil {
+			return nil, err
+		}
+		ko, err := loadKernelOffsets()
+		if err != nil {
+			return nil, err
+		}
+		realParent, err := ko.offset("task_struct", "real_parent")
+		if err != nil {
+			return nil, err
+		}
+		tgid, err := ko.offset("task_struct", "tgid")
+		if err != nil {
+			return nil, err
+		}
+
+		insns := asm.Instructions{asm.Mov.Reg(asm.R6, asm.R1)}
+		insns = append(insns, reserveRecord(execEvent.Size)...)
+		insns = append(insns, storePidTgid(offsetOf(execEvent, "pid"), offsetOf(execEvent, "tid"))...)
+		insns = append(insns, storeUID(offsetOf(execEvent, "uid"))...)
+		insns = append(insns, storeParentTgid(offsetOf(execEvent, "ppid"), realParent, tgid)...)
+		insns = append(insns, storeComm(offsetOf(execEvent, "comm"))...)
+		insns = append(insns,
+			asm.Mov.Reg(asm.R1, asm.R9),
+			asm.Add.Imm(asm.R1, int32(offsetOf(execEvent, "filename"))),
+			asm.Mov.Imm(asm.R2, builtinPathLen),
+			asm.LoadMem(asm.R3, asm.R6, int16(filename.Offset), asm.DWord),
+			asm.FnProbeReadUserStr.Call(),
+		)
+		insns = append(insns, submitRecord()...)
+		insns = append(insns, programExit()...)
+
+		return &ebpf.CollectionSpec{
+			Maps:     map[string]*ebpf.MapSpec{builtinEventsMap: eventsMapSpec()},
+			Programs: map[string]*ebpf.ProgramSpec{"execsnoop": tracepointProgram("execsnoop", insns)},
+		}, nil
+	},
+}
+
+// storeParentTgid writes current->real_parent->tgid to the record, using
+// the stack slot at -8 for the parent pointer.
+func storeParentTgid(off int16, realParent, tgid int32) asm.Instructions {
+	return asm.Instructions{
+		asm.FnGetCurrentTask.Call(),
+		asm.Mov.Reg(asm.R3, asm.R0),
+		asm.Add.Imm(asm.R3, realParent),
+		asm.Mov.Reg(asm.R1, asm.RFP),
+		asm.Add.Imm(asm.R1, -8),
+		asm.Mov.Imm(asm.R2, 8),
+		asm.FnProbeReadKernel.Call(),
+		asm.LoadMem(asm.R3, asm.RFP, -8, asm.DWord),
+		asm.Add.Imm(asm.R3, tgid),
+		asm.Mov.Reg(asm.R1, asm.R9),
+		asm.Add.Imm(asm.R1, int32(off)),
+		asm.Mov.Imm(asm.R2, 4),
+		asm.FnProbeReadKernel.Call(),
+	}
+}
+
+var openEvent = newStruct("open_event",
+	structField{"pid", btfU32},
+	structField{"tid", btfU32},
+	structField{"uid", btfU32},
+	structField{"ret", btfS32},
+	structField{"flags", btfU32},
+	structField{"comm", btfArray(btfChar, taskCommLen)},
+	structField{"filename", btfArray(btfChar, builtinPathLen)},
+)
+
+// openStart is what opensnoop remembers between openat entry and exit.
+var openStart = newStruct("open_start",
+	structField{"filename", btfU64},
+	structField{"flags", btfU64},
+)
+
+var opensnoopBuiltin = &builtinProgram{
+	name:        "opensnoop",
+	description: "File opens through openat: pid, uid, command, path, flags and the resulting fd or negative errno.",
+	hooks: []builtinHook{
+		{Program: "opensnoop_enter", AttachType: "tracepoint", Target: "syscalls:sys_enter_openat"},
+		{Program: "opensnoop_exit", AttachType: "tracepoint", Target: "syscalls:sys_exit_openat"},
+	},
+	event: openEvent,
+	spec: func() (*ebpf.CollectionSpec, error) {
+		enter, err := loadTracepointFormat("syscalls", "sys_enter_openat")
+		if err != nil {
+			return nil, err
+		}
+		filename, err := enter.field("filename", 8)
+		if err != nil {
+			return nil, err
+		}
+		flags, err := enter.field("flags", 0)
+		if err != nil {
+			return nil, err
+		}
+		exit, err := loadTracepointFormat("syscalls", "sys_exit_openat")
+		if err != nil {
+			return nil, err
+		}
+		ret, err := exit.field("ret", 8)
+		if err != nil {
+			return nil, err
+		}
+
+		// Entry: start[pid_tgid] = {filename, flags}
+		enterInsns := asm.Instructions{
+			asm.Mov.Reg(asm.R6, asm.R1),
+			asm.FnGetCurrentPidTgid.Call(),
+			asm.StoreMem(asm.RFP, -8, asm.R0, asm.DWord),
+			asm.LoadMem(asm.R1, asm.R6, int16(filename.Offset), asm.DWord),
+			asm.StoreMem(asm.RFP, -24, asm.R1, asm.DWord),
+			asm.LoadMem(asm.R1, asm.R6, int16(flags.Offset), sizeOf(flags.Size)),
+			asm.StoreMem(asm.RFP, -16, asm.R1, asm.DWord),
+			asm.LoadMapPtr(asm.R1, 0).WithReference("start"),
+			asm.Mov.Reg(asm.R2, asm.RFP),
+			asm.Add.Imm(asm.R2, -8),
+			asm.Mov.Reg(asm.R3, asm.RFP),
+			asm.Add.Imm(asm.R3, -24),
+			asm.Mov.Imm(asm.R4, int32(ebpf.UpdateAny)),
+			asm.FnMapUpdateElem.Call(),
+		}
+		enterInsns = append(enterInsns, programExit()...)
+
+		// Exit: look the entry up, emit a record and forget it.
+		exitInsns := asm.Instructions{
+			asm.Mov.Reg(asm.R6, asm.R1),
+			asm.FnGetCurrentPidTgid.Call(),
+			asm.StoreMem(asm.RFP, -8, asm.R0, asm.DWord),
+			asm.LoadMapPtr(asm.R1, 0).WithReference("start"),
+			asm.Mov.Reg(asm.R2, asm.RFP),
+			asm.Add.Imm(asm.R2, -8),
+			asm.FnMapLookupElem.Call(),
+			asm.JEq.Imm(asm.R0, 0, "out"),
+			asm.Mov.Reg(asm.R8, asm.R0),
+			asm.LoadMapPtr(asm.R1, 0).WithReference(builtinEventsMap),
+			asm.Mov.Imm(asm.R2, int32(openEvent.Size)),
+			asm.Mov.Imm(asm.R3, 0),
+			asm.FnRingbufReserve.Call(),
+			asm.JEq.Imm(asm.R0, 0, "forget"),
+			asm.Mov.Reg(asm.R9, asm.R0),
+		}
+		exitInsns = append(exitInsns, storePidTgid(offsetOf(openEvent, "pid"), offsetOf(openEvent, "tid"))...)
+		exitInsns = append(exitInsns, storeUID(offsetOf(openEvent, "uid"))...)
+		exitInsns = append(exitInsns, storeComm(offsetOf(openEvent, "comm"))...)
+		exitInsns = append(exitInsns, copyCtxField(ret, offsetOf(openEvent, "ret"), asm.Word)...)
+		exitInsns = append(exitInsns,
+			asm.LoadMem(asm.R1, asm.R8, offsetOf(openStart, "flags"), asm.DWord),
+			asm.StoreMem(asm.R9, offsetOf(openEvent, "flags"), asm.R1, asm.Word),
+			asm.Mov.Reg(asm.R1, asm.R9),
+			asm.Add.Imm(asm.R1, int32(offsetOf(openEvent, "filename"))),
+			asm.Mov.Imm(asm.R2, builtinPathLen),
+			asm.LoadMem(asm.R3, asm.R8, offsetOf(openStart, "filename"), asm.DWord),
+			asm.FnProbeReadUserStr.Call(),
+		)
+		exitInsns = append(exitInsns, submitRecord()...)
+		exitInsns = append(exitInsns,
+			asm.LoadMapPtr(asm.R1, 0).WithReference("start").WithSymbol("forget"),
+			asm.Mov.Reg(asm.R2, asm.RFP),
+			asm.Add.Imm(asm.R2, -8),
+			asm.FnMapDeleteElem.Call(),
+		)
+		exitInsns = append(exitInsns, programExit()...)
+
+		return &ebpf.CollectionSpec{
+			Maps: map[string]*ebpf.MapSpec{
+				builtinEventsMap: eventsMapSpec(),
+				"start": {
+					Name:       "opensnoop_start",
+					Type:       ebpf.Hash,
+					KeySize:    8,
+					ValueSize:  openStart.Size,
+					MaxEntries: builtinTrackedEntries,
+					Key:        btfU64,
+					Value:      openStart,
+				},
+			},
+			Programs: map[string]*ebpf.ProgramSpec{
+				"opensnoop_enter": tracepointProgram("opensnoop_enter", enterInsns),
+				"opensnoop_exit":  tracepointProgram("opensnoop_exit", exitInsns),
+			},
+		}, nil
+	},
+}
+
+// tcpState mirrors the kernel's TCP states, which are part of the
+// inet_sock_set_state tracepoint's ABI.
+var tcpState = &btf.Enum{
+	Name:   "tcp_state",
+	Size:   4,
+	Signed: true,
+	Values: []btf.EnumValue{
+		{Name: "TCP_ESTABLISHED", Value: 1},
+		{Name: "TCP_SYN_SENT", Value: 2},
+		{Name: "TCP_SYN_RECV", Value: 3},
+		{Name: "TCP_FIN_WAIT1", Value: 4},
+		{Name: "TCP_FIN_WAIT2", Value: 5},
+		{Name: "TCP_TIME_WAIT", Value: 6},
+		{Name: "TCP_CLOSE", Value: 7},
+		{Name: "TCP_CLOSE_WAIT", Value: 8},
+		{Name: "TCP_LAST_ACK", Value: 9},
+		{Name: "TCP_LISTEN", Value: 10},
+		{Name: "TCP_CLOSING", Value: 11},
+		{Name: "TCP_NEW_SYN_RECV", Value: 12},
+	},
+}
+
+const (
+	afInet6     = 10
+	ipprotoTCP  = 6
+	ipAddrBytes = 16
+)
+
+// tcpStateEvent carries IPv4 addresses in the first 4 bytes of saddr and
+// daddr.
+var tcpStateEvent = newStruct("tcp_state_event",
+	structField{"skaddr", btfU64},
+	structField{"saddr", btfArray(btfU8, ipAddrBytes)},
+	structField{"daddr", btfArray(btfU8, ipAddrBytes)},
+	structField{"pid", btfU32},
+	structField{"oldstate", tcpState},
+	structField{"newstate", tcpState},
+	structField{"sport", btfU16},
+	structField{"dport", btfU16},
+	structField{"family", btfU16},
+	structField{"comm", btfArray(btfChar, taskCommLen)},
+)
+
+var tcpstatesBuiltin = &builtinProgram{
+	name:        "tcpstates",
+	description: "TCP state changes for IPv4 and IPv6: connects (CLOSE to SYN_SENT), accepts (SYN_RECV to ESTABLISHED) and closes, with addresses, ports and the current task. The task is only meaningful for transitions made in process context, such as connect and close.",
+	hooks: []builtinHook{
+		{Program: "tcpstates", AttachType: "tracepoint", Target: "sock:inet_sock_set_state"},
+	},
+	event: tcpStateEvent,
+	spec: func() (*ebpf.CollectionSpec, error) {
+		tf, err := loadTracepointFormat("sock", "inet_sock_set_state")
+		if err != nil {
+			return nil, err
+		}
+		fields, err := tf.fieldsOf(sockStateFields)
+		if err != nil {
+			return nil, err
+		}
+
+		insns := asm.Instructions{
+			asm.Mov.Reg(asm.R6, asm.R1),
+			asm.LoadMem(asm.R1, asm.R6, int16(fields["protocol"].Offset), asm.Half),
+			asm.JNE.Imm(asm.R1, ipprotoTCP, "out"),
+		}
+		insns = append(insns, reserveRecord(tcpStateEvent.Size)...)
+		insns = append(insns, copyCtxField(fields["skaddr"], offsetOf(tcpStateEvent, "skaddr"), asm.DWord)...)
+		insns = append(insns, copyCtxField(fields["oldstate"], offsetOf(tcpStateEvent, "oldstate"), asm.Word)...)
+		insns = append(insns, copyCtxField(fields["newstate"], offsetOf(tcpStateEvent, "newstate"), asm.Word)...)
+		insns = append(insns, copyCtxField(fields["sport"], offsetOf(tcpStateEvent, "sport"), asm.Half)...)
+		insns = append(insns, copyCtxField(fields["dport"], offsetOf(tcpStateEvent, "dport"), asm.Half)...)
+		insns = append(insns, copyCtxField(fields["family"], offsetOf(tcpStateEvent, "family"), asm.Half)...)
+		insns = append(insns, copySockAddrs(fields, offsetOf(tcpStateEvent, "saddr"), offsetOf(tcpStateEvent, "daddr"))...)
+		insns = append(insns, storeComm(offsetOf(tcpStateEvent, "comm"))...)
+		insns = append(insns,
+			asm.FnGetCurrentPidTgid.Call(),
+			asm.RSh.Imm(asm.R0, 32),
+			asm.StoreMem(asm.R9, offsetOf(tcpStateEvent, "pid"), asm.R0, asm.Word),
+		)
+		insns = append(insns, submitRecord()...)
+		insns = append(insns, programExit()...)
+
+		return &ebpf.CollectionSpec{
+			Maps:     map[string]*ebpf.MapSpec{builtinEventsMap: eventsMapSpec()},
+			Programs: map[string]*ebpf.ProgramSpec{"tcpstates": tracepointProgram("tcpstates", insns)},
+		}, nil
+	},
+}
+
+// sockStateFields are the inet_sock_set_state fields tcpstates and
+// trace_tcp use, with their sizes.
+var sockStateFields = map[string]int{
+	"skaddr": 8, "oldstate": 4, "newstate": 4, "sport": 2, "dport": 2,
+	"family": 2, "protocol": 2, "saddr": 4, "daddr": 4, "saddr_v6": 16, "daddr_v6": 16,
+}
+
+// copySockAddrs copies the addresses of a sock or tcp tracepoint into
+// 16 byte record fields, the IPv6 ones for AF_INET6 sockets. IPv4
+// addresses take the first 4 bytes and the rest is zeroed.
+func copySockAddrs(fields map[string]tracepointField, saddrOff, daddrOff int16) asm.Instructions {
+	insns := asm.Instructions{
+		asm.StoreImm(asm.R9, saddrOff, 0, asm.DWord),
+		asm.StoreImm(asm.R9, saddrOff+8, 0, asm.DWord),
+		asm.StoreImm(asm.R9, daddrOff, 0, asm.DWord),
+		asm.StoreImm(asm.R9, daddrOff+8, 0, asm.DWord),
+		asm.LoadMem(asm.R1, asm.R6, int16(fields["family"].Offset), asm.Half),
+		asm.JEq.Imm(asm.R1, afInet6, "ipv6"),
+	}
+	insns = append(insns, copyCtxBytes(fields["saddr"], saddrOff)...)
+	insns = append(insns, copyCtxBytes(fields["daddr"], daddrOff)...)
+	insns = append(insns, asm.Ja.Label("addrs_done"))
+	v6 := copyCtxBytes(fields["saddr_v6"], saddrOff)
+	v6[0] = v6[0].WithSymbol("ipv6")
+	insns = append(insns, v6...)
+	insns = append(insns, copyCtxBytes(fields["daddr_v6"], daddrOff)...)
+	return append(insns, asm.Mov.Imm(asm.R1, 0).WithSymbol("addrs_done"))
+}
+
+var oomEvent = newStruct("oom_event",
+	structField{"total_vm_kb", btfU64},
+	structField{"anon_rss_kb", btfU64},
+	structField{"file_rss_kb", btfU64},
+	structField{"shmem_rss_kb", btfU64},
+	structField{"pid", btfU32},
+	structField{"uid", btfU32},
+	structField{"trigger_pid", btfU32},
+	structField{"oom_score_adj", btfS32},
+	structField{"comm", btfArray(btfChar, taskCommLen)},
+	structField{"trigger_comm", btfArray(btfChar, taskCommLen)},
+)
+
+var oomkillBuiltin = &builtinProgram{
+	name:        "oomkill",
+	description: "OOM killer victims with their memory usage, and the process whose allocation triggered the kill. Older kernels only report the victim pid; the other victim fields are zero there.",
+	hooks: []builtinHook{
+		{Program: "oomkill", AttachType: "tracepoint", Target: "oom:mark_victim"},
+	},
+	event: oomEvent,
+	spec: func() (*ebpf.CollectionSpec, error) {
+		tf, err := loadTracepointFormat("oom", "mark_victim")
+		if err != nil {
+			return nil, err
+		}
+		pid, err := tf.field("pid", 4)
+		if err != nil {
+			return nil, err
+		}
+
+		insns := asm.Instructions{asm.Mov.Reg(asm.R6, asm.R1)}
+		insns = append(insns, reserveRecord(oomEvent.Size)...)
+		insns = append(insns, copyCtxField(pid, offsetOf(oomEvent, "pid"), asm.Word)...)
+		// Fields added to the tracepoint over time are copied if present.
+		for _, f := range []struct {
+			field, member string
+			size          asm.Size
+		}{
+			{"total_vm", "total_vm_kb", asm.DWord},
+			{"anon_rss", "anon_rss_kb", asm.DWord},
+			{"file_rss", "file_rss_kb", asm.DWord},
+			{"shmem_rss", "shmem_rss_kb", asm.DWord},
+			{"uid", "uid", asm.Word},
+			{"oom_score_adj", "oom_score_adj", asm.Word},
+		} {
+			if field, ok := tf.fields[f.field]; ok && !field.DataLoc {
+				insns = append(insns, copyCtxField(field, offsetOf(oomEvent, f.member), f.size)...)
+				if field.Signed && field.Size < 4 {
+					// Sign extend narrow fields such as oom_score_adj.
+					shift := int32(64 - 8*field.Size)
+					insns = append(insns,
+						asm.LSh.Imm(asm.R1, shift),
+						asm.ArSh.Imm(asm.R1, shift),
+						asm.StoreMem(asm.R9, offsetOf(oomEvent, f.member), asm.R1, f.size),
+					)
+				}
+			} else {
+				insns = append(insns, asm.StoreImm(asm.R9, offsetOf(oomEvent, f.member), 0, f.size))
+			}
+		}
+		if comm, ok := tf.fields["comm"]; ok && comm.DataLoc {
+			insns = append(insns, copyCtxString(comm, offsetOf(oomEvent, "comm"), taskCommLen)...)
+		} else {
+			insns = append(insns, asm.StoreImm(asm.R9, offsetOf(oomEvent, "comm"), 0, asm.Byte))
+		}
+		insns = append(insns,
+			asm.FnGetCurrentPidTgid.Call(),
+			asm.RSh.Imm(asm.R0, 32),
+			asm.StoreMem(asm.R9, offsetOf(oomEvent, "trigger_pid"), asm.R0, asm.Word),
+		)
+		insns = append(insns, storeComm(offsetOf(oomEvent, "trigger_comm"))...)
+		insns = append(insns, submitRecord()...)
+		insns = append(insns, programExit()...)
+
+		return &ebpf.CollectionSpec{
+			Maps:     map[string]*ebpf.MapSpec{builtinEventsMap: eventsMapSpec()},
+			Programs: map[string]*ebpf.ProgramSpec{"oomkill": tracepointProgram("oomkill", insns)},
+		}, nil
+	},
+}
+
+// blockRequest identifies an in-flight request by device and sector.
+var blockRequest = newStruct("block_request",
+	structField{"dev", btfU32},
+	structField{"sector", btfU64},
+)
+
+// latencySlot is a log2 histogram bucket of one device.
+var latencySlot = newStruct("latency_slot",
+	structField{"dev", btfU32},
+	structField{"slot", btfU32},
+)
+
+const maxHistogramSlots = 4096
+
+var biolatencyBuiltin = &builtinProgram{
+	name:        "biolatency",
+	description: "Block I/O latency from issue to completion as a log2 histogram of microseconds per device. The hist map holds a count per (dev, slot), where slot n covers [2^n, 2^(n+1)) us and dev is the kernel dev_t (major << 20 | minor).",
+	hooks: []builtinHook{
+		{Program: "biolat_issue", AttachType: "tracepoint", Target: "block:block_rq_issue"},
+		{Program: "biolat_complete", AttachType: "tracepoint", Target: "block:block_rq_complete"},
+	},
+	spec: func() (*ebpf.CollectionSpec, error) {
+		issue, err := loadTracepointFormat("block", "block_rq_issue")
+		if err != nil {
+			return nil, err
+		}
+		complete, err := loadTracepointFormat("block", "block_rq_complete")
+		if err != nil {
+			return nil, err
+		}
+
+		issueKey, err := storeBlockRequestKey(issue)
+		if err != nil {
+			return nil, err
+		}
+		issueInsns := append(asm.Instructions{asm.Mov.Reg(asm.R6, asm.R1)}, issueKey...)
+		issueInsns = append(issueInsns,
+			asm.FnKtimeGetNs.Call(),
+			asm.StoreMem(asm.RFP, -24, asm.R0, asm.DWord),
+			asm.LoadMapPtr(asm.R1, 0).WithReference("start"),
+			asm.Mov.Reg(asm.R2, asm.RFP),
+			asm.Add.Imm(asm.R2, -16),
+			asm.Mov.Reg(asm.R3, asm.RFP),
+			asm.Add.Imm(asm.R3, -24),
+			asm.Mov.Imm(asm.R4, int32(ebpf.UpdateAny)),
+			asm.FnMapUpdateElem.Call(),
+		)
+		issueInsns = append(issueInsns, programExit()...)
+
+		completeKey, err := storeBlockRequestKey(complete)
+		if err != nil {
+			return nil, err
+		}
+		completeInsns := append(asm.Instructions{asm.Mov.Reg(asm.R6, asm.R1)}, completeKey...)
+		completeInsns = append(completeInsns,
+			asm.LoadMapPtr(asm.R1, 0).WithReference("start"),
+			asm.Mov.Reg(asm.R2, asm.RFP),
+			asm.Add.Imm(asm.R2, -16),
+			asm.FnMapLookupElem.Call(),
+			asm.JEq.Imm(asm.R0, 0, "out"),
+			asm.LoadMem(asm.R7, asm.R0, 0, asm.DWord),
+			asm.FnKtimeGetNs.Call(),
+			asm.Sub.Reg(asm.R0, asm.R7),
+			asm.Div.Imm(asm.R0, 1000),
+			asm.Mov.Reg(asm.R7, asm.R0),
+		)
+		completeInsns = append(completeInsns, log2Slot(asm.R8, asm.R7, "log2")...)
+		completeInsns = append(completeInsns, histogramIncrement("hist", asm.Instructions{
+			asm.LoadMem(asm.R1, asm.RFP, -16+offsetOf(blockRequest, "dev"), asm.Word),
+		}, "forget")...)
+		completeInsns = append(completeInsns,
+			asm.LoadMapPtr(asm.R1, 0).WithReference("start").WithSymbol("forget"),
+			asm.Mov.Reg(asm.R2, asm.RFP),
+			asm.Add.Imm(asm.R2, -16),
+			asm.FnMapDeleteElem.Call(),
+		)
+		completeInsns = append(completeInsns, programExit()...)
+
+		return &ebpf.CollectionSpec{
+			Maps: map[string]*ebpf.MapSpec{
+				"start": {
+					Name:       "biolat_start",
+					Type:       ebpf.Hash,
+					KeySize:    blockRequest.Size,
+					ValueSize:  8,
+					MaxEntries: builtinTrackedEntries,
+					Key:        blockRequest,
+					Value:      btfU64,
+				},
+				"hist": {
+					Name:       "biolat_hist",
+					Type:       ebpf.Hash,
+					KeySize:    latencySlot.Size,
+					ValueSize:  8,
+					MaxEntries: maxHistogramSlots,
+					Key:        latencySlot,
+					Value:      btfU64,
+				},
+			},
+			Programs: map[string]*ebpf.ProgramSpec{
+				"biolat_issue":    tracepointProgram("biolat_issue", issueInsns),
+				"biolat_complete": tracepointProgram("biolat_complete", completeInsns),
+			},
+		}, nil
+	},
+}
+
+// storeBlockRequestKey builds a blockRequest at -16 from the context of a
+// block_rq tracepoint.
+func storeBlockRequestKey(tf *tracepointFormat) (asm.Instructions, error) {
+	dev, err := tf.field("dev", 4)
+	if err != nil {
+		return nil, err
+	}
+	sector, err := tf.field("sector", 8)
+	if err != nil {
+		return nil, err
+	}
+	return asm.Instructions{
+		asm.StoreImm(asm.RFP, -16, 0, asm.DWord),
+		asm.LoadMem(asm.R1, asm.R6, int16(dev.Offset), asm.Word),
+		asm.StoreMem(asm.RFP, -16+offsetOf(blockRequest, "dev"), asm.R1, asm.Word),
+		asm.LoadMem(asm.R1, asm.R6, int16(sector.Offset), asm.DWord),
+		asm.StoreMem(asm.RFP, -16+offsetOf(blockRequest, "sector"), asm.R1, asm.DWord),
+	}, nil
+}
+
+// histogramIncrement adds one to the histogram map hist at {id, R8}, where
+// loadID leaves the id (a device, a CPU, ...) in R1. The key has the
+// layout of latencySlot. It uses the stack at -32 to -40 and ends at done.
+func histogramIncrement(hist string, loadID asm.Instructions, done string) asm.Instructions {
+	insns := append(asm.Instructions{}, loadID...)
+	return append(insns,
+		asm.StoreMem(asm.RFP, -32+offsetOf(latencySlot, "dev"), asm.R1, asm.Word),
+		asm.StoreMem(asm.RFP, -32+offsetOf(latencySlot, "slot"), asm.R8, asm.Word),
+		asm.LoadMapPtr(asm.R1, 0).WithReference(hist),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, -32),
+		asm.FnMapLookupElem.Call(),
+		asm.JEq.Imm(asm.R0, 0, hist+"_new"),
+		asm.Mov.Imm(asm.R1, 1),
+		asm.StoreXAdd(asm.R0, asm.R1, asm.DWord),
+		asm.Ja.Label(done),
+		asm.StoreImm(asm.RFP, -40, 1, asm.DWord).WithSymbol(hist+"_new"),
+		asm.LoadMapPtr(asm.R1, 0).WithReference(hist),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, -32),
+		asm.Mov.Reg(asm.R3, asm.RFP),
+		asm.Add.Imm(asm.R3, -40),
+		asm.Mov.Imm(asm.R4, int32(ebpf.UpdateNoExist)),
+		asm.FnMapUpdateElem.Call(),
+	)
+}
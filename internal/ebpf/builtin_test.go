@@ -0,0 +1,36 @@
+package ebpf
+
+import (
+	"testing"
+
+	"github.com/cilium/ebpf"
+)
+
+func TestBuiltinEventTypeReleased(t *testing.T) {
+	events, err := ebpf.NewMap(eventsMapSpec())
+	if err != nil {
+		t.Skipf("creating a ringbuf: %v", err)
+	}
+	info, err := events.Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := info.ID()
+
+	r := NewRegistry()
+	handle, err := r.AddCollection("builtin", &ebpf.Collection{Maps: map[string]*ebpf.Map{builtinEventsMap: events}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	registerBuiltinEventType(events, testEventType())
+	if _, ok := builtinEventType(int(id)); !ok {
+		t.Fatal("event type not registered")
+	}
+
+	if _, err := r.Release(handle); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := builtinEventType(int(id)); ok {
+		t.Error("event type still registered after the map was released")
+	}
+}
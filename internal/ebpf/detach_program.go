@@ -0,0 +1,191 @@
+// internal/ebpf/detach_program.go
+package ebpf
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"unsafe"
+
+	"github.com/cilium/ebpf/link"
+	"golang.org/x/sys/unix"
+)
+
+type DetachProgramArgs struct {
+	LinkID  int    `json:"link_id,omitempty"`
+	PinPath string `json:"pin_path,omitempty"`
+	Handle  string `json:"handle,omitempty"`
+	Force   bool   `json:"force,omitempty"`
+}
+
+type DetachProgramResult struct {
+	Success     bool        `json:"success"`
+	ToolVersion string      `json:"tool_version"`
+	LinkID      int         `json:"link_id,omitempty"`
+	ProgramID   int         `json:"program_id,omitempty"`
+	Unpinned    []string    `json:"unpinned,omitempty"`
+	Released    []ObjectRef `json:"released,omitempty"`
+	Message     string      `json:"message,omitempty"`
+	Error       string      `json:"error,omitempty"`
+}
+
+// resolvedLink is a link looked up by ID, pin path or registry handle.
+type resolvedLink struct {
+	link    link.Link
+	id      int
+	handle  string
+	pinPath string
+}
+
+// close drops the reference taken by resolveLink for links the server does
+// not hold.
+func (rl *resolvedLink) close() {
+	if rl.handle == "" {
+		rl.link.Close()
+	}
+}
+
+// resolveLink finds a link by registry handle, pin path or kernel ID, in that
+// order. Links held by the registry are returned as is; anything else is
+// opened and must be closed by the caller.
+func resolveLink(linkID int, pinPath, handle string) (*resolvedLink, error) {
+	if handle != "" {
+		ref, v, ok := objects.Get(handle)
+		if !ok || ref.Kind != KindLink {
+			return nil, fmt.Errorf("link handle %s: %w", handle, ErrObjectNotFound)
+		}
+		// The recorded pin is the one removed on detach; a caller supplied
+		// path could name any file.
+		if pinPath != "" {
+			return nil, errors.New("pin_path cannot be combined with handle")
+		}
+		return &resolvedLink{link: v.(link.Link), id: ref.ID, handle: handle, pinPath: ref.PinPath}, nil
+	}
+
+	if pinPath != "" {
+		l, err := link.LoadPinnedLink(pinPath, nil)
+		if err != nil {
+			return nil, fmt.Errorf("load pinned link %s: %w", pinPath, err)
+		}
+		info, err := l.Info()
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("link info: %w", err)
+		}
+		id := int(info.ID)
+		if h, ok := objects.HandleFor(KindLink, id); ok {
+			l.Close()
+			rl, err := resolveLink(0, "", h)
+			if err == nil {
+				rl.pinPath = pinPath
+			}
+			return rl, err
+		}
+		return &resolvedLink{link: l, id: id, pinPath: pinPath}, nil
+	}
+
+	if linkID != 0 {
+		if h, ok := objects.HandleFor(KindLink, linkID); ok {
+			return resolveLink(0, "", h)
+		}
+		l, err := link.NewFromID(link.ID(linkID))
+		if err != nil {
+			return nil, fmt.Errorf("link %d: %w", linkID, err)
+		}
+		return &resolvedLink{link: l, id: linkID}, nil
+	}
+
+	return nil, errors.New("must specify link_id, pin_path or handle")
+}
+
+// forceDetachLink issues BPF_LINK_DETACH, breaking the link even while other
+// processes still hold references to it.
+func forceDetachLink(l link.Link) error {
+	fder, ok := l.(interface{ FD() int })
+	if !ok {
+		return fmt.Errorf("link does not expose a file descriptor")
+	}
+
+	const bpfLinkDetach = 34
+	attr := struct{ linkFD uint32 }{uint32(fder.FD())}
+	_, _, errno := unix.Syscall(unix.SYS_BPF, bpfLinkDetach, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+	if errno != 0 {
+		return fmt.Errorf("BPF_LINK_DETACH: %w", errno)
+	}
+	return nil
+}
+
+func detachFailure(err error) (*DetachProgramResult, error) {
+	return &DetachProgramResult{
+		Success:     false,
+		ToolVersion: "v1",
+		Error:       err.Error(),
+	}, err
+}
+
+// DetachProgram undoes attach_program: the link is unpinned, closed and
+// released from the registry. With Force the kernel link is detached even if
+// other processes hold it open.
+func DetachProgram(args *DetachProgramArgs) (*DetachProgramResult, error) {
+	if args == nil {
+		return detachFailure(errors.New("args cannot be nil"))
+	}
+
+	rl, err := resolveLink(args.LinkID, args.PinPath, args.Handle)
+	if err != nil {
+		return detachFailure(err)
+	}
+	return detachResolvedLink(rl, args.Force)
+}
+
+func detachResolvedLink(rl *resolvedLink, force bool) (*DetachProgramResult, error) {
+	result := &DetachProgramResult{
+		Success:     true,
+		ToolVersion: "v1",
+		LinkID:      rl.id,
+	}
+
+	if info, err := rl.link.Info(); err == nil {
+		result.ProgramID = int(info.Program)
+	}
+
+	if rl.pinPath != "" {
+		if err := checkLinkPin(rl.pinPath, rl.id); err != nil {
+			rl.close()
+			return detachFailure(err)
+		}
+		if err := os.Remove(rl.pinPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			rl.close()
+			return detachFailure(fmt.Errorf("unpin %s: %w", rl.pinPath, err))
+		}
+		result.Unpinned = append(result.Unpinned, rl.pinPath)
+	}
+
+	if force {
+		if err := forceDetachLink(rl.link); err != nil {
+			rl.close()
+			return detachFailure(err)
+		}
+	}
+
+	if rl.handle != "" {
+		released, err := objects.Release(rl.handle)
+		result.Released = released
+		if err != nil {
+			result.Success = false
+			result.Error = err.Error()
+			return result, err
+		}
+	} else if err := rl.link.Close(); err != nil {
+		return detachFailure(fmt.Errorf("close link %d: %w", rl.id, err))
+	}
+
+	result.Message = fmt.Sprintf("Detached link %d from program %d", rl.id, result.ProgramID)
+	if len(result.Unpinned) > 0 {
+		result.Message += fmt.Sprintf(" and removed pin %s", result.Unpinned[0])
+	}
+	if rl.handle == "" && !force && len(result.Unpinned) == 0 {
+		result.Message += " (link was not created by this server; it stays attached while other holders keep it open, use force to break it)"
+	}
+	return result, nil
+}
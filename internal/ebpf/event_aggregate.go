@@ -0,0 +1,261 @@
+// internal/ebpf/event_aggregate.go
+package ebpf
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cilium/ebpf/btf"
+)
+
+const (
+	defaultAggregateTop = 10
+	maxAggregateTop     = 1000
+	// maxAggregateGroups bounds the groups tracked per window; events of
+	// further groups are counted as other.
+	maxAggregateGroups = 10000
+	// maxFieldSamples bounds the values kept per field and group for
+	// percentiles. Beyond it percentiles come from a uniform sample.
+	maxFieldSamples = 2048
+	// minAggregateWindow keeps the number of windows reasonable.
+	minAggregateWindow = 100 * time.Millisecond
+)
+
+// AggregateArgs switches stream_events from returning events to summarising
+// them. Events are grouped by the group_by fields over tumbling windows.
+type AggregateArgs struct {
+	GroupBy  []string `json:"group_by,omitempty"`
+	Fields   []string `json:"fields,omitempty"`
+	WindowMs int      `json:"window_ms,omitempty"`
+	Top      int      `json:"top,omitempty"`
+}
+
+// eventAggregator accumulates events into the current window.
+type eventAggregator struct {
+	groupBy    []fieldRef
+	groupNames []string
+	fields     []fieldRef
+	fieldNames []string
+	top        int
+	window     time.Duration
+
+	windowStart time.Time
+	groups      map[string]*aggregateGroup
+	events      int
+	other       int
+	windows     int
+}
+
+type aggregateGroup struct {
+	key    map[string]interface{}
+	count  int
+	fields []fieldSummary
+}
+
+// fieldSummary tracks a numeric field exactly, except for percentiles,
+// which are computed over at most maxFieldSamples values.
+type fieldSummary struct {
+	n        int
+	min, max float64
+	sum      float64
+	samples  []float64
+}
+
+func (f *fieldSummary) add(v float64) {
+	if f.n == 0 || v < f.min {
+		f.min = v
+	}
+	if f.n == 0 || v > f.max {
+		f.max = v
+	}
+	f.n++
+	f.sum += v
+	if len(f.samples) < maxFieldSamples {
+		f.samples = append(f.samples, v)
+	} else if i := rand.Intn(f.n); i < maxFieldSamples {
+		f.samples[i] = v
+	}
+}
+
+func (f *fieldSummary) summary() map[string]interface{} {
+	if f.n == 0 {
+		return map[string]interface{}{"count": 0}
+	}
+	sort.Float64s(f.samples)
+	return map[string]interface{}{
+		"count": f.n,
+		"min":   f.min,
+		"max":   f.max,
+		"avg":   f.sum / float64(f.n),
+		"p50":   percentile(f.samples, 0.50),
+		"p99":   percentile(f.samples, 0.99),
+	}
+}
+
+// percentile uses the nearest-rank method on sorted values. It returns 0
+// for no values, although summary only asks once a value was added.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	return sorted[max(rank, 0)]
+}
+
+// newEventAggregator validates the aggregation against typ, the BTF type
+// events decode to. Group keys may be any scalar or string field, summarised
+// fields must be numbers.
+func newEventAggregator(args *AggregateArgs, typ btf.Type, duration time.Duration) (*eventAggregator, error) {
+	a := &eventAggregator{
+		groupNames: append([]string{}, args.GroupBy...),
+		fieldNames: append([]string{}, args.Fields...),
+		top:        args.Top,
+		window:     time.Duration(args.WindowMs) * time.Millisecond,
+	}
+	if a.top == 0 {
+		a.top = defaultAggregateTop
+	}
+	if a.top < 0 || a.top > maxAggregateTop {
+		return nil, fmt.Errorf("aggregate.top must be between 1 and %d", maxAggregateTop)
+	}
+	if a.window < 0 {
+		return nil, errors.New("aggregate.window_ms cannot be negative")
+	}
+	if a.window > 0 && a.window < minAggregateWindow {
+		return nil, fmt.Errorf("aggregate.window_ms must be at least %d", minAggregateWindow.Milliseconds())
+	}
+	if a.window == 0 || a.window > duration {
+		a.window = duration
+	}
+
+	for _, name := range args.GroupBy {
+		ref, _, _, err := resolveEventField(typ, name)
+		if err != nil {
+			return nil, fmt.Errorf("aggregate.group_by: %w", err)
+		}
+		a.groupBy = append(a.groupBy, ref)
+	}
+	for _, name := range args.Fields {
+		ref, kind, _, err := resolveEventField(typ, name)
+		if err != nil {
+			return nil, fmt.Errorf("aggregate.fields: %w", err)
+		}
+		if kind != kindNumber {
+			return nil, fmt.Errorf("aggregate.fields: %s is a %s; only numbers can be summarised", name, kind)
+		}
+		a.fields = append(a.fields, ref)
+	}
+	return a, nil
+}
+
+// start opens the first window.
+func (a *eventAggregator) start(now time.Time) {
+	a.windowStart = now
+	a.groups = make(map[string]*aggregateGroup)
+}
+
+// windowEnd is when the current window closes.
+func (a *eventAggregator) windowEnd() time.Time {
+	return a.windowStart.Add(a.window)
+}
+
+func (a *eventAggregator) add(event map[string]interface{}) {
+	data := event["data"]
+	a.events++
+
+	key := make(map[string]interface{}, len(a.groupBy))
+	parts := make([]string, len(a.groupBy))
+	for i, ref := range a.groupBy {
+		v, ok := ref.lookup(event, data)
+		if !ok {
+			v = nil
+		}
+		key[a.groupNames[i]] = v
+		parts[i] = fmt.Sprintf("%T:%v", v, v)
+	}
+	id := strings.Join(parts, "\x00")
+
+	g, ok := a.groups[id]
+	if !ok {
+		if len(a.groups) >= maxAggregateGroups {
+			a.other++
+			return
+		}
+		g = &aggregateGroup{key: key, fields: make([]fieldSummary, len(a.fields))}
+		a.groups[id] = g
+	}
+	g.count++
+	for i, ref := range a.fields {
+		if v, ok := ref.lookup(event, data); ok {
+			if f, ok := toFloat(v); ok {
+				g.fields[i].add(f)
+			}
+		}
+	}
+}
+
+// flush summarises the current window, closed at end, and opens the next.
+func (a *eventAggregator) flush(end time.Time) map[string]interface{} {
+	groups := make([]*aggregateGroup, 0, len(a.groups))
+	for _, g := range a.groups {
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].count != groups[j].count {
+			return groups[i].count > groups[j].count
+		}
+		return fmt.Sprint(groups[i].key) < fmt.Sprint(groups[j].key)
+	})
+
+	seconds := end.Sub(a.windowStart).Seconds()
+	other := a.other
+	top := make([]map[string]interface{}, 0, min(len(groups), a.top))
+	for i, g := range groups {
+		if i >= a.top {
+			other += g.count
+			continue
+		}
+		entry := map[string]interface{}{
+			"key":   g.key,
+			"count": g.count,
+			"rate":  rate(g.count, seconds),
+		}
+		if len(a.fields) > 0 {
+			fields := make(map[string]interface{}, len(a.fields))
+			for j := range g.fields {
+				fields[a.fieldNames[j]] = g.fields[j].summary()
+			}
+			entry["fields"] = fields
+		}
+		top = append(top, entry)
+	}
+
+	window := map[string]interface{}{
+		"type":            "window",
+		"window":          a.windows,
+		"window_start_ns": a.windowStart.UnixNano(),
+		"window_end_ns":   end.UnixNano(),
+		"events":          a.events,
+		"rate":            rate(a.events, seconds),
+		"groups":          len(groups),
+		"top":             top,
+		"other_count":     other,
+	}
+
+	a.windows++
+	a.events, a.other = 0, 0
+	a.start(end)
+	return window
+}
+
+func rate(count int, seconds float64) float64 {
+	if seconds <= 0 {
+		return 0
+	}
+	return float64(count) / seconds
+}
@@ -0,0 +1,229 @@
+package ebpf
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestAggregator(t *testing.T, args AggregateArgs) *eventAggregator {
+	t.Helper()
+	a, err := newEventAggregator(&args, testEventType(), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// aggregateEvent wraps data the way stream_events hands events over.
+func aggregateEvent(cpu int, data map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"cpu": cpu, "map_id": 1, "data": data}
+}
+
+func TestEventAggregatorWindows(t *testing.T) {
+	a := newTestAggregator(t, AggregateArgs{
+		GroupBy:  []string{"comm", "cpu"},
+		Fields:   []string{"ret"},
+		WindowMs: 1000,
+	})
+	if a.window != time.Second {
+		t.Fatalf("window = %v, want 1s", a.window)
+	}
+
+	start := time.Unix(100, 0)
+	a.start(start)
+	if end := a.windowEnd(); !end.Equal(start.Add(time.Second)) {
+		t.Fatalf("windowEnd = %v, want %v", end, start.Add(time.Second))
+	}
+
+	for _, ret := range []int64{-1, -2, -3, -4} {
+		a.add(aggregateEvent(0, map[string]interface{}{"comm": "nginx", "ret": ret}))
+	}
+	a.add(aggregateEvent(1, map[string]interface{}{"comm": "nginx", "ret": int64(5)}))
+	a.add(aggregateEvent(0, map[string]interface{}{"comm": "sshd"}))
+
+	w := a.flush(start.Add(2 * time.Second))
+	if w["window"] != 0 || w["events"] != 6 || w["groups"] != 3 || w["other_count"] != 0 {
+		t.Fatalf("window = %v", w)
+	}
+	if w["rate"] != 3.0 {
+		t.Errorf("rate = %v, want 3 over two seconds", w["rate"])
+	}
+	if w["window_start_ns"] != start.UnixNano() || w["window_end_ns"] != start.Add(2*time.Second).UnixNano() {
+		t.Errorf("window bounds = %v, %v", w["window_start_ns"], w["window_end_ns"])
+	}
+
+	top := w["top"].([]map[string]interface{})
+	if len(top) != 3 {
+		t.Fatalf("got %d groups, want 3", len(top))
+	}
+	first := top[0]
+	if !reflect.DeepEqual(first["key"], map[string]interface{}{"comm": "nginx", "cpu": 0}) || first["count"] != 4 {
+		t.Errorf("first group = %v", first)
+	}
+	want := map[string]interface{}{"count": 4, "min": -4.0, "max": -1.0, "avg": -2.5, "p50": -3.0, "p99": -1.0}
+	if got := first["fields"].(map[string]interface{})["ret"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("ret summary = %v, want %v", got, want)
+	}
+
+	// Groups of equal count are ordered by key; sshd has no ret.
+	if !reflect.DeepEqual(top[1]["key"], map[string]interface{}{"comm": "nginx", "cpu": 1}) {
+		t.Errorf("second group = %v", top[1])
+	}
+	last := top[2]
+	if !reflect.DeepEqual(last["key"], map[string]interface{}{"comm": "sshd", "cpu": 0}) {
+		t.Errorf("third group = %v", last)
+	}
+	if got := last["fields"].(map[string]interface{})["ret"]; !reflect.DeepEqual(got, map[string]interface{}{"count": 0}) {
+		t.Errorf("missing field summary = %v", got)
+	}
+
+	// The next window starts where the last one ended, empty.
+	if end := a.windowEnd(); !end.Equal(start.Add(3 * time.Second)) {
+		t.Errorf("next windowEnd = %v", end)
+	}
+	a.add(aggregateEvent(0, map[string]interface{}{"comm": "sshd"}))
+	w = a.flush(start.Add(3 * time.Second))
+	if w["window"] != 1 || w["events"] != 1 || w["groups"] != 1 {
+		t.Errorf("second window = %v", w)
+	}
+}
+
+func TestEventAggregatorTop(t *testing.T) {
+	a := newTestAggregator(t, AggregateArgs{GroupBy: []string{"pid"}, Top: 2})
+	start := time.Unix(0, 0)
+	a.start(start)
+
+	// pid n is seen n times.
+	for pid := 1; pid <= 5; pid++ {
+		for i := 0; i < pid; i++ {
+			a.add(aggregateEvent(0, map[string]interface{}{"pid": uint64(pid)}))
+		}
+	}
+
+	w := a.flush(start.Add(time.Second))
+	top := w["top"].([]map[string]interface{})
+	if len(top) != 2 || top[0]["key"].(map[string]interface{})["pid"] != uint64(5) || top[1]["key"].(map[string]interface{})["pid"] != uint64(4) {
+		t.Fatalf("top = %v", top)
+	}
+	if _, ok := top[0]["fields"]; ok {
+		t.Errorf("fields reported without aggregate.fields: %v", top[0])
+	}
+	if w["groups"] != 5 || w["events"] != 15 || w["other_count"] != 1+2+3 {
+		t.Errorf("window = %v", w)
+	}
+}
+
+func TestEventAggregatorMaxGroups(t *testing.T) {
+	a := newTestAggregator(t, AggregateArgs{GroupBy: []string{"pid"}, Top: 1})
+	start := time.Unix(0, 0)
+	a.start(start)
+
+	for pid := 0; pid < maxAggregateGroups+10; pid++ {
+		a.add(aggregateEvent(0, map[string]interface{}{"pid": uint64(pid)}))
+	}
+	// Groups already tracked keep counting once the limit is reached.
+	a.add(aggregateEvent(0, map[string]interface{}{"pid": uint64(0)}))
+
+	w := a.flush(start.Add(time.Second))
+	if w["groups"] != maxAggregateGroups {
+		t.Errorf("groups = %v, want %d", w["groups"], maxAggregateGroups)
+	}
+	// Ten events beyond the limit, plus every group but the top one.
+	if want := 10 + maxAggregateGroups - 1; w["other_count"] != want {
+		t.Errorf("other_count = %v, want %d", w["other_count"], want)
+	}
+	top := w["top"].([]map[string]interface{})
+	if len(top) != 1 || top[0]["count"] != 2 {
+		t.Errorf("top = %v", top)
+	}
+
+	// Overflow is per window.
+	a.add(aggregateEvent(0, map[string]interface{}{"pid": uint64(maxAggregateGroups + 20)}))
+	if w = a.flush(start.Add(2 * time.Second)); w["other_count"] != 0 || w["groups"] != 1 {
+		t.Errorf("next window = %v", w)
+	}
+}
+
+func TestEventAggregatorArgs(t *testing.T) {
+	tests := []struct {
+		args AggregateArgs
+		want string
+	}{
+		{AggregateArgs{Top: -1}, "aggregate.top must be between 1 and 1000"},
+		{AggregateArgs{Top: maxAggregateTop + 1}, "aggregate.top must be between 1 and 1000"},
+		{AggregateArgs{WindowMs: -1}, "aggregate.window_ms cannot be negative"},
+		{AggregateArgs{WindowMs: 10}, "aggregate.window_ms must be at least 100"},
+		{AggregateArgs{GroupBy: []string{"nope"}}, `aggregate.group_by: unknown field "nope"`},
+		{AggregateArgs{Fields: []string{"comm"}}, "aggregate.fields: comm is a string; only numbers can be summarised"},
+		{AggregateArgs{Fields: []string{"args"}}, "aggregate.fields: args is a struct args"},
+	}
+	for _, tt := range tests {
+		_, err := newEventAggregator(&tt.args, testEventType(), time.Minute)
+		if err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+			t.Errorf("%+v: got %v, want %q", tt.args, err, tt.want)
+		}
+	}
+
+	// Windows default to, and are capped by, the stream duration.
+	a, err := newEventAggregator(&AggregateArgs{}, testEventType(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.window != 5*time.Second || a.top != defaultAggregateTop {
+		t.Errorf("defaults: window %v, top %d", a.window, a.top)
+	}
+	a, err = newEventAggregator(&AggregateArgs{WindowMs: 10000}, testEventType(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.window != 5*time.Second {
+		t.Errorf("window %v, want the 5s duration", a.window)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	tests := []struct {
+		values []float64
+		p      float64
+		want   float64
+	}{
+		{nil, 0.5, 0},
+		{[]float64{7}, 0.5, 7},
+		{[]float64{7}, 0.99, 7},
+		{sorted, 0, 1},
+		{sorted, 0.1, 1},
+		{sorted, 0.11, 2},
+		{sorted, 0.5, 5},
+		{sorted, 0.99, 10},
+		{sorted, 1, 10},
+	}
+	for _, tt := range tests {
+		if got := percentile(tt.values, tt.p); got != tt.want {
+			t.Errorf("percentile(%v, %v) = %v, want %v", tt.values, tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestFieldSummarySampling(t *testing.T) {
+	var f fieldSummary
+	n := 3 * maxFieldSamples
+	for i := 1; i <= n; i++ {
+		f.add(float64(i))
+	}
+	if len(f.samples) != maxFieldSamples {
+		t.Fatalf("kept %d samples, want %d", len(f.samples), maxFieldSamples)
+	}
+
+	s := f.summary()
+	// count, min, max and avg stay exact; percentiles come from the sample.
+	if s["count"] != n || s["min"] != 1.0 || s["max"] != float64(n) || s["avg"] != float64(n+1)/2 {
+		t.Errorf("summary = %v", s)
+	}
+	p50 := s["p50"].(float64)
+	if p50 < float64(n)/4 || p50 > 3*float64(n)/4 {
+		t.Errorf("p50 = %v, far from the median %d", p50, n/2)
+	}
+}
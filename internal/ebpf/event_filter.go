@@ -0,0 +1,743 @@
+// internal/ebpf/event_filter.go
+package ebpf
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/cilium/ebpf/btf"
+)
+
+// An event filter is a boolean expression over the fields of a decoded
+// event, for example:
+//
+//	pid in (1, 2) && comm =~ "nginx.*" && ret < 0
+//
+// Fields name struct members of the event's BTF type, with dots for nested
+// members (args.fd), or one of the record fields cpu, size, timestamp_ns and
+// map_id. Comparisons are ==, !=, <, <=, >, >=, =~ and !~ (RE2, unanchored)
+// and "in (...)"; they combine with &&, || and !, and group with
+// parentheses. Filters are checked against the BTF type when compiled, so
+// unknown fields and comparisons that can never match are rejected up front.
+
+// valueKind is what a field holds once decoded.
+type valueKind int
+
+const (
+	kindNumber valueKind = iota
+	kindBool
+	kindString
+	kindEnum
+)
+
+func (k valueKind) String() string {
+	switch k {
+	case kindNumber:
+		return "number"
+	case kindBool:
+		return "bool"
+	case kindString:
+		return "string"
+	case kindEnum:
+		return "enum"
+	}
+	return "unknown"
+}
+
+// recordFields are available for every event, decoded or not.
+var recordFields = map[string]valueKind{
+	"cpu":          kindNumber,
+	"size":         kindNumber,
+	"timestamp_ns": kindNumber,
+	"map_id":       kindNumber,
+}
+
+// eventFilter is a compiled filter expression.
+type eventFilter struct {
+	root filterNode
+}
+
+type filterNode interface {
+	eval(meta map[string]interface{}, data interface{}) bool
+}
+
+type andNode struct{ left, right filterNode }
+type orNode struct{ left, right filterNode }
+type notNode struct{ inner filterNode }
+
+func (n andNode) eval(meta map[string]interface{}, data interface{}) bool {
+	return n.left.eval(meta, data) && n.right.eval(meta, data)
+}
+
+func (n orNode) eval(meta map[string]interface{}, data interface{}) bool {
+	return n.left.eval(meta, data) || n.right.eval(meta, data)
+}
+
+func (n notNode) eval(meta map[string]interface{}, data interface{}) bool {
+	return !n.inner.eval(meta, data)
+}
+
+// compareNode compares a field against one or more literals. With several
+// literals (the in operator) it matches if any of them compares equal.
+type compareNode struct {
+	field  fieldRef
+	op     string
+	values []interface{}
+	re     *regexp.Regexp
+}
+
+// fieldRef locates a field either in the decoded data or in the record.
+type fieldRef struct {
+	path   []string
+	record bool
+}
+
+func (f fieldRef) lookup(meta map[string]interface{}, data interface{}) (interface{}, bool) {
+	if f.record {
+		v, ok := meta[f.path[0]]
+		return v, ok
+	}
+	v := data
+	for _, name := range f.path {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = obj[name]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+func (n compareNode) eval(meta map[string]interface{}, data interface{}) bool {
+	v, ok := n.field.lookup(meta, data)
+	if !ok {
+		// Events that failed to decode match no comparison.
+		return false
+	}
+
+	switch n.op {
+	case "=~", "!~":
+		s, ok := v.(string)
+		return ok && n.re.MatchString(s) == (n.op == "=~")
+	case "in":
+		for _, want := range n.values {
+			if c, ok := compareValues(v, want); ok && c == 0 {
+				return true
+			}
+		}
+		return false
+	}
+
+	c, ok := compareValues(v, n.values[0])
+	if !ok {
+		return n.op == "!="
+	}
+	switch n.op {
+	case "==":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+// compareValues orders a decoded value against a literal. Integers are
+// compared exactly whatever their signedness.
+func compareValues(a, b interface{}) (int, bool) {
+	switch av := a.(type) {
+	case string:
+		bv, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(av, bv), true
+	case bool:
+		bv, ok := b.(bool)
+		if !ok {
+			return 0, false
+		}
+		if av == bv {
+			return 0, true
+		}
+		if !av {
+			return -1, true
+		}
+		return 1, true
+	}
+
+	switch av := a.(type) {
+	case int64:
+		return compareInt(av, b)
+	case uint64:
+		if av <= math.MaxInt64 {
+			return compareInt(int64(av), b)
+		}
+		switch bv := b.(type) {
+		case uint64:
+			return compareUint(av, bv), true
+		case int64:
+			return 1, true
+		}
+	}
+
+	af, aok := toFloat(a)
+	bf, bok := toFloat(b)
+	if !aok || !bok {
+		return 0, false
+	}
+	switch {
+	case af < bf:
+		return -1, true
+	case af > bf:
+		return 1, true
+	}
+	return 0, true
+}
+
+func compareInt(a int64, b interface{}) (int, bool) {
+	switch bv := b.(type) {
+	case int64:
+		switch {
+		case a < bv:
+			return -1, true
+		case a > bv:
+			return 1, true
+		}
+		return 0, true
+	case uint64:
+		if a < 0 {
+			return -1, true
+		}
+		return compareUint(uint64(a), bv), true
+	}
+	bf, ok := toFloat(b)
+	if !ok {
+		return 0, false
+	}
+	af := float64(a)
+	switch {
+	case af < bf:
+		return -1, true
+	case af > bf:
+		return 1, true
+	}
+	return 0, true
+}
+
+func compareUint(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+func (f *eventFilter) match(meta map[string]interface{}, data interface{}) bool {
+	return f.root.eval(meta, data)
+}
+
+// compileEventFilter parses expr and checks it against typ, the BTF type
+// events decode to. A nil typ only allows the record fields.
+func compileEventFilter(expr string, typ btf.Type) (*eventFilter, error) {
+	tokens, err := lexFilter(expr)
+	if err != nil {
+		return nil, fmt.Errorf("filter: %w", err)
+	}
+	p := &filterParser{tokens: tokens, typ: typ}
+	root, err := p.parseOr()
+	if err == nil && p.peek().kind != tokEOF {
+		err = p.errorf(p.peek(), "unexpected %s", p.peek())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("filter: %w", err)
+	}
+	return &eventFilter{root: root}, nil
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokOp
+)
+
+type filterToken struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t filterToken) String() string {
+	if t.kind == tokEOF {
+		return "end of filter"
+	}
+	return strconv.Quote(t.text)
+}
+
+var filterOps = []string{"&&", "||", "==", "!=", "<=", ">=", "=~", "!~", "<", ">", "!", "(", ")", ","}
+
+func lexFilter(expr string) ([]filterToken, error) {
+	var tokens []filterToken
+	for i := 0; i < len(expr); {
+		c := rune(expr[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+
+		case c == '"':
+			end := i + 1
+			for end < len(expr) && expr[end] != '"' {
+				if expr[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(expr) {
+				return nil, fmt.Errorf("position %d: unterminated string", i+1)
+			}
+			tokens = append(tokens, filterToken{tokString, unescapeFilterString(expr[i+1 : end]), i})
+			i = end + 1
+
+		case unicode.IsDigit(c) || (c == '-' && i+1 < len(expr) && unicode.IsDigit(rune(expr[i+1]))):
+			end := i + 1
+			for end < len(expr) && (unicode.IsLetter(rune(expr[end])) || unicode.IsDigit(rune(expr[end])) || expr[end] == '.') {
+				end++
+			}
+			tokens = append(tokens, filterToken{tokNumber, expr[i:end], i})
+			i = end
+
+		case unicode.IsLetter(c) || c == '_':
+			end := i + 1
+			for end < len(expr) && (unicode.IsLetter(rune(expr[end])) || unicode.IsDigit(rune(expr[end])) || expr[end] == '_' || expr[end] == '.') {
+				end++
+			}
+			tokens = append(tokens, filterToken{tokIdent, expr[i:end], i})
+			i = end
+
+		default:
+			op := ""
+			for _, candidate := range filterOps {
+				if strings.HasPrefix(expr[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("position %d: unexpected character %q", i+1, c)
+			}
+			tokens = append(tokens, filterToken{tokOp, op, i})
+			i += len(op)
+		}
+	}
+	return append(tokens, filterToken{kind: tokEOF, pos: len(expr)}), nil
+}
+
+// unescapeFilterString resolves \" and \\ only, so regular expressions
+// such as "\d+" need no double escaping.
+func unescapeFilterString(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\') {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+	typ    btf.Type
+}
+
+func (p *filterParser) peek() filterToken { return p.tokens[p.pos] }
+
+func (p *filterParser) next() filterToken {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *filterParser) isOp(op string) bool {
+	t := p.peek()
+	return t.kind == tokOp && t.text == op
+}
+
+func (p *filterParser) errorf(t filterToken, format string, args ...interface{}) error {
+	return fmt.Errorf("position %d: %s", t.pos+1, fmt.Sprintf(format, args...))
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("||") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("&&") {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseUnary() (filterNode, error) {
+	if p.isOp("!") {
+		p.next()
+		inner, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{inner}, nil
+	}
+	if p.isOp("(") {
+		p.next()
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.isOp(")") {
+			return nil, p.errorf(p.peek(), "expected \")\", got %s", p.peek())
+		}
+		p.next()
+		return inner, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *filterParser) parseComparison() (filterNode, error) {
+	fieldTok := p.next()
+	if fieldTok.kind != tokIdent {
+		return nil, p.errorf(fieldTok, "expected a field name, got %s", fieldTok)
+	}
+	field, kind, enum, err := p.resolveField(fieldTok)
+	if err != nil {
+		return nil, err
+	}
+
+	opTok := p.next()
+	node := compareNode{field: field}
+	switch {
+	case opTok.kind == tokIdent && opTok.text == "in":
+		node.op = "in"
+		if !p.isOp("(") {
+			return nil, p.errorf(p.peek(), "expected \"(\" after in, got %s", p.peek())
+		}
+		p.next()
+		for {
+			v, err := p.parseLiteral(fieldTok.text, kind, enum, "in")
+			if err != nil {
+				return nil, err
+			}
+			node.values = append(node.values, v)
+			if p.isOp(",") {
+				p.next()
+				continue
+			}
+			if !p.isOp(")") {
+				return nil, p.errorf(p.peek(), "expected \",\" or \")\", got %s", p.peek())
+			}
+			p.next()
+			return node, nil
+		}
+
+	case opTok.kind == tokOp && (opTok.text == "=~" || opTok.text == "!~"):
+		if kind != kindString {
+			return nil, p.errorf(opTok, "%s is a %s; %s only applies to strings", fieldTok.text, kind, opTok.text)
+		}
+		t := p.next()
+		if t.kind != tokString {
+			return nil, p.errorf(t, "expected a quoted regular expression after %s, got %s", opTok.text, t)
+		}
+		re, err := regexp.Compile(t.text)
+		if err != nil {
+			return nil, p.errorf(t, "invalid regular expression: %v", err)
+		}
+		node.op, node.re = opTok.text, re
+		return node, nil
+
+	case opTok.kind == tokOp && (opTok.text == "==" || opTok.text == "!="):
+		node.op = opTok.text
+
+	case opTok.kind == tokOp && (opTok.text == "<" || opTok.text == "<=" || opTok.text == ">" || opTok.text == ">="):
+		if kind != kindNumber {
+			return nil, p.errorf(opTok, "%s is a %s; %s only applies to numbers", fieldTok.text, kind, opTok.text)
+		}
+		node.op = opTok.text
+
+	default:
+		return nil, p.errorf(opTok, "expected a comparison after %s, got %s", fieldTok.text, opTok)
+	}
+
+	v, err := p.parseLiteral(fieldTok.text, kind, enum, node.op)
+	if err != nil {
+		return nil, err
+	}
+	node.values = []interface{}{v}
+	return node, nil
+}
+
+// parseLiteral reads a literal and converts it to the form decoded values
+// of the given kind take, so comparisons need no conversion at runtime.
+func (p *filterParser) parseLiteral(field string, kind valueKind, enum *btf.Enum, op string) (interface{}, error) {
+	t := p.next()
+
+	switch kind {
+	case kindNumber:
+		if t.kind != tokNumber {
+			return nil, p.errorf(t, "%s is a number; cannot compare it with %s", field, t)
+		}
+		return parseNumber(t.text, p, t)
+
+	case kindBool:
+		if t.kind == tokIdent && (t.text == "true" || t.text == "false") {
+			return t.text == "true", nil
+		}
+		return nil, p.errorf(t, "%s is a bool; expected true or false, got %s", field, t)
+
+	case kindString:
+		if t.kind != tokString {
+			return nil, p.errorf(t, "%s is a string; expected a quoted string, got %s", field, t)
+		}
+		return t.text, nil
+
+	case kindEnum:
+		// Enums decode to their value name when it is known.
+		switch t.kind {
+		case tokIdent, tokString:
+			for _, v := range enum.Values {
+				if v.Name == t.text {
+					return t.text, nil
+				}
+			}
+			return nil, p.errorf(t, "%s has no value %s; valid values are %s", field, t, enumNames(enum))
+		case tokNumber:
+			n, err := parseNumber(t.text, p, t)
+			if err != nil {
+				return nil, err
+			}
+			for _, v := range enum.Values {
+				if c, ok := compareValues(v.Value, n); ok && c == 0 {
+					return v.Name, nil
+				}
+			}
+			return n, nil
+		}
+		return nil, p.errorf(t, "%s is an enum; expected a value name, got %s", field, t)
+	}
+	return nil, p.errorf(t, "cannot compare %s with %s %s", field, op, t)
+}
+
+func parseNumber(text string, p *filterParser, t filterToken) (interface{}, error) {
+	if n, err := strconv.ParseInt(text, 0, 64); err == nil {
+		return n, nil
+	}
+	if n, err := strconv.ParseUint(text, 0, 64); err == nil {
+		return n, nil
+	}
+	if f, err := strconv.ParseFloat(text, 64); err == nil {
+		return f, nil
+	}
+	return nil, p.errorf(t, "invalid number %s", t)
+}
+
+func enumNames(enum *btf.Enum) string {
+	names := make([]string, len(enum.Values))
+	for i, v := range enum.Values {
+		names[i] = v.Name
+	}
+	return strings.Join(names, ", ")
+}
+
+func (p *filterParser) resolveField(t filterToken) (fieldRef, valueKind, *btf.Enum, error) {
+	ref, kind, enum, err := resolveEventField(p.typ, t.text)
+	if err != nil {
+		return fieldRef{}, 0, nil, p.errorf(t, "%v", err)
+	}
+	return ref, kind, enum, nil
+}
+
+// resolveEventField checks that a field exists in events decoded as typ and
+// returns what it decodes to. Members of the event type take precedence
+// over record fields.
+func resolveEventField(typ btf.Type, name string) (fieldRef, valueKind, *btf.Enum, error) {
+	path := strings.Split(name, ".")
+
+	if typ != nil {
+		mt, bitfield, err := memberType(typ, path)
+		if err == nil {
+			if bitfield {
+				return fieldRef{path: path}, kindNumber, nil, nil
+			}
+			kind, enum, err := kindOf(mt)
+			if err != nil {
+				return fieldRef{}, 0, nil, fmt.Errorf("%s %v", name, err)
+			}
+			return fieldRef{path: path}, kind, enum, nil
+		}
+		if _, ok := recordFields[name]; !ok {
+			return fieldRef{}, 0, nil, err
+		}
+	}
+
+	if kind, ok := recordFields[name]; ok {
+		return fieldRef{path: path, record: true}, kind, nil, nil
+	}
+	return fieldRef{}, 0, nil, fmt.Errorf("unknown field %q; events have no BTF type (pass struct_type to decode them), so only %s are available",
+		name, strings.Join(sortedKeys(recordFields), ", "))
+}
+
+// memberType follows a member path through structs and unions, looking
+// inside anonymous members the way C does.
+func memberType(typ btf.Type, path []string) (btf.Type, bool, error) {
+	for i, name := range path {
+		members, ok := compositeMembers(typ)
+		if !ok {
+			return nil, false, fmt.Errorf("%s is not a struct", strings.Join(path[:i], "."))
+		}
+		m, found := findMember(members, name)
+		if !found {
+			return nil, false, fmt.Errorf("unknown field %q; %s has %s", strings.Join(path[:i+1], "."),
+				btfTypeName(btf.UnderlyingType(typ)), strings.Join(memberNames(members), ", "))
+		}
+		if m.BitfieldSize > 0 {
+			if i != len(path)-1 {
+				return nil, false, fmt.Errorf("%s is not a struct", strings.Join(path[:i+1], "."))
+			}
+			return m.Type, true, nil
+		}
+		typ = m.Type
+	}
+	return typ, false, nil
+}
+
+func compositeMembers(typ btf.Type) ([]btf.Member, bool) {
+	switch t := btf.UnderlyingType(typ).(type) {
+	case *btf.Struct:
+		return t.Members, true
+	case *btf.Union:
+		return t.Members, true
+	}
+	return nil, false
+}
+
+func findMember(members []btf.Member, name string) (btf.Member, bool) {
+	for _, m := range members {
+		if m.Name == name {
+			return m, true
+		}
+		if m.Name == "" {
+			if nested, ok := compositeMembers(m.Type); ok {
+				if found, ok := findMember(nested, name); ok {
+					return found, true
+				}
+			}
+		}
+	}
+	return btf.Member{}, false
+}
+
+func memberNames(members []btf.Member) []string {
+	var names []string
+	for _, m := range members {
+		if m.Name == "" {
+			if nested, ok := compositeMembers(m.Type); ok {
+				names = append(names, memberNames(nested)...)
+			}
+			continue
+		}
+		names = append(names, m.Name)
+	}
+	return names
+}
+
+// kindOf maps a BTF type to the kind decodeBTF produces for it.
+func kindOf(typ btf.Type) (valueKind, *btf.Enum, error) {
+	switch t := btf.UnderlyingType(typ).(type) {
+	case *btf.Int:
+		if t.Encoding == btf.Bool {
+			return kindBool, nil, nil
+		}
+		return kindNumber, nil, nil
+	case *btf.Float:
+		return kindNumber, nil, nil
+	case *btf.Enum:
+		return kindEnum, t, nil
+	case *btf.Pointer:
+		return kindString, nil, nil
+	case *btf.Array:
+		if isCharType(t.Type) {
+			return kindString, nil, nil
+		}
+		return 0, nil, fmt.Errorf("is an array; only scalars and strings can be compared")
+	case *btf.Struct, *btf.Union:
+		return 0, nil, fmt.Errorf("is a %s; compare one of its members", btfTypeName(t))
+	}
+	return 0, nil, fmt.Errorf("has unsupported type %s", btfTypeName(typ))
+}
+
+func sortedKeys(m map[string]valueKind) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,269 @@
+package ebpf
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cilium/ebpf/btf"
+)
+
+// testEventType is the BTF of
+//
+//	struct event {
+//		__u32 pid;
+//		__s32 ret;
+//		char comm[16];
+//		bool ok;
+//		enum state state;
+//		struct { __s64 fd; } args;
+//		__u64 big;
+//		union { __u32 flags; };
+//	};
+func testEventType() *btf.Struct {
+	u32 := &btf.Int{Name: "__u32", Size: 4}
+	s32 := &btf.Int{Name: "__s32", Size: 4, Encoding: btf.Signed}
+	s64 := &btf.Int{Name: "__s64", Size: 8, Encoding: btf.Signed}
+	u64 := &btf.Int{Name: "__u64", Size: 8}
+	char := &btf.Int{Name: "char", Size: 1, Encoding: btf.Char}
+	boolean := &btf.Int{Name: "bool", Size: 1, Encoding: btf.Bool}
+	state := &btf.Enum{Name: "state", Size: 4, Values: []btf.EnumValue{
+		{Name: "RUNNING", Value: 0},
+		{Name: "SLEEPING", Value: 1},
+	}}
+	args := &btf.Struct{Name: "args", Size: 8, Members: []btf.Member{
+		{Name: "fd", Type: s64},
+	}}
+	anon := &btf.Union{Size: 4, Members: []btf.Member{
+		{Name: "flags", Type: u32},
+	}}
+
+	return &btf.Struct{Name: "event", Size: 64, Members: []btf.Member{
+		{Name: "pid", Type: u32, Offset: 0},
+		{Name: "ret", Type: s32, Offset: 32},
+		{Name: "comm", Type: &btf.Array{Type: char, Index: u32, Nelems: 16}, Offset: 64},
+		{Name: "ok", Type: boolean, Offset: 192},
+		{Name: "state", Type: state, Offset: 224},
+		{Name: "args", Type: args, Offset: 256},
+		{Name: "big", Type: u64, Offset: 320},
+		{Name: "", Type: anon, Offset: 384},
+	}}
+}
+
+// testEvent is an event as decodeBTF returns it for testEventType.
+func testEvent() map[string]interface{} {
+	return map[string]interface{}{
+		"pid":   uint64(42),
+		"ret":   int64(-2),
+		"comm":  "nginx: worker",
+		"ok":    true,
+		"state": "SLEEPING",
+		"args":  map[string]interface{}{"fd": int64(3)},
+		"big":   uint64(1 << 63),
+		"flags": uint64(0x10),
+	}
+}
+
+func TestEventFilterMatch(t *testing.T) {
+	meta := map[string]interface{}{
+		"cpu":          0,
+		"size":         64,
+		"timestamp_ns": int64(1000),
+		"map_id":       7,
+	}
+
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		// Numbers, signed and unsigned.
+		{"pid == 42", true},
+		{"pid != 42", false},
+		{"pid < 43", true},
+		{"pid <= 42", true},
+		{"pid > 42", false},
+		{"pid >= 0x2a", true},
+		{"ret < 0", true},
+		{"ret == -2", true},
+		{"ret > -3", true},
+		{"big > 0", true},
+		{"big == 9223372036854775808", true},
+		{"big > 9223372036854775807", true},
+		{"big < -1", false},
+		{"args.fd == 3", true},
+		{"flags == 16", true},
+
+		// Strings and regular expressions.
+		{`comm == "nginx: worker"`, true},
+		{`comm != "nginx"`, true},
+		{`comm =~ "^nginx"`, true},
+		{`comm =~ "worker$"`, true},
+		{`comm !~ "nginx"`, false},
+		{`comm =~ "\d"`, false},
+
+		// Bools and enums, by name or value.
+		{"ok == true", true},
+		{"ok != false", true},
+		{"state == SLEEPING", true},
+		{`state == "RUNNING"`, false},
+		{"state == 1", true},
+		{"state != 0", true},
+
+		// in.
+		{"pid in (1, 2, 42)", true},
+		{"pid in (1, 2)", false},
+		{`comm in ("sshd", "nginx: worker")`, true},
+		{"state in (RUNNING)", false},
+		{"ret in (-1, -2)", true},
+
+		// Record fields.
+		{"cpu == 0", true},
+		{"size >= 64", true},
+		{"timestamp_ns > 999", true},
+		{"map_id == 7", true},
+
+		// Precedence: ! binds tighter than &&, which binds tighter than ||.
+		{"pid == 1 || pid == 42 && ret < 0", true},
+		{"pid == 42 || pid == 1 && ret > 0", true},
+		{"(pid == 42 || pid == 1) && ret > 0", false},
+		{"pid == 1 && ret < 0 || ok == true", true},
+		{"pid == 1 && (ret < 0 || ok == true)", false},
+		{"!pid == 42", false},
+		{"!(pid == 1) && !(ret > 0)", true},
+		{"!!(pid == 42)", true},
+		{"!(pid == 42 || ok == false)", false},
+	}
+
+	typ := testEventType()
+	for _, tt := range tests {
+		f, err := compileEventFilter(tt.expr, typ)
+		if err != nil {
+			t.Errorf("%s: %v", tt.expr, err)
+			continue
+		}
+		if got := f.match(meta, testEvent()); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestEventFilterUndecoded(t *testing.T) {
+	// Events that failed to decode have no data: comparisons on members
+	// never match, but record fields still do.
+	typ := testEventType()
+	meta := map[string]interface{}{"cpu": 1}
+
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"pid == 42", false},
+		{"pid != 42", false},
+		{"!(pid == 42)", true},
+		{"cpu == 1", true},
+		{"cpu == 1 && pid == 42", false},
+	}
+	for _, tt := range tests {
+		f, err := compileEventFilter(tt.expr, typ)
+		if err != nil {
+			t.Errorf("%s: %v", tt.expr, err)
+			continue
+		}
+		if got := f.match(meta, nil); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestEventFilterErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		typ  btf.Type
+		want string
+	}{
+		// Unknown fields.
+		{"nope == 1", testEventType(), `unknown field "nope"`},
+		{"args.nope == 1", testEventType(), `unknown field "args.nope"`},
+		{"pid.x == 1", testEventType(), "pid is not a struct"},
+		{"pid == 1", nil, "events have no BTF type"},
+
+		// Comparisons that can never match.
+		{"args == 1", testEventType(), "compare one of its members"},
+		{`pid == "42"`, testEventType(), "pid is a number"},
+		{"comm == nginx", testEventType(), "expected a quoted string"},
+		{"comm > 1", testEventType(), "only applies to numbers"},
+		{`comm < "nginy"`, testEventType(), "only applies to numbers"},
+		{`pid =~ "4"`, testEventType(), "only applies to strings"},
+		{"ok == 1", testEventType(), "expected true or false"},
+		{"state == STOPPED", testEventType(), "valid values are RUNNING, SLEEPING"},
+		{`comm =~ "("`, testEventType(), "invalid regular expression"},
+		{"comm =~ nginx", testEventType(), "expected a quoted regular expression"},
+
+		// Malformed expressions.
+		{"", testEventType(), "expected a field name, got end of filter"},
+		{"pid", testEventType(), "expected a comparison"},
+		{"pid ==", testEventType(), "cannot compare it with end of filter"},
+		{"pid == 1 &&", testEventType(), "expected a field name"},
+		{"pid == 1 ||| pid == 2", testEventType(), "unexpected character"},
+		{"(pid == 1", testEventType(), `expected ")"`},
+		{"pid == 1)", testEventType(), `unexpected ")"`},
+		{"pid in 1, 2", testEventType(), `expected "(" after in`},
+		{"pid in (1, 2", testEventType(), `expected "," or ")"`},
+		{"pid in ()", testEventType(), "cannot compare it with"},
+		{"pid == 1 pid == 2", testEventType(), `unexpected "pid"`},
+		{`comm == "nginx`, testEventType(), "unterminated string"},
+		{`comm == "nginx\"`, testEventType(), "unterminated string"},
+		{"pid == 1 & pid == 2", testEventType(), "unexpected character"},
+		{"pid == 1e", testEventType(), "invalid number"},
+		{"pid == 0x", testEventType(), "invalid number"},
+		{"pid @ 1", testEventType(), "unexpected character"},
+		{"== 1", testEventType(), "expected a field name"},
+		{"!", testEventType(), "expected a field name"},
+		{"()", testEventType(), "expected a field name"},
+	}
+
+	for _, tt := range tests {
+		f, err := compileEventFilter(tt.expr, tt.typ)
+		if err == nil {
+			t.Errorf("%q: compiled to %v, want an error", tt.expr, f)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: got %q, want it to contain %q", tt.expr, err, tt.want)
+		}
+	}
+}
+
+func TestUnescapeFilterString(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{`abc`, `abc`},
+		{`a\"b`, `a"b`},
+		{`a\\b`, `a\b`},
+		{`\d+`, `\d+`},
+		{`trailing\`, `trailing\`},
+	}
+	for _, tt := range tests {
+		if got := unescapeFilterString(tt.in); got != tt.want {
+			t.Errorf("unescapeFilterString(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func FuzzCompileEventFilter(f *testing.F) {
+	for _, seed := range []string{
+		`pid in (1, 2) && comm =~ "nginx.*" && ret < 0`,
+		`!(state == RUNNING) || args.fd >= 0x10`,
+		`comm == "a\"b"`,
+		`(((`,
+	} {
+		f.Add(seed)
+	}
+	typ := testEventType()
+	f.Fuzz(func(t *testing.T, expr string) {
+		filter, err := compileEventFilter(expr, typ)
+		if err != nil {
+			return
+		}
+		filter.match(map[string]interface{}{"cpu": 0}, testEvent())
+		filter.match(nil, nil)
+	})
+}
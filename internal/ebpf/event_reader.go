@@ -0,0 +1,102 @@
+// internal/ebpf/event_reader.go
+package ebpf
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/perf"
+	"github.com/cilium/ebpf/ringbuf"
+)
+
+// Event buffer kinds accepted as source.type.
+const (
+	SourceRingbuf = "ringbuf"
+	SourcePerfbuf = "perfbuf"
+)
+
+// perfPagesPerCPU sizes the per-CPU perf ring the reader allocates.
+const perfPagesPerCPU = 64
+
+// eventRecord is one sample read from a ringbuf or perf buffer. Perf
+// buffers report samples lost to overflow in Lost, with no Data.
+type eventRecord struct {
+	CPU  int
+	Data []byte
+	Lost uint64
+}
+
+// eventReader hides the differences between ringbuf and perf readers. Read
+// returns os.ErrDeadlineExceeded once the deadline passes and os.ErrClosed
+// after Close, which may be called concurrently to interrupt it.
+type eventReader interface {
+	Read() (eventRecord, error)
+	SetDeadline(time.Time)
+	Close() error
+}
+
+// sourceKind returns the source.type matching a map type, or "" if events
+// can't be read from it.
+func sourceKind(t ebpf.MapType) string {
+	switch t {
+	case ebpf.RingBuf:
+		return SourceRingbuf
+	case ebpf.PerfEventArray:
+		return SourcePerfbuf
+	}
+	return ""
+}
+
+func newEventReader(m *ebpf.Map, kind string) (eventReader, error) {
+	switch kind {
+	case SourceRingbuf:
+		rd, err := ringbuf.NewReader(m)
+		if err != nil {
+			return nil, fmt.Errorf("ringbuf reader: %w", err)
+		}
+		return ringbufReader{rd}, nil
+	case SourcePerfbuf:
+		rd, err := perf.NewReader(m, perfPagesPerCPU*os.Getpagesize())
+		if err != nil {
+			return nil, fmt.Errorf("perf reader: %w", err)
+		}
+		return perfReader{rd}, nil
+	}
+	return nil, fmt.Errorf("unsupported source type: %s", kind)
+}
+
+type ringbufReader struct{ rd *ringbuf.Reader }
+
+func (r ringbufReader) Read() (eventRecord, error) {
+	rec, err := r.rd.Read()
+	if err != nil {
+		if errors.Is(err, ringbuf.ErrClosed) {
+			return eventRecord{}, os.ErrClosed
+		}
+		return eventRecord{}, err
+	}
+	// Ringbuf records aren't tied to a CPU.
+	return eventRecord{CPU: -1, Data: rec.RawSample}, nil
+}
+
+func (r ringbufReader) SetDeadline(t time.Time) { r.rd.SetDeadline(t) }
+func (r ringbufReader) Close() error            { return r.rd.Close() }
+
+type perfReader struct{ rd *perf.Reader }
+
+func (r perfReader) Read() (eventRecord, error) {
+	rec, err := r.rd.Read()
+	if err != nil {
+		if errors.Is(err, perf.ErrClosed) {
+			return eventRecord{}, os.ErrClosed
+		}
+		return eventRecord{}, err
+	}
+	return eventRecord{CPU: rec.CPU, Data: rec.RawSample, Lost: rec.LostSamples}, nil
+}
+
+func (r perfReader) SetDeadline(t time.Time) { r.rd.SetDeadline(t) }
+func (r perfReader) Close() error            { return r.rd.Close() }
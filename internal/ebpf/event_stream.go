@@ -0,0 +1,169 @@
+// internal/ebpf/event_stream.go
+package ebpf
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cilium/ebpf/btf"
+)
+
+// eventStream reads and renders events from a resolved source. It backs
+// both stream_events and background stream sessions.
+type eventStream struct {
+	src     *eventSource
+	rd      eventReader
+	decoder *eventDecoder
+	format  string
+	filter  *eventFilter
+	filters map[string]interface{}
+
+	// dropped counts samples the kernel lost, filtered those the filters
+	// or filter rejected.
+	dropped  uint64
+	filtered int
+}
+
+// openEventStream resolves source and opens a reader on it. Records are
+// decoded through BTF for the json format, and whenever a filter expression
+// needs their fields.
+func openEventStream(source StreamSource, format, structType, filter string, filters map[string]interface{}) (*eventStream, error) {
+	// Records don't say which hook produced them, so there is nothing to
+	// match event types against; the source already selects the programs.
+	if _, ok := filters["event_types"]; ok {
+		return nil, errors.New("filters.event_types is not supported: events don't carry the hook that produced them, choose the hook through source")
+	}
+
+	src, err := resolveEventSource(source)
+	if err != nil {
+		return nil, err
+	}
+
+	var decoder *eventDecoder
+	if format == "json" || filter != "" {
+		typ, err := src.eventType(structType)
+		if err != nil {
+			src.close()
+			return nil, err
+		}
+		decoder = &eventDecoder{typ: typ}
+	}
+
+	var compiled *eventFilter
+	if filter != "" {
+		compiled, err = compileEventFilter(filter, decoder.typ)
+		if err != nil {
+			src.close()
+			return nil, err
+		}
+	}
+
+	rd, err := newEventReader(src.om.m, src.kind)
+	if err != nil {
+		src.close()
+		return nil, err
+	}
+
+	return &eventStream{src: src, rd: rd, decoder: decoder, format: format, filter: compiled, filters: filters}, nil
+}
+
+// next reads one record. It returns a nil event without error for lost
+// samples and filtered events, and the reader's error once the deadline
+// passes or the reader is closed.
+func (s *eventStream) next() (map[string]interface{}, error) {
+	rec, err := s.rd.Read()
+	if err != nil {
+		return nil, fmt.Errorf("read events from %s: %w", s.src.desc, err)
+	}
+	if rec.Lost > 0 {
+		s.dropped += rec.Lost
+		return nil, nil
+	}
+
+	var data interface{}
+	var decodeErr error
+	if s.decoder != nil && s.decoder.typ != nil {
+		data, decodeErr = s.decoder.decode(rec.Data)
+	}
+
+	event := newStreamEvent(rec, s.src.om.id, s.format, data, decodeErr)
+	if s.filter != nil && !s.filter.match(event, data) {
+		s.filtered++
+		return nil, nil
+	}
+	if !shouldIncludeEvent(event, s.filters) {
+		s.filtered++
+		return nil, nil
+	}
+	return event, nil
+}
+
+// structType names the BTF type records are decoded as, if any.
+func (s *eventStream) structType() string {
+	if s.decoder == nil || s.decoder.typ == nil {
+		return ""
+	}
+	return btfTypeName(s.decoder.typ)
+}
+
+func (s *eventStream) close() {
+	s.rd.Close()
+	s.src.close()
+}
+
+// eventDecoder turns records into JSON following a BTF type. A nil type
+// leaves records as hex.
+type eventDecoder struct {
+	typ  btf.Type
+	size int
+}
+
+func (d *eventDecoder) decode(data []byte) (interface{}, error) {
+	if d.size == 0 {
+		size, err := btf.Sizeof(d.typ)
+		if err != nil {
+			return nil, err
+		}
+		d.size = size
+	}
+	// Perf samples are padded to 8 bytes, and programs may submit records
+	// with a trailing variable length part; decode the fixed prefix.
+	if len(data) > d.size {
+		data = data[:d.size]
+	}
+	return decodeBTF(d.typ, data)
+}
+
+// newStreamEvent renders a record in the requested format from its decoded
+// data, if any. JSON events fall back to hex when the record couldn't be
+// decoded.
+func newStreamEvent(rec eventRecord, mapID int, format string, data interface{}, decodeErr error) map[string]interface{} {
+	event := map[string]interface{}{
+		"timestamp_ns": time.Now().UnixNano(),
+		"map_id":       mapID,
+		"size":         len(rec.Data),
+	}
+	if rec.CPU >= 0 {
+		event["cpu"] = rec.CPU
+	}
+
+	switch format {
+	case "base64":
+		event["data_base64"] = base64.StdEncoding.EncodeToString(rec.Data)
+	case "json":
+		if data != nil {
+			event["data"] = data
+			return event
+		}
+		if decodeErr != nil {
+			event["decode_error"] = decodeErr.Error()
+		}
+		fallthrough
+	default:
+		event["raw_data"] = hex.EncodeToString(rec.Data)
+	}
+	return event
+}
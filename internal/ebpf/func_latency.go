@@ -0,0 +1,495 @@
+package ebpf
+
+import (
+	"context"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/btf"
+	"github.com/cilium/ebpf/link"
+	"github.com/cilium/ebpf/rlimit"
+	"github.com/sameehj/ebpf-mcp/pkg/types"
+)
+
+const (
+	defaultLatencyDuration = 5 * time.Second
+	latencySlots           = 64
+)
+
+// latencyUnits are the histogram units func_latency accepts, in ns.
+var latencyUnits = map[string]int32{
+	"ns": 1,
+	"us": 1000,
+	"ms": 1000000,
+}
+
+type FuncLatencyArgs struct {
+	Function   string `json:"function"`
+	Binary     string `json:"binary,omitempty"`
+	Pid        int    `json:"pid,omitempty"`
+	DurationMs int    `json:"duration_ms,omitempty"`
+	Unit       string `json:"unit,omitempty"`
+}
+
+type FuncLatencyResult struct {
+	Success     bool                   `json:"success"`
+	ToolVersion string                 `json:"tool_version"`
+	Status      string                 `json:"status"`
+	Function    string                 `json:"function,omitempty"`
+	Binary      string                 `json:"binary,omitempty"`
+	AttachMode  string                 `json:"attach_mode,omitempty"`
+	Unit        string                 `json:"unit,omitempty"`
+	Count       uint64                 `json:"count"`
+	Histogram   []LatencyBucket        `json:"histogram"`
+	Stats       map[string]interface{} `json:"stats"`
+	Complete    bool                   `json:"complete"`
+	Warnings    []string               `json:"warnings,omitempty"`
+	Error       string                 `json:"error,omitempty"`
+}
+
+// LatencyBucket counts the calls with a latency in [Low, High).
+type LatencyBucket struct {
+	Low   uint64 `json:"low"`
+	High  uint64 `json:"high"`
+	Count uint64 `json:"count"`
+}
+
+func ParseFuncLatencyArgs(input map[string]interface{}) (*FuncLatencyArgs, error) {
+	var args FuncLatencyArgs
+	if err := types.StrictUnmarshal(input, &args); err != nil {
+		return nil, fmt.Errorf("failed to parse func latency args: %w", err)
+	}
+	return &args, nil
+}
+
+func funcLatencyFailure(err error) (*FuncLatencyResult, error) {
+	return &FuncLatencyResult{
+		Success:     false,
+		ToolVersion: "v1",
+		Status:      "failed",
+		Error:       err.Error(),
+	}, err
+}
+
+// RunFuncLatency measures how long calls to a kernel function, or to a
+// function of a user binary, take for the requested duration, or until ctx
+// is cancelled. Latencies are counted in an in-kernel log2 histogram.
+func RunFuncLatency(ctx context.Context, args *FuncLatencyArgs) (*FuncLatencyResult, error) {
+	if args == nil {
+		return funcLatencyFailure(errors.New("args cannot be nil"))
+	}
+	if args.Function == "" {
+		return funcLatencyFailure(errors.New("function is required"))
+	}
+
+	duration := time.Duration(args.DurationMs) * time.Millisecond
+	if duration == 0 {
+		duration = defaultLatencyDuration
+	}
+	if duration < 0 || duration > maxTraceDuration {
+		return funcLatencyFailure(fmt.Errorf("duration_ms must be between 1 and %d", maxTraceDuration.Milliseconds()))
+	}
+	unit := args.Unit
+	if unit == "" {
+		unit = "us"
+	}
+	divisor, ok := latencyUnits[unit]
+	if !ok {
+		return funcLatencyFailure(fmt.Errorf("unknown unit %q (expected ns, us or ms)", unit))
+	}
+	if args.Pid < 0 {
+		return funcLatencyFailure(fmt.Errorf("invalid pid %d", args.Pid))
+	}
+
+	// path is the file to probe, binary the path to report; they differ for
+	// binaries reached through the root of pid.
+	path, binary := "", ""
+	if args.Binary != "" {
+		var err error
+		path, binary, err = resolveUprobeTarget(args.Binary, args.Pid)
+		if err != nil {
+			return funcLatencyFailure(err)
+		}
+		f, err := elf.Open(path)
+		if err != nil {
+			return funcLatencyFailure(fmt.Errorf("open %s: %w", binary, err))
+		}
+		goBinary := isGoBinary(f)
+		f.Close()
+		if goBinary {
+			return funcLatencyFailure(fmt.Errorf("%s is a Go binary: uretprobes corrupt the stacks of Go programs when they grow, so function latency cannot be measured in it", binary))
+		}
+	} else {
+		exists, err := kernelSymbolExists(args.Function)
+		if err != nil {
+			return funcLatencyFailure(fmt.Errorf("cannot validate kernel symbol %s: %w", args.Function, err))
+		}
+		if !exists {
+			return funcLatencyFailure(fmt.Errorf("kernel function %q not found in %s", args.Function, kallsymsPath))
+		}
+	}
+
+	if err := rlimit.RemoveMemlock(); err != nil {
+		return funcLatencyFailure(fmt.Errorf("rlimit error: %v", err))
+	}
+
+	var probe *latencyProbe
+	var err error
+	if binary != "" {
+		probe, err = attachUserLatency(path, args.Function, args.Pid, divisor)
+	} else {
+		probe, err = attachKernelLatency(args.Function, args.Pid, divisor)
+	}
+	if err != nil {
+		return funcLatencyFailure(err)
+	}
+	defer probe.Close()
+
+	start := time.Now()
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return funcLatencyFailure(fmt.Errorf("trace cancelled: %w", ctx.Err()))
+	}
+	elapsed := time.Since(start)
+
+	counts := make([]uint64, latencySlots)
+	for slot := range counts {
+		if err := probe.coll.Maps["hist"].Lookup(uint32(slot), &counts[slot]); err != nil {
+			return funcLatencyFailure(fmt.Errorf("read histogram: %w", err))
+		}
+	}
+	var sumNs uint64
+	if err := probe.coll.Maps["total"].Lookup(uint32(0), &sumNs); err != nil {
+		return funcLatencyFailure(fmt.Errorf("read total: %w", err))
+	}
+	inFlight := 0
+	iter := probe.coll.Maps["start"].Iterate()
+	var key, value uint64
+	for iter.Next(&key, &value) {
+		inFlight++
+	}
+
+	result := &FuncLatencyResult{
+		Success:     true,
+		ToolVersion: "v1",
+		Function:    args.Function,
+		Binary:      binary,
+		AttachMode:  probe.mode,
+		Unit:        unit,
+		Histogram:   latencyHistogram(counts),
+	}
+	for _, c := range counts {
+		result.Count += c
+	}
+	result.Stats = map[string]interface{}{
+		"duration_ms":      elapsed.Milliseconds(),
+		"calls_per_second": rate(int(result.Count), elapsed.Seconds()),
+		"in_flight":        inFlight,
+	}
+	if result.Count > 0 {
+		result.Stats["avg"] = float64(sumNs) / float64(result.Count) / float64(divisor)
+		result.Stats["p50"] = histogramPercentile(counts, result.Count, 0.50)
+		result.Stats["p90"] = histogramPercentile(counts, result.Count, 0.90)
+		result.Stats["p99"] = histogramPercentile(counts, result.Count, 0.99)
+	}
+	if inFlight > 0 {
+		result.Warnings = append(result.Warnings,
+			fmt.Sprintf("calls still in progress when the trace ended are not counted: %d", inFlight))
+	}
+	result.Complete = true
+	result.Status = fmt.Sprintf("Measured %d calls of %s for %dms", result.Count, args.Function, elapsed.Milliseconds())
+	return result, nil
+}
+
+// resolveBinary makes a uprobe target absolute, looking up bare names in
+// PATH.
+func resolveBinary(name string) (string, error) {
+	if filepath.IsAbs(name) {
+		return name, nil
+	}
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return "", fmt.Errorf("binary %q: %w", name, err)
+	}
+	return filepath.Abs(path)
+}
+
+// latencyProbe is a loaded func_latency collection with its links.
+type latencyProbe struct {
+	coll  *ebpf.Collection
+	links []link.Link
+	mode  string
+}
+
+func (p *latencyProbe) Close() {
+	for _, l := range p.links {
+		l.Close()
+	}
+	p.coll.Close()
+}
+
+// attachKernelLatency uses fentry/fexit when the function is in kernel BTF
+// and BPF trampolines work, and a kprobe/kretprobe pair otherwise.
+func attachKernelLatency(function string, pid int, divisor int32) (*latencyProbe, error) {
+	var errs []error
+	if ko, err := loadKernelOffsets(); err != nil {
+		errs = append(errs, fmt.Errorf("fentry: %w", err))
+	} else {
+		var fn *btf.Func
+		if err := ko.spec.TypeByName(function, &fn); err != nil {
+			errs = append(errs, fmt.Errorf("fentry: %s: %w", function, err))
+		} else {
+			probe, err := attachLatencyPair("fentry", function, pid, divisor,
+				func(entry, ret *ebpf.Program) (link.Link, link.Link, error) {
+					el, err := link.AttachTracing(link.TracingOptions{Program: entry})
+					if err != nil {
+						return nil, nil, err
+					}
+					rl, err := link.AttachTracing(link.TracingOptions{Program: ret})
+					if err != nil {
+						el.Close()
+						return nil, nil, err
+					}
+					return el, rl, nil
+				})
+			if err == nil {
+				return probe, nil
+			}
+			errs = append(errs, fmt.Errorf("fentry: %w", err))
+		}
+	}
+
+	probe, err := attachLatencyPair("kprobe", function, pid, divisor,
+		func(entry, ret *ebpf.Program) (link.Link, link.Link, error) {
+			el, err := link.Kprobe(function, entry, nil)
+			if err != nil {
+				return nil, nil, err
+			}
+			rl, err := link.Kretprobe(function, ret, nil)
+			if err != nil {
+				el.Close()
+				return nil, nil, err
+			}
+			return el, rl, nil
+		})
+	if err != nil {
+		errs = append(errs, fmt.Errorf("kprobe: %w", err))
+		return nil, fmt.Errorf("cannot attach to %s: %w", function, errors.Join(errs...))
+	}
+	return probe, nil
+}
+
+// attachUserLatency attaches a uprobe/uretprobe pair to a function of a
+// user binary, in all processes or only in pid.
+func attachUserLatency(binary, function string, pid int, divisor int32) (*latencyProbe, error) {
+	ex, err := link.OpenExecutable(binary)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", binary, err)
+	}
+	opts := &link.UprobeOptions{PID: pid}
+	return attachLatencyPair("uprobe", function, pid, divisor,
+		func(entry, ret *ebpf.Program) (link.Link, link.Link, error) {
+			el, err := ex.Uprobe(function, entry, opts)
+			if errors.Is(err, link.ErrNoSymbol) {
+				// Symbols only in MiniDebugInfo are not seen by the library.
+				if off, ok := symbolFileOffset(binary, function); ok {
+					opts.Address = off
+					el, err = ex.Uprobe(function, entry, opts)
+				}
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			rl, err := ex.Uretprobe(function, ret, opts)
+			if err != nil {
+				el.Close()
+				return nil, nil, err
+			}
+			return el, rl, nil
+		})
+}
+
+// attachLatencyPair loads the programs for mode and attaches them.
+func attachLatencyPair(mode, function string, pid int, divisor int32,
+	attach func(entry, ret *ebpf.Program) (link.Link, link.Link, error)) (*latencyProbe, error) {
+	coll, err := ebpf.NewCollection(funcLatencySpec(mode, function, pid, divisor))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load programs: %w", err)
+	}
+	entry, ret, err := attach(coll.Programs["latency_entry"], coll.Programs["latency_return"])
+	if err != nil {
+		coll.Close()
+		return nil, fmt.Errorf("attach %s to %s: %w", mode, function, err)
+	}
+	return &latencyProbe{coll: coll, links: []link.Link{entry, ret}, mode: mode}, nil
+}
+
+// funcLatencySpec assembles the entry and return programs. Neither reads
+// its context, so the same instructions serve fentry/fexit, kprobes and
+// uprobes. The entry program records the time per thread; the return
+// program adds the elapsed nanoseconds to total and counts the call in the
+// log2 slot of its latency in the requested unit.
+func funcLatencySpec(mode, function string, pid int, divisor int32) *ebpf.CollectionSpec {
+	entry := asm.Instructions{
+		asm.FnGetCurrentPidTgid.Call(),
+		asm.StoreMem(asm.RFP, -8, asm.R0, asm.DWord),
+	}
+	if pid != 0 {
+		entry = append(entry,
+			asm.RSh.Imm(asm.R0, 32),
+			asm.JNE.Imm(asm.R0, int32(pid), "out"),
+		)
+	}
+	entry = append(entry,
+		asm.FnKtimeGetNs.Call(),
+		asm.StoreMem(asm.RFP, -16, asm.R0, asm.DWord),
+		asm.LoadMapPtr(asm.R1, 0).WithReference("start"),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, -8),
+		asm.Mov.Reg(asm.R3, asm.RFP),
+		asm.Add.Imm(asm.R3, -16),
+		asm.Mov.Imm(asm.R4, int32(ebpf.UpdateAny)),
+		asm.FnMapUpdateElem.Call(),
+	)
+	entry = append(entry, programExit()...)
+
+	ret := asm.Instructions{
+		asm.FnGetCurrentPidTgid.Call(),
+		asm.StoreMem(asm.RFP, -8, asm.R0, asm.DWord),
+		asm.LoadMapPtr(asm.R1, 0).WithReference("start"),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, -8),
+		asm.FnMapLookupElem.Call(),
+		asm.JEq.Imm(asm.R0, 0, "out"),
+		asm.LoadMem(asm.R7, asm.R0, 0, asm.DWord),
+		asm.FnKtimeGetNs.Call(),
+		asm.Sub.Reg(asm.R0, asm.R7),
+		asm.Mov.Reg(asm.R7, asm.R0),
+
+		asm.StoreImm(asm.RFP, -16, 0, asm.Word),
+		asm.LoadMapPtr(asm.R1, 0).WithReference("total"),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, -16),
+		asm.FnMapLookupElem.Call(),
+		asm.JEq.Imm(asm.R0, 0, "forget"),
+		asm.StoreXAdd(asm.R0, asm.R7, asm.DWord),
+
+		asm.Mov.Reg(asm.R8, asm.R7),
+		asm.Div.Imm(asm.R8, divisor),
+	}
+	ret = append(ret, log2Slot(asm.R7, asm.R8, "log2")...)
+	ret = append(ret,
+		asm.StoreMem(asm.RFP, -16, asm.R7, asm.Word),
+		asm.LoadMapPtr(asm.R1, 0).WithReference("hist"),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, -16),
+		asm.FnMapLookupElem.Call(),
+		asm.JEq.Imm(asm.R0, 0, "forget"),
+		asm.Mov.Imm(asm.R1, 1),
+		asm.StoreXAdd(asm.R0, asm.R1, asm.DWord),
+
+		asm.LoadMapPtr(asm.R1, 0).WithReference("start").WithSymbol("forget"),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, -8),
+		asm.FnMapDeleteElem.Call(),
+	)
+	ret = append(ret, programExit()...)
+
+	entrySpec := &ebpf.ProgramSpec{Name: "latency_entry", License: "GPL", Instructions: entry}
+	retSpec := &ebpf.ProgramSpec{Name: "latency_return", License: "GPL", Instructions: ret}
+	if mode == "fentry" {
+		entrySpec.Type, entrySpec.AttachType, entrySpec.AttachTo = ebpf.Tracing, ebpf.AttachTraceFEntry, function
+		retSpec.Type, retSpec.AttachType, retSpec.AttachTo = ebpf.Tracing, ebpf.AttachTraceFExit, function
+	} else {
+		entrySpec.Type, retSpec.Type = ebpf.Kprobe, ebpf.Kprobe
+	}
+
+	return &ebpf.CollectionSpec{
+		Maps: map[string]*ebpf.MapSpec{
+			"start": {
+				Name:       "latency_start",
+				Type:       ebpf.Hash,
+				KeySize:    8,
+				ValueSize:  8,
+				MaxEntries: builtinTrackedEntries,
+			},
+			"total": {
+				Name:       "latency_total",
+				Type:       ebpf.Array,
+				KeySize:    4,
+				ValueSize:  8,
+				MaxEntries: 1,
+			},
+			"hist": {
+				Name:       "latency_hist",
+				Type:       ebpf.Array,
+				KeySize:    4,
+				ValueSize:  8,
+				MaxEntries: latencySlots,
+			},
+		},
+		Programs: map[string]*ebpf.ProgramSpec{
+			"latency_entry":  entrySpec,
+			"latency_return": retSpec,
+		},
+	}
+}
+
+// latencyHistogram returns the slots from the first to the last non-empty
+// one. Slot 0 also holds latencies of 0.
+func latencyHistogram(counts []uint64) []LatencyBucket {
+	first, last := -1, -1
+	for slot, c := range counts {
+		if c == 0 {
+			continue
+		}
+		if first < 0 {
+			first = slot
+		}
+		last = slot
+	}
+	buckets := []LatencyBucket{}
+	for slot := first; first >= 0 && slot <= last; slot++ {
+		low, high := slotBounds(slot)
+		buckets = append(buckets, LatencyBucket{Low: low, High: high, Count: counts[slot]})
+	}
+	return buckets
+}
+
+func slotBounds(slot int) (uint64, uint64) {
+	if slot == 0 {
+		return 0, 2
+	}
+	high := uint64(1) << (slot + 1)
+	if slot == latencySlots-1 {
+		high = ^uint64(0)
+	}
+	return uint64(1) << slot, high
+}
+
+// histogramPercentile estimates a percentile by interpolating linearly
+// inside the slot that holds it.
+func histogramPercentile(counts []uint64, total uint64, p float64) float64 {
+	rank := p * float64(total)
+	var seen uint64
+	for slot, c := range counts {
+		if c == 0 {
+			continue
+		}
+		if float64(seen+c) >= rank {
+			low, high := slotBounds(slot)
+			return float64(low) + (rank-float64(seen))/float64(c)*float64(high-low)
+		}
+		seen += c
+	}
+	return 0
+}
@@ -0,0 +1,229 @@
+// internal/ebpf/inspect_filter.go
+package ebpf
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// InspectFilters narrow down what inspect_state returns.
+//
+// ProgramType, ProgramID and Interface select programs; the maps those
+// programs use and the links running them are returned alongside. MapID
+// selects a map and the programs using it. NamePattern and PinnedOnly apply
+// to programs and maps by their own name and pins, and PinnedOnly to links
+// by theirs.
+//
+// Interface matches programs attached through XDP, TCX or netkit links;
+// programs attached through legacy netlink or tc filters aren't visible as
+// links and are not matched.
+type InspectFilters struct {
+	ProgramType string `json:"program_type,omitempty"`
+	Interface   string `json:"interface,omitempty"`
+	NamePattern string `json:"name_pattern,omitempty"`
+	// NameMatch is "glob" (the default) or "regex".
+	NameMatch  string `json:"name_match,omitempty"`
+	ProgramID  int    `json:"program_id,omitempty"`
+	MapID      int    `json:"map_id,omitempty"`
+	PinnedOnly bool   `json:"pinned_only,omitempty"`
+}
+
+// inspectFilter is a compiled InspectFilters.
+type inspectFilter struct {
+	InspectFilters
+	ifindex   int
+	matchName func(string) bool
+}
+
+func compileFilters(f InspectFilters) (*inspectFilter, error) {
+	c := &inspectFilter{InspectFilters: f}
+
+	if f.Interface != "" {
+		iface, err := resolveInterface(f.Interface)
+		if err != nil {
+			return nil, err
+		}
+		c.ifindex = iface.Index
+	}
+
+	if f.NamePattern != "" {
+		switch f.NameMatch {
+		case "", "glob":
+			if _, err := path.Match(f.NamePattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid name_pattern %q: %w", f.NamePattern, err)
+			}
+			c.matchName = func(name string) bool {
+				ok, _ := path.Match(f.NamePattern, name)
+				return ok
+			}
+		case "regex":
+			re, err := regexp.Compile(f.NamePattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid name_pattern %q: %w", f.NamePattern, err)
+			}
+			c.matchName = re.MatchString
+		default:
+			return nil, fmt.Errorf("name_match must be glob or regex, got %q", f.NameMatch)
+		}
+	}
+
+	return c, nil
+}
+
+// normalizeProgramType lets "CGROUP_SKB", "cgroup_skb" and "CGroupSKB" all
+// refer to the same program type.
+func normalizeProgramType(t string) string {
+	return strings.ToLower(strings.ReplaceAll(t, "_", ""))
+}
+
+// selectsPrograms reports whether any program-scoped filter is set.
+func (f *inspectFilter) selectsPrograms() bool {
+	return f.ProgramType != "" || f.ProgramID != 0 || f.Interface != ""
+}
+
+func (f *inspectFilter) apply(programs []Program, maps []Map, links []Link) ([]Program, []Map, []Link) {
+	onInterface := make(map[int]bool)
+	if f.ifindex != 0 {
+		for _, l := range links {
+			if l.ifindex == f.ifindex {
+				onInterface[l.ProgramID] = true
+			}
+		}
+	}
+
+	// scoped are the programs picked by the program-scoped filters, which
+	// also decide which maps and links are relevant.
+	scoped := make(map[int]bool)
+	scopedMaps := make(map[int]bool)
+	for _, p := range programs {
+		if f.ProgramType != "" && normalizeProgramType(p.Type) != normalizeProgramType(f.ProgramType) {
+			continue
+		}
+		if f.ProgramID != 0 && p.ID != f.ProgramID {
+			continue
+		}
+		if f.ifindex != 0 && !onInterface[p.ID] {
+			continue
+		}
+		if f.MapID != 0 && !containsID(p.mapIDs, f.MapID) {
+			continue
+		}
+		if f.matchName != nil && !f.matchName(p.Name) {
+			continue
+		}
+		scoped[p.ID] = true
+		for _, mid := range p.mapIDs {
+			scopedMaps[mid] = true
+		}
+	}
+
+	var outPrograms []Program
+	for _, p := range programs {
+		if scoped[p.ID] && (!f.PinnedOnly || p.PinPath != "") {
+			outPrograms = append(outPrograms, p)
+		}
+	}
+
+	var outMaps []Map
+	for _, m := range maps {
+		if f.MapID != 0 && m.ID != f.MapID {
+			continue
+		}
+		if f.selectsPrograms() && !scopedMaps[m.ID] {
+			continue
+		}
+		if f.matchName != nil && !f.matchName(m.Name) {
+			continue
+		}
+		if f.PinnedOnly && m.PinPath == "" {
+			continue
+		}
+		outMaps = append(outMaps, m)
+	}
+
+	var outLinks []Link
+	for _, l := range links {
+		if !scoped[l.ProgramID] {
+			continue
+		}
+		if f.ifindex != 0 && l.ifindex != f.ifindex {
+			continue
+		}
+		if f.PinnedOnly && l.PinPath == "" {
+			continue
+		}
+		outLinks = append(outLinks, l)
+	}
+
+	return outPrograms, outMaps, outLinks
+}
+
+func containsID(ids []int, id int) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// inspectCursor records where the next page starts for each kind of object.
+// A kind whose last page has been returned is marked with -1.
+type inspectCursor struct {
+	Programs int `json:"p"`
+	Maps     int `json:"m"`
+	Links    int `json:"l"`
+}
+
+const cursorDone = -1
+
+func decodeCursor(s string) (*inspectCursor, error) {
+	c := &inspectCursor{}
+	if s == "" {
+		return c, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor: %w", err)
+	}
+	if err := json.Unmarshal(raw, c); err != nil {
+		return nil, fmt.Errorf("invalid cursor: %w", err)
+	}
+	return c, nil
+}
+
+func (c *inspectCursor) encode() string {
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func (c *inspectCursor) done() bool {
+	return c.Programs == cursorDone && c.Maps == cursorDone && c.Links == cursorDone
+}
+
+// paginate returns up to limit items with an ID greater than *after, which
+// is advanced to the last ID returned or set to cursorDone once the list is
+// exhausted. Items must be sorted by ID.
+func paginate[T any](items []T, id func(T) int, after *int, limit int) []T {
+	if *after == cursorDone {
+		return nil
+	}
+
+	start := 0
+	for start < len(items) && id(items[start]) <= *after {
+		start++
+	}
+	items = items[start:]
+
+	if limit <= 0 || len(items) <= limit {
+		*after = cursorDone
+		return items
+	}
+	items = items[:limit]
+	*after = id(items[len(items)-1])
+	return items
+}
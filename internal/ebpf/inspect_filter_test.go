@@ -0,0 +1,57 @@
+package ebpf
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPaginate(t *testing.T) {
+	ids := []int{1, 2, 4, 5, 9}
+	id := func(i int) int { return i }
+
+	var pages [][]int
+	after := 0
+	for after != cursorDone {
+		pages = append(pages, paginate(ids, id, &after, 2))
+	}
+	if want := [][]int{{1, 2}, {4, 5}, {9}}; !reflect.DeepEqual(pages, want) {
+		t.Errorf("pages = %v, want %v", pages, want)
+	}
+	if page := paginate(ids, id, &after, 2); page != nil {
+		t.Errorf("page after the last = %v", page)
+	}
+
+	// A cursor on an ID that has since gone away resumes after it.
+	after = 3
+	if page := paginate(ids, id, &after, 2); !reflect.DeepEqual(page, []int{4, 5}) || after != 5 {
+		t.Errorf("page after deleted ID 3 = %v, cursor %d", page, after)
+	}
+	after = 8
+	if page := paginate([]int{1, 2}, id, &after, 2); len(page) != 0 || after != cursorDone {
+		t.Errorf("page after every ID = %v, cursor %d", page, after)
+	}
+
+	after = 0
+	if page := paginate(ids, id, &after, 0); len(page) != len(ids) || after != cursorDone {
+		t.Errorf("page without a limit = %v, cursor %d", page, after)
+	}
+}
+
+func TestInspectCursor(t *testing.T) {
+	c := &inspectCursor{Programs: 12, Maps: cursorDone, Links: 3}
+	got, err := decodeCursor(c.encode())
+	if err != nil || *got != *c {
+		t.Errorf("decodeCursor(encode(%+v)) = %+v, %v", c, got, err)
+	}
+	if got, err := decodeCursor(""); err != nil || *got != (inspectCursor{}) {
+		t.Errorf("empty cursor = %+v, %v", got, err)
+	}
+	for _, s := range []string{"not base64!", "bm90IGpzb24"} {
+		if _, err := decodeCursor(s); err == nil {
+			t.Errorf("decodeCursor(%q) succeeded", s)
+		}
+	}
+	if c.done() || !(&inspectCursor{cursorDone, cursorDone, cursorDone}).done() {
+		t.Error("done() is wrong")
+	}
+}
@@ -2,15 +2,35 @@
 package ebpf
 
 import (
+	"bufio"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/btf"
+	"github.com/cilium/ebpf/features"
+	"github.com/cilium/ebpf/link"
 	"github.com/sameehj/ebpf-mcp/pkg/types"
+	"golang.org/x/sys/unix"
 )
 
 type InspectStateArgs struct {
-	Fields  []string               `json:"fields"`
-	Filters map[string]interface{} `json:"filters"`
+	Fields  []string       `json:"fields"`
+	Filters InspectFilters `json:"filters"`
+	// Limit caps the number of programs, maps and links returned per page,
+	// each counted separately. Zero returns everything.
+	Limit  int    `json:"limit,omitempty"`
+	Cursor string `json:"cursor,omitempty"`
 }
 
 type InspectStateResult struct {
@@ -21,29 +41,38 @@ type InspectStateResult struct {
 	Links       []Link             `json:"links,omitempty"`
 	System      *SystemInfo        `json:"system,omitempty"`
 	Tools       []InspectToolMeta  `json:"tools,omitempty"`
+	NextCursor  string             `json:"next_cursor,omitempty"`
 	Error       *types.ErrorDetail `json:"error,omitempty"`
 }
 
+// Program describes a loaded program. FD is only set for programs the
+// server holds open.
 type Program struct {
 	ID           int      `json:"id"`
-	FD           int      `json:"fd"`
+	FD           int      `json:"fd,omitempty"`
 	Type         string   `json:"type"`
 	Name         string   `json:"name"`
 	AttachedTo   []string `json:"attached_to"`
 	Instructions int      `json:"instructions"`
 	MemoryKB     int      `json:"memory_kb"`
 	LoadTime     string   `json:"load_time"`
+	BTFID        int      `json:"btf_id,omitempty"`
 	PinPath      string   `json:"pin_path"`
+
+	mapIDs []int
 }
 
+// Map describes a map in the kernel. FD is only set for maps the server
+// holds open.
 type Map struct {
 	ID             int    `json:"id"`
-	FD             int    `json:"fd"`
+	FD             int    `json:"fd,omitempty"`
 	Name           string `json:"name"`
 	Type           string `json:"type"`
 	CurrentEntries int    `json:"current_entries"`
 	MaxEntries     int    `json:"max_entries"`
 	MemoryKB       int    `json:"memory_kb"`
+	BTFID          int    `json:"btf_id,omitempty"`
 	PinPath        string `json:"pin_path"`
 }
 
@@ -53,6 +82,9 @@ type Link struct {
 	Type      string `json:"type"`
 	Target    string `json:"target"`
 	PinPath   string `json:"pin_path"`
+
+	// ifindex is the interface of XDP, TCX and netkit links.
+	ifindex int
 }
 
 type SystemInfo struct {
@@ -87,52 +119,564 @@ func ParseInspectStateArgs(input map[string]interface{}) (*InspectStateArgs, err
 	return &args, nil
 }
 
+// InspectState enumerates the programs, maps and links loaded in the kernel,
+// narrowed down by the filters and split into pages of at most Limit objects
+// of each kind. System totals always cover the whole host. Tool metadata is
+// filled in by the tools package, which owns the registry of tools.
 func InspectState(args *InspectStateArgs) (*InspectStateResult, error) {
-	// TODO: Replace with actual introspection of loaded programs, maps, etc.
-	demoTools := []types.Tool{
-		{
-			ID:          "load_program",
-			Description: "Load an eBPF program",
-		},
-		{
-			ID:          "attach_program",
-			Description: "Attach a loaded program to a hook",
-		},
+	if args == nil {
+		return inspectFailure(errors.New("args cannot be nil"))
+	}
+	if args.Limit < 0 {
+		return inspectValidationFailure(errors.New("limit must not be negative"))
 	}
 
-	var toolList []InspectToolMeta
-	for _, t := range demoTools {
-		toolList = append(toolList, InspectToolMeta{
-			Name:         t.ID,
-			Version:      "v1",
-			Description:  t.Description,
-			InputSchema:  "https://ebpf-mcp.dev/schemas/" + t.ID + "_input.json",
-			OutputSchema: "https://ebpf-mcp.dev/schemas/" + t.ID + "_output.json",
-		})
+	filter, err := compileFilters(args.Filters)
+	if err != nil {
+		return inspectValidationFailure(err)
+	}
+	cursor, err := decodeCursor(args.Cursor)
+	if err != nil {
+		return inspectValidationFailure(err)
 	}
 
-	return &InspectStateResult{
+	want := make(map[string]bool)
+	for _, f := range args.Fields {
+		want[f] = true
+	}
+
+	result := &InspectStateResult{
 		Success:     true,
 		ToolVersion: "v1",
-		Programs: []Program{{
-			ID:           123,
-			FD:           3,
-			Type:         "XDP",
-			Name:         "example",
-			AttachedTo:   []string{"eth0"},
-			Instructions: 256,
-			MemoryKB:     64,
-			LoadTime:     time.Now().Format(time.RFC3339),
-			PinPath:      "/sys/fs/bpf/example",
-		}},
-		System: &SystemInfo{
-			KernelVersion:         "6.9.0",
-			BTFEnabled:            true,
-			TotalPrograms:         1,
-			TotalMaps:             1,
-			MemoryUsageKB:         128,
-			SupportedProgramTypes: []string{"XDP", "KPROBE", "TRACEPOINT"},
+	}
+
+	needObjects := want["programs"] || want["maps"] || want["links"] || want["system"]
+	if !needObjects {
+		return result, nil
+	}
+
+	// System totals don't need pins, and the walk is only cheap when the
+	// pins are unchanged since the last one.
+	pins := &pinIndex{}
+	if want["programs"] || want["maps"] || want["links"] {
+		if pins, err = scanPins(bpffsRoot); err != nil {
+			log.Printf("[DEBUG] InspectState: scanning %s: %v", bpffsRoot, err)
+			pins = &pinIndex{}
+		}
+	}
+
+	links, err := listLinks(pins)
+	if err != nil {
+		return inspectFailure(err)
+	}
+	programs, err := listPrograms(pins, links)
+	if err != nil {
+		return inspectFailure(err)
+	}
+	maps, err := listMaps(pins)
+	if err != nil {
+		return inspectFailure(err)
+	}
+
+	if want["system"] {
+		result.System = systemInfo(programs, maps)
+	}
+
+	programs, maps, links = filter.apply(programs, maps, links)
+
+	if want["programs"] {
+		result.Programs = paginate(programs, func(p Program) int { return p.ID }, &cursor.Programs, args.Limit)
+	} else {
+		cursor.Programs = cursorDone
+	}
+	if want["maps"] {
+		result.Maps = paginate(maps, func(m Map) int { return m.ID }, &cursor.Maps, args.Limit)
+		countPageEntries(result.Maps)
+	} else {
+		cursor.Maps = cursorDone
+	}
+	if want["links"] {
+		result.Links = paginate(links, func(l Link) int { return l.ID }, &cursor.Links, args.Limit)
+	} else {
+		cursor.Links = cursorDone
+	}
+	if !cursor.done() {
+		result.NextCursor = cursor.encode()
+	}
+	return result, nil
+}
+
+func inspectFailure(err error) (*InspectStateResult, error) {
+	return &InspectStateResult{
+		Success:     false,
+		ToolVersion: "v1",
+		Error: &types.ErrorDetail{
+			Type:    "KERNEL_ERROR",
+			Message: err.Error(),
 		},
-		Tools: toolList,
-	}, nil
+	}, err
+}
+
+func inspectValidationFailure(err error) (*InspectStateResult, error) {
+	return &InspectStateResult{
+		Success:     false,
+		ToolVersion: "v1",
+		Error:       types.ValidationError(err.Error()),
+	}, err
+}
+
+func listPrograms(pins *pinIndex, links []Link) ([]Program, error) {
+	attached := make(map[int][]string)
+	for _, l := range links {
+		target := l.Target
+		if target == "" {
+			target = l.Type
+		}
+		attached[l.ProgramID] = append(attached[l.ProgramID], target)
+	}
+
+	bootTime, err := bootTime()
+	if err != nil {
+		log.Printf("[DEBUG] InspectState: %v", err)
+	}
+
+	var programs []Program
+	var id ebpf.ProgramID
+	for {
+		next, err := ebpf.ProgramGetNextID(id)
+		if errors.Is(err, os.ErrNotExist) {
+			return programs, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("enumerate programs: %w", err)
+		}
+		id = next
+
+		prog, held := objects.Program(int(id))
+		if !held {
+			prog, err = ebpf.NewProgramFromID(id)
+			if err != nil {
+				// Unloaded while we were iterating.
+				continue
+			}
+		}
+		p, err := describeProgram(prog, bootTime)
+		if !held {
+			prog.Close()
+		}
+		if err != nil {
+			log.Printf("[DEBUG] InspectState: program %d: %v", id, err)
+			continue
+		}
+		if held {
+			p.FD = prog.FD()
+		}
+		p.AttachedTo = attached[p.ID]
+		if p.AttachedTo == nil {
+			p.AttachedTo = []string{}
+		}
+		if paths := pins.Programs[p.ID]; len(paths) > 0 {
+			p.PinPath = paths[0]
+		}
+		programs = append(programs, p)
+	}
+}
+
+func describeProgram(prog *ebpf.Program, bootTime time.Time) (Program, error) {
+	info, err := prog.Info()
+	if err != nil {
+		return Program{}, err
+	}
+	id, _ := info.ID()
+
+	p := Program{
+		ID:       int(id),
+		Type:     info.Type.String(),
+		Name:     info.Name,
+		MemoryKB: bytesToKB(fdinfoMemlock(prog.FD())),
+	}
+
+	if size, err := info.TranslatedSize(); err == nil {
+		p.Instructions = size / asm.InstructionSize
+	} else if n, ok := info.VerifiedInstructions(); ok {
+		p.Instructions = int(n)
+	}
+
+	if btfID, ok := info.BTFID(); ok {
+		p.BTFID = int(btfID)
+	}
+
+	mapIDs, _ := info.MapIDs()
+	for _, mid := range mapIDs {
+		p.mapIDs = append(p.mapIDs, int(mid))
+	}
+
+	if since, ok := info.LoadTime(); ok && !bootTime.IsZero() {
+		p.LoadTime = bootTime.Add(since).Format(time.RFC3339)
+	}
+	return p, nil
+}
+
+func listMaps(pins *pinIndex) ([]Map, error) {
+	var maps []Map
+	var id ebpf.MapID
+	for {
+		next, err := ebpf.MapGetNextID(id)
+		if errors.Is(err, os.ErrNotExist) {
+			return maps, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("enumerate maps: %w", err)
+		}
+		id = next
+
+		m, held := objects.Map(int(id))
+		if !held {
+			m, err = ebpf.NewMapFromID(id)
+			if err != nil {
+				continue
+			}
+		}
+		desc, err := describeMap(m)
+		if !held {
+			m.Close()
+		}
+		if err != nil {
+			log.Printf("[DEBUG] InspectState: map %d: %v", id, err)
+			continue
+		}
+		if held {
+			desc.FD = m.FD()
+		}
+		if paths := pins.Maps[desc.ID]; len(paths) > 0 {
+			desc.PinPath = paths[0]
+		}
+		maps = append(maps, desc)
+	}
+}
+
+func describeMap(m *ebpf.Map) (Map, error) {
+	info, err := m.Info()
+	if err != nil {
+		return Map{}, err
+	}
+	id, _ := info.ID()
+	memlock, _ := info.Memlock()
+
+	desc := Map{
+		ID:         int(id),
+		Name:       info.Name,
+		Type:       info.Type.String(),
+		MaxEntries: int(info.MaxEntries),
+		MemoryKB:   bytesToKB(memlock),
+	}
+	if btfID, ok := info.BTFID(); ok {
+		desc.BTFID = int(btfID)
+	}
+	return desc, nil
+}
+
+// countPageEntries fills in CurrentEntries for the maps of a page. Counting
+// walks every key, so it is left until the page is known rather than done
+// for every map on the host.
+func countPageEntries(maps []Map) {
+	for i := range maps {
+		m, held := objects.Map(maps[i].ID)
+		if !held {
+			var err error
+			if m, err = ebpf.NewMapFromID(ebpf.MapID(maps[i].ID)); err != nil {
+				// Deleted since it was listed.
+				continue
+			}
+		}
+		if info, err := m.Info(); err == nil {
+			maps[i].CurrentEntries = countEntries(m, info)
+		}
+		if !held {
+			m.Close()
+		}
+	}
+}
+
+// countEntries walks the keys of a map. Arrays always hold MaxEntries
+// elements; maps that cannot be iterated, like ring buffers, report zero.
+func countEntries(m *ebpf.Map, info *ebpf.MapInfo) int {
+	switch info.Type {
+	case ebpf.Array, ebpf.PerCPUArray:
+		return int(info.MaxEntries)
+	}
+	if info.KeySize == 0 {
+		return 0
+	}
+
+	n := 0
+	key := make([]byte, info.KeySize)
+	next := make([]byte, info.KeySize)
+	var prev interface{}
+	for n < int(info.MaxEntries) {
+		if err := m.NextKey(prev, next); err != nil {
+			break
+		}
+		n++
+		copy(key, next)
+		prev = key
+	}
+	return n
+}
+
+func listLinks(pins *pinIndex) ([]Link, error) {
+	resolver := &targetResolver{}
+
+	var links []Link
+	it := new(link.Iterator)
+	defer it.Close()
+	for it.Next() {
+		info, err := it.Link.Info()
+		if err != nil {
+			log.Printf("[DEBUG] InspectState: link %d: %v", it.ID, err)
+			continue
+		}
+		l := Link{
+			ID:        int(info.ID),
+			ProgramID: int(info.Program),
+			Type:      linkTypeName(info.Type),
+			Target:    resolver.target(info),
+			ifindex:   linkIfindex(info),
+		}
+		if l.Target == "" {
+			// Perf event links don't report their tracepoint; fall back
+			// to the hook recorded when the server attached it.
+			if h, ok := objects.HandleFor(KindLink, l.ID); ok {
+				if ref, _, ok := objects.Get(h); ok {
+					l.Target = ref.Name
+				}
+			}
+		}
+		if paths := pins.Links[l.ID]; len(paths) > 0 {
+			l.PinPath = paths[0]
+		}
+		links = append(links, l)
+	}
+	if err := it.Err(); err != nil {
+		return nil, fmt.Errorf("enumerate links: %w", err)
+	}
+	return links, nil
+}
+
+func linkIfindex(info *link.Info) int {
+	if xdp := info.XDP(); xdp != nil {
+		return int(xdp.Ifindex)
+	}
+	if tcx := info.TCX(); tcx != nil {
+		return int(tcx.Ifindex)
+	}
+	if nk := info.Netkit(); nk != nil {
+		return int(nk.Ifindex)
+	}
+	return 0
+}
+
+// targetResolver turns the type-specific link info into a human readable
+// hook. Kernel symbols and cgroup paths are loaded on first use.
+type targetResolver struct {
+	ksyms      *ksymTable
+	kernelBTF  *btf.Spec
+	cgroups    map[uint64]string
+	cgroupsErr error
+}
+
+func (r *targetResolver) target(info *link.Info) string {
+	if xdp := info.XDP(); xdp != nil {
+		return interfaceName(xdp.Ifindex)
+	}
+	if tcx := info.TCX(); tcx != nil {
+		return fmt.Sprintf("%s/%s", interfaceName(tcx.Ifindex), attachTypeName(ebpf.AttachType(tcx.AttachType)))
+	}
+	if nk := info.Netkit(); nk != nil {
+		return fmt.Sprintf("%s/%s", interfaceName(nk.Ifindex), attachTypeName(ebpf.AttachType(nk.AttachType)))
+	}
+	if cg := info.Cgroup(); cg != nil {
+		return fmt.Sprintf("%s/%s", r.cgroupPath(cg.CgroupId), attachTypeName(ebpf.AttachType(cg.AttachType)))
+	}
+	if ns := info.NetNs(); ns != nil {
+		return fmt.Sprintf("netns:%d", ns.NetnsIno)
+	}
+	if nf := info.Netfilter(); nf != nil {
+		return fmt.Sprintf("netfilter pf=%d hook=%d priority=%d", nf.Pf, nf.Hooknum, nf.Priority)
+	}
+	if tr := info.Tracing(); tr != nil {
+		return r.btfFunc(tr.TargetObjId, btf.TypeID(tr.TargetBtfId))
+	}
+	if pe := info.PerfEvent(); pe != nil {
+		if kp := pe.Kprobe(); kp != nil {
+			if addr, ok := kp.Address(); ok {
+				return r.symbol(addr)
+			}
+		}
+	}
+	if km := info.KprobeMulti(); km != nil {
+		if n, ok := km.AddressCount(); ok {
+			return fmt.Sprintf("%d functions", n)
+		}
+	}
+	return ""
+}
+
+func (r *targetResolver) symbol(addr uint64) string {
+	if r.ksyms == nil {
+		t, err := loadKsyms()
+		if err != nil {
+			log.Printf("[DEBUG] InspectState: %v", err)
+			t = &ksymTable{}
+		}
+		r.ksyms = t
+	}
+	return r.ksyms.lookup(addr)
+}
+
+func (r *targetResolver) btfFunc(objID uint32, typeID btf.TypeID) string {
+	// Targets in modules or other programs live in a different BTF blob.
+	if objID != 0 {
+		return fmt.Sprintf("btf_obj:%d/type:%d", objID, typeID)
+	}
+	if r.kernelBTF == nil {
+		spec, err := btf.LoadKernelSpec()
+		if err != nil {
+			return fmt.Sprintf("type:%d", typeID)
+		}
+		r.kernelBTF = spec
+	}
+	typ, err := r.kernelBTF.TypeByID(typeID)
+	if err != nil {
+		return fmt.Sprintf("type:%d", typeID)
+	}
+	return typ.TypeName()
+}
+
+func (r *targetResolver) cgroupPath(id uint64) string {
+	if r.cgroups == nil && r.cgroupsErr == nil {
+		r.cgroups, r.cgroupsErr = cgroupPaths()
+		if r.cgroupsErr != nil {
+			log.Printf("[DEBUG] InspectState: %v", r.cgroupsErr)
+		}
+	}
+	if p, ok := r.cgroups[id]; ok {
+		return p
+	}
+	return fmt.Sprintf("cgroup:%d", id)
+}
+
+// cgroupPaths maps cgroup IDs to their paths in the cgroup v2 hierarchy. On
+// cgroup v2 the ID of a cgroup is the inode number of its directory.
+func cgroupPaths() (map[uint64]string, error) {
+	root, err := cgroup2Mount()
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make(map[uint64]string)
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			paths[st.Ino] = path
+		}
+		return nil
+	})
+	return paths, err
+}
+
+// cgroup2Mount returns where the cgroup v2 hierarchy is mounted.
+func cgroup2Mount() (string, error) {
+	f, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Format: <source> <mountpoint> <fstype> <options> ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 3 && fields[2] == "cgroup2" {
+			return fields[1], nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", errors.New("cgroup2 is not mounted")
+}
+
+func interfaceName(ifindex uint32) string {
+	if iface, err := net.InterfaceByIndex(int(ifindex)); err == nil {
+		return iface.Name
+	}
+	return fmt.Sprintf("ifindex:%d", ifindex)
+}
+
+// attachTypeName returns the attach_program name of an attach type, falling
+// back to the kernel name.
+func attachTypeName(t ebpf.AttachType) string {
+	for name, at := range cgroupAttachTypes {
+		if at == t {
+			return name
+		}
+	}
+	return t.String()
+}
+
+// bootTime returns the wall clock time the system booted, used to convert
+// the kernel's boot-relative program load times.
+func bootTime() (time.Time, error) {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_BOOTTIME, &ts); err != nil {
+		return time.Time{}, fmt.Errorf("read CLOCK_BOOTTIME: %w", err)
+	}
+	return time.Now().Add(-time.Duration(ts.Nano())), nil
+}
+
+func systemInfo(programs []Program, maps []Map) *SystemInfo {
+	kver, err := getKernelVersion()
+	if err != nil {
+		kver = fmt.Sprintf("unknown: %v", err)
+	}
+
+	memoryKB := 0
+	for _, p := range programs {
+		memoryKB += p.MemoryKB
+	}
+	for _, m := range maps {
+		memoryKB += m.MemoryKB
+	}
+
+	return &SystemInfo{
+		KernelVersion:         kver,
+		BTFEnabled:            btfEnabled(),
+		TotalPrograms:         len(programs),
+		TotalMaps:             len(maps),
+		MemoryUsageKB:         memoryKB,
+		SupportedProgramTypes: supportedProgramTypes(),
+	}
+}
+
+// supportedProgramTypes probes the kernel for each program type. Results
+// are cached by the features package.
+func supportedProgramTypes() []string {
+	var supported []string
+	for t := ebpf.SocketFilter; t <= ebpf.Netfilter; t++ {
+		if err := features.HaveProgramType(t); err == nil {
+			supported = append(supported, t.String())
+		}
+	}
+	return supported
+}
+
+func bytesToKB(n uint64) int {
+	return int((n + 1023) / 1024)
 }
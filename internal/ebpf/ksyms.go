@@ -0,0 +1,112 @@
+// internal/ebpf/ksyms.go
+package ebpf
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const kallsymsPath = "/proc/kallsyms"
+
+// kernelSymbolExists reports whether name is a function symbol in
+// /proc/kallsyms.
+func kernelSymbolExists(name string) (bool, error) {
+	f, err := os.Open(kallsymsPath)
+	if err != nil {
+		return false, fmt.Errorf("open %s: %w", kallsymsPath, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Format: <address> <type> <name> [<module>]
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[2] != name {
+			continue
+		}
+		switch fields[1] {
+		case "t", "T", "w", "W":
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// ksymTable resolves kernel addresses to function symbols.
+type ksymTable struct {
+	addrs []uint64
+	names []string
+}
+
+// loadKsyms reads the function symbols from /proc/kallsyms. Addresses are
+// only visible to privileged readers; otherwise the table is empty.
+func loadKsyms() (*ksymTable, error) {
+	f, err := os.Open(kallsymsPath)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", kallsymsPath, err)
+	}
+	defer f.Close()
+
+	type sym struct {
+		addr uint64
+		name string
+	}
+	var syms []sym
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || (fields[1] != "t" && fields[1] != "T") {
+			continue
+		}
+		addr, err := strconv.ParseUint(fields[0], 16, 64)
+		if err != nil || addr == 0 {
+			continue
+		}
+		syms = append(syms, sym{addr, fields[2]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(syms, func(i, j int) bool { return syms[i].addr < syms[j].addr })
+	t := &ksymTable{
+		addrs: make([]uint64, len(syms)),
+		names: make([]string, len(syms)),
+	}
+	for i, s := range syms {
+		t.addrs[i] = s.addr
+		t.names[i] = s.name
+	}
+	return t, nil
+}
+
+// lookup returns the symbol containing addr, with an offset if addr is not
+// the start of the function.
+func (t *ksymTable) lookup(addr uint64) string {
+	i := t.index(addr)
+	if i < 0 {
+		return fmt.Sprintf("0x%x", addr)
+	}
+	if off := addr - t.addrs[i]; off != 0 {
+		return fmt.Sprintf("%s+0x%x", t.names[i], off)
+	}
+	return t.names[i]
+}
+
+// function returns the name of the function containing addr.
+func (t *ksymTable) function(addr uint64) string {
+	i := t.index(addr)
+	if i < 0 {
+		return fmt.Sprintf("0x%x", addr)
+	}
+	return t.names[i]
+}
+
+func (t *ksymTable) index(addr uint64) int {
+	return sort.Search(len(t.addrs), func(i int) bool { return t.addrs[i] > addr }) - 1
+}
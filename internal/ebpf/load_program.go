@@ -7,6 +7,7 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"sort"
 	"strings"
 
 	"github.com/cilium/ebpf"
@@ -17,10 +18,14 @@ type LoadProgramArgs struct {
 		Type     string `json:"type"`
 		Path     string `json:"path,omitempty"`
 		Blob     string `json:"blob,omitempty"`
+		Name     string `json:"name,omitempty"`
 		Checksum string `json:"checksum,omitempty"`
 	} `json:"source"`
 	ProgramType string `json:"program_type"`
 	Section     string `json:"section,omitempty"`
+	// AttachTo names the function, LSM hook, tracepoint or iterator of
+	// BTF based program types, overriding the object's section name.
+	AttachTo    string `json:"attach_to,omitempty"`
 	BTFPath     string `json:"btf_path,omitempty"`
 	Constraints struct {
 		MaxInstructions int      `json:"max_instructions,omitempty"`
@@ -38,16 +43,34 @@ type MapInfo struct {
 	ValueSize  int    `json:"value_size,omitempty"`
 	MaxEntries int    `json:"max_entries,omitempty"`
 	PinPath    string `json:"pin_path,omitempty"`
+	Handle     string `json:"handle,omitempty"`
+}
+
+// LoadedProgramInfo is a program of a loaded object. Programs of builtins
+// carry the attach_program arguments they are meant for.
+type LoadedProgramInfo struct {
+	Name       string `json:"name"`
+	ID         int    `json:"id"`
+	Handle     string `json:"handle,omitempty"`
+	Section    string `json:"section,omitempty"`
+	AttachType string `json:"attach_type,omitempty"`
+	Target     string `json:"target,omitempty"`
 }
 
 type LoadProgramResult struct {
-	Success      bool      `json:"success"`
-	ToolVersion  string    `json:"tool_version"`
-	ProgramFD    int       `json:"program_fd,omitempty"`
-	ProgramID    int       `json:"program_id,omitempty"`
-	Maps         []MapInfo `json:"maps,omitempty"`
-	VerifierLog  string    `json:"verifier_log,omitempty"`
-	ErrorMessage string    `json:"error,omitempty"`
+	Success     bool   `json:"success"`
+	ToolVersion string `json:"tool_version"`
+	ProgramFD   int    `json:"program_fd,omitempty"`
+	ProgramID   int    `json:"program_id,omitempty"`
+	Handle      string `json:"handle,omitempty"`
+	// Programs lists every program of the object, by name, or of a
+	// builtin in the order they are meant to be attached. ProgramID and
+	// Handle are the first of them, or the one in the requested section.
+	Programs     []LoadedProgramInfo `json:"programs,omitempty"`
+	Maps         []MapInfo           `json:"maps,omitempty"`
+	BTFTargets   []BTFTarget         `json:"btf_targets,omitempty"`
+	VerifierLog  string              `json:"verifier_log,omitempty"`
+	ErrorMessage string              `json:"error,omitempty"`
 }
 
 func ParseLoadProgramArgs(input map[string]interface{}) (LoadProgramArgs, error) {
@@ -60,13 +83,18 @@ func ParseLoadProgramArgs(input map[string]interface{}) (LoadProgramArgs, error)
 		args.Source.Path = src["path"].(string)
 	} else if args.Source.Type == "data" {
 		args.Source.Blob = src["blob"].(string)
+	} else if args.Source.Type == "builtin" {
+		args.Source.Name, _ = src["name"].(string)
 	}
 
-	args.ProgramType = input["program_type"].(string)
+	args.ProgramType, _ = input["program_type"].(string)
 
 	if sec, ok := input["section"].(string); ok {
 		args.Section = sec
 	}
+	if attachTo, ok := input["attach_to"].(string); ok {
+		args.AttachTo = attachTo
+	}
 	if btf, ok := input["btf_path"].(string); ok {
 		args.BTFPath = btf
 	}
@@ -92,7 +120,9 @@ func ParseLoadProgramArgs(input map[string]interface{}) (LoadProgramArgs, error)
 
 func LoadProgram(args LoadProgramArgs) (*LoadProgramResult, error) {
 	var spec *ebpf.CollectionSpec
+	var builtin *builtinProgram
 	var err error
+	name := args.Source.Path
 
 	switch args.Source.Type {
 	case "file":
@@ -117,6 +147,9 @@ func LoadProgram(args LoadProgramArgs) (*LoadProgramResult, error) {
 			return &LoadProgramResult{Success: false, ErrorMessage: "invalid base64"}, err
 		}
 		spec, err = ebpf.LoadCollectionSpecFromReader(bytes.NewReader(blob))
+	case "builtin":
+		builtin, spec, err = builtinCollectionSpec(args.Source.Name)
+		name = "builtin:" + args.Source.Name
 	default:
 		return &LoadProgramResult{Success: false, ErrorMessage: "invalid source type"}, errors.New("invalid source type")
 	}
@@ -125,11 +158,37 @@ func LoadProgram(args LoadProgramArgs) (*LoadProgramResult, error) {
 		return &LoadProgramResult{Success: false, ErrorMessage: err.Error()}, err
 	}
 
+	var targets []BTFTarget
+	if builtin == nil {
+		if err := applyProgramType(spec, args.ProgramType, args.Section, args.AttachTo); err != nil {
+			return &LoadProgramResult{Success: false, ErrorMessage: err.Error()}, err
+		}
+		if targets, err = resolveBTFTargets(spec); err != nil {
+			return &LoadProgramResult{Success: false, ErrorMessage: err.Error()}, err
+		}
+	}
+
 	coll, err := ebpf.NewCollection(spec)
 	if err != nil {
 		return &LoadProgramResult{Success: false, ErrorMessage: err.Error()}, err
 	}
-	defer coll.Close()
+
+	// Verification only: the programs passed the verifier, don't keep them.
+	if args.Constraints.VerifyOnly {
+		coll.Close()
+		return &LoadProgramResult{
+			Success:     true,
+			ToolVersion: "1.0.0",
+		}, nil
+	}
+
+	// The registry owns the collection from here on, so the programs and maps
+	// outlive this call and can be attached or inspected later.
+	collHandle, err := objects.AddCollection(name, coll)
+	if err != nil {
+		coll.Close()
+		return &LoadProgramResult{Success: false, ErrorMessage: err.Error()}, err
+	}
 
 	maps := make([]MapInfo, 0)
 	for name, m := range coll.Maps {
@@ -138,6 +197,7 @@ func LoadProgram(args LoadProgramArgs) (*LoadProgramResult, error) {
 			continue
 		}
 		mid, _ := info.ID()
+		handle, _ := objects.HandleFor(KindMap, int(mid))
 		maps = append(maps, MapInfo{
 			Name:       name,
 			FD:         m.FD(),
@@ -146,24 +206,52 @@ func LoadProgram(args LoadProgramArgs) (*LoadProgramResult, error) {
 			KeySize:    int(info.KeySize),
 			ValueSize:  int(info.ValueSize),
 			MaxEntries: int(info.MaxEntries),
+			Handle:     handle,
 		})
 	}
 
-	// Assuming only one program loaded for now
-	for _, prog := range coll.Programs {
+	if builtin != nil {
+		return builtinLoadResult(builtin, coll, maps)
+	}
+
+	result := &LoadProgramResult{
+		Success:     true,
+		ToolVersion: "1.0.0",
+		Maps:        maps,
+		BTFTargets:  targets,
+	}
+	names := make([]string, 0, len(coll.Programs))
+	for name := range coll.Programs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		prog := coll.Programs[name]
 		info, err := prog.Info()
 		if err != nil {
 			continue
 		}
 		pid, _ := info.ID()
-		return &LoadProgramResult{
-			Success:     true,
-			ToolVersion: "1.0.0",
-			ProgramFD:   prog.FD(),
-			ProgramID:   int(pid),
-			Maps:        maps,
-		}, nil
+		handle, _ := objects.HandleFor(KindProgram, int(pid))
+		ps := spec.Programs[name]
+		result.Programs = append(result.Programs, LoadedProgramInfo{
+			Name:    name,
+			ID:      int(pid),
+			Handle:  handle,
+			Section: ps.SectionName,
+			Target:  ps.AttachTo,
+		})
+		selected := args.Section != "" && (ps.SectionName == args.Section || name == args.Section)
+		if result.ProgramID == 0 || selected {
+			result.ProgramFD = prog.FD()
+			result.ProgramID = int(pid)
+			result.Handle = handle
+		}
+	}
+	if result.ProgramID != 0 {
+		return result, nil
 	}
 
+	objects.Release(collHandle)
 	return &LoadProgramResult{Success: false, ErrorMessage: "no programs found"}, errors.New("no programs found")
 }
@@ -0,0 +1,175 @@
+// internal/ebpf/map_dump.go
+package ebpf
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+
+	"github.com/cilium/ebpf"
+)
+
+const (
+	defaultMapDumpEntries = 100
+	mapDumpBatchSize      = 64
+)
+
+type MapDumpArgs struct {
+	MapSelector
+	MaxEntries int `json:"max_entries,omitempty"`
+}
+
+type MapDumpResult struct {
+	Success     bool            `json:"success"`
+	ToolVersion string          `json:"tool_version"`
+	Map         *MapDescription `json:"map,omitempty"`
+	Entries     []MapEntry      `json:"entries"`
+	Count       int             `json:"count"`
+	Truncated   bool            `json:"truncated"`
+	Method      string          `json:"method,omitempty"`
+	Message     string          `json:"message,omitempty"`
+	Error       string          `json:"error,omitempty"`
+}
+
+func mapDumpFailure(err error) (*MapDumpResult, error) {
+	return &MapDumpResult{
+		Success:     false,
+		ToolVersion: "v1",
+		Entries:     []MapEntry{},
+		Error:       err.Error(),
+	}, err
+}
+
+// MapDump reads up to MaxEntries entries of a map. Batch lookups are used
+// when the kernel and map type support them, falling back to walking the
+// keys one at a time.
+func MapDump(args *MapDumpArgs) (*MapDumpResult, error) {
+	if args == nil {
+		return mapDumpFailure(errors.New("args cannot be nil"))
+	}
+	limit := args.MaxEntries
+	if limit <= 0 {
+		limit = defaultMapDumpEntries
+	}
+
+	om, err := openMap(args.MapSelector)
+	if err != nil {
+		return mapDumpFailure(err)
+	}
+	defer om.close()
+
+	if om.info.KeySize == 0 {
+		return mapDumpFailure(fmt.Errorf("map %d is a %s, which has no keys to dump", om.id, om.info.Type))
+	}
+
+	cpus := 1
+	if om.perCPU() {
+		if cpus, err = ebpf.PossibleCPU(); err != nil {
+			return mapDumpFailure(err)
+		}
+	}
+
+	// Read one entry past the limit to tell whether the dump is complete.
+	method := "batch"
+	keys, values, err := dumpBatch(om, cpus, limit+1)
+	if err != nil {
+		log.Printf("[DEBUG] MapDump: batch lookup on map %d failed, iterating: %v", om.id, err)
+		method = "iterate"
+		keys, values, err = dumpIterate(om, limit+1)
+	}
+	if err != nil {
+		return mapDumpFailure(fmt.Errorf("dump map %d: %w", om.id, err))
+	}
+
+	result := &MapDumpResult{
+		Success:     true,
+		ToolVersion: "v1",
+		Map:         om.describe(),
+		Entries:     []MapEntry{},
+		Method:      method,
+	}
+	if len(keys) > limit {
+		keys, values = keys[:limit], values[:limit]
+		result.Truncated = true
+	}
+	for i := range keys {
+		result.Entries = append(result.Entries, om.newMapEntry(keys[i], values[i]))
+	}
+	result.Count = len(result.Entries)
+
+	result.Message = fmt.Sprintf("Dumped %d entries from map %d (%s)", result.Count, om.id, om.info.Name)
+	if result.Truncated {
+		result.Message += fmt.Sprintf(", truncated at max_entries=%d", limit)
+	}
+	return result, nil
+}
+
+// dumpBatch reads up to limit entries with BPF_MAP_LOOKUP_BATCH. Keys and
+// values are read into slices of fixed size byte arrays, since the batch API
+// needs one slice element per map element.
+func dumpBatch(om *openedMap, cpus, limit int) ([][]byte, [][][]byte, error) {
+	keyType := reflect.ArrayOf(int(om.info.KeySize), reflect.TypeOf(byte(0)))
+	valueType := reflect.ArrayOf(int(om.info.ValueSize), reflect.TypeOf(byte(0)))
+
+	var keys [][]byte
+	var values [][][]byte
+	cursor := new(ebpf.MapBatchCursor)
+	for len(keys) < limit {
+		n := min(mapDumpBatchSize, limit-len(keys))
+		keysOut := reflect.MakeSlice(reflect.SliceOf(keyType), n, n)
+		valuesOut := reflect.MakeSlice(reflect.SliceOf(valueType), n*cpus, n*cpus)
+
+		count, err := om.m.BatchLookup(cursor, keysOut.Interface(), valuesOut.Interface(), nil)
+		for i := 0; i < count; i++ {
+			keys = append(keys, arrayBytes(keysOut.Index(i)))
+			vals := make([][]byte, cpus)
+			for cpu := range vals {
+				vals[cpu] = arrayBytes(valuesOut.Index(i*cpus + cpu))
+			}
+			values = append(values, vals)
+		}
+		if errors.Is(err, ebpf.ErrKeyNotExist) {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return keys, values, nil
+}
+
+// arrayBytes copies a reflect value holding a [N]byte.
+func arrayBytes(v reflect.Value) []byte {
+	b := make([]byte, v.Len())
+	reflect.Copy(reflect.ValueOf(b), v)
+	return b
+}
+
+// dumpIterate reads up to limit entries by walking the keys.
+func dumpIterate(om *openedMap, limit int) ([][]byte, [][][]byte, error) {
+	var keys [][]byte
+	var values [][][]byte
+
+	it := om.m.Iterate()
+	var key []byte
+	if om.perCPU() {
+		var vals [][]byte
+		for len(keys) < limit && it.Next(&key, &vals) {
+			keys = append(keys, key)
+			values = append(values, vals)
+			key, vals = nil, nil
+		}
+	} else {
+		var val []byte
+		for len(keys) < limit && it.Next(&key, &val) {
+			keys = append(keys, key)
+			values = append(values, [][]byte{val})
+			key, val = nil, nil
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, nil, err
+	}
+	return keys, values, nil
+}
@@ -0,0 +1,60 @@
+package ebpf
+
+import (
+	"net"
+	"testing"
+
+	"github.com/cilium/ebpf"
+)
+
+func TestMapDump(t *testing.T) {
+	hash := newTestHash(t)
+	// Device maps have no BPF_MAP_LOOKUP_BATCH, so they are iterated.
+	devs, err := ebpf.NewMap(&ebpf.MapSpec{Type: ebpf.DevMapHash, KeySize: 4, ValueSize: 4, MaxEntries: 8})
+	if err != nil {
+		t.Skipf("creating a device map: %v", err)
+	}
+	defer devs.Close()
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip(err)
+	}
+	for i := uint32(1); i <= 3; i++ {
+		if err := hash.Put(i, i*10); err != nil {
+			t.Fatal(err)
+		}
+		if err := devs.Put(i, uint32(lo.Index)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		m         *ebpf.Map
+		limit     int
+		method    string
+		count     int
+		truncated bool
+	}{
+		{"batch", hash, 0, "batch", 3, false},
+		{"batch truncated", hash, 2, "batch", 2, true},
+		{"batch at the limit", hash, 3, "batch", 3, false},
+		{"iterate", devs, 0, "iterate", 3, false},
+		{"iterate truncated", devs, 1, "iterate", 1, true},
+	}
+	for _, tt := range tests {
+		res, err := MapDump(&MapDumpArgs{MapSelector: MapSelector{MapID: testMapID(t, tt.m)}, MaxEntries: tt.limit})
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if res.Method != tt.method || res.Count != tt.count || len(res.Entries) != tt.count || res.Truncated != tt.truncated {
+			t.Errorf("%s: method %s, count %d, %d entries, truncated %v", tt.name, res.Method, res.Count, len(res.Entries), res.Truncated)
+		}
+		for _, e := range res.Entries {
+			if len(e.Key) != 2*int(tt.m.KeySize()) || len(e.Value) != 8 {
+				t.Errorf("%s: entry %+v", tt.name, e)
+			}
+		}
+	}
+}
@@ -0,0 +1,477 @@
+// internal/ebpf/map_ops.go
+package ebpf
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/btf"
+)
+
+// Key and value encodings accepted by the map tools. Strings are hex by
+// default; any non-string JSON value is encoded through the map's BTF.
+const (
+	FormatHex    = "hex"
+	FormatBase64 = "base64"
+	FormatJSON   = "json"
+)
+
+var mapUpdateFlags = map[string]ebpf.MapUpdateFlags{
+	"":        ebpf.UpdateAny,
+	"any":     ebpf.UpdateAny,
+	"noexist": ebpf.UpdateNoExist,
+	"exist":   ebpf.UpdateExist,
+}
+
+// MapUpdateEntry is a key with the value to store. Per-CPU maps take either
+// Value, stored on every CPU, or Values with one value per possible CPU.
+type MapUpdateEntry struct {
+	Key    interface{}   `json:"key"`
+	Value  interface{}   `json:"value,omitempty"`
+	Values []interface{} `json:"values,omitempty"`
+}
+
+type MapLookupArgs struct {
+	MapSelector
+	Keys   []interface{} `json:"keys"`
+	Format string        `json:"format,omitempty"`
+}
+
+type MapUpdateArgs struct {
+	MapSelector
+	Entries []MapUpdateEntry `json:"entries"`
+	Flags   string           `json:"flags,omitempty"`
+	Format  string           `json:"format,omitempty"`
+}
+
+type MapDeleteArgs struct {
+	MapSelector
+	Keys   []interface{} `json:"keys"`
+	Format string        `json:"format,omitempty"`
+}
+
+// MapLookupEntry is the result of looking up a single key.
+type MapLookupEntry struct {
+	Found bool `json:"found"`
+	MapEntry
+}
+
+type MapLookupResult struct {
+	Success     bool             `json:"success"`
+	ToolVersion string           `json:"tool_version"`
+	Map         *MapDescription  `json:"map,omitempty"`
+	Entries     []MapLookupEntry `json:"entries"`
+	Found       int              `json:"found"`
+	Message     string           `json:"message,omitempty"`
+	Error       string           `json:"error,omitempty"`
+}
+
+type MapUpdateResult struct {
+	Success     bool            `json:"success"`
+	ToolVersion string          `json:"tool_version"`
+	Map         *MapDescription `json:"map,omitempty"`
+	Updated     int             `json:"updated"`
+	Message     string          `json:"message,omitempty"`
+	Error       string          `json:"error,omitempty"`
+}
+
+type MapDeleteResult struct {
+	Success     bool            `json:"success"`
+	ToolVersion string          `json:"tool_version"`
+	Map         *MapDescription `json:"map,omitempty"`
+	Deleted     int             `json:"deleted"`
+	NotFound    []string        `json:"not_found,omitempty"`
+	Message     string          `json:"message,omitempty"`
+	Error       string          `json:"error,omitempty"`
+}
+
+// encodeMapBytes turns a key or value given by the caller into exactly size
+// bytes.
+func encodeMapBytes(raw interface{}, format string, typ btf.Type, size int) ([]byte, error) {
+	var (
+		buf []byte
+		err error
+	)
+
+	s, isString := raw.(string)
+	switch {
+	case isString && (format == "" || format == FormatHex):
+		s = strings.TrimPrefix(strings.ReplaceAll(s, " ", ""), "0x")
+		if buf, err = hex.DecodeString(s); err != nil {
+			return nil, fmt.Errorf("invalid hex: %w", err)
+		}
+	case isString && format == FormatBase64:
+		if buf, err = base64.StdEncoding.DecodeString(s); err != nil {
+			return nil, fmt.Errorf("invalid base64: %w", err)
+		}
+	case format == "" || format == FormatHex || format == FormatBase64 || format == FormatJSON:
+		if typ == nil {
+			return nil, errors.New("map has no BTF type information; pass keys and values as hex or base64 strings")
+		}
+		if buf, err = encodeBTF(typ, raw); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("format must be hex, base64 or json, got %q", format)
+	}
+
+	if len(buf) != size {
+		return nil, fmt.Errorf("got %d bytes, map expects %d", len(buf), size)
+	}
+	return buf, nil
+}
+
+func (om *openedMap) keyType() btf.Type {
+	if om.btf == nil {
+		return nil
+	}
+	return om.btf.Key
+}
+
+func (om *openedMap) valueType() btf.Type {
+	if om.btf == nil {
+		return nil
+	}
+	return om.btf.Value
+}
+
+func (om *openedMap) encodeKey(raw interface{}, format string) ([]byte, error) {
+	if raw == nil {
+		return nil, errors.New("key is required")
+	}
+	key, err := encodeMapBytes(raw, format, om.keyType(), int(om.info.KeySize))
+	if err != nil {
+		return nil, fmt.Errorf("key: %w", err)
+	}
+	return key, nil
+}
+
+// encodeValue returns one value per possible CPU for per-CPU maps and a
+// single value otherwise.
+func (om *openedMap) encodeValue(e MapUpdateEntry, format string) ([][]byte, error) {
+	size := int(om.info.ValueSize)
+
+	if !om.perCPU() {
+		if e.Values != nil {
+			return nil, fmt.Errorf("values is only valid for per-CPU maps, use value")
+		}
+		if e.Value == nil {
+			return nil, errors.New("value is required")
+		}
+		v, err := encodeMapBytes(e.Value, format, om.valueType(), size)
+		if err != nil {
+			return nil, fmt.Errorf("value: %w", err)
+		}
+		return [][]byte{v}, nil
+	}
+
+	cpus, err := ebpf.PossibleCPU()
+	if err != nil {
+		return nil, err
+	}
+
+	if e.Values != nil {
+		if len(e.Values) != cpus {
+			return nil, fmt.Errorf("values has %d elements, map has %d possible CPUs", len(e.Values), cpus)
+		}
+		out := make([][]byte, cpus)
+		for i, raw := range e.Values {
+			if out[i], err = encodeMapBytes(raw, format, om.valueType(), size); err != nil {
+				return nil, fmt.Errorf("value for CPU %d: %w", i, err)
+			}
+		}
+		return out, nil
+	}
+
+	if e.Value == nil {
+		return nil, errors.New("value or values is required")
+	}
+	v, err := encodeMapBytes(e.Value, format, om.valueType(), size)
+	if err != nil {
+		return nil, fmt.Errorf("value: %w", err)
+	}
+	out := make([][]byte, cpus)
+	for i := range out {
+		out[i] = v
+	}
+	return out, nil
+}
+
+// byteArrays packs equally sized byte slices into a []([size]byte), the
+// shape the batch APIs expect.
+func byteArrays(elems [][]byte, size int) interface{} {
+	typ := reflect.ArrayOf(size, reflect.TypeOf(byte(0)))
+	out := reflect.MakeSlice(reflect.SliceOf(typ), len(elems), len(elems))
+	for i, e := range elems {
+		reflect.Copy(out.Index(i), reflect.ValueOf(e))
+	}
+	return out.Interface()
+}
+
+// mapValueArg is what Map.Update and Map.Lookup take for one element.
+func (om *openedMap) mapValueArg(values [][]byte) interface{} {
+	if om.perCPU() {
+		return values
+	}
+	return values[0]
+}
+
+func mapLookupFailure(err error) (*MapLookupResult, error) {
+	return &MapLookupResult{
+		Success:     false,
+		ToolVersion: "v1",
+		Entries:     []MapLookupEntry{},
+		Error:       err.Error(),
+	}, err
+}
+
+// MapLookup reads the values stored under one or more keys. Missing keys
+// are reported with found set to false rather than failing the call.
+func MapLookup(args *MapLookupArgs) (*MapLookupResult, error) {
+	if args == nil {
+		return mapLookupFailure(errors.New("args cannot be nil"))
+	}
+	if len(args.Keys) == 0 {
+		return mapLookupFailure(errors.New("at least one key is required"))
+	}
+
+	om, err := openMap(args.MapSelector)
+	if err != nil {
+		return mapLookupFailure(err)
+	}
+	defer om.close()
+
+	keys := make([][]byte, len(args.Keys))
+	for i, raw := range args.Keys {
+		if keys[i], err = om.encodeKey(raw, args.Format); err != nil {
+			return mapLookupFailure(fmt.Errorf("key %d: %w", i, err))
+		}
+	}
+
+	result := &MapLookupResult{
+		Success:     true,
+		ToolVersion: "v1",
+		Map:         om.describe(),
+		Entries:     []MapLookupEntry{},
+	}
+
+	for i, key := range keys {
+		var values [][]byte
+		if om.perCPU() {
+			err = om.m.Lookup(key, &values)
+		} else {
+			var v []byte
+			err = om.m.Lookup(key, &v)
+			values = [][]byte{v}
+		}
+		if errors.Is(err, ebpf.ErrKeyNotExist) {
+			result.Entries = append(result.Entries, MapLookupEntry{
+				Found:    false,
+				MapEntry: MapEntry{Key: hex.EncodeToString(key)},
+			})
+			continue
+		}
+		if err != nil {
+			return mapLookupFailure(fmt.Errorf("lookup key %d: %w", i, err))
+		}
+		result.Entries = append(result.Entries, MapLookupEntry{
+			Found:    true,
+			MapEntry: om.newMapEntry(key, values),
+		})
+		result.Found++
+	}
+
+	result.Message = fmt.Sprintf("Found %d of %d keys in map %d (%s)", result.Found, len(keys), om.id, om.info.Name)
+	return result, nil
+}
+
+func mapUpdateFailure(err error) (*MapUpdateResult, error) {
+	return &MapUpdateResult{
+		Success:     false,
+		ToolVersion: "v1",
+		Error:       err.Error(),
+	}, err
+}
+
+// MapUpdate stores one or more entries. Several entries are written with a
+// single BPF_MAP_UPDATE_BATCH where the kernel supports it; the kernel takes
+// no noexist or exist flags for batches, so those are written one by one. On
+// failure the entries before the failing one have been written, as reported
+// by Updated.
+func MapUpdate(args *MapUpdateArgs) (*MapUpdateResult, error) {
+	if args == nil {
+		return mapUpdateFailure(errors.New("args cannot be nil"))
+	}
+	if len(args.Entries) == 0 {
+		return mapUpdateFailure(errors.New("at least one entry is required"))
+	}
+	flags, ok := mapUpdateFlags[args.Flags]
+	if !ok {
+		return mapUpdateFailure(fmt.Errorf("flags must be any, noexist or exist, got %q", args.Flags))
+	}
+
+	om, err := openMap(args.MapSelector)
+	if err != nil {
+		return mapUpdateFailure(err)
+	}
+	defer om.close()
+
+	keys := make([][]byte, len(args.Entries))
+	values := make([][][]byte, len(args.Entries))
+	for i, e := range args.Entries {
+		if keys[i], err = om.encodeKey(e.Key, args.Format); err != nil {
+			return mapUpdateFailure(fmt.Errorf("entry %d: %w", i, err))
+		}
+		if values[i], err = om.encodeValue(e, args.Format); err != nil {
+			return mapUpdateFailure(fmt.Errorf("entry %d: %w", i, err))
+		}
+	}
+
+	result := &MapUpdateResult{
+		Success:     true,
+		ToolVersion: "v1",
+		Map:         om.describe(),
+	}
+
+	start := 0
+	if len(keys) > 1 && flags == ebpf.UpdateAny {
+		var flat [][]byte
+		for _, v := range values {
+			flat = append(flat, v...)
+		}
+		n, err := om.m.BatchUpdate(byteArrays(keys, len(keys[0])), byteArrays(flat, int(om.info.ValueSize)),
+			&ebpf.BatchOptions{ElemFlags: uint64(flags)})
+		switch {
+		case err == nil:
+			start = len(keys)
+			result.Updated = n
+		case errors.Is(err, ebpf.ErrNotSupported):
+			// Fall back to one update per entry below.
+		default:
+			// The kernel leaves the count alone when it rejects the batch
+			// before writing anything.
+			if n == len(keys) {
+				n = 0
+			}
+			result.Updated = n
+			return mapUpdatePartial(result, n, keys, err)
+		}
+	}
+
+	for i := start; i < len(keys); i++ {
+		if err := om.m.Update(keys[i], om.mapValueArg(values[i]), flags); err != nil {
+			return mapUpdatePartial(result, i, keys, err)
+		}
+		result.Updated++
+	}
+
+	result.Message = fmt.Sprintf("Updated %d entries in map %d (%s)", result.Updated, om.id, om.info.Name)
+	return result, nil
+}
+
+func mapUpdatePartial(result *MapUpdateResult, failed int, keys [][]byte, err error) (*MapUpdateResult, error) {
+	err = fmt.Errorf("entry %d (key %s): %w", failed, hex.EncodeToString(keys[failed]), err)
+	result.Success = false
+	result.Error = err.Error()
+	result.Message = fmt.Sprintf("Updated %d of %d entries before failing", result.Updated, len(keys))
+	return result, err
+}
+
+func mapDeleteFailure(err error) (*MapDeleteResult, error) {
+	return &MapDeleteResult{
+		Success:     false,
+		ToolVersion: "v1",
+		Error:       err.Error(),
+	}, err
+}
+
+// MapDelete removes one or more keys. Keys that don't exist are reported in
+// NotFound and don't fail the call.
+func MapDelete(args *MapDeleteArgs) (*MapDeleteResult, error) {
+	if args == nil {
+		return mapDeleteFailure(errors.New("args cannot be nil"))
+	}
+	if len(args.Keys) == 0 {
+		return mapDeleteFailure(errors.New("at least one key is required"))
+	}
+
+	om, err := openMap(args.MapSelector)
+	if err != nil {
+		return mapDeleteFailure(err)
+	}
+	defer om.close()
+
+	keys := make([][]byte, len(args.Keys))
+	for i, raw := range args.Keys {
+		if keys[i], err = om.encodeKey(raw, args.Format); err != nil {
+			return mapDeleteFailure(fmt.Errorf("key %d: %w", i, err))
+		}
+	}
+
+	result := &MapDeleteResult{
+		Success:     true,
+		ToolVersion: "v1",
+		Map:         om.describe(),
+	}
+
+	// BPF_MAP_DELETE_BATCH stops at the first missing key; record it and
+	// carry on with the rest.
+	batch := len(keys) > 1
+	for start := 0; start < len(keys); {
+		if batch && len(keys)-start > 1 {
+			n, err := om.m.BatchDelete(byteArrays(keys[start:], len(keys[0])), nil)
+			if errors.Is(err, ebpf.ErrNotSupported) {
+				// Nothing was deleted, whatever the count says.
+				batch = false
+				continue
+			}
+			if err != nil && n == len(keys)-start {
+				// The kernel leaves the count alone when it rejects the
+				// batch before deleting anything.
+				n = 0
+			}
+			result.Deleted += n
+			start += n
+			switch {
+			case err == nil:
+				continue
+			case errors.Is(err, ebpf.ErrKeyNotExist):
+				result.NotFound = append(result.NotFound, hex.EncodeToString(keys[start]))
+				start++
+				continue
+			default:
+				return mapDeletePartial(result, start, keys, err)
+			}
+		}
+
+		err := om.m.Delete(keys[start])
+		switch {
+		case err == nil:
+			result.Deleted++
+		case errors.Is(err, ebpf.ErrKeyNotExist):
+			result.NotFound = append(result.NotFound, hex.EncodeToString(keys[start]))
+		default:
+			return mapDeletePartial(result, start, keys, err)
+		}
+		start++
+	}
+
+	result.Message = fmt.Sprintf("Deleted %d entries from map %d (%s)", result.Deleted, om.id, om.info.Name)
+	if len(result.NotFound) > 0 {
+		result.Message += fmt.Sprintf(", %d keys not found", len(result.NotFound))
+	}
+	return result, nil
+}
+
+func mapDeletePartial(result *MapDeleteResult, failed int, keys [][]byte, err error) (*MapDeleteResult, error) {
+	err = fmt.Errorf("key %d (%s): %w", failed, hex.EncodeToString(keys[failed]), err)
+	result.Success = false
+	result.Error = err.Error()
+	result.Message = fmt.Sprintf("Deleted %d of %d keys before failing", result.Deleted, len(keys))
+	return result, err
+}
@@ -0,0 +1,107 @@
+package ebpf
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+)
+
+func newTestHash(t *testing.T) *ebpf.Map {
+	t.Helper()
+	m, err := ebpf.NewMap(&ebpf.MapSpec{Type: ebpf.Hash, KeySize: 4, ValueSize: 4, MaxEntries: 8})
+	if err != nil {
+		t.Skipf("creating a map: %v", err)
+	}
+	t.Cleanup(func() { m.Close() })
+	return m
+}
+
+func testMapID(t *testing.T, m *ebpf.Map) int {
+	t.Helper()
+	info, err := m.Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := info.ID()
+	return int(id)
+}
+
+func TestMapUpdateBatch(t *testing.T) {
+	m := newTestHash(t)
+	sel := MapSelector{MapID: testMapID(t, m)}
+
+	res, err := MapUpdate(&MapUpdateArgs{MapSelector: sel, Entries: []MapUpdateEntry{
+		{Key: "01000000", Value: "0a000000"},
+		{Key: "02000000", Value: "14000000"},
+		{Key: "03000000", Value: "1e000000"},
+	}})
+	if err != nil || res.Updated != 3 {
+		t.Fatalf("MapUpdate = %+v, %v", res, err)
+	}
+	var v uint32
+	if err := m.Lookup(uint32(2), &v); err != nil || v != 20 {
+		t.Errorf("key 2 = %d, %v", v, err)
+	}
+
+	// With noexist the batch stops at the first key already present, and
+	// the entries before it stay written.
+	res, err = MapUpdate(&MapUpdateArgs{MapSelector: sel, Flags: "noexist", Entries: []MapUpdateEntry{
+		{Key: "04000000", Value: "28000000"},
+		{Key: "02000000", Value: "00000000"},
+	}})
+	if err == nil || res.Updated != 1 || res.Success {
+		t.Errorf("MapUpdate over an existing key = %+v, %v", res, err)
+	}
+	if err := m.Lookup(uint32(2), &v); err != nil || v != 20 {
+		t.Errorf("key 2 = %d, %v; want it unchanged", v, err)
+	}
+}
+
+func TestMapDeleteMissingKeys(t *testing.T) {
+	m := newTestHash(t)
+	for _, k := range []uint32{1, 2, 4} {
+		if err := m.Put(k, uint32(0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// BPF_MAP_DELETE_BATCH stops at missing keys; the rest are still deleted.
+	res, err := MapDelete(&MapDeleteArgs{
+		MapSelector: MapSelector{MapID: testMapID(t, m)},
+		Keys:        []interface{}{"01000000", "03000000", "02000000", "05000000", "04000000"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Deleted != 3 || len(res.NotFound) != 2 || res.NotFound[0] != "03000000" || res.NotFound[1] != "05000000" {
+		t.Errorf("MapDelete = %+v", res)
+	}
+	var k, v uint32
+	if err := m.NextKey(nil, &k); err == nil {
+		m.Lookup(k, &v)
+		t.Errorf("key %d left in the map", k)
+	}
+}
+
+func TestMapDeleteWithoutBatch(t *testing.T) {
+	// LPM tries delete single keys but have no BPF_MAP_DELETE_BATCH.
+	m, err := ebpf.NewMap(&ebpf.MapSpec{Type: ebpf.LPMTrie, KeySize: 8, ValueSize: 4, MaxEntries: 8, Flags: unix.BPF_F_NO_PREALLOC})
+	if err != nil {
+		t.Skipf("creating an LPM trie: %v", err)
+	}
+	defer m.Close()
+	keys := []interface{}{"200000000a000001", "200000000a000002", "200000000a000003"}
+	for _, k := range []string{"200000000a000001", "200000000a000003"} {
+		b, _ := hex.DecodeString(k)
+		if err := m.Put(b, uint32(0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, err := MapDelete(&MapDeleteArgs{MapSelector: MapSelector{MapID: testMapID(t, m)}, Keys: keys})
+	if err != nil || res.Deleted != 2 || len(res.NotFound) != 1 || res.NotFound[0] != "200000000a000002" {
+		t.Errorf("MapDelete = %+v, %v", res, err)
+	}
+}
@@ -0,0 +1,213 @@
+// internal/ebpf/maps.go
+package ebpf
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+)
+
+// MapSelector identifies a map by kernel ID, pin path or name, in that order
+// of precedence.
+type MapSelector struct {
+	MapID   int    `json:"map_id,omitempty"`
+	PinPath string `json:"pin_path,omitempty"`
+	MapName string `json:"map_name,omitempty"`
+}
+
+// MapDescription summarizes the map a map tool operated on.
+type MapDescription struct {
+	ID         int    `json:"id"`
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	KeySize    int    `json:"key_size"`
+	ValueSize  int    `json:"value_size"`
+	MaxEntries int    `json:"max_entries"`
+	PerCPU     bool   `json:"per_cpu,omitempty"`
+	KeyType    string `json:"key_type,omitempty"`
+	ValueType  string `json:"value_type,omitempty"`
+}
+
+// openedMap is a map resolved from a MapSelector. close must be called once
+// the caller is done with it.
+type openedMap struct {
+	m     *ebpf.Map
+	info  *ebpf.MapInfo
+	id    int
+	btf   *mapBTF
+	close func()
+}
+
+// openMap resolves sel to a map. Maps found by ID or name go through the
+// registry, so maps the server loaded are reused rather than reopened.
+func openMap(sel MapSelector) (*openedMap, error) {
+	var (
+		m       *ebpf.Map
+		release func()
+	)
+
+	switch {
+	case sel.MapID != 0:
+		var handle string
+		var err error
+		m, handle, err = objects.OpenMap(sel.MapID)
+		if err != nil {
+			return nil, err
+		}
+		release = func() { objects.Release(handle) }
+
+	case sel.PinPath != "":
+		var err error
+		m, err = ebpf.LoadPinnedMap(sel.PinPath, nil)
+		if err != nil {
+			return nil, fmt.Errorf("load pinned map %s: %w", sel.PinPath, err)
+		}
+		release = func() { m.Close() }
+
+	case sel.MapName != "":
+		id, err := findMapByName(sel.MapName)
+		if err != nil {
+			return nil, err
+		}
+		return openMap(MapSelector{MapID: id})
+
+	default:
+		return nil, errors.New("must specify map_id, pin_path or map_name")
+	}
+
+	info, err := m.Info()
+	if err != nil {
+		release()
+		return nil, fmt.Errorf("map info: %w", err)
+	}
+	id, _ := info.ID()
+
+	types, err := loadMapBTF(m)
+	if err != nil {
+		// Maps stay usable as raw bytes without BTF.
+		log.Printf("[DEBUG] Map %d: BTF unavailable: %v", id, err)
+		types = nil
+	}
+
+	return &openedMap{m: m, info: info, id: int(id), btf: types, close: release}, nil
+}
+
+// findMapByName returns the ID of the only map called name. Kernel map
+// names are truncated to 15 characters, so longer names match on prefix.
+func findMapByName(name string) (int, error) {
+	want := name
+	if len(want) >= unix.BPF_OBJ_NAME_LEN {
+		want = want[:unix.BPF_OBJ_NAME_LEN-1]
+	}
+
+	var matches []int
+	var id ebpf.MapID
+	for {
+		next, err := ebpf.MapGetNextID(id)
+		if errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("enumerate maps: %w", err)
+		}
+		id = next
+
+		m, err := ebpf.NewMapFromID(id)
+		if err != nil {
+			continue
+		}
+		info, err := m.Info()
+		m.Close()
+		if err == nil && info.Name == want {
+			matches = append(matches, int(id))
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return 0, fmt.Errorf("map %q: %w", name, ErrObjectNotFound)
+	case 1:
+		return matches[0], nil
+	}
+	return 0, fmt.Errorf("map name %q is ambiguous, matching IDs %v; use map_id", name, matches)
+}
+
+func (om *openedMap) perCPU() bool {
+	switch om.info.Type {
+	case ebpf.PerCPUHash, ebpf.PerCPUArray, ebpf.LRUCPUHash, ebpf.PerCPUCGroupStorage:
+		return true
+	}
+	return false
+}
+
+func (om *openedMap) describe() *MapDescription {
+	d := &MapDescription{
+		ID:         om.id,
+		Name:       om.info.Name,
+		Type:       om.info.Type.String(),
+		KeySize:    int(om.info.KeySize),
+		ValueSize:  int(om.info.ValueSize),
+		MaxEntries: int(om.info.MaxEntries),
+		PerCPU:     om.perCPU(),
+	}
+	if om.btf != nil {
+		d.KeyType = btfTypeName(om.btf.Key)
+		d.ValueType = btfTypeName(om.btf.Value)
+	}
+	return d
+}
+
+// MapEntry is a key/value pair rendered as hex, plus the BTF decoded form
+// when the map carries type information. Per-CPU maps fill Values and
+// DecodedValues with one element per possible CPU instead of Value; a
+// value that fails to decode is nil in DecodedValues, so indexes match.
+type MapEntry struct {
+	Key           string        `json:"key"`
+	Value         string        `json:"value,omitempty"`
+	Values        []string      `json:"values,omitempty"`
+	DecodedKey    interface{}   `json:"decoded_key,omitempty"`
+	DecodedValue  interface{}   `json:"decoded_value,omitempty"`
+	DecodedValues []interface{} `json:"decoded_values,omitempty"`
+}
+
+// newMapEntry renders a key and its value(s). Decoding errors only drop the
+// decoded form; the hex is always returned.
+func (om *openedMap) newMapEntry(key []byte, values [][]byte) MapEntry {
+	e := MapEntry{Key: hex.EncodeToString(key)}
+
+	if om.btf != nil && om.btf.Key != nil {
+		if v, err := decodeBTF(om.btf.Key, key); err == nil {
+			e.DecodedKey = v
+		}
+	}
+
+	if !om.perCPU() {
+		e.Value = hex.EncodeToString(values[0])
+		if om.btf != nil {
+			if v, err := decodeBTF(om.btf.Value, values[0]); err == nil {
+				e.DecodedValue = v
+			}
+		}
+		return e
+	}
+
+	decoded := make([]interface{}, len(values))
+	anyDecoded := false
+	for i, v := range values {
+		e.Values = append(e.Values, hex.EncodeToString(v))
+		if om.btf != nil {
+			if dv, err := decodeBTF(om.btf.Value, v); err == nil {
+				decoded[i], anyDecoded = dv, true
+			}
+		}
+	}
+	if anyDecoded {
+		e.DecodedValues = decoded
+	}
+	return e
+}
@@ -0,0 +1,179 @@
+// internal/ebpf/pins.go
+package ebpf
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+)
+
+const bpffsRoot = "/sys/fs/bpf"
+
+// pinIndex maps kernel object IDs to the paths they are pinned at.
+type pinIndex struct {
+	Programs map[int][]string
+	Maps     map[int][]string
+	Links    map[int][]string
+}
+
+// pinKind is what a pinned file resolved to.
+type pinKind int
+
+const (
+	pinOther pinKind = iota
+	pinProgram
+	pinMap
+	pinLink
+)
+
+// pinEntry is a resolved pin. ino and ctime identify the file, so that a
+// pin replaced at the same path is resolved again.
+type pinEntry struct {
+	ino   uint64
+	ctime int64
+	kind  pinKind
+	id    int
+}
+
+// pinCache remembers what every pinned file resolved to, so that walks only
+// open the pins created since the previous one.
+var pinCache = struct {
+	sync.Mutex
+	entries map[string]pinEntry
+}{entries: make(map[string]pinEntry)}
+
+// scanPins walks a bpffs mount and resolves every pinned object to its ID.
+// Files that are not BPF objects are skipped. Pins seen by an earlier walk
+// are not opened again.
+func scanPins(root string) (*pinIndex, error) {
+	idx := &pinIndex{
+		Programs: make(map[int][]string),
+		Maps:     make(map[int][]string),
+		Links:    make(map[int][]string),
+	}
+
+	pinCache.Lock()
+	defer pinCache.Unlock()
+	seen := make(map[string]bool)
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Unreadable subtrees shouldn't hide the rest of the mount.
+			if d != nil && d.IsDir() && path != root {
+				return fs.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			return nil
+		}
+		seen[path] = true
+
+		e, ok := pinCache.entries[path]
+		if !ok || e.ino != st.Ino || e.ctime != st.Ctim.Nano() {
+			e = resolvePin(path)
+			e.ino, e.ctime = st.Ino, st.Ctim.Nano()
+			// Failures may be transient, retry them on the next walk.
+			if e.kind != pinOther {
+				pinCache.entries[path] = e
+			}
+		}
+		switch e.kind {
+		case pinProgram:
+			idx.Programs[e.id] = append(idx.Programs[e.id], path)
+		case pinMap:
+			idx.Maps[e.id] = append(idx.Maps[e.id], path)
+		case pinLink:
+			idx.Links[e.id] = append(idx.Links[e.id], path)
+		}
+		return nil
+	})
+
+	for path := range pinCache.entries {
+		if !seen[path] && strings.HasPrefix(path, root) {
+			delete(pinCache.entries, path)
+		}
+	}
+	return idx, err
+}
+
+// resolvePin opens a pinned file to find the kind and ID of its object.
+func resolvePin(path string) pinEntry {
+	readOnly := &ebpf.LoadPinOptions{ReadOnly: true}
+
+	if prog, err := ebpf.LoadPinnedProgram(path, readOnly); err == nil {
+		defer prog.Close()
+		if info, err := prog.Info(); err == nil {
+			if id, ok := info.ID(); ok {
+				return pinEntry{kind: pinProgram, id: int(id)}
+			}
+		}
+		return pinEntry{}
+	}
+
+	if m, err := ebpf.LoadPinnedMap(path, readOnly); err == nil {
+		defer m.Close()
+		if info, err := m.Info(); err == nil {
+			if id, ok := info.ID(); ok {
+				return pinEntry{kind: pinMap, id: int(id)}
+			}
+		}
+		return pinEntry{}
+	}
+
+	// Links can't be opened read-only.
+	if l, err := link.LoadPinnedLink(path, nil); err == nil {
+		defer l.Close()
+		if info, err := l.Info(); err == nil {
+			return pinEntry{kind: pinLink, id: int(info.ID)}
+		}
+	}
+	return pinEntry{}
+}
+
+// checkLinkPin makes sure a path about to be removed is a pin of link id on
+// bpffs, so that removing it can't delete anything else. Paths that are
+// already gone pass.
+func checkLinkPin(path string, id int) error {
+	resolved, err := filepath.EvalSymlinks(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("pin %s: %w", path, err)
+	}
+	if resolved != bpffsRoot && !strings.HasPrefix(resolved, bpffsRoot+"/") {
+		return fmt.Errorf("pin %s is not under %s", path, bpffsRoot)
+	}
+
+	l, err := link.LoadPinnedLink(resolved, nil)
+	if err != nil {
+		return fmt.Errorf("pin %s is not a link: %w", path, err)
+	}
+	defer l.Close()
+	info, err := l.Info()
+	if err != nil {
+		return fmt.Errorf("pin %s: link info: %w", path, err)
+	}
+	if int(info.ID) != id {
+		return fmt.Errorf("pin %s holds link %d, not %d", path, info.ID, id)
+	}
+	return nil
+}
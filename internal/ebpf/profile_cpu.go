@@ -0,0 +1,583 @@
+package ebpf
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/rlimit"
+	"github.com/sameehj/ebpf-mcp/pkg/types"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	defaultProfileDuration  = 5 * time.Second
+	defaultProfileFrequency = 49
+	maxProfileFrequency     = 1000
+	defaultProfileTop       = 20
+	maxProfileTop           = 200
+	defaultProfileStacks    = 200
+	maxProfileStacks        = 10000
+	profileStackEntries     = 16384
+	profileMaxDepth         = 127
+	onlineCPUsPath          = "/sys/devices/system/cpu/online"
+
+	// bpfFUserStack makes bpf_get_stackid walk the user stack.
+	bpfFUserStack = 1 << 8
+)
+
+// profileKey is what samples are counted by. The command comes first so
+// it can be compared a DWord at a time.
+var profileKey = newStruct("profile_key",
+	structField{"comm", btfArray(btfChar, taskCommLen)},
+	structField{"pid", btfU32},
+	structField{"kernel_stack", btfS32},
+	structField{"user_stack", btfS32},
+)
+
+type ProfileCPUArgs struct {
+	DurationMs  int    `json:"duration_ms,omitempty"`
+	FrequencyHz int    `json:"frequency_hz,omitempty"`
+	Pids        []int  `json:"pids,omitempty"`
+	Cgroup      string `json:"cgroup,omitempty"`
+	Comm        string `json:"comm,omitempty"`
+	Top         int    `json:"top,omitempty"`
+	MaxStacks   int    `json:"max_stacks,omitempty"`
+}
+
+type ProfileCPUResult struct {
+	Success      bool                   `json:"success"`
+	ToolVersion  string                 `json:"tool_version"`
+	Status       string                 `json:"status"`
+	Samples      uint64                 `json:"samples"`
+	Folded       []FoldedStack          `json:"folded"`
+	TopFunctions []HotFunction          `json:"top_functions"`
+	Stats        map[string]interface{} `json:"stats"`
+	Complete     bool                   `json:"complete"`
+	Warnings     []string               `json:"warnings,omitempty"`
+	Error        string                 `json:"error,omitempty"`
+}
+
+// FoldedStack is a stack in folded format: the command, then frames from
+// the outermost in, separated by semicolons. Kernel frames end in "_[k]".
+type FoldedStack struct {
+	Stack string `json:"stack"`
+	Count uint64 `json:"count"`
+}
+
+// HotFunction counts the samples a function was running in (self) or on
+// the stack of (total).
+type HotFunction struct {
+	Function     string  `json:"function"`
+	Module       string  `json:"module,omitempty"`
+	Self         uint64  `json:"self"`
+	Total        uint64  `json:"total"`
+	SelfPercent  float64 `json:"self_percent"`
+	TotalPercent float64 `json:"total_percent"`
+}
+
+func ParseProfileCPUArgs(input map[string]interface{}) (*ProfileCPUArgs, error) {
+	var args ProfileCPUArgs
+	if input == nil {
+		return &args, nil
+	}
+	if err := types.StrictUnmarshal(input, &args); err != nil {
+		return nil, fmt.Errorf("failed to parse profile cpu args: %w", err)
+	}
+	return &args, nil
+}
+
+func profileCPUFailure(err error) (*ProfileCPUResult, error) {
+	return &ProfileCPUResult{
+		Success:     false,
+		ToolVersion: "v1",
+		Status:      "failed",
+		Error:       err.Error(),
+	}, err
+}
+
+// RunProfileCPU samples the stacks of running tasks on every CPU for the
+// requested duration, or until ctx is cancelled, and returns them folded
+// and summarised by function. Idle CPUs are not sampled.
+func RunProfileCPU(ctx context.Context, args *ProfileCPUArgs) (*ProfileCPUResult, error) {
+	if args == nil {
+		return profileCPUFailure(errors.New("args cannot be nil"))
+	}
+
+	duration := time.Duration(args.DurationMs) * time.Millisecond
+	if duration == 0 {
+		duration = defaultProfileDuration
+	}
+	if duration < 0 || duration > maxTraceDuration {
+		return profileCPUFailure(fmt.Errorf("duration_ms must be between 1 and %d", maxTraceDuration.Milliseconds()))
+	}
+	frequency := args.FrequencyHz
+	if frequency == 0 {
+		frequency = defaultProfileFrequency
+	}
+	if frequency < 0 || frequency > maxProfileFrequency {
+		return profileCPUFailure(fmt.Errorf("frequency_hz must be between 1 and %d", maxProfileFrequency))
+	}
+	top := args.Top
+	if top == 0 {
+		top = defaultProfileTop
+	}
+	if top < 0 || top > maxProfileTop {
+		return profileCPUFailure(fmt.Errorf("top must be between 1 and %d", maxProfileTop))
+	}
+	maxStacks := args.MaxStacks
+	if maxStacks == 0 {
+		maxStacks = defaultProfileStacks
+	}
+	if maxStacks < 0 || maxStacks > maxProfileStacks {
+		return profileCPUFailure(fmt.Errorf("max_stacks must be between 1 and %d", maxProfileStacks))
+	}
+	if len(args.Pids) > maxTracePids {
+		return profileCPUFailure(fmt.Errorf("at most %d pids can be profiled", maxTracePids))
+	}
+	for _, pid := range args.Pids {
+		if pid <= 0 {
+			return profileCPUFailure(fmt.Errorf("invalid pid %d", pid))
+		}
+	}
+	if len(args.Comm) >= taskCommLen {
+		return profileCPUFailure(fmt.Errorf("comm must be shorter than %d bytes", taskCommLen))
+	}
+
+	var cgroup *os.File
+	if args.Cgroup != "" {
+		path := args.Cgroup
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(cgroupFSRoot, path)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return profileCPUFailure(fmt.Errorf("cgroup: %w", err))
+		}
+		defer f.Close()
+		cgroup = f
+	}
+
+	cpus, err := onlineCPUs()
+	if err != nil {
+		return profileCPUFailure(err)
+	}
+
+	if err := rlimit.RemoveMemlock(); err != nil {
+		return profileCPUFailure(fmt.Errorf("rlimit error: %v", err))
+	}
+
+	coll, err := ebpf.NewCollection(profileSpec(len(args.Pids), cgroup != nil, args.Comm))
+	if err != nil {
+		return profileCPUFailure(fmt.Errorf("failed to load programs: %v", err))
+	}
+	defer coll.Close()
+	for _, pid := range args.Pids {
+		if err := coll.Maps["pids"].Put(uint32(pid), uint8(1)); err != nil {
+			return profileCPUFailure(fmt.Errorf("failed to add pid %d to filter: %v", pid, err))
+		}
+	}
+	if cgroup != nil {
+		if err := coll.Maps["cgroup"].Put(uint32(0), uint32(cgroup.Fd())); err != nil {
+			return profileCPUFailure(fmt.Errorf("failed to set cgroup filter (is %s a cgroup v2 directory?): %v", cgroup.Name(), err))
+		}
+	}
+
+	prog := coll.Programs["profile"]
+	for _, cpu := range cpus {
+		fd, err := openSamplingEvent(cpu, frequency)
+		if err != nil {
+			return profileCPUFailure(fmt.Errorf("perf event on cpu %d: %w", cpu, err))
+		}
+		defer unix.Close(fd)
+		if err := unix.IoctlSetInt(fd, unix.PERF_EVENT_IOC_SET_BPF, prog.FD()); err != nil {
+			return profileCPUFailure(fmt.Errorf("attach to perf event on cpu %d: %w", cpu, err))
+		}
+		if err := unix.IoctlSetInt(fd, unix.PERF_EVENT_IOC_ENABLE, 0); err != nil {
+			return profileCPUFailure(fmt.Errorf("enable perf event on cpu %d: %w", cpu, err))
+		}
+	}
+
+	start := time.Now()
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return profileCPUFailure(fmt.Errorf("profile cancelled: %w", ctx.Err()))
+	}
+	elapsed := time.Since(start)
+
+	symbols, err := newStackSymbolizer(coll.Maps["stacks"])
+	if err != nil {
+		return profileCPUFailure(err)
+	}
+	folded := make(map[string]uint64)
+	self := make(map[stackFrame]uint64)
+	total := make(map[stackFrame]uint64)
+	var samples, lostStacks uint64
+
+	var key struct {
+		Comm        [taskCommLen]byte
+		Pid         uint32
+		KernelStack int32
+		UserStack   int32
+	}
+	var count uint64
+	iter := coll.Maps["counts"].Iterate()
+	for iter.Next(&key, &count) {
+		samples += count
+		if key.KernelStack == -int32(unix.EEXIST) || key.UserStack == -int32(unix.EEXIST) {
+			lostStacks += count
+		}
+
+		stack := symbols.stack(key.Pid, key.KernelStack, key.UserStack)
+		folded[foldStack(strings.TrimRight(string(key.Comm[:]), "\x00"), stack)] += count
+
+		if len(stack) > 0 {
+			self[stack[0]] += count
+		}
+		seen := make(map[stackFrame]bool, len(stack))
+		for _, f := range stack {
+			if !seen[f] {
+				seen[f] = true
+				total[f] += count
+			}
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return profileCPUFailure(fmt.Errorf("read samples: %w", err))
+	}
+
+	percent := func(n uint64) float64 {
+		if samples == 0 {
+			return 0
+		}
+		return float64(n) * 100 / float64(samples)
+	}
+	result := &ProfileCPUResult{
+		Success:      true,
+		ToolVersion:  "v1",
+		Samples:      samples,
+		Folded:       []FoldedStack{},
+		TopFunctions: []HotFunction{},
+	}
+	for stack, n := range folded {
+		result.Folded = append(result.Folded, FoldedStack{Stack: stack, Count: n})
+	}
+	sort.Slice(result.Folded, func(i, j int) bool {
+		a, b := result.Folded[i], result.Folded[j]
+		return a.Count > b.Count || (a.Count == b.Count && a.Stack < b.Stack)
+	})
+	if len(result.Folded) > maxStacks {
+		var shown uint64
+		for _, s := range result.Folded[:maxStacks] {
+			shown += s.Count
+		}
+		result.Warnings = append(result.Warnings,
+			fmt.Sprintf("showing the %d hottest of %d stacks, covering %.1f%% of samples", maxStacks, len(result.Folded), percent(shown)))
+		result.Folded = result.Folded[:maxStacks]
+	}
+
+	for f, n := range total {
+		result.TopFunctions = append(result.TopFunctions, HotFunction{
+			Function:     f.function,
+			Module:       f.module,
+			Self:         self[f],
+			Total:        n,
+			SelfPercent:  percent(self[f]),
+			TotalPercent: percent(n),
+		})
+	}
+	sort.Slice(result.TopFunctions, func(i, j int) bool {
+		a, b := result.TopFunctions[i], result.TopFunctions[j]
+		if a.Self != b.Self {
+			return a.Self > b.Self
+		}
+		if a.Total != b.Total {
+			return a.Total > b.Total
+		}
+		return a.Function < b.Function
+	})
+	if len(result.TopFunctions) > top {
+		result.TopFunctions = result.TopFunctions[:top]
+	}
+
+	if lostStacks > 0 {
+		result.Warnings = append(result.Warnings,
+			fmt.Sprintf("the stack map was full or had collisions: %d samples have incomplete stacks", lostStacks))
+	}
+	if n := len(symbols.usyms.exited); n > 0 {
+		result.Warnings = append(result.Warnings,
+			fmt.Sprintf("user stacks of %d processes that exited during the profile could not be symbolized", n))
+	}
+
+	result.Stats = map[string]interface{}{
+		"duration_ms":        elapsed.Milliseconds(),
+		"frequency_hz":       frequency,
+		"cpus":               len(cpus),
+		"samples_per_second": rate(int(samples), elapsed.Seconds()),
+		"distinct_stacks":    len(folded),
+		"lost_stacks":        lostStacks,
+	}
+	result.Complete = true
+	result.Status = fmt.Sprintf("Collected %d samples on %d CPUs for %dms", samples, len(cpus), elapsed.Milliseconds())
+	return result, nil
+}
+
+// stackFrame is a symbolized frame; module is "kernel" for kernel frames.
+type stackFrame struct{ function, module string }
+
+// stackSymbolizer resolves the stack IDs of a StackTrace map to frames,
+// caching kernel stacks by ID.
+type stackSymbolizer struct {
+	stacks *ebpf.Map
+	ksyms  *ksymTable
+	usyms  *userSymbolizer
+	kernel map[int32][]string
+}
+
+func newStackSymbolizer(stacks *ebpf.Map) (*stackSymbolizer, error) {
+	ksyms, err := loadKsyms()
+	if err != nil {
+		return nil, err
+	}
+	return &stackSymbolizer{
+		stacks: stacks,
+		ksyms:  ksyms,
+		usyms:  newUserSymbolizer(),
+		kernel: make(map[int32][]string),
+	}, nil
+}
+
+// frames returns the addresses of a stack, leaf first. Negative IDs are
+// errors of bpf_get_stackid and have no frames.
+func (s *stackSymbolizer) frames(id int32) []uint64 {
+	if id < 0 {
+		return nil
+	}
+	var ips [profileMaxDepth]uint64
+	if err := s.stacks.Lookup(uint32(id), &ips); err != nil {
+		return nil
+	}
+	var out []uint64
+	for _, ip := range ips {
+		if ip == 0 {
+			break
+		}
+		out = append(out, ip)
+	}
+	return out
+}
+
+// stack symbolizes the kernel and user stacks of process pid, leaf first.
+func (s *stackSymbolizer) stack(pid uint32, kernelStack, userStack int32) []stackFrame {
+	var stack []stackFrame
+	names, ok := s.kernel[kernelStack]
+	if !ok {
+		for _, ip := range s.frames(kernelStack) {
+			names = append(names, s.ksyms.function(ip))
+		}
+		s.kernel[kernelStack] = names
+	}
+	for _, name := range names {
+		stack = append(stack, stackFrame{name, "kernel"})
+	}
+	for _, ip := range s.frames(userStack) {
+		name, module := s.usyms.resolve(int(pid), ip)
+		stack = append(stack, stackFrame{name, module})
+	}
+	return stack
+}
+
+// foldStack formats a leaf first stack as a FoldedStack does.
+func foldStack(comm string, stack []stackFrame) string {
+	parts := []string{comm}
+	for i := len(stack) - 1; i >= 0; i-- {
+		if stack[i].module == "kernel" {
+			parts = append(parts, stack[i].function+"_[k]")
+		} else {
+			parts = append(parts, stack[i].function)
+		}
+	}
+	return strings.Join(parts, ";")
+}
+
+// openSamplingEvent opens a disabled CPU clock event sampling at frequency
+// Hz on cpu.
+func openSamplingEvent(cpu, frequency int) (int, error) {
+	attr := unix.PerfEventAttr{
+		Type:   unix.PERF_TYPE_SOFTWARE,
+		Config: unix.PERF_COUNT_SW_CPU_CLOCK,
+		Sample: uint64(frequency),
+		Bits:   unix.PerfBitFreq | unix.PerfBitDisabled,
+	}
+	attr.Size = uint32(unsafe.Sizeof(attr))
+	return unix.PerfEventOpen(&attr, -1, cpu, -1, unix.PERF_FLAG_FD_CLOEXEC)
+}
+
+// onlineCPUs parses a CPU list such as "0-3,6".
+func onlineCPUs() ([]int, error) {
+	data, err := os.ReadFile(onlineCPUsPath)
+	if err != nil {
+		return nil, err
+	}
+	var cpus []int
+	for _, part := range strings.Split(strings.TrimSpace(string(data)), ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		lo, err := strconv.Atoi(first)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", onlineCPUsPath, err)
+		}
+		hi := lo
+		if isRange {
+			if hi, err = strconv.Atoi(last); err != nil {
+				return nil, fmt.Errorf("parse %s: %w", onlineCPUsPath, err)
+			}
+		}
+		for cpu := lo; cpu <= hi; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
+
+// profileSpec assembles the sampling program. It counts samples by
+// process, kernel and user stack and command, skipping the idle task and,
+// with filters, tasks not in the pids map, not under the cgroup in slot 0
+// of the cgroup map, or with another command.
+func profileSpec(pids int, cgroupFilter bool, comm string) *ebpf.CollectionSpec {
+	const keyOff = -32
+
+	insns := asm.Instructions{
+		asm.Mov.Reg(asm.R6, asm.R1),
+		asm.FnGetCurrentPidTgid.Call(),
+		asm.JEq.Imm(asm.R0, 0, "out"),
+		asm.RSh.Imm(asm.R0, 32),
+		asm.StoreMem(asm.RFP, keyOff+offsetOf(profileKey, "pid"), asm.R0, asm.Word),
+	}
+	if pids > 0 {
+		insns = append(insns,
+			asm.LoadMapPtr(asm.R1, 0).WithReference("pids"),
+			asm.Mov.Reg(asm.R2, asm.RFP),
+			asm.Add.Imm(asm.R2, int32(keyOff+offsetOf(profileKey, "pid"))),
+			asm.FnMapLookupElem.Call(),
+			asm.JEq.Imm(asm.R0, 0, "out"),
+		)
+	}
+	if cgroupFilter {
+		insns = append(insns,
+			asm.LoadMapPtr(asm.R1, 0).WithReference("cgroup"),
+			asm.Mov.Imm(asm.R2, 0),
+			asm.FnCurrentTaskUnderCgroup.Call(),
+			asm.JNE.Imm(asm.R0, 1, "out"),
+		)
+	}
+	insns = append(insns,
+		asm.Mov.Reg(asm.R1, asm.RFP),
+		asm.Add.Imm(asm.R1, int32(keyOff+offsetOf(profileKey, "comm"))),
+		asm.Mov.Imm(asm.R2, taskCommLen),
+		asm.FnGetCurrentComm.Call(),
+	)
+	if comm != "" {
+		// Commands are NUL padded, so compare both halves.
+		var want [taskCommLen]byte
+		copy(want[:], comm)
+		for half := 0; half < taskCommLen; half += 8 {
+			insns = append(insns,
+				asm.LoadMem(asm.R1, asm.RFP, keyOff+offsetOf(profileKey, "comm")+int16(half), asm.DWord),
+				asm.LoadImm(asm.R2, int64(binary.NativeEndian.Uint64(want[half:half+8])), asm.DWord),
+				asm.JNE.Reg(asm.R1, asm.R2, "out"),
+			)
+		}
+	}
+	for _, s := range []struct {
+		field string
+		flags int32
+	}{{"kernel_stack", 0}, {"user_stack", bpfFUserStack}} {
+		insns = append(insns,
+			asm.Mov.Reg(asm.R1, asm.R6),
+			asm.LoadMapPtr(asm.R2, 0).WithReference("stacks"),
+			asm.Mov.Imm(asm.R3, s.flags),
+			asm.FnGetStackid.Call(),
+			asm.StoreMem(asm.RFP, keyOff+offsetOf(profileKey, s.field), asm.R0, asm.Word),
+		)
+	}
+	insns = append(insns,
+		asm.LoadMapPtr(asm.R1, 0).WithReference("counts"),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, keyOff),
+		asm.FnMapLookupElem.Call(),
+		asm.JEq.Imm(asm.R0, 0, "new_key"),
+		asm.Mov.Imm(asm.R1, 1),
+		asm.StoreXAdd(asm.R0, asm.R1, asm.DWord),
+		asm.Ja.Label("out"),
+		asm.StoreImm(asm.RFP, -40, 1, asm.DWord).WithSymbol("new_key"),
+		asm.LoadMapPtr(asm.R1, 0).WithReference("counts"),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, keyOff),
+		asm.Mov.Reg(asm.R3, asm.RFP),
+		asm.Add.Imm(asm.R3, -40),
+		asm.Mov.Imm(asm.R4, int32(ebpf.UpdateNoExist)),
+		asm.FnMapUpdateElem.Call(),
+	)
+	insns = append(insns, programExit()...)
+
+	spec := &ebpf.CollectionSpec{
+		Maps: map[string]*ebpf.MapSpec{
+			"stacks": {
+				Name:       "profile_stacks",
+				Type:       ebpf.StackTrace,
+				KeySize:    4,
+				ValueSize:  8 * profileMaxDepth,
+				MaxEntries: profileStackEntries,
+			},
+			"counts": {
+				Name:       "profile_counts",
+				Type:       ebpf.Hash,
+				KeySize:    profileKey.Size,
+				ValueSize:  8,
+				MaxEntries: profileStackEntries,
+				Key:        profileKey,
+				Value:      btfU64,
+			},
+		},
+		Programs: map[string]*ebpf.ProgramSpec{
+			"profile": {
+				Name:         "profile",
+				Type:         ebpf.PerfEvent,
+				License:      "GPL",
+				Instructions: insns,
+			},
+		},
+	}
+	if pids > 0 {
+		spec.Maps["pids"] = &ebpf.MapSpec{
+			Name:       "profile_pids",
+			Type:       ebpf.Hash,
+			KeySize:    4,
+			ValueSize:  1,
+			MaxEntries: uint32(pids),
+		}
+	}
+	if cgroupFilter {
+		spec.Maps["cgroup"] = &ebpf.MapSpec{
+			Name:       "profile_cg",
+			Type:       ebpf.CGroupArray,
+			KeySize:    4,
+			ValueSize:  4,
+			MaxEntries: 1,
+		}
+	}
+	return spec
+}
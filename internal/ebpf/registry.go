@@ -0,0 +1,473 @@
+// internal/ebpf/registry.go
+package ebpf
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+)
+
+// ObjectKind identifies the kind of kernel object held by the registry.
+type ObjectKind string
+
+const (
+	KindCollection ObjectKind = "collection"
+	KindProgram    ObjectKind = "program"
+	KindMap        ObjectKind = "map"
+	KindLink       ObjectKind = "link"
+)
+
+var ErrObjectNotFound = errors.New("object not found")
+
+// ObjectRef describes an object kept alive by the server.
+type ObjectRef struct {
+	Handle    string     `json:"handle"`
+	Kind      ObjectKind `json:"kind"`
+	ID        int        `json:"id,omitempty"`
+	Name      string     `json:"name,omitempty"`
+	Owner     string     `json:"owner,omitempty"`
+	PinPath   string     `json:"pin_path,omitempty"`
+	Refs      int        `json:"refs"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+type registryEntry struct {
+	ref   ObjectRef
+	value interface{}
+	// closer is nil for collection members; the owning collection closes them.
+	closer io.Closer
+	// members are the handles of programs and maps owned by a collection.
+	members []string
+	// holds are the handles this entry keeps a reference on, e.g. a link
+	// holds the program it is attached to.
+	holds []string
+}
+
+// Registry keeps loaded collections, programs, maps and links alive across
+// tool calls. Objects are addressable by kernel ID and by a server handle.
+//
+// Reference counts live on root objects (collections, links and objects
+// opened by ID). Programs and maps loaded as part of a collection share the
+// reference count of their collection.
+type Registry struct {
+	mu      sync.Mutex
+	entries map[string]*registryEntry
+	ids     map[ObjectKind]map[int]string
+	seq     map[ObjectKind]int
+}
+
+var objects = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{
+		entries: make(map[string]*registryEntry),
+		ids:     make(map[ObjectKind]map[int]string),
+		seq:     make(map[ObjectKind]int),
+	}
+}
+
+// collectionCloser adapts *ebpf.Collection to io.Closer.
+type collectionCloser struct{ coll *ebpf.Collection }
+
+func (c collectionCloser) Close() error {
+	c.coll.Close()
+	return nil
+}
+
+// newEntry must be called with r.mu held.
+func (r *Registry) newEntry(kind ObjectKind, id int, name string, value interface{}, closer io.Closer) *registryEntry {
+	r.seq[kind]++
+	e := &registryEntry{
+		ref: ObjectRef{
+			Handle:    fmt.Sprintf("%s-%d", kind, r.seq[kind]),
+			Kind:      kind,
+			ID:        id,
+			Name:      name,
+			CreatedAt: time.Now(),
+		},
+		value:  value,
+		closer: closer,
+	}
+	r.entries[e.ref.Handle] = e
+	if id != 0 {
+		if r.ids[kind] == nil {
+			r.ids[kind] = make(map[int]string)
+		}
+		r.ids[kind][id] = e.ref.Handle
+	}
+	return e
+}
+
+// root returns the entry that carries the reference count for e.
+// Must be called with r.mu held.
+func (r *Registry) root(e *registryEntry) *registryEntry {
+	if e.ref.Owner != "" {
+		if owner, ok := r.entries[e.ref.Owner]; ok {
+			return owner
+		}
+	}
+	return e
+}
+
+// lookup must be called with r.mu held.
+func (r *Registry) lookup(kind ObjectKind, id int) (*registryEntry, bool) {
+	handle, ok := r.ids[kind][id]
+	if !ok {
+		return nil, false
+	}
+	e, ok := r.entries[handle]
+	return e, ok
+}
+
+// AddCollection takes ownership of coll and registers its programs and maps.
+// It returns the collection handle.
+func (r *Registry) AddCollection(name string, coll *ebpf.Collection) (string, error) {
+	type member struct {
+		kind  ObjectKind
+		id    int
+		name  string
+		value interface{}
+	}
+
+	var members []member
+	for progName, prog := range coll.Programs {
+		info, err := prog.Info()
+		if err != nil {
+			return "", fmt.Errorf("program %s info: %w", progName, err)
+		}
+		id, _ := info.ID()
+		members = append(members, member{KindProgram, int(id), progName, prog})
+	}
+	for mapName, m := range coll.Maps {
+		info, err := m.Info()
+		if err != nil {
+			return "", fmt.Errorf("map %s info: %w", mapName, err)
+		}
+		id, _ := info.ID()
+		members = append(members, member{KindMap, int(id), mapName, m})
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ce := r.newEntry(KindCollection, 0, name, coll, collectionCloser{coll})
+	ce.ref.Refs = 1
+	for _, m := range members {
+		me := r.newEntry(m.kind, m.id, m.name, m.value, nil)
+		me.ref.Owner = ce.ref.Handle
+		ce.members = append(ce.members, me.ref.Handle)
+	}
+
+	log.Printf("[DEBUG] Registry: added %s with %d members", ce.ref.Handle, len(ce.members))
+	return ce.ref.Handle, nil
+}
+
+// AddLink takes ownership of l. The link is named after the hook it is
+// attached to and keeps a reference on the program identified by progHandle
+// until it is released.
+func (r *Registry) AddLink(l link.Link, id int, target, progHandle, pinPath string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	le := r.newEntry(KindLink, id, target, l, l)
+	le.ref.Refs = 1
+	le.ref.PinPath = pinPath
+
+	if pe, ok := r.entries[progHandle]; ok {
+		root := r.root(pe)
+		root.ref.Refs++
+		le.holds = append(le.holds, root.ref.Handle)
+	}
+
+	return le.ref.Handle
+}
+
+// Rebind moves the program reference held by a link to the program behind
+// progHandle, e.g. after the link was updated to run a different program.
+// The previous program is released and returned if it was freed.
+func (r *Registry) Rebind(linkHandle, progHandle string) ([]ObjectRef, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	le, ok := r.entries[linkHandle]
+	if !ok || le.ref.Kind != KindLink {
+		return nil, fmt.Errorf("link %s: %w", linkHandle, ErrObjectNotFound)
+	}
+	pe, ok := r.entries[progHandle]
+	if !ok {
+		return nil, fmt.Errorf("program %s: %w", progHandle, ErrObjectNotFound)
+	}
+
+	newRoot := r.root(pe)
+	newRoot.ref.Refs++
+	old := le.holds
+	le.holds = []string{newRoot.ref.Handle}
+
+	var released []ObjectRef
+	var errs []error
+	for _, hh := range old {
+		if he, ok := r.entries[hh]; ok {
+			more, err := r.release(he)
+			released = append(released, more...)
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return released, errors.Join(errs...)
+}
+
+// OpenProgram returns the program with the given kernel ID, opening and
+// registering it if the server does not hold it yet. The caller owns a
+// reference on the returned handle and must Release it when done.
+func (r *Registry) OpenProgram(id int) (*ebpf.Program, string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if e, ok := r.lookup(KindProgram, id); ok {
+		r.root(e).ref.Refs++
+		return e.value.(*ebpf.Program), e.ref.Handle, nil
+	}
+
+	prog, err := ebpf.NewProgramFromID(ebpf.ProgramID(id))
+	if err != nil {
+		return nil, "", fmt.Errorf("program %d: %w", id, err)
+	}
+
+	name := ""
+	if info, err := prog.Info(); err == nil {
+		name = info.Name
+	}
+	e := r.newEntry(KindProgram, id, name, prog, prog)
+	e.ref.Refs = 1
+	return prog, e.ref.Handle, nil
+}
+
+// OpenMap returns the map with the given kernel ID, opening and registering
+// it if the server does not hold it yet. The caller owns a reference on the
+// returned handle and must Release it when done.
+func (r *Registry) OpenMap(id int) (*ebpf.Map, string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if e, ok := r.lookup(KindMap, id); ok {
+		r.root(e).ref.Refs++
+		return e.value.(*ebpf.Map), e.ref.Handle, nil
+	}
+
+	m, err := ebpf.NewMapFromID(ebpf.MapID(id))
+	if err != nil {
+		return nil, "", fmt.Errorf("map %d: %w", id, err)
+	}
+
+	name := ""
+	if info, err := m.Info(); err == nil {
+		name = info.Name
+	}
+	e := r.newEntry(KindMap, id, name, m, m)
+	e.ref.Refs = 1
+	return m, e.ref.Handle, nil
+}
+
+// Program returns a program held by the registry.
+func (r *Registry) Program(id int) (*ebpf.Program, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if e, ok := r.lookup(KindProgram, id); ok {
+		return e.value.(*ebpf.Program), true
+	}
+	return nil, false
+}
+
+// Map returns a map held by the registry.
+func (r *Registry) Map(id int) (*ebpf.Map, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if e, ok := r.lookup(KindMap, id); ok {
+		return e.value.(*ebpf.Map), true
+	}
+	return nil, false
+}
+
+// Link returns a link held by the registry.
+func (r *Registry) Link(id int) (link.Link, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if e, ok := r.lookup(KindLink, id); ok {
+		return e.value.(link.Link), true
+	}
+	return nil, false
+}
+
+// Get returns the object registered under handle.
+func (r *Registry) Get(handle string) (ObjectRef, interface{}, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e, ok := r.entries[handle]
+	if !ok {
+		return ObjectRef{}, nil, false
+	}
+	ref := e.ref
+	ref.Refs = r.root(e).ref.Refs
+	return ref, e.value, true
+}
+
+// HandleFor returns the handle of a registered object by kernel ID.
+func (r *Registry) HandleFor(kind ObjectKind, id int) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e, ok := r.lookup(kind, id)
+	if !ok {
+		return "", false
+	}
+	return e.ref.Handle, true
+}
+
+// Group returns the root object that carries the reference count for handle,
+// together with the programs and maps it owns.
+func (r *Registry) Group(handle string) (ObjectRef, []ObjectRef, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e, ok := r.entries[handle]
+	if !ok {
+		return ObjectRef{}, nil, fmt.Errorf("%s: %w", handle, ErrObjectNotFound)
+	}
+	root := r.root(e)
+
+	var members []ObjectRef
+	for _, mh := range root.members {
+		if me, ok := r.entries[mh]; ok {
+			ref := me.ref
+			ref.Refs = root.ref.Refs
+			members = append(members, ref)
+		}
+	}
+	return root.ref, members, nil
+}
+
+// Holders returns the objects holding a reference on the root of handle,
+// e.g. the links attached to a program, ordered by handle.
+func (r *Registry) Holders(handle string) []ObjectRef {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e, ok := r.entries[handle]
+	if !ok {
+		return nil
+	}
+	root := r.root(e).ref.Handle
+
+	var refs []ObjectRef
+	for _, he := range r.entries {
+		if slices.Contains(he.holds, root) {
+			refs = append(refs, he.ref)
+		}
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].Handle < refs[j].Handle })
+	return refs
+}
+
+// Acquire takes an additional reference on the object behind handle.
+func (r *Registry) Acquire(handle string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e, ok := r.entries[handle]
+	if !ok {
+		return fmt.Errorf("%s: %w", handle, ErrObjectNotFound)
+	}
+	r.root(e).ref.Refs++
+	return nil
+}
+
+// Release drops a reference on the object behind handle. Objects whose
+// reference count drops to zero are closed, together with the members they
+// own and the references they hold. The released objects are returned.
+func (r *Registry) Release(handle string) ([]ObjectRef, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e, ok := r.entries[handle]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", handle, ErrObjectNotFound)
+	}
+	return r.release(r.root(e))
+}
+
+// release must be called with r.mu held.
+func (r *Registry) release(e *registryEntry) ([]ObjectRef, error) {
+	e.ref.Refs--
+	if e.ref.Refs > 0 {
+		return nil, nil
+	}
+
+	var released []ObjectRef
+	var errs []error
+
+	if e.closer != nil {
+		if err := e.closer.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("close %s: %w", e.ref.Handle, err))
+		}
+	}
+
+	for _, mh := range e.members {
+		if me, ok := r.entries[mh]; ok {
+			r.forget(me)
+			released = append(released, me.ref)
+		}
+	}
+	r.forget(e)
+	released = append(released, e.ref)
+
+	for _, hh := range e.holds {
+		if he, ok := r.entries[hh]; ok {
+			more, err := r.release(he)
+			released = append(released, more...)
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	log.Printf("[DEBUG] Registry: released %s (%d objects)", e.ref.Handle, len(released))
+	return released, errors.Join(errs...)
+}
+
+// forget must be called with r.mu held.
+func (r *Registry) forget(e *registryEntry) {
+	delete(r.entries, e.ref.Handle)
+	if e.ref.ID != 0 && r.ids[e.ref.Kind][e.ref.ID] == e.ref.Handle {
+		delete(r.ids[e.ref.Kind], e.ref.ID)
+	}
+	if e.ref.Kind == KindMap {
+		forgetBuiltinEventType(e.ref.ID)
+	}
+}
+
+// List returns all objects currently held by the registry.
+func (r *Registry) List() []ObjectRef {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	refs := make([]ObjectRef, 0, len(r.entries))
+	for _, e := range r.entries {
+		ref := e.ref
+		ref.Refs = r.root(e).ref.Refs
+		refs = append(refs, ref)
+	}
+	return refs
+}
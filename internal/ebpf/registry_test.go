@@ -0,0 +1,102 @@
+package ebpf
+
+import (
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+)
+
+// fakeLink counts how often the registry closes it.
+type fakeLink struct {
+	link.Link
+	closed int
+}
+
+func (l *fakeLink) Close() error {
+	l.closed++
+	return nil
+}
+
+func newTestCollection(t *testing.T) *ebpf.Collection {
+	t.Helper()
+	m, err := ebpf.NewMap(&ebpf.MapSpec{Type: ebpf.Array, KeySize: 4, ValueSize: 4, MaxEntries: 1})
+	if err != nil {
+		t.Skipf("creating a map: %v", err)
+	}
+	return &ebpf.Collection{Maps: map[string]*ebpf.Map{"counts": m}}
+}
+
+func TestRegistryRefcounting(t *testing.T) {
+	r := NewRegistry()
+	coll, err := r.AddCollection("test", newTestCollection(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, members, err := r.Group(coll)
+	if err != nil || len(members) != 1 || root.Refs != 1 {
+		t.Fatalf("Group = %+v, %+v, %v", root, members, err)
+	}
+	member := members[0].Handle
+
+	// A link holds the root of the program it is attached to, even when
+	// added by the handle of a member.
+	l := &fakeLink{}
+	lh := r.AddLink(l, 0, "test", member, "")
+	if root, _, _ := r.Group(member); root.Refs != 2 {
+		t.Errorf("refs with a link = %d, want 2", root.Refs)
+	}
+	if holders := r.Holders(member); len(holders) != 1 || holders[0].Handle != lh {
+		t.Errorf("Holders = %+v, want %s", holders, lh)
+	}
+
+	if err := r.Acquire(coll); err != nil {
+		t.Fatal(err)
+	}
+	if released, err := r.Release(coll); err != nil || len(released) != 0 {
+		t.Errorf("releasing an extra reference freed %+v, %v", released, err)
+	}
+
+	// Releasing the link closes it and drops its reference on the
+	// collection, which the load still holds.
+	released, err := r.Release(lh)
+	if err != nil || len(released) != 1 || released[0].Handle != lh || l.closed != 1 {
+		t.Fatalf("Release(link) = %+v, %v; closed %d times", released, err, l.closed)
+	}
+	if root, _, _ := r.Group(coll); root.Refs != 1 {
+		t.Errorf("refs after releasing the link = %d, want 1", root.Refs)
+	}
+
+	released, err = r.Release(member)
+	if err != nil || len(released) != 2 {
+		t.Fatalf("Release(member) = %+v, %v; want the member and the collection", released, err)
+	}
+	if refs := r.List(); len(refs) != 0 {
+		t.Errorf("registry still holds %+v", refs)
+	}
+	if _, err := r.Release(coll); err == nil {
+		t.Error("released a freed collection")
+	}
+}
+
+func TestRegistryReleaseCascades(t *testing.T) {
+	r := NewRegistry()
+	coll, err := r.AddCollection("test", newTestCollection(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &fakeLink{}
+	lh := r.AddLink(l, 0, "test", coll, "")
+
+	// Dropping the load's reference leaves the collection to the link.
+	if released, err := r.Release(coll); err != nil || len(released) != 0 {
+		t.Fatalf("Release(collection) = %+v, %v", released, err)
+	}
+	released, err := r.Release(lh)
+	if err != nil || len(released) != 3 {
+		t.Errorf("Release(link) = %+v, %v; want the link, collection and map", released, err)
+	}
+	if l.closed != 1 || len(r.List()) != 0 {
+		t.Errorf("link closed %d times, registry holds %+v", l.closed, r.List())
+	}
+}
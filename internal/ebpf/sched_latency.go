@@ -0,0 +1,824 @@
+package ebpf
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/link"
+	"github.com/cilium/ebpf/rlimit"
+	"github.com/sameehj/ebpf-mcp/pkg/types"
+)
+
+const (
+	defaultSchedDuration = 5 * time.Second
+	defaultSchedTop      = 20
+	maxSchedTop          = 200
+	defaultOffCPUStacks  = 50
+	// schedTrackedTasks bounds the tasks waiting to run, blocked or
+	// filtered at once, and the tasks with a histogram.
+	schedTrackedTasks = 65536
+	schedTaskSlots    = 4 * schedTrackedTasks
+
+	// schedRunnableMask selects the sleeping states of sched_switch's
+	// prev_state. A task switched out with none of them set is still
+	// runnable: it yielded or was preempted.
+	schedRunnableMask = 0xff
+)
+
+// offCPUStart is what is recorded when a task blocks: when, and the key
+// its time off the CPU is counted by.
+var offCPUStart = newStruct("off_cpu_start",
+	structField{"ts", btfU64},
+	structField{"key", profileKey},
+)
+
+// offCPUTime is the value of the off-CPU map.
+var offCPUTime = newStruct("off_cpu_time",
+	structField{"total_ns", btfU64},
+	structField{"count", btfU64},
+)
+
+type SchedLatencyArgs struct {
+	DurationMs int    `json:"duration_ms,omitempty"`
+	Pids       []int  `json:"pids,omitempty"`
+	Unit       string `json:"unit,omitempty"`
+	Top        int    `json:"top,omitempty"`
+	OffCPU     bool   `json:"off_cpu,omitempty"`
+	MaxStacks  int    `json:"max_stacks,omitempty"`
+}
+
+type SchedLatencyResult struct {
+	Success     bool                   `json:"success"`
+	ToolVersion string                 `json:"tool_version"`
+	Status      string                 `json:"status"`
+	Unit        string                 `json:"unit,omitempty"`
+	RunQueue    LatencySummary         `json:"run_queue"`
+	PerCPU      []CPULatency           `json:"per_cpu"`
+	PerProcess  []ProcessLatency       `json:"per_process"`
+	OffCPU      []OffCPUStack          `json:"off_cpu,omitempty"`
+	Stats       map[string]interface{} `json:"stats"`
+	Complete    bool                   `json:"complete"`
+	Warnings    []string               `json:"warnings,omitempty"`
+	Error       string                 `json:"error,omitempty"`
+}
+
+// LatencySummary is a log2 latency histogram with the percentiles
+// estimated from it.
+type LatencySummary struct {
+	Count     uint64          `json:"count"`
+	P50       float64         `json:"p50"`
+	P90       float64         `json:"p90"`
+	P99       float64         `json:"p99"`
+	Histogram []LatencyBucket `json:"histogram"`
+}
+
+type CPULatency struct {
+	CPU int `json:"cpu"`
+	LatencySummary
+}
+
+type ProcessLatency struct {
+	Pid  uint32 `json:"pid"`
+	Comm string `json:"comm,omitempty"`
+	LatencySummary
+}
+
+// OffCPUStack is a folded stack tasks blocked in, with how often and for
+// how long in total.
+type OffCPUStack struct {
+	Stack string  `json:"stack"`
+	Count uint64  `json:"count"`
+	Total float64 `json:"total"`
+}
+
+func ParseSchedLatencyArgs(input map[string]interface{}) (*SchedLatencyArgs, error) {
+	var args SchedLatencyArgs
+	if input == nil {
+		return &args, nil
+	}
+	if err := types.StrictUnmarshal(input, &args); err != nil {
+		return nil, fmt.Errorf("failed to parse sched latency args: %w", err)
+	}
+	return &args, nil
+}
+
+func schedLatencyFailure(err error) (*SchedLatencyResult, error) {
+	return &SchedLatencyResult{
+		Success:     false,
+		ToolVersion: "v1",
+		Status:      "failed",
+		Error:       err.Error(),
+	}, err
+}
+
+// RunSchedLatency measures how long tasks wait on a run queue between
+// being woken and running, for the requested duration or until ctx is
+// cancelled, per CPU and per process. With OffCPU it also sums the time
+// tasks spend blocked by the stack they blocked in.
+func RunSchedLatency(ctx context.Context, args *SchedLatencyArgs) (*SchedLatencyResult, error) {
+	if args == nil {
+		return schedLatencyFailure(errors.New("args cannot be nil"))
+	}
+
+	duration := time.Duration(args.DurationMs) * time.Millisecond
+	if duration == 0 {
+		duration = defaultSchedDuration
+	}
+	if duration < 0 || duration > maxTraceDuration {
+		return schedLatencyFailure(fmt.Errorf("duration_ms must be between 1 and %d", maxTraceDuration.Milliseconds()))
+	}
+	unit := args.Unit
+	if unit == "" {
+		unit = "us"
+	}
+	divisor, ok := latencyUnits[unit]
+	if !ok {
+		return schedLatencyFailure(fmt.Errorf("unknown unit %q (expected ns, us or ms)", unit))
+	}
+	top := args.Top
+	if top == 0 {
+		top = defaultSchedTop
+	}
+	if top < 0 || top > maxSchedTop {
+		return schedLatencyFailure(fmt.Errorf("top must be between 1 and %d", maxSchedTop))
+	}
+	maxStacks := args.MaxStacks
+	if maxStacks == 0 {
+		maxStacks = defaultOffCPUStacks
+	}
+	if maxStacks < 0 || maxStacks > maxProfileStacks {
+		return schedLatencyFailure(fmt.Errorf("max_stacks must be between 1 and %d", maxProfileStacks))
+	}
+	if len(args.Pids) > maxTracePids {
+		return schedLatencyFailure(fmt.Errorf("at most %d pids can be traced", maxTracePids))
+	}
+	// The filter is by thread, so it starts with the threads of the
+	// processes; threads and children they create are added as they are
+	// woken for the first time.
+	var tids []uint32
+	for _, pid := range args.Pids {
+		if pid <= 0 {
+			return schedLatencyFailure(fmt.Errorf("invalid pid %d", pid))
+		}
+		threads, err := processThreads(pid)
+		if err != nil {
+			return schedLatencyFailure(fmt.Errorf("process %d: %w", pid, err))
+		}
+		tids = append(tids, threads...)
+	}
+
+	cpus, err := onlineCPUs()
+	if err != nil {
+		return schedLatencyFailure(err)
+	}
+
+	if err := rlimit.RemoveMemlock(); err != nil {
+		return schedLatencyFailure(fmt.Errorf("rlimit error: %v", err))
+	}
+
+	spec, err := schedLatencySpec(len(args.Pids) > 0, args.OffCPU, divisor, cpus[len(cpus)-1]+1)
+	if err != nil {
+		return schedLatencyFailure(err)
+	}
+	coll, err := ebpf.NewCollection(spec)
+	if err != nil {
+		return schedLatencyFailure(fmt.Errorf("failed to load programs: %v", err))
+	}
+	defer coll.Close()
+	for _, tid := range tids {
+		if err := coll.Maps["tids"].Put(tid, uint8(1)); err != nil {
+			return schedLatencyFailure(fmt.Errorf("failed to add thread %d to filter: %v", tid, err))
+		}
+	}
+
+	// sched_switch is attached last so the first switches already see the
+	// wakeups that precede them.
+	for _, h := range []struct{ name, prog string }{
+		{"sched_wakeup", "sched_wakeup"},
+		{"sched_wakeup_new", "sched_wakeup_new"},
+		{"sched_switch", "sched_switch"},
+	} {
+		tp, err := link.Tracepoint("sched", h.name, coll.Programs[h.prog], nil)
+		if err != nil {
+			return schedLatencyFailure(fmt.Errorf("tracepoint sched:%s attach failed: %v", h.name, err))
+		}
+		defer tp.Close()
+	}
+
+	start := time.Now()
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return schedLatencyFailure(fmt.Errorf("trace cancelled: %w", ctx.Err()))
+	}
+	elapsed := time.Since(start)
+
+	var key struct{ ID, Slot uint32 }
+	var count uint64
+
+	overall := make([]uint64, latencySlots)
+	perCPU := make(map[uint32][]uint64)
+	iter := coll.Maps["cpu_hist"].Iterate()
+	for iter.Next(&key, &count) {
+		if key.Slot >= latencySlots {
+			continue
+		}
+		if perCPU[key.ID] == nil {
+			perCPU[key.ID] = make([]uint64, latencySlots)
+		}
+		perCPU[key.ID][key.Slot] += count
+		overall[key.Slot] += count
+	}
+	if err := iter.Err(); err != nil {
+		return schedLatencyFailure(fmt.Errorf("read cpu histograms: %w", err))
+	}
+
+	comms := make(map[uint32]string)
+	var comm [taskCommLen]byte
+	var tid uint32
+	iter = coll.Maps["comms"].Iterate()
+	for iter.Next(&tid, &comm) {
+		comms[tid] = strings.TrimRight(string(comm[:]), "\x00")
+	}
+	if err := iter.Err(); err != nil {
+		return schedLatencyFailure(fmt.Errorf("read commands: %w", err))
+	}
+
+	// Threads are grouped into their process while it is still around;
+	// threads that exited are reported on their own.
+	tgids := make(map[uint32]uint32)
+	perProcess := make(map[uint32][]uint64)
+	var taskSlots, exited int
+	iter = coll.Maps["task_hist"].Iterate()
+	for iter.Next(&key, &count) {
+		taskSlots++
+		if key.Slot >= latencySlots {
+			continue
+		}
+		tgid, ok := tgids[key.ID]
+		if !ok {
+			var err error
+			if tgid, err = threadGroup(key.ID); err != nil {
+				tgid = key.ID
+				exited++
+			}
+			tgids[key.ID] = tgid
+		}
+		if perProcess[tgid] == nil {
+			perProcess[tgid] = make([]uint64, latencySlots)
+		}
+		perProcess[tgid][key.Slot] += count
+	}
+	if err := iter.Err(); err != nil {
+		return schedLatencyFailure(fmt.Errorf("read task histograms: %w", err))
+	}
+
+	var totalNs uint64
+	if err := coll.Maps["total"].Lookup(uint32(0), &totalNs); err != nil {
+		return schedLatencyFailure(fmt.Errorf("read total: %w", err))
+	}
+	waiting := 0
+	var value uint64
+	iter = coll.Maps["start"].Iterate()
+	for iter.Next(&tid, &value) {
+		waiting++
+	}
+
+	result := &SchedLatencyResult{
+		Success:     true,
+		ToolVersion: "v1",
+		Unit:        unit,
+		RunQueue:    latencySummary(overall),
+		PerCPU:      []CPULatency{},
+		PerProcess:  []ProcessLatency{},
+	}
+	for _, cpu := range cpus {
+		counts := perCPU[uint32(cpu)]
+		if counts == nil {
+			counts = make([]uint64, latencySlots)
+		}
+		result.PerCPU = append(result.PerCPU, CPULatency{CPU: cpu, LatencySummary: latencySummary(counts)})
+	}
+	for tgid, counts := range perProcess {
+		p := ProcessLatency{Pid: tgid, Comm: comms[tgid], LatencySummary: latencySummary(counts)}
+		if p.Comm == "" {
+			p.Comm = processComm(tgid)
+		}
+		result.PerProcess = append(result.PerProcess, p)
+	}
+	sort.Slice(result.PerProcess, func(i, j int) bool {
+		a, b := result.PerProcess[i], result.PerProcess[j]
+		if a.P99 != b.P99 {
+			return a.P99 > b.P99
+		}
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.Pid < b.Pid
+	})
+	processes := len(result.PerProcess)
+	if processes > top {
+		result.PerProcess = result.PerProcess[:top]
+	}
+
+	result.Stats = map[string]interface{}{
+		"duration_ms":        elapsed.Milliseconds(),
+		"cpus":               len(cpus),
+		"wakeups_per_second": rate(int(result.RunQueue.Count), elapsed.Seconds()),
+		"processes":          processes,
+		"waiting":            waiting,
+	}
+	if result.RunQueue.Count > 0 {
+		result.Stats["avg"] = float64(totalNs) / float64(result.RunQueue.Count) / float64(divisor)
+	}
+
+	if args.OffCPU {
+		stacks, blocked, err := offCPUStacks(coll, divisor)
+		if err != nil {
+			return schedLatencyFailure(err)
+		}
+		result.OffCPU = stacks
+		result.Stats["off_cpu_stacks"] = len(stacks)
+		result.Stats["blocked"] = blocked
+		if len(result.OffCPU) > maxStacks {
+			result.Warnings = append(result.Warnings,
+				fmt.Sprintf("showing the %d longest of %d off-CPU stacks", maxStacks, len(result.OffCPU)))
+			result.OffCPU = result.OffCPU[:maxStacks]
+		}
+	}
+
+	if waiting > 0 {
+		result.Warnings = append(result.Warnings,
+			fmt.Sprintf("tasks still waiting to run when the trace ended are not counted: %d", waiting))
+	}
+	if exited > 0 {
+		result.Warnings = append(result.Warnings,
+			fmt.Sprintf("%d threads exited during the trace and are reported by thread ID", exited))
+	}
+	if taskSlots >= schedTaskSlots {
+		result.Warnings = append(result.Warnings, "the per-task histogram map was full: some processes are missing or undercounted")
+	}
+	result.Complete = true
+	result.Status = fmt.Sprintf("Measured %d run queue waits on %d CPUs for %dms", result.RunQueue.Count, len(cpus), elapsed.Milliseconds())
+	return result, nil
+}
+
+// offCPUStacks folds the off-CPU map, longest total first, and counts the
+// tasks still blocked.
+func offCPUStacks(coll *ebpf.Collection, divisor int32) ([]OffCPUStack, int, error) {
+	symbols, err := newStackSymbolizer(coll.Maps["stacks"])
+	if err != nil {
+		return nil, 0, err
+	}
+
+	type offCPU struct{ count, totalNs uint64 }
+	folded := make(map[string]*offCPU)
+	var key struct {
+		Comm        [taskCommLen]byte
+		Pid         uint32
+		KernelStack int32
+		UserStack   int32
+	}
+	var value struct{ TotalNs, Count uint64 }
+	iter := coll.Maps["off_cpu"].Iterate()
+	for iter.Next(&key, &value) {
+		stack := symbols.stack(key.Pid, key.KernelStack, key.UserStack)
+		s := foldStack(strings.TrimRight(string(key.Comm[:]), "\x00"), stack)
+		if folded[s] == nil {
+			folded[s] = &offCPU{}
+		}
+		folded[s].count += value.Count
+		folded[s].totalNs += value.TotalNs
+	}
+	if err := iter.Err(); err != nil {
+		return nil, 0, fmt.Errorf("read off-CPU stacks: %w", err)
+	}
+
+	blocked := 0
+	var tid uint32
+	start := make([]byte, offCPUStart.Size)
+	iter = coll.Maps["off_start"].Iterate()
+	for iter.Next(&tid, &start) {
+		blocked++
+	}
+
+	stacks := []OffCPUStack{}
+	for s, t := range folded {
+		stacks = append(stacks, OffCPUStack{Stack: s, Count: t.count, Total: float64(t.totalNs) / float64(divisor)})
+	}
+	sort.Slice(stacks, func(i, j int) bool {
+		a, b := stacks[i], stacks[j]
+		return a.Total > b.Total || (a.Total == b.Total && a.Stack < b.Stack)
+	})
+	return stacks, blocked, nil
+}
+
+func latencySummary(counts []uint64) LatencySummary {
+	s := LatencySummary{Histogram: latencyHistogram(counts)}
+	for _, c := range counts {
+		s.Count += c
+	}
+	if s.Count > 0 {
+		s.P50 = histogramPercentile(counts, s.Count, 0.50)
+		s.P90 = histogramPercentile(counts, s.Count, 0.90)
+		s.P99 = histogramPercentile(counts, s.Count, 0.99)
+	}
+	return s
+}
+
+// processThreads lists the thread IDs of a process.
+func processThreads(pid int) ([]uint32, error) {
+	entries, err := os.ReadDir(fmt.Sprintf("/proc/%d/task", pid))
+	if err != nil {
+		return nil, err
+	}
+	var tids []uint32
+	for _, e := range entries {
+		if tid, err := strconv.ParseUint(e.Name(), 10, 32); err == nil {
+			tids = append(tids, uint32(tid))
+		}
+	}
+	return tids, nil
+}
+
+// threadGroup returns the process a thread belongs to.
+func threadGroup(tid uint32) (uint32, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", tid))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), "Tgid:"); ok {
+			tgid, err := strconv.ParseUint(strings.TrimSpace(value), 10, 32)
+			return uint32(tgid), err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("no Tgid in /proc/%d/status", tid)
+}
+
+func processComm(pid uint32) string {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// schedLatencySpec assembles the scheduler programs. The wakeup programs
+// record when a task became runnable, and sched_switch records it again
+// for a task switched out while still runnable. When the task is switched
+// in, the wait is counted in the log2 slot of its latency in the requested
+// unit, both for the CPU and for the task. With a filter only threads in
+// tids are recorded. With offCPU, sched_switch also records when and where
+// a task blocks, and adds the time it was blocked to its stack in off_cpu
+// when it is switched back in.
+func schedLatencySpec(filter, offCPU bool, divisor int32, cpus int) (*ebpf.CollectionSpec, error) {
+	wakeup, err := loadTracepointFormat("sched", "sched_wakeup")
+	if err != nil {
+		return nil, err
+	}
+	wakeupPid, err := wakeup.field("pid", 4)
+	if err != nil {
+		return nil, err
+	}
+	wakeupNew, err := loadTracepointFormat("sched", "sched_wakeup_new")
+	if err != nil {
+		return nil, err
+	}
+	wakeupNewPid, err := wakeupNew.field("pid", 4)
+	if err != nil {
+		return nil, err
+	}
+	switchFormat, err := loadTracepointFormat("sched", "sched_switch")
+	if err != nil {
+		return nil, err
+	}
+	sw, err := switchFormat.fieldsOf(map[string]int{
+		"prev_comm":  taskCommLen,
+		"prev_pid":   4,
+		"prev_state": 0,
+		"next_comm":  taskCommLen,
+		"next_pid":   4,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The task's thread ID is kept at -8 as the key of start, tids and
+	// the other per-task maps.
+	filterTask := func(skip string) asm.Instructions {
+		if !filter {
+			return nil
+		}
+		return asm.Instructions{
+			asm.LoadMapPtr(asm.R1, 0).WithReference("tids"),
+			asm.Mov.Reg(asm.R2, asm.RFP),
+			asm.Add.Imm(asm.R2, -8),
+			asm.FnMapLookupElem.Call(),
+			asm.JEq.Imm(asm.R0, 0, skip),
+		}
+	}
+	recordStart := asm.Instructions{
+		asm.FnKtimeGetNs.Call(),
+		asm.StoreMem(asm.RFP, -16, asm.R0, asm.DWord),
+		asm.LoadMapPtr(asm.R1, 0).WithReference("start"),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, -8),
+		asm.Mov.Reg(asm.R3, asm.RFP),
+		asm.Add.Imm(asm.R3, -16),
+		asm.Mov.Imm(asm.R4, int32(ebpf.UpdateAny)),
+		asm.FnMapUpdateElem.Call(),
+	}
+
+	wakeupInsns := asm.Instructions{
+		asm.LoadMem(asm.R1, asm.R1, int16(wakeupPid.Offset), asm.Word),
+		asm.StoreMem(asm.RFP, -8, asm.R1, asm.Word),
+	}
+	wakeupInsns = append(wakeupInsns, filterTask("out")...)
+	wakeupInsns = append(wakeupInsns, recordStart...)
+	wakeupInsns = append(wakeupInsns, programExit()...)
+
+	// A new task is woken by its creator, which it inherits the filter
+	// from.
+	wakeupNewInsns := asm.Instructions{
+		asm.LoadMem(asm.R1, asm.R1, int16(wakeupNewPid.Offset), asm.Word),
+		asm.StoreMem(asm.RFP, -8, asm.R1, asm.Word),
+	}
+	if filter {
+		wakeupNewInsns = append(wakeupNewInsns,
+			asm.FnGetCurrentPidTgid.Call(),
+			asm.StoreMem(asm.RFP, -16, asm.R0, asm.Word),
+			asm.LoadMapPtr(asm.R1, 0).WithReference("tids"),
+			asm.Mov.Reg(asm.R2, asm.RFP),
+			asm.Add.Imm(asm.R2, -16),
+			asm.FnMapLookupElem.Call(),
+			asm.JEq.Imm(asm.R0, 0, "out"),
+			asm.StoreImm(asm.RFP, -24, 1, asm.Byte),
+			asm.LoadMapPtr(asm.R1, 0).WithReference("tids"),
+			asm.Mov.Reg(asm.R2, asm.RFP),
+			asm.Add.Imm(asm.R2, -8),
+			asm.Mov.Reg(asm.R3, asm.RFP),
+			asm.Add.Imm(asm.R3, -24),
+			asm.Mov.Imm(asm.R4, int32(ebpf.UpdateAny)),
+			asm.FnMapUpdateElem.Call(),
+		)
+	}
+	wakeupNewInsns = append(wakeupNewInsns, recordStart...)
+	wakeupNewInsns = append(wakeupNewInsns, programExit()...)
+
+	// The task switched out. The idle task is never tracked.
+	blocked := "next"
+	if offCPU {
+		blocked = "blocked"
+	}
+	switchInsns := asm.Instructions{
+		asm.Mov.Reg(asm.R6, asm.R1),
+		asm.LoadMem(asm.R1, asm.R6, int16(sw["prev_pid"].Offset), asm.Word),
+		asm.StoreMem(asm.RFP, -8, asm.R1, asm.Word),
+		asm.JEq.Imm(asm.R1, 0, "next"),
+	}
+	switchInsns = append(switchInsns, filterTask("next")...)
+	switchInsns = append(switchInsns,
+		asm.LoadMem(asm.R1, asm.R6, int16(sw["prev_state"].Offset), sizeOf(sw["prev_state"].Size)),
+		asm.And.Imm(asm.R1, schedRunnableMask),
+		asm.JNE.Imm(asm.R1, 0, blocked),
+	)
+	switchInsns = append(switchInsns, recordStart...)
+	switchInsns = append(switchInsns, asm.Ja.Label("next"))
+	if offCPU {
+		// The off_cpu_start record is built at -88, and R9 points at the
+		// stack so the context helpers can fill it in.
+		const startOff, keyOff = -88, -88 + 8
+		switchInsns = append(switchInsns,
+			asm.FnKtimeGetNs.Call().WithSymbol("blocked"),
+			asm.StoreMem(asm.RFP, startOff+offsetOf(offCPUStart, "ts"), asm.R0, asm.DWord),
+			// Zero the tail padding, the verifier rejects reads of
+			// uninitialized stack.
+			asm.StoreImm(asm.RFP, startOff+int16(offCPUStart.Size)-4, 0, asm.Word),
+			asm.Mov.Reg(asm.R9, asm.RFP),
+		)
+		switchInsns = append(switchInsns, copyCtxBytes(sw["prev_comm"], keyOff+offsetOf(profileKey, "comm"))...)
+		switchInsns = append(switchInsns,
+			asm.FnGetCurrentPidTgid.Call(),
+			asm.RSh.Imm(asm.R0, 32),
+			asm.StoreMem(asm.RFP, keyOff+offsetOf(profileKey, "pid"), asm.R0, asm.Word),
+		)
+		// The kernel stack skips the tracepoint's own frame.
+		for _, s := range []struct {
+			field string
+			flags int32
+		}{{"kernel_stack", 1}, {"user_stack", bpfFUserStack}} {
+			switchInsns = append(switchInsns,
+				asm.Mov.Reg(asm.R1, asm.R6),
+				asm.LoadMapPtr(asm.R2, 0).WithReference("stacks"),
+				asm.Mov.Imm(asm.R3, s.flags),
+				asm.FnGetStackid.Call(),
+				asm.StoreMem(asm.RFP, keyOff+offsetOf(profileKey, s.field), asm.R0, asm.Word),
+			)
+		}
+		switchInsns = append(switchInsns,
+			asm.LoadMapPtr(asm.R1, 0).WithReference("off_start"),
+			asm.Mov.Reg(asm.R2, asm.RFP),
+			asm.Add.Imm(asm.R2, -8),
+			asm.Mov.Reg(asm.R3, asm.RFP),
+			asm.Add.Imm(asm.R3, startOff),
+			asm.Mov.Imm(asm.R4, int32(ebpf.UpdateAny)),
+			asm.FnMapUpdateElem.Call(),
+		)
+	}
+
+	// The task switched in.
+	notWaiting := "out"
+	if offCPU {
+		notWaiting = "off_cpu"
+	}
+	switchInsns = append(switchInsns,
+		asm.LoadMem(asm.R1, asm.R6, int16(sw["next_pid"].Offset), asm.Word).WithSymbol("next"),
+		asm.StoreMem(asm.RFP, -8, asm.R1, asm.Word),
+		asm.LoadMapPtr(asm.R1, 0).WithReference("start"),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, -8),
+		asm.FnMapLookupElem.Call(),
+		asm.JEq.Imm(asm.R0, 0, notWaiting),
+		asm.LoadMem(asm.R7, asm.R0, 0, asm.DWord),
+		asm.FnKtimeGetNs.Call(),
+		asm.Sub.Reg(asm.R0, asm.R7),
+		asm.Mov.Reg(asm.R7, asm.R0),
+
+		asm.StoreImm(asm.RFP, -16, 0, asm.Word),
+		asm.LoadMapPtr(asm.R1, 0).WithReference("total"),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, -16),
+		asm.FnMapLookupElem.Call(),
+		asm.JEq.Imm(asm.R0, 0, "forget"),
+		asm.StoreXAdd(asm.R0, asm.R7, asm.DWord),
+		asm.Div.Imm(asm.R7, divisor),
+	)
+	switchInsns = append(switchInsns, log2Slot(asm.R8, asm.R7, "log2")...)
+	switchInsns = append(switchInsns, histogramIncrement("cpu_hist", asm.Instructions{
+		asm.FnGetSmpProcessorId.Call(),
+		asm.Mov.Reg(asm.R1, asm.R0),
+	}, "task_slot")...)
+	switchInsns = append(switchInsns, histogramIncrement("task_hist", asm.Instructions{
+		asm.LoadMem(asm.R1, asm.RFP, -8, asm.Word).WithSymbol("task_slot"),
+	}, "comm")...)
+	switchInsns = append(switchInsns, asm.Mov.Reg(asm.R9, asm.RFP).WithSymbol("comm"))
+	switchInsns = append(switchInsns, copyCtxBytes(sw["next_comm"], -56)...)
+	switchInsns = append(switchInsns,
+		asm.LoadMapPtr(asm.R1, 0).WithReference("comms"),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, -8),
+		asm.Mov.Reg(asm.R3, asm.RFP),
+		asm.Add.Imm(asm.R3, -56),
+		asm.Mov.Imm(asm.R4, int32(ebpf.UpdateAny)),
+		asm.FnMapUpdateElem.Call(),
+		asm.LoadMapPtr(asm.R1, 0).WithReference("start").WithSymbol("forget"),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, -8),
+		asm.FnMapDeleteElem.Call(),
+	)
+	if offCPU {
+		// The key of off_cpu is read straight from the off_start value.
+		keyOff := int32(offsetOf(offCPUStart, "key"))
+		switchInsns = append(switchInsns,
+			asm.LoadMapPtr(asm.R1, 0).WithReference("off_start").WithSymbol("off_cpu"),
+			asm.Mov.Reg(asm.R2, asm.RFP),
+			asm.Add.Imm(asm.R2, -8),
+			asm.FnMapLookupElem.Call(),
+			asm.JEq.Imm(asm.R0, 0, "out"),
+			asm.Mov.Reg(asm.R7, asm.R0),
+			asm.FnKtimeGetNs.Call(),
+			asm.LoadMem(asm.R1, asm.R7, offsetOf(offCPUStart, "ts"), asm.DWord),
+			asm.Sub.Reg(asm.R0, asm.R1),
+			asm.Mov.Reg(asm.R8, asm.R0),
+
+			asm.LoadMapPtr(asm.R1, 0).WithReference("off_cpu"),
+			asm.Mov.Reg(asm.R2, asm.R7),
+			asm.Add.Imm(asm.R2, keyOff),
+			asm.FnMapLookupElem.Call(),
+			asm.JEq.Imm(asm.R0, 0, "new_stack"),
+			asm.StoreXAdd(asm.R0, asm.R8, asm.DWord),
+			asm.Mov.Imm(asm.R1, 1),
+			asm.Mov.Reg(asm.R2, asm.R0),
+			asm.Add.Imm(asm.R2, int32(offsetOf(offCPUTime, "count"))),
+			asm.StoreXAdd(asm.R2, asm.R1, asm.DWord),
+			asm.Ja.Label("unblocked"),
+			asm.StoreMem(asm.RFP, -104+offsetOf(offCPUTime, "total_ns"), asm.R8, asm.DWord).WithSymbol("new_stack"),
+			asm.StoreImm(asm.RFP, -104+offsetOf(offCPUTime, "count"), 1, asm.DWord),
+			asm.LoadMapPtr(asm.R1, 0).WithReference("off_cpu"),
+			asm.Mov.Reg(asm.R2, asm.R7),
+			asm.Add.Imm(asm.R2, keyOff),
+			asm.Mov.Reg(asm.R3, asm.RFP),
+			asm.Add.Imm(asm.R3, -104),
+			asm.Mov.Imm(asm.R4, int32(ebpf.UpdateNoExist)),
+			asm.FnMapUpdateElem.Call(),
+
+			asm.LoadMapPtr(asm.R1, 0).WithReference("off_start").WithSymbol("unblocked"),
+			asm.Mov.Reg(asm.R2, asm.RFP),
+			asm.Add.Imm(asm.R2, -8),
+			asm.FnMapDeleteElem.Call(),
+		)
+	}
+	switchInsns = append(switchInsns, programExit()...)
+
+	spec := &ebpf.CollectionSpec{
+		Maps: map[string]*ebpf.MapSpec{
+			"start": {
+				Name:       "sched_start",
+				Type:       ebpf.Hash,
+				KeySize:    4,
+				ValueSize:  8,
+				MaxEntries: schedTrackedTasks,
+			},
+			"total": {
+				Name:       "sched_total",
+				Type:       ebpf.Array,
+				KeySize:    4,
+				ValueSize:  8,
+				MaxEntries: 1,
+			},
+			"cpu_hist": {
+				Name:       "sched_cpu_hist",
+				Type:       ebpf.Hash,
+				KeySize:    latencySlot.Size,
+				ValueSize:  8,
+				MaxEntries: uint32(cpus * latencySlots),
+				Key:        latencySlot,
+				Value:      btfU64,
+			},
+			"task_hist": {
+				Name:       "sched_task_hist",
+				Type:       ebpf.Hash,
+				KeySize:    latencySlot.Size,
+				ValueSize:  8,
+				MaxEntries: schedTaskSlots,
+				Key:        latencySlot,
+				Value:      btfU64,
+			},
+			"comms": {
+				Name:       "sched_comms",
+				Type:       ebpf.Hash,
+				KeySize:    4,
+				ValueSize:  taskCommLen,
+				MaxEntries: schedTrackedTasks,
+			},
+		},
+		Programs: map[string]*ebpf.ProgramSpec{
+			"sched_wakeup":     tracepointProgram("sched_wakeup", wakeupInsns),
+			"sched_wakeup_new": tracepointProgram("sched_wakeup_new", wakeupNewInsns),
+			"sched_switch":     tracepointProgram("sched_switch", switchInsns),
+		},
+	}
+	if filter {
+		spec.Maps["tids"] = &ebpf.MapSpec{
+			Name:       "sched_tids",
+			Type:       ebpf.Hash,
+			KeySize:    4,
+			ValueSize:  1,
+			MaxEntries: schedTrackedTasks,
+		}
+	}
+	if offCPU {
+		spec.Maps["off_start"] = &ebpf.MapSpec{
+			Name:       "sched_off_start",
+			Type:       ebpf.Hash,
+			KeySize:    4,
+			ValueSize:  offCPUStart.Size,
+			MaxEntries: schedTrackedTasks,
+			Value:      offCPUStart,
+		}
+		spec.Maps["off_cpu"] = &ebpf.MapSpec{
+			Name:       "sched_off_cpu",
+			Type:       ebpf.Hash,
+			KeySize:    profileKey.Size,
+			ValueSize:  offCPUTime.Size,
+			MaxEntries: profileStackEntries,
+			Key:        profileKey,
+			Value:      offCPUTime,
+		}
+		spec.Maps["stacks"] = &ebpf.MapSpec{
+			Name:       "sched_stacks",
+			Type:       ebpf.StackTrace,
+			KeySize:    4,
+			ValueSize:  8 * profileMaxDepth,
+			MaxEntries: profileStackEntries,
+		}
+	}
+	return spec, nil
+}
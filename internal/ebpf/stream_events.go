@@ -1,25 +1,25 @@
 package ebpf
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"os"
 	"time"
 
 	"github.com/sameehj/ebpf-mcp/pkg/types"
 )
 
 type StreamEventsArgs struct {
-	Source struct {
-		ProgramID int    `json:"program_id,omitempty"`
-		LinkID    int    `json:"link_id,omitempty"`
-		MapID     int    `json:"map_id,omitempty"`
-		Type      string `json:"type,omitempty"`
-	} `json:"source"`
+	Source     StreamSource           `json:"source"`
 	Duration   int                    `json:"duration,omitempty"`    // seconds
 	DurationMs int                    `json:"duration_ms,omitempty"` // milliseconds
 	MaxEvents  int                    `json:"max_events,omitempty"`
 	Filters    map[string]interface{} `json:"filters,omitempty"`
+	Filter     string                 `json:"filter,omitempty"`
 	Format     string                 `json:"format,omitempty"`
+	StructType string                 `json:"struct_type,omitempty"`
+	Aggregate  *AggregateArgs         `json:"aggregate,omitempty"`
 }
 
 type StreamEventsResult struct {
@@ -41,7 +41,11 @@ func ParseStreamEventsArgs(input map[string]interface{}) (*StreamEventsArgs, err
 	return &args, nil
 }
 
-func StreamEvents(args *StreamEventsArgs, emit func(any)) error {
+// StreamEvents reads events until the duration passes, max_events have
+// been emitted or ctx is cancelled. The reader and event map are released
+// on return. With args.Aggregate set, events are summarised per window
+// instead of emitted, and max_events only applies when given.
+func StreamEvents(ctx context.Context, args *StreamEventsArgs, emit func(any)) error {
 	// Validate inputs
 	if args == nil {
 		return errors.New("args cannot be nil")
@@ -50,38 +54,6 @@ func StreamEvents(args *StreamEventsArgs, emit func(any)) error {
 		return errors.New("emit function cannot be nil")
 	}
 
-	// Set default type if not provided
-	sourceType := args.Source.Type
-	if sourceType == "" {
-		sourceType = "ringbuf" // default
-	}
-
-	// Validate type
-	if sourceType != "ringbuf" && sourceType != "perfbuf" {
-		return fmt.Errorf("unsupported map type: %s", sourceType)
-	}
-
-	// Determine the source
-	var mapID int
-	var sourceDesc string
-
-	if args.Source.MapID != 0 {
-		mapID = args.Source.MapID
-		sourceDesc = fmt.Sprintf("map %d", mapID)
-	} else if args.Source.ProgramID != 0 {
-		// For now, use the program ID as map ID
-		// (in real implementation, you'd look up the actual map)
-		mapID = args.Source.ProgramID
-		sourceDesc = fmt.Sprintf("program %d", args.Source.ProgramID)
-	} else if args.Source.LinkID != 0 {
-		// For now, use the link ID as map ID
-		// (in real implementation, you'd look up the actual map)
-		mapID = args.Source.LinkID
-		sourceDesc = fmt.Sprintf("link %d", args.Source.LinkID)
-	} else {
-		return errors.New("must specify program_id, link_id, or map_id in source")
-	}
-
 	// Set duration (prefer duration_ms, fall back to duration * 1000)
 	durationMs := args.DurationMs
 	if durationMs == 0 && args.Duration > 0 {
@@ -93,7 +65,7 @@ func StreamEvents(args *StreamEventsArgs, emit func(any)) error {
 
 	// Set max events
 	maxEvents := args.MaxEvents
-	if maxEvents == 0 {
+	if maxEvents == 0 && args.Aggregate == nil {
 		maxEvents = 100 // default
 	}
 
@@ -108,62 +80,126 @@ func StreamEvents(args *StreamEventsArgs, emit func(any)) error {
 		return fmt.Errorf("unsupported format: %s", format)
 	}
 
+	// Aggregation needs decoded records whatever the output format.
+	streamFormat := format
+	if args.Aggregate != nil {
+		streamFormat = "json"
+	}
+
+	stream, err := openEventStream(args.Source, streamFormat, args.StructType, args.Filter, args.Filters)
+	if err != nil {
+		return err
+	}
+	defer stream.close()
+
+	duration := time.Duration(durationMs) * time.Millisecond
+	var agg *eventAggregator
+	if args.Aggregate != nil {
+		agg, err = newEventAggregator(args.Aggregate, stream.decoder.typ, duration)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Cancellation interrupts a blocked Read by closing the reader.
+	stop := context.AfterFunc(ctx, func() { stream.rd.Close() })
+	defer stop()
+
 	// Initialize session
 	sessionID := fmt.Sprintf("stream-session-%d", time.Now().Unix())
 
-	// Start streaming simulation
 	start := time.Now()
-	eventsGenerated := 0
+	deadline := start.Add(duration)
+	stream.rd.SetDeadline(deadline)
+	if agg != nil {
+		agg.start(start)
+		stream.rd.SetDeadline(earliest(agg.windowEnd(), deadline))
+	}
 
-	// Emit initial status
-	emit(map[string]interface{}{
+	status := map[string]interface{}{
 		"type":       "status",
-		"message":    fmt.Sprintf("Starting event stream from %s for %dms", sourceDesc, durationMs),
+		"message":    fmt.Sprintf("Starting event stream from %s for %dms", stream.src.desc, durationMs),
 		"session_id": sessionID,
 		"format":     format,
-	})
-
-	// Generate events over the duration
-	eventInterval := time.Duration(durationMs) * time.Millisecond / time.Duration(maxEvents)
-	if eventInterval < time.Millisecond {
-		eventInterval = time.Millisecond
+		"map_id":     stream.src.om.id,
+		"map_type":   stream.src.kind,
+	}
+	if name := stream.structType(); name != "" {
+		status["struct_type"] = name
+	} else if format == "json" {
+		status["message"] = status["message"].(string) + "; no BTF type for records, pass struct_type to decode them"
+	}
+	emit(status)
+
+	var received int
+	var windows []map[string]interface{}
+	// flush closes the current window, keeping it unless it saw no events.
+	flush := func(end time.Time) {
+		window := agg.flush(end)
+		emit(window)
+		if window["events"].(int) > 0 {
+			windows = append(windows, window)
+		}
+		stream.rd.SetDeadline(earliest(agg.windowEnd(), deadline))
 	}
 
-	ticker := time.NewTicker(eventInterval)
-	defer ticker.Stop()
-
-	timeout := time.After(time.Duration(durationMs) * time.Millisecond)
-
-eventLoop:
-	for eventsGenerated < maxEvents {
-		select {
-		case <-timeout:
-			break eventLoop
-		case <-ticker.C:
-			// Generate a mock event
-			event := generateMockEvent(eventsGenerated, mapID, format)
-
-			// Apply filters if any
-			if shouldIncludeEvent(event, args.Filters) {
-				emit(map[string]interface{}{
-					"type":  "event",
-					"event": event,
-				})
-				eventsGenerated++
+	for maxEvents == 0 || received < maxEvents {
+		event, err := stream.next()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			// Readers may wake up to a millisecond early, so go by the
+			// window rather than the clock.
+			if agg != nil && agg.windowEnd().Before(deadline) {
+				flush(agg.windowEnd())
+				continue
 			}
+			break
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("stream from %s cancelled: %w", stream.src.desc, ctx.Err())
+		}
+		if err != nil {
+			return err
+		}
+		if event == nil {
+			continue
 		}
+		if agg != nil {
+			// Busy readers may not hit the window deadline.
+			for !time.Now().Before(agg.windowEnd()) {
+				flush(agg.windowEnd())
+			}
+			agg.add(event)
+			received++
+			continue
+		}
+		emit(map[string]interface{}{
+			"type":  "event",
+			"event": event,
+		})
+		received++
 	}
 
 	// Calculate final stats
 	actualDuration := time.Since(start).Milliseconds()
+	eventsPerSecond := 0.0
+	if actualDuration > 0 {
+		eventsPerSecond = float64(received) / (float64(actualDuration) / 1000.0)
+	}
 	stats := map[string]interface{}{
-		"events_received":   eventsGenerated,
-		"events_dropped":    0,
+		"events_received":   received,
+		"events_dropped":    stream.dropped,
+		"events_filtered":   stream.filtered,
 		"duration_ms":       actualDuration,
-		"events_per_second": float64(eventsGenerated) / (float64(actualDuration) / 1000.0),
-		"source":            sourceDesc,
+		"events_per_second": eventsPerSecond,
+		"source":            stream.src.desc,
 		"format":            format,
 	}
+	if agg != nil {
+		if agg.events > 0 || agg.windows == 0 {
+			flush(earliest(time.Now(), deadline))
+		}
+		stats["windows"] = agg.windows
+	}
 
 	// Emit final result
 	result := map[string]interface{}{
@@ -172,43 +208,24 @@ eventLoop:
 		"session_id":   sessionID,
 		"stats":        stats,
 		"complete":     true,
-		"message":      fmt.Sprintf("Stream completed: %d events in %dms", eventsGenerated, actualDuration),
-	}
-
-	emit(result)
-	return nil
-}
-
-func generateMockEvent(index, mapID int, format string) map[string]interface{} {
-	timestamp := time.Now().UnixNano()
-
-	baseEvent := map[string]interface{}{
-		"timestamp_ns": timestamp,
-		"cpu":          index % 4,
-		"pid":          1000 + index,
-		"tid":          1000 + index,
-		"comm":         fmt.Sprintf("task-%d", index),
-		"map_id":       mapID,
-		"index":        index,
+		"message":      fmt.Sprintf("Stream completed: %d events in %dms", received, actualDuration),
 	}
-
-	switch format {
-	case "json":
-		baseEvent["data"] = map[string]interface{}{
-			"syscall":   "execve",
-			"args":      []string{"/bin/ls", "-la"},
-			"exit_code": 0,
-			"message":   fmt.Sprintf("kprobe event %d from map %d", index, mapID),
+	if agg != nil {
+		if windows == nil {
+			windows = []map[string]interface{}{}
+		}
+		result["aggregation"] = map[string]interface{}{
+			"group_by":  agg.groupNames,
+			"fields":    agg.fieldNames,
+			"window_ms": agg.window.Milliseconds(),
+			"windows":   windows,
 		}
-	case "raw":
-		baseEvent["raw_data"] = fmt.Sprintf("raw_event_%d_map_%d_ts_%d", index, mapID, timestamp)
-	case "base64":
-		// Simulate base64 encoded data
-		data := fmt.Sprintf("event_%d_map_%d", index, mapID)
-		baseEvent["data_base64"] = data // In real implementation, this would be base64 encoded
+		result["message"] = fmt.Sprintf("Stream completed: %d events aggregated over %d windows in %dms",
+			received, agg.windows, actualDuration)
 	}
 
-	return baseEvent
+	emit(result)
+	return nil
 }
 
 func shouldIncludeEvent(event map[string]interface{}, filters map[string]interface{}) bool {
@@ -216,31 +233,15 @@ func shouldIncludeEvent(event map[string]interface{}, filters map[string]interfa
 		return true
 	}
 
-	// Apply event type filter
-	if eventTypes, ok := filters["event_types"].([]interface{}); ok {
-		if len(eventTypes) > 0 {
-			// For mock events, we'll assume they're all "kprobe" type
-			hasKprobe := false
-			for _, et := range eventTypes {
-				if et == "kprobe" {
-					hasKprobe = true
-					break
-				}
-			}
-			if !hasKprobe {
-				return false
-			}
-		}
-	}
-
-	// Apply PID filter
+	// Apply PID filter. PIDs arrive from JSON as float64 and events carry
+	// them in their decoded data.
 	if targetPids, ok := filters["target_pids"].([]interface{}); ok {
 		if len(targetPids) > 0 {
-			eventPid, hasPid := event["pid"].(int)
+			eventPid, hasPid := eventField(event, "pid")
 			if hasPid {
 				pidMatch := false
 				for _, pid := range targetPids {
-					if pidInt, ok := pid.(int); ok && pidInt == eventPid {
+					if c, ok := compareValues(eventPid, pid); ok && c == 0 {
 						pidMatch = true
 						break
 					}
@@ -264,3 +265,22 @@ func shouldIncludeEvent(event map[string]interface{}, filters map[string]interfa
 	// Apply max events filter (handled in main loop)
 	return true
 }
+
+// eventField looks a field up in an event's decoded data, then in the event
+// itself.
+func eventField(event map[string]interface{}, name string) (interface{}, bool) {
+	if data, ok := event["data"].(map[string]interface{}); ok {
+		if v, ok := data[name]; ok {
+			return v, true
+		}
+	}
+	v, ok := event[name]
+	return v, ok
+}
+
+func earliest(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,472 @@
+// internal/ebpf/stream_sessions.go
+package ebpf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sameehj/ebpf-mcp/pkg/types"
+)
+
+const (
+	defaultSessionBuffer = 1000
+	maxSessionBuffer     = 100000
+	maxStreamSessions    = 16
+	defaultPollEvents    = 100
+	maxPollWait          = 30 * time.Second
+	// endedSessionTTL is how long the events of a session that ended on
+	// its own stay available to polls when it is never stopped.
+	endedSessionTTL = 10 * time.Minute
+)
+
+// ErrSessionNotFound is returned for unknown or stopped session IDs.
+var ErrSessionNotFound = errors.New("stream session not found")
+
+type StreamStartArgs struct {
+	Source     StreamSource           `json:"source"`
+	DurationMs int                    `json:"duration_ms,omitempty"`
+	BufferSize int                    `json:"buffer_size,omitempty"`
+	Filters    map[string]interface{} `json:"filters,omitempty"`
+	Filter     string                 `json:"filter,omitempty"`
+	Format     string                 `json:"format,omitempty"`
+	StructType string                 `json:"struct_type,omitempty"`
+}
+
+type StreamPollArgs struct {
+	SessionID string `json:"session_id"`
+	Cursor    int    `json:"cursor,omitempty"`
+	MaxEvents int    `json:"max_events,omitempty"`
+	WaitMs    int    `json:"wait_ms,omitempty"`
+}
+
+type StreamStopArgs struct {
+	SessionID string `json:"session_id"`
+}
+
+// StreamStats summarizes a stream session.
+type StreamStats struct {
+	EventsReceived    int     `json:"events_received"`
+	EventsDropped     uint64  `json:"events_dropped"`
+	EventsFiltered    int     `json:"events_filtered"`
+	EventsOverwritten int     `json:"events_overwritten"`
+	Buffered          int     `json:"buffered"`
+	DurationMs        int64   `json:"duration_ms"`
+	EventsPerSecond   float64 `json:"events_per_second"`
+}
+
+type StreamStartResult struct {
+	Success     bool   `json:"success"`
+	ToolVersion string `json:"tool_version"`
+	SessionID   string `json:"session_id,omitempty"`
+	Source      string `json:"source,omitempty"`
+	MapID       int    `json:"map_id,omitempty"`
+	MapType     string `json:"map_type,omitempty"`
+	StructType  string `json:"struct_type,omitempty"`
+	BufferSize  int    `json:"buffer_size,omitempty"`
+	Message     string `json:"message,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+type StreamPollResult struct {
+	Success     bool                     `json:"success"`
+	ToolVersion string                   `json:"tool_version"`
+	SessionID   string                   `json:"session_id,omitempty"`
+	Events      []map[string]interface{} `json:"events"`
+	NextCursor  int                      `json:"next_cursor"`
+	Missed      int                      `json:"missed,omitempty"`
+	Active      bool                     `json:"active"`
+	StreamError string                   `json:"stream_error,omitempty"`
+	Stats       *StreamStats             `json:"stats,omitempty"`
+	Message     string                   `json:"message,omitempty"`
+	Error       string                   `json:"error,omitempty"`
+}
+
+type StreamStopResult struct {
+	Success     bool         `json:"success"`
+	ToolVersion string       `json:"tool_version"`
+	SessionID   string       `json:"session_id,omitempty"`
+	Unread      int          `json:"unread"`
+	Stats       *StreamStats `json:"stats,omitempty"`
+	Message     string       `json:"message,omitempty"`
+	Error       string       `json:"error,omitempty"`
+}
+
+// streamSession reads events in the background into a bounded buffer.
+// Events are numbered from 0 in arrival order; the buffer holds the events
+// numbered first to first+len(events)-1, dropping the oldest when full.
+type streamSession struct {
+	id      string
+	stream  *eventStream
+	limit   int
+	started time.Time
+
+	mu       sync.Mutex
+	events   []map[string]interface{}
+	first    int
+	polled   int
+	received int
+	evicted  int
+	dropped  uint64
+	filtered int
+	ended    time.Time
+	err      error
+	// wake is closed and replaced whenever events arrive or the reader
+	// stops, to release waiting polls.
+	wake chan struct{}
+	done chan struct{}
+}
+
+type sessionManager struct {
+	mu       sync.Mutex
+	next     int
+	sessions map[string]*streamSession
+}
+
+var sessions = &sessionManager{sessions: make(map[string]*streamSession)}
+
+func ParseStreamStartArgs(input map[string]interface{}) (*StreamStartArgs, error) {
+	if input == nil {
+		return nil, errors.New("input cannot be nil")
+	}
+
+	var args StreamStartArgs
+	if err := types.StrictUnmarshal(input, &args); err != nil {
+		return nil, fmt.Errorf("failed to parse stream start args: %w", err)
+	}
+	return &args, nil
+}
+
+func streamStartFailure(err error) (*StreamStartResult, error) {
+	return &StreamStartResult{
+		Success:     false,
+		ToolVersion: "v1",
+		Error:       err.Error(),
+	}, err
+}
+
+// StreamStart opens the event source and starts reading it in the
+// background. Without DurationMs the session runs until stopped.
+func StreamStart(args *StreamStartArgs) (*StreamStartResult, error) {
+	if args == nil {
+		return streamStartFailure(errors.New("args cannot be nil"))
+	}
+
+	format := args.Format
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "raw" && format != "base64" {
+		return streamStartFailure(fmt.Errorf("unsupported format: %s", format))
+	}
+
+	limit := args.BufferSize
+	if limit <= 0 {
+		limit = defaultSessionBuffer
+	}
+	if limit > maxSessionBuffer {
+		return streamStartFailure(fmt.Errorf("buffer_size must be at most %d", maxSessionBuffer))
+	}
+	if args.DurationMs < 0 {
+		return streamStartFailure(errors.New("duration_ms must not be negative"))
+	}
+
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+
+	sessions.reap(time.Now())
+	if len(sessions.sessions) >= maxStreamSessions && !sessions.evictEnded() {
+		return streamStartFailure(fmt.Errorf("too many stream sessions (%d), stop one first", maxStreamSessions))
+	}
+
+	stream, err := openEventStream(args.Source, format, args.StructType, args.Filter, args.Filters)
+	if err != nil {
+		return streamStartFailure(err)
+	}
+
+	sessions.next++
+	s := &streamSession{
+		id:      fmt.Sprintf("stream-%d", sessions.next),
+		stream:  stream,
+		limit:   limit,
+		started: time.Now(),
+		wake:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if args.DurationMs > 0 {
+		stream.rd.SetDeadline(s.started.Add(time.Duration(args.DurationMs) * time.Millisecond))
+	}
+	sessions.sessions[s.id] = s
+	go s.run()
+
+	log.Printf("[DEBUG] StreamStart: session %s reading from %s", s.id, stream.src.desc)
+
+	msg := fmt.Sprintf("Streaming from %s in session %s", stream.src.desc, s.id)
+	if args.DurationMs > 0 {
+		msg += fmt.Sprintf(" for %dms", args.DurationMs)
+	}
+	return &StreamStartResult{
+		Success:     true,
+		ToolVersion: "v1",
+		SessionID:   s.id,
+		Source:      stream.src.desc,
+		MapID:       stream.src.om.id,
+		MapType:     stream.src.kind,
+		StructType:  stream.structType(),
+		BufferSize:  limit,
+		Message:     msg,
+	}, nil
+}
+
+// run reads events until the deadline passes, the reader fails or the
+// session is stopped, then releases the event source.
+func (s *streamSession) run() {
+	defer close(s.done)
+
+	for {
+		event, err := s.stream.next()
+
+		s.mu.Lock()
+		s.dropped, s.filtered = s.stream.dropped, s.stream.filtered
+		if err != nil {
+			if !errors.Is(err, os.ErrDeadlineExceeded) && !errors.Is(err, os.ErrClosed) {
+				s.err = err
+			}
+			s.ended = time.Now()
+			s.notify()
+			s.mu.Unlock()
+			s.stream.close()
+			return
+		}
+		if event != nil {
+			s.events = append(s.events, event)
+			s.received++
+			if len(s.events) > s.limit {
+				s.events[0] = nil
+				s.events = s.events[1:]
+				s.first++
+				s.evicted++
+			}
+			s.notify()
+		}
+		s.mu.Unlock()
+	}
+}
+
+// notify wakes waiting polls. Must be called with mu held.
+func (s *streamSession) notify() {
+	close(s.wake)
+	s.wake = make(chan struct{})
+}
+
+// stats must be called with mu held.
+func (s *streamSession) stats() *StreamStats {
+	end := s.ended
+	if end.IsZero() {
+		end = time.Now()
+	}
+	elapsed := end.Sub(s.started)
+
+	st := &StreamStats{
+		EventsReceived:    s.received,
+		EventsDropped:     s.dropped,
+		EventsFiltered:    s.filtered,
+		EventsOverwritten: s.evicted,
+		Buffered:          len(s.events),
+		DurationMs:        elapsed.Milliseconds(),
+	}
+	if elapsed > 0 {
+		st.EventsPerSecond = float64(s.received) / elapsed.Seconds()
+	}
+	return st
+}
+
+// reap forgets sessions that ended more than endedSessionTTL before now.
+// Their readers are already closed. Must be called with m.mu held.
+func (m *sessionManager) reap(now time.Time) {
+	for id, s := range m.sessions {
+		s.mu.Lock()
+		expired := !s.ended.IsZero() && now.Sub(s.ended) > endedSessionTTL
+		s.mu.Unlock()
+		if expired {
+			delete(m.sessions, id)
+		}
+	}
+}
+
+// evictEnded forgets the session that ended first, to make room for a new
+// one, and reports whether there was one. Must be called with m.mu held.
+func (m *sessionManager) evictEnded() bool {
+	var oldest *streamSession
+	var oldestEnd time.Time
+	for _, s := range m.sessions {
+		s.mu.Lock()
+		ended := s.ended
+		s.mu.Unlock()
+		if !ended.IsZero() && (oldest == nil || ended.Before(oldestEnd)) {
+			oldest, oldestEnd = s, ended
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	delete(m.sessions, oldest.id)
+	return true
+}
+
+func (m *sessionManager) get(id string) (*streamSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sessions[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrSessionNotFound, id)
+	}
+	return s, nil
+}
+
+func streamPollFailure(err error) (*StreamPollResult, error) {
+	return &StreamPollResult{
+		Success:     false,
+		ToolVersion: "v1",
+		Events:      []map[string]interface{}{},
+		Error:       err.Error(),
+	}, err
+}
+
+// StreamPoll returns buffered events numbered Cursor and up. With WaitMs it
+// waits up to that long, or until ctx is cancelled, for an event when none
+// is buffered yet. Missed counts events past the cursor that were
+// overwritten before this poll.
+//
+// Sessions themselves are not tied to the context of the request that
+// started them; they run until stopped or their duration passes. Ended
+// sessions can be polled until stopped, for endedSessionTTL, or until
+// their slot is needed by a new session.
+func StreamPoll(ctx context.Context, args *StreamPollArgs) (*StreamPollResult, error) {
+	if args == nil {
+		return streamPollFailure(errors.New("args cannot be nil"))
+	}
+	if args.SessionID == "" {
+		return streamPollFailure(errors.New("session_id is required"))
+	}
+	if args.Cursor < 0 {
+		return streamPollFailure(errors.New("cursor must not be negative"))
+	}
+	limit := args.MaxEvents
+	if limit <= 0 {
+		limit = defaultPollEvents
+	}
+	wait := time.Duration(args.WaitMs) * time.Millisecond
+	if wait > maxPollWait {
+		wait = maxPollWait
+	}
+
+	s, err := sessions.get(args.SessionID)
+	if err != nil {
+		return streamPollFailure(err)
+	}
+
+	s.mu.Lock()
+	if last := s.first + len(s.events); args.Cursor > last {
+		s.mu.Unlock()
+		return streamPollFailure(fmt.Errorf("cursor %d is past the next event, %d", args.Cursor, last))
+	}
+	if wait > 0 && s.first+len(s.events) <= args.Cursor && s.ended.IsZero() {
+		wake := s.wake
+		s.mu.Unlock()
+		select {
+		case <-wake:
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return streamPollFailure(ctx.Err())
+		}
+		s.mu.Lock()
+	}
+	defer s.mu.Unlock()
+
+	cursor := args.Cursor
+	result := &StreamPollResult{
+		Success:     true,
+		ToolVersion: "v1",
+		SessionID:   s.id,
+		Events:      []map[string]interface{}{},
+		Active:      s.ended.IsZero(),
+		Stats:       s.stats(),
+	}
+	if s.err != nil {
+		result.StreamError = s.err.Error()
+	}
+
+	if cursor < s.first {
+		result.Missed = s.first - cursor
+		cursor = s.first
+	}
+	start := min(cursor-s.first, len(s.events))
+	end := min(start+limit, len(s.events))
+	result.Events = append(result.Events, s.events[start:end]...)
+	result.NextCursor = s.first + end
+	s.polled = max(s.polled, result.NextCursor)
+
+	result.Message = fmt.Sprintf("Returned %d events, %d more buffered", len(result.Events), len(s.events)-end)
+	if result.Missed > 0 {
+		result.Message += fmt.Sprintf("; %d events were overwritten before being polled", result.Missed)
+	}
+	if !result.Active {
+		result.Message += "; stream has ended"
+	}
+	return result, nil
+}
+
+func streamStopFailure(err error) (*StreamStopResult, error) {
+	return &StreamStopResult{
+		Success:     false,
+		ToolVersion: "v1",
+		Error:       err.Error(),
+	}, err
+}
+
+// StreamStop stops reading, releases the event source and forgets the
+// session. Events not yet polled are discarded and counted in Unread.
+func StreamStop(args *StreamStopArgs) (*StreamStopResult, error) {
+	if args == nil {
+		return streamStopFailure(errors.New("args cannot be nil"))
+	}
+	if args.SessionID == "" {
+		return streamStopFailure(errors.New("session_id is required"))
+	}
+
+	sessions.mu.Lock()
+	s, ok := sessions.sessions[args.SessionID]
+	delete(sessions.sessions, args.SessionID)
+	sessions.mu.Unlock()
+	if !ok {
+		return streamStopFailure(fmt.Errorf("%w: %s", ErrSessionNotFound, args.SessionID))
+	}
+
+	// Closing the reader unblocks run, which releases the source.
+	s.stream.rd.Close()
+	<-s.done
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := s.stats()
+	result := &StreamStopResult{
+		Success:     true,
+		ToolVersion: "v1",
+		SessionID:   s.id,
+		Unread:      s.first + len(s.events) - max(s.polled, s.first),
+		Stats:       stats,
+		Message: fmt.Sprintf("Stopped session %s after %dms: %d events received, %d dropped",
+			s.id, stats.DurationMs, stats.EventsReceived, stats.EventsDropped),
+	}
+	if s.err != nil {
+		result.Message += fmt.Sprintf("; stream failed: %v", s.err)
+	}
+	return result, nil
+}
@@ -0,0 +1,271 @@
+// internal/ebpf/stream_source.go
+package ebpf
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/btf"
+)
+
+// StreamSource selects the ringbuf or perf event array to read events from,
+// either directly or through the program (or link) writing to it.
+type StreamSource struct {
+	ProgramID int    `json:"program_id,omitempty"`
+	LinkID    int    `json:"link_id,omitempty"`
+	MapID     int    `json:"map_id,omitempty"`
+	Type      string `json:"type,omitempty"`
+}
+
+// eventSource is a resolved StreamSource. close must be called once the
+// caller is done with it.
+type eventSource struct {
+	om        *openedMap
+	kind      string
+	desc      string
+	programID int
+}
+
+func (s *eventSource) close() { s.om.close() }
+
+// resolveEventSource opens the event map src refers to.
+func resolveEventSource(src StreamSource) (*eventSource, error) {
+	if src.Type != "" && src.Type != SourceRingbuf && src.Type != SourcePerfbuf {
+		return nil, fmt.Errorf("unsupported map type: %s", src.Type)
+	}
+
+	switch {
+	case src.MapID != 0:
+		om, err := openMap(MapSelector{MapID: src.MapID})
+		if err != nil {
+			return nil, err
+		}
+		kind := sourceKind(om.info.Type)
+		if kind == "" {
+			om.close()
+			return nil, fmt.Errorf("map %d is a %s, not a ringbuf or perf event array", src.MapID, om.info.Type)
+		}
+		if src.Type != "" && src.Type != kind {
+			om.close()
+			return nil, fmt.Errorf("map %d is a %s, not a %s", src.MapID, kind, src.Type)
+		}
+		return &eventSource{om: om, kind: kind, desc: fmt.Sprintf("map %d", src.MapID)}, nil
+
+	case src.ProgramID != 0:
+		return programEventSource(src.ProgramID, src.Type, fmt.Sprintf("program %d", src.ProgramID))
+
+	case src.LinkID != 0:
+		rl, err := resolveLink(src.LinkID, "", "")
+		if err != nil {
+			return nil, err
+		}
+		info, err := rl.link.Info()
+		rl.close()
+		if err != nil {
+			return nil, fmt.Errorf("link %d info: %w", src.LinkID, err)
+		}
+		return programEventSource(int(info.Program), src.Type, fmt.Sprintf("link %d", src.LinkID))
+	}
+
+	return nil, errors.New("must specify program_id, link_id, or map_id in source")
+}
+
+// eventMapCandidate is an event map referenced by a program.
+type eventMapCandidate struct {
+	id   int
+	name string
+	kind string
+}
+
+func (c eventMapCandidate) String() string {
+	return fmt.Sprintf("map %d %q (%s)", c.id, c.name, c.kind)
+}
+
+// programEventSource opens the event map a program writes to. The map must
+// be unique among the program's ringbuf and perf event array maps, or among
+// those of the requested kind.
+func programEventSource(progID int, kind, desc string) (*eventSource, error) {
+	prog, handle, err := objects.OpenProgram(progID)
+	if err != nil {
+		return nil, err
+	}
+	info, err := prog.Info()
+	objects.Release(handle)
+	if err != nil {
+		return nil, fmt.Errorf("program %d info: %w", progID, err)
+	}
+
+	mapIDs, ok := info.MapIDs()
+	if !ok {
+		return nil, fmt.Errorf("%s: kernel does not report the maps a program uses; pass map_id", desc)
+	}
+
+	var all, candidates []eventMapCandidate
+	for _, id := range mapIDs {
+		m, err := ebpf.NewMapFromID(id)
+		if err != nil {
+			continue
+		}
+		mi, err := m.Info()
+		m.Close()
+		if err != nil {
+			continue
+		}
+		c := eventMapCandidate{id: int(id), name: mi.Name, kind: sourceKind(mi.Type)}
+		if c.kind == "" {
+			continue
+		}
+		all = append(all, c)
+		if kind == "" || c.kind == kind {
+			candidates = append(candidates, c)
+		}
+	}
+
+	switch {
+	case len(candidates) == 1:
+		om, err := openMap(MapSelector{MapID: candidates[0].id})
+		if err != nil {
+			return nil, err
+		}
+		desc = fmt.Sprintf("%s (map %d)", desc, candidates[0].id)
+		return &eventSource{om: om, kind: candidates[0].kind, desc: desc, programID: progID}, nil
+
+	case len(candidates) > 1:
+		return nil, fmt.Errorf("%s writes to several event maps, pick one with source.map_id: %s",
+			desc, joinCandidates(candidates))
+
+	case len(all) > 0:
+		return nil, fmt.Errorf("%s uses no %s map, only %s", desc, kind, joinCandidates(all))
+	}
+	return nil, fmt.Errorf("%s uses no ringbuf or perf event array map", desc)
+}
+
+func joinCandidates(candidates []eventMapCandidate) string {
+	names := make([]string, len(candidates))
+	for i, c := range candidates {
+		names[i] = c.String()
+	}
+	return strings.Join(names, ", ")
+}
+
+// eventType returns the BTF type records are decoded with. An explicit
+// name is looked up in the map's BTF, then in the BTF of the programs
+// writing to the map, then in the kernel's. Without a name the events of
+// builtin programs use their record type and other maps their value
+// type, except for perf event arrays, whose values are just the
+// perf event file descriptors. A nil type means records stay raw.
+func (s *eventSource) eventType(name string) (btf.Type, error) {
+	if name == "" {
+		if typ, ok := builtinEventType(s.om.id); ok {
+			return typ, nil
+		}
+		if s.kind == SourcePerfbuf || s.om.btf == nil {
+			return nil, nil
+		}
+		return s.om.btf.Value, nil
+	}
+	if typ, ok := builtinEventType(s.om.id); ok && typ.TypeName() == strings.TrimPrefix(name, "struct ") {
+		return typ, nil
+	}
+
+	for _, id := range s.btfIDs() {
+		spec, err := loadBTFByID(id)
+		if err != nil {
+			continue
+		}
+		if typ, err := lookupCompositeType(spec, name); err == nil {
+			return typ, nil
+		}
+	}
+
+	kernel, err := btf.LoadKernelSpec()
+	if err != nil {
+		return nil, fmt.Errorf("type %q not found in program BTF and kernel BTF is unavailable: %w", name, err)
+	}
+	typ, err := lookupCompositeType(kernel, name)
+	if err != nil {
+		return nil, fmt.Errorf("type %q: %w", name, err)
+	}
+	return typ, nil
+}
+
+// btfIDs lists the BTF objects that may describe the records in the map.
+func (s *eventSource) btfIDs() []btf.ID {
+	var ids []btf.ID
+	if raw, err := rawMapInfoFromFD(s.om.m.FD()); err == nil && raw.BTFID != 0 {
+		ids = append(ids, btf.ID(raw.BTFID))
+	}
+
+	progIDs := []int{s.programID}
+	if s.programID == 0 {
+		progIDs = programsUsingMap(s.om.id)
+	}
+	for _, progID := range progIDs {
+		prog, err := ebpf.NewProgramFromID(ebpf.ProgramID(progID))
+		if err != nil {
+			continue
+		}
+		info, err := prog.Info()
+		prog.Close()
+		if err != nil {
+			continue
+		}
+		if id, ok := info.BTFID(); ok && id != 0 {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// programsUsingMap returns the IDs of the loaded programs referencing a map.
+func programsUsingMap(mapID int) []int {
+	var progs []int
+	var id ebpf.ProgramID
+	for {
+		next, err := ebpf.ProgramGetNextID(id)
+		if err != nil {
+			// os.ErrNotExist ends the walk; anything else leaves the
+			// list partial, which only narrows the type search.
+			break
+		}
+		id = next
+
+		prog, err := ebpf.NewProgramFromID(id)
+		if err != nil {
+			continue
+		}
+		info, err := prog.Info()
+		prog.Close()
+		if err != nil {
+			continue
+		}
+		mapIDs, _ := info.MapIDs()
+		for _, m := range mapIDs {
+			if int(m) == mapID {
+				progs = append(progs, int(id))
+				break
+			}
+		}
+	}
+	return progs
+}
+
+// lookupCompositeType finds a struct or union by name. The name may carry
+// a C style "struct " or "union " prefix.
+func lookupCompositeType(spec *btf.Spec, name string) (btf.Type, error) {
+	if rest, ok := strings.CutPrefix(name, "union "); ok {
+		var u *btf.Union
+		if err := spec.TypeByName(strings.TrimSpace(rest), &u); err != nil {
+			return nil, err
+		}
+		return u, nil
+	}
+
+	var st *btf.Struct
+	if err := spec.TypeByName(strings.TrimSpace(strings.TrimPrefix(name, "struct ")), &st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
@@ -0,0 +1,9 @@
+// internal/ebpf/syscall_names_other.go
+
+//go:build !amd64 && !arm64
+
+package ebpf
+
+// syscallNames is empty on architectures without a table; system calls are
+// reported by number.
+var syscallNames = map[int64]string{}
@@ -0,0 +1,6 @@
+#include <stdio.h>
+
+static int __attribute__((noinline)) mdi_static_helper(int x) { return x * 3 + 1; }
+int __attribute__((noinline)) mdi_global_func(int x) { return mdi_static_helper(x) - 2; }
+
+int main(int argc, char **argv) { printf("%d\n", mdi_global_func(argc)); return 0; }
@@ -0,0 +1,825 @@
+package ebpf
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/link"
+	"github.com/cilium/ebpf/rlimit"
+	"github.com/sameehj/ebpf-mcp/pkg/types"
+)
+
+const (
+	defaultBlockIODuration = 5 * time.Second
+	defaultBlockIOEvents   = 100
+	maxBlockIOEvents       = 10000
+	maxBlockDevices        = 256
+
+	// A request's class is its operation in the low two bits, and
+	// blockIOSync if it is synchronous.
+	blockIORead    = 0
+	blockIOWrite   = 1
+	blockIODiscard = 2
+	blockIOOther   = 3
+	blockIOSync    = 4
+	blockIOClasses = 8
+)
+
+var blockIOOps = []string{"read", "write", "discard", "other"}
+
+// blockIOStart is what is recorded when a request is issued.
+var blockIOStart = newStruct("block_io_start",
+	structField{"ts", btfU64},
+	structField{"comm", btfArray(btfChar, taskCommLen)},
+	structField{"bytes", btfU32},
+	structField{"class", btfU32},
+	structField{"pid", btfU32},
+)
+
+// blockIOClass keys the totals of a class of requests of a device.
+var blockIOClass = newStruct("block_io_class",
+	structField{"dev", btfU32},
+	structField{"class", btfU32},
+)
+
+var blockIOTotals = newStruct("block_io_totals",
+	structField{"count", btfU64},
+	structField{"bytes", btfU64},
+	structField{"latency_ns", btfU64},
+	structField{"errors", btfU64},
+)
+
+// blockIOSlot is a log2 latency bucket of a class of requests of a device.
+var blockIOSlot = newStruct("block_io_slot",
+	structField{"dev", btfU32},
+	structField{"class", btfU32},
+	structField{"slot", btfU32},
+)
+
+// blockIORecord is the per-request event submitted on completion.
+var blockIORecord = newStruct("block_io_record",
+	structField{"ktime_ns", btfU64},
+	structField{"latency_ns", btfU64},
+	structField{"sector", btfU64},
+	structField{"dev", btfU32},
+	structField{"bytes", btfU32},
+	structField{"class", btfU32},
+	structField{"pid", btfU32},
+	structField{"error", btfS32},
+	structField{"comm", btfArray(btfChar, taskCommLen)},
+)
+
+type TraceBlockIOArgs struct {
+	DurationMs int      `json:"duration_ms,omitempty"`
+	Devices    []string `json:"devices,omitempty"`
+	Unit       string   `json:"unit,omitempty"`
+	Events     bool     `json:"events,omitempty"`
+	MaxEvents  int      `json:"max_events,omitempty"`
+}
+
+type TraceBlockIOResult struct {
+	Success     bool                     `json:"success"`
+	ToolVersion string                   `json:"tool_version"`
+	Status      string                   `json:"status"`
+	Unit        string                   `json:"unit,omitempty"`
+	Devices     []BlockDevice            `json:"devices"`
+	Events      []map[string]interface{} `json:"events,omitempty"`
+	Stats       map[string]interface{}   `json:"stats"`
+	Complete    bool                     `json:"complete"`
+	Warnings    []string                 `json:"warnings,omitempty"`
+	Error       string                   `json:"error,omitempty"`
+}
+
+// BlockDevice summarises the requests a device completed, overall and by
+// class. The average queue depth is the mean number of requests in flight,
+// from the total latency over the trace (Little's law).
+type BlockDevice struct {
+	Device         string  `json:"device"`
+	Dev            string  `json:"dev"`
+	IOPS           float64 `json:"iops"`
+	Bytes          uint64  `json:"bytes"`
+	BytesPerSecond float64 `json:"bytes_per_second"`
+	AvgLatency     float64 `json:"avg_latency"`
+	AvgQueueDepth  float64 `json:"avg_queue_depth"`
+	InFlight       int     `json:"in_flight"`
+	Errors         uint64  `json:"errors"`
+	LatencySummary
+	Classes []BlockIOClass `json:"classes"`
+}
+
+// BlockIOClass summarises the requests of one operation, synchronous or
+// not, of a device.
+type BlockIOClass struct {
+	Op             string  `json:"op"`
+	Sync           bool    `json:"sync"`
+	IOPS           float64 `json:"iops"`
+	Bytes          uint64  `json:"bytes"`
+	BytesPerSecond float64 `json:"bytes_per_second"`
+	AvgLatency     float64 `json:"avg_latency"`
+	Errors         uint64  `json:"errors"`
+	LatencySummary
+}
+
+func ParseTraceBlockIOArgs(input map[string]interface{}) (*TraceBlockIOArgs, error) {
+	var args TraceBlockIOArgs
+	if input == nil {
+		return &args, nil
+	}
+	if err := types.StrictUnmarshal(input, &args); err != nil {
+		return nil, fmt.Errorf("failed to parse trace block io args: %w", err)
+	}
+	return &args, nil
+}
+
+func traceBlockIOFailure(err error) (*TraceBlockIOResult, error) {
+	return &TraceBlockIOResult{
+		Success:     false,
+		ToolVersion: "v1",
+		Status:      "failed",
+		Error:       err.Error(),
+	}, err
+}
+
+// RunTraceBlockIO measures block requests from issue to completion for the
+// requested duration, or until ctx is cancelled, aggregating latency,
+// operations and bytes per device and class in the kernel. With Events,
+// completed requests are also returned one by one.
+func RunTraceBlockIO(ctx context.Context, args *TraceBlockIOArgs) (*TraceBlockIOResult, error) {
+	if args == nil {
+		return traceBlockIOFailure(errors.New("args cannot be nil"))
+	}
+
+	duration := time.Duration(args.DurationMs) * time.Millisecond
+	if duration == 0 {
+		duration = defaultBlockIODuration
+	}
+	if duration < 0 || duration > maxTraceDuration {
+		return traceBlockIOFailure(fmt.Errorf("duration_ms must be between 1 and %d", maxTraceDuration.Milliseconds()))
+	}
+	unit := args.Unit
+	if unit == "" {
+		unit = "us"
+	}
+	divisor, ok := latencyUnits[unit]
+	if !ok {
+		return traceBlockIOFailure(fmt.Errorf("unknown unit %q (expected ns, us or ms)", unit))
+	}
+	maxEvents := args.MaxEvents
+	if maxEvents == 0 {
+		maxEvents = defaultBlockIOEvents
+	}
+	if maxEvents < 0 || maxEvents > maxBlockIOEvents {
+		return traceBlockIOFailure(fmt.Errorf("max_events must be between 1 and %d", maxBlockIOEvents))
+	}
+	if len(args.Devices) > maxBlockDevices {
+		return traceBlockIOFailure(fmt.Errorf("at most %d devices can be traced", maxBlockDevices))
+	}
+	var devs []uint32
+	for _, name := range args.Devices {
+		dev, err := resolveBlockDevice(name)
+		if err != nil {
+			return traceBlockIOFailure(err)
+		}
+		devs = append(devs, dev)
+	}
+
+	if err := rlimit.RemoveMemlock(); err != nil {
+		return traceBlockIOFailure(fmt.Errorf("rlimit error: %v", err))
+	}
+
+	spec, err := blockIOSpec(len(devs), args.Events, divisor)
+	if err != nil {
+		return traceBlockIOFailure(err)
+	}
+	coll, err := ebpf.NewCollection(spec)
+	if err != nil {
+		return traceBlockIOFailure(fmt.Errorf("failed to load programs: %v", err))
+	}
+	defer coll.Close()
+	for _, dev := range devs {
+		if err := coll.Maps["devs"].Put(dev, uint8(1)); err != nil {
+			return traceBlockIOFailure(fmt.Errorf("failed to add device %s to filter: %v", formatDev(dev), err))
+		}
+	}
+
+	var rd eventReader
+	if args.Events {
+		if rd, err = newEventReader(coll.Maps[builtinEventsMap], SourceRingbuf); err != nil {
+			return traceBlockIOFailure(err)
+		}
+		defer rd.Close()
+	}
+
+	// Completions are attached first so no request issued during the
+	// trace is left in flight.
+	for _, h := range []struct{ name, prog string }{
+		{"block_rq_complete", "block_io_complete"},
+		{"block_rq_issue", "block_io_issue"},
+	} {
+		tp, err := link.Tracepoint("block", h.name, coll.Programs[h.prog], nil)
+		if err != nil {
+			return traceBlockIOFailure(fmt.Errorf("tracepoint block:%s attach failed: %v", h.name, err))
+		}
+		defer tp.Close()
+	}
+
+	start := time.Now()
+	result := &TraceBlockIOResult{
+		Success:     true,
+		ToolVersion: "v1",
+		Unit:        unit,
+		Devices:     []BlockDevice{},
+	}
+	var received, dropped int
+	names := make(map[uint32]string)
+	if rd != nil {
+		stop := context.AfterFunc(ctx, func() { rd.Close() })
+		defer stop()
+		rd.SetDeadline(start.Add(duration))
+
+		mapID := 0
+		if info, err := coll.Maps[builtinEventsMap].Info(); err == nil {
+			id, _ := info.ID()
+			mapID = int(id)
+		}
+		result.Events = []map[string]interface{}{}
+		for {
+			rec, err := rd.Read()
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			if ctx.Err() != nil {
+				return traceBlockIOFailure(fmt.Errorf("trace cancelled: %w", ctx.Err()))
+			}
+			if err != nil {
+				return traceBlockIOFailure(fmt.Errorf("read events: %w", err))
+			}
+			data, ok := decodeBlockIORecord(rec.Data, names, divisor)
+			if !ok {
+				continue
+			}
+			received++
+			if len(result.Events) >= maxEvents {
+				dropped++
+				continue
+			}
+			result.Events = append(result.Events, newStreamEvent(rec, mapID, "json", data, nil))
+		}
+	} else {
+		timer := time.NewTimer(duration)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return traceBlockIOFailure(fmt.Errorf("trace cancelled: %w", ctx.Err()))
+		}
+	}
+	elapsed := time.Since(start)
+	seconds := elapsed.Seconds()
+
+	type classStats struct {
+		count, bytes, latencyNs, errors uint64
+		hist                            []uint64
+	}
+	classes := make(map[uint32]*[blockIOClasses]*classStats)
+	classOf := func(dev, class uint32) *classStats {
+		if classes[dev] == nil {
+			classes[dev] = &[blockIOClasses]*classStats{}
+		}
+		if classes[dev][class] == nil {
+			classes[dev][class] = &classStats{hist: make([]uint64, latencySlots)}
+		}
+		return classes[dev][class]
+	}
+
+	var classKey struct{ Dev, Class uint32 }
+	var totals struct{ Count, Bytes, LatencyNs, Errors uint64 }
+	iter := coll.Maps["totals"].Iterate()
+	for iter.Next(&classKey, &totals) {
+		if classKey.Class >= blockIOClasses {
+			continue
+		}
+		c := classOf(classKey.Dev, classKey.Class)
+		c.count, c.bytes, c.latencyNs, c.errors = totals.Count, totals.Bytes, totals.LatencyNs, totals.Errors
+	}
+	if err := iter.Err(); err != nil {
+		return traceBlockIOFailure(fmt.Errorf("read totals: %w", err))
+	}
+
+	var slotKey struct{ Dev, Class, Slot uint32 }
+	var count uint64
+	iter = coll.Maps["hist"].Iterate()
+	for iter.Next(&slotKey, &count) {
+		if slotKey.Class >= blockIOClasses || slotKey.Slot >= latencySlots {
+			continue
+		}
+		classOf(slotKey.Dev, slotKey.Class).hist[slotKey.Slot] += count
+	}
+	if err := iter.Err(); err != nil {
+		return traceBlockIOFailure(fmt.Errorf("read histograms: %w", err))
+	}
+
+	inFlight := make(map[uint32]int)
+	var request struct {
+		Dev    uint32
+		_      uint32
+		Sector uint64
+	}
+	value := make([]byte, blockIOStart.Size)
+	iter = coll.Maps["start"].Iterate()
+	for iter.Next(&request, &value) {
+		inFlight[request.Dev]++
+	}
+	if err := iter.Err(); err != nil {
+		return traceBlockIOFailure(fmt.Errorf("read requests in flight: %w", err))
+	}
+	for dev := range inFlight {
+		if classes[dev] == nil {
+			classes[dev] = &[blockIOClasses]*classStats{}
+		}
+	}
+
+	var completed uint64
+	waiting := 0
+	for dev, byClass := range classes {
+		d := BlockDevice{
+			Device:   blockDeviceName(dev, names),
+			Dev:      formatDev(dev),
+			InFlight: inFlight[dev],
+			Classes:  []BlockIOClass{},
+		}
+		hist := make([]uint64, latencySlots)
+		var latencyNs uint64
+		for class, c := range byClass {
+			if c == nil {
+				continue
+			}
+			for slot, n := range c.hist {
+				hist[slot] += n
+			}
+			d.Bytes += c.bytes
+			d.Errors += c.errors
+			latencyNs += c.latencyNs
+			bc := BlockIOClass{
+				Op:             blockIOOps[class&^blockIOSync],
+				Sync:           class&blockIOSync != 0,
+				IOPS:           float64(c.count) / seconds,
+				Bytes:          c.bytes,
+				BytesPerSecond: float64(c.bytes) / seconds,
+				Errors:         c.errors,
+				LatencySummary: latencySummary(c.hist),
+			}
+			if c.count > 0 {
+				bc.AvgLatency = float64(c.latencyNs) / float64(c.count) / float64(divisor)
+			}
+			d.Classes = append(d.Classes, bc)
+		}
+		d.LatencySummary = latencySummary(hist)
+		d.IOPS = float64(d.Count) / seconds
+		d.BytesPerSecond = float64(d.Bytes) / seconds
+		d.AvgQueueDepth = float64(latencyNs) / float64(elapsed.Nanoseconds())
+		if d.Count > 0 {
+			d.AvgLatency = float64(latencyNs) / float64(d.Count) / float64(divisor)
+		}
+		completed += d.Count
+		waiting += d.InFlight
+		result.Devices = append(result.Devices, d)
+	}
+	sort.Slice(result.Devices, func(i, j int) bool {
+		a, b := result.Devices[i], result.Devices[j]
+		return a.Count > b.Count || (a.Count == b.Count && a.Dev < b.Dev)
+	})
+
+	var lost uint64
+	if err := coll.Maps["lost"].Lookup(uint32(0), &lost); err != nil {
+		return traceBlockIOFailure(fmt.Errorf("read lost events: %w", err))
+	}
+
+	result.Stats = map[string]interface{}{
+		"duration_ms": elapsed.Milliseconds(),
+		"devices":     len(result.Devices),
+		"completed":   completed,
+		"iops":        float64(completed) / seconds,
+		"in_flight":   waiting,
+	}
+	if args.Events {
+		result.Stats["events_received"] = received
+		result.Stats["events_dropped"] = dropped
+		result.Stats["events_lost"] = lost
+	}
+	if waiting > 0 {
+		result.Warnings = append(result.Warnings,
+			fmt.Sprintf("requests still in flight when the trace ended are not counted: %d", waiting))
+	}
+	if dropped > 0 {
+		result.Warnings = append(result.Warnings,
+			fmt.Sprintf("max_events reached: %d further requests were not returned", dropped))
+	}
+	if lost > 0 {
+		result.Warnings = append(result.Warnings,
+			fmt.Sprintf("the event buffer was full: %d requests are counted but have no event", lost))
+	}
+	result.Complete = true
+	result.Status = fmt.Sprintf("Measured %d block requests on %d devices for %dms", completed, len(result.Devices), elapsed.Milliseconds())
+	return result, nil
+}
+
+func decodeBlockIORecord(data []byte, names map[uint32]string, divisor int32) (map[string]interface{}, bool) {
+	if len(data) < int(blockIORecord.Size) {
+		return nil, false
+	}
+	u32 := func(name string) uint32 {
+		return binary.NativeEndian.Uint32(data[offsetOf(blockIORecord, name):])
+	}
+	u64 := func(name string) uint64 {
+		return binary.NativeEndian.Uint64(data[offsetOf(blockIORecord, name):])
+	}
+	comm := data[offsetOf(blockIORecord, "comm"):][:taskCommLen]
+	if i := bytes.IndexByte(comm, 0); i >= 0 {
+		comm = comm[:i]
+	}
+
+	dev, class := u32("dev"), u32("class")
+	if class >= blockIOClasses {
+		return nil, false
+	}
+	event := map[string]interface{}{
+		"device":   blockDeviceName(dev, names),
+		"dev":      formatDev(dev),
+		"op":       blockIOOps[class&^blockIOSync],
+		"sync":     class&blockIOSync != 0,
+		"sector":   u64("sector"),
+		"bytes":    u32("bytes"),
+		"latency":  float64(u64("latency_ns")) / float64(divisor),
+		"pid":      u32("pid"),
+		"comm":     string(comm),
+		"ktime_ns": u64("ktime_ns"),
+	}
+	if errno := -int32(u32("error")); errno != 0 {
+		event["error"] = errnoName(int(errno))
+	}
+	return event, true
+}
+
+// Kernel dev_t values are major << 20 | minor.
+func formatDev(dev uint32) string {
+	return fmt.Sprintf("%d:%d", dev>>20, dev&(1<<20-1))
+}
+
+// blockDeviceName returns the name of a block device, or major:minor if it
+// has none, caching names.
+func blockDeviceName(dev uint32, names map[uint32]string) string {
+	if name, ok := names[dev]; ok {
+		return name
+	}
+	name := formatDev(dev)
+	if f, err := os.Open(fmt.Sprintf("/sys/dev/block/%s/uevent", name)); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if value, ok := strings.CutPrefix(scanner.Text(), "DEVNAME="); ok {
+				name = value
+				break
+			}
+		}
+		f.Close()
+	}
+	names[dev] = name
+	return name
+}
+
+// resolveBlockDevice returns the kernel dev_t of a block device given by
+// name, path under /dev or major:minor.
+func resolveBlockDevice(name string) (uint32, error) {
+	numbers := name
+	if !strings.Contains(name, ":") {
+		data, err := os.ReadFile(fmt.Sprintf("/sys/class/block/%s/dev", strings.TrimPrefix(name, "/dev/")))
+		if err != nil {
+			return 0, fmt.Errorf("block device %q not found", name)
+		}
+		numbers = strings.TrimSpace(string(data))
+	}
+	major, minor, _ := strings.Cut(numbers, ":")
+	ma, err := strconv.ParseUint(major, 10, 12)
+	if err != nil {
+		return 0, fmt.Errorf("invalid block device %q", name)
+	}
+	mi, err := strconv.ParseUint(minor, 10, 20)
+	if err != nil {
+		return 0, fmt.Errorf("invalid block device %q", name)
+	}
+	return uint32(ma<<20 | mi), nil
+}
+
+// lookupOrInit leaves a pointer to the value of m at the key at keyOff in
+// R0, first inserting a zeroed value built at valueOff if there is none.
+// It jumps to miss if the map is full.
+func lookupOrInit(m string, keyOff, valueOff int16, valueSize uint32, miss string) asm.Instructions {
+	found := m + "_found"
+	insns := asm.Instructions{
+		asm.LoadMapPtr(asm.R1, 0).WithReference(m),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, int32(keyOff)),
+		asm.FnMapLookupElem.Call(),
+		asm.JNE.Imm(asm.R0, 0, found),
+	}
+	for off := int16(0); off < int16(valueSize); off += 8 {
+		insns = append(insns, asm.StoreImm(asm.RFP, valueOff+off, 0, asm.DWord))
+	}
+	return append(insns,
+		asm.LoadMapPtr(asm.R1, 0).WithReference(m),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, int32(keyOff)),
+		asm.Mov.Reg(asm.R3, asm.RFP),
+		asm.Add.Imm(asm.R3, int32(valueOff)),
+		asm.Mov.Imm(asm.R4, int32(ebpf.UpdateNoExist)),
+		asm.FnMapUpdateElem.Call(),
+		asm.LoadMapPtr(asm.R1, 0).WithReference(m),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, int32(keyOff)),
+		asm.FnMapLookupElem.Call(),
+		asm.JEq.Imm(asm.R0, 0, miss),
+		asm.Mov.Reg(asm.R1, asm.R0).WithSymbol(found),
+	)
+}
+
+// addTo atomically adds src to the u64 at off in the value R0 points to.
+func addTo(off int16, src asm.Register) asm.Instructions {
+	return asm.Instructions{
+		asm.Mov.Reg(asm.R2, asm.R0),
+		asm.Add.Imm(asm.R2, int32(off)),
+		asm.StoreXAdd(asm.R2, src, asm.DWord),
+	}
+}
+
+// classifyRWBS sets R7 to the class of a request from its rwbs field, as
+// in "R", "WS" or "FWFS": the operation, and whether it is synchronous.
+func classifyRWBS(rwbs tracepointField) asm.Instructions {
+	insns := asm.Instructions{
+		asm.Mov.Imm(asm.R7, blockIOOther),
+		asm.Mov.Imm(asm.R8, 0),
+	}
+	for i := 0; i < rwbs.Size; i++ {
+		label := func(c byte) string { return fmt.Sprintf("rwbs_%d_%c", i, c) }
+		next := fmt.Sprintf("rwbs_%d", i+1)
+		if i == rwbs.Size-1 {
+			next = "classified"
+		}
+		insns = append(insns,
+			asm.LoadMem(asm.R1, asm.R6, int16(rwbs.Offset+i), asm.Byte).WithSymbol(fmt.Sprintf("rwbs_%d", i)),
+			asm.JEq.Imm(asm.R1, 0, "classified"),
+			asm.JNE.Imm(asm.R1, 'R', label('W')),
+			asm.Mov.Imm(asm.R7, blockIORead),
+			asm.JNE.Imm(asm.R1, 'W', label('D')).WithSymbol(label('W')),
+			asm.Mov.Imm(asm.R7, blockIOWrite),
+			asm.JNE.Imm(asm.R1, 'D', label('S')).WithSymbol(label('D')),
+			asm.Mov.Imm(asm.R7, blockIODiscard),
+			asm.JNE.Imm(asm.R1, 'S', next).WithSymbol(label('S')),
+			asm.Mov.Imm(asm.R8, blockIOSync),
+		)
+	}
+	return append(insns, asm.Or.Reg(asm.R7, asm.R8).WithSymbol("classified"))
+}
+
+// blockIOSpec assembles the programs of trace_block_io. The issue program
+// records each request in start, keyed by device and sector, unless a
+// device filter leaves its device out. The complete program adds the
+// request to the totals and the latency histogram of its device and class
+// and, with events, submits it.
+func blockIOSpec(devFilter int, events bool, divisor int32) (*ebpf.CollectionSpec, error) {
+	issue, err := loadTracepointFormat("block", "block_rq_issue")
+	if err != nil {
+		return nil, err
+	}
+	issueFields, err := issue.fieldsOf(map[string]int{"nr_sector": 4, "rwbs": 0, "comm": taskCommLen})
+	if err != nil {
+		return nil, err
+	}
+	complete, err := loadTracepointFormat("block", "block_rq_complete")
+	if err != nil {
+		return nil, err
+	}
+	completeError, err := complete.field("error", 4)
+	if err != nil {
+		return nil, err
+	}
+
+	// The request is built at -56, and R9 points at the stack so the
+	// context helpers can fill it in.
+	const startOff = -56
+	issueKey, err := storeBlockRequestKey(issue)
+	if err != nil {
+		return nil, err
+	}
+	issueInsns := append(asm.Instructions{asm.Mov.Reg(asm.R6, asm.R1)}, issueKey...)
+	if devFilter > 0 {
+		issueInsns = append(issueInsns,
+			asm.LoadMapPtr(asm.R1, 0).WithReference("devs"),
+			asm.Mov.Reg(asm.R2, asm.RFP),
+			asm.Add.Imm(asm.R2, int32(-16+offsetOf(blockRequest, "dev"))),
+			asm.FnMapLookupElem.Call(),
+			asm.JEq.Imm(asm.R0, 0, "out"),
+		)
+	}
+	issueInsns = append(issueInsns,
+		asm.FnKtimeGetNs.Call(),
+		asm.StoreMem(asm.RFP, startOff+offsetOf(blockIOStart, "ts"), asm.R0, asm.DWord),
+		// Zero the tail padding, the verifier rejects reads of
+		// uninitialized stack.
+		asm.StoreImm(asm.RFP, startOff+int16(blockIOStart.Size)-4, 0, asm.Word),
+		asm.Mov.Reg(asm.R9, asm.RFP),
+	)
+	issueInsns = append(issueInsns, copyCtxBytes(issueFields["comm"], startOff+offsetOf(blockIOStart, "comm"))...)
+	issueInsns = append(issueInsns,
+		asm.FnGetCurrentPidTgid.Call(),
+		asm.RSh.Imm(asm.R0, 32),
+		asm.StoreMem(asm.RFP, startOff+offsetOf(blockIOStart, "pid"), asm.R0, asm.Word),
+		asm.LoadMem(asm.R1, asm.R6, int16(issueFields["nr_sector"].Offset), asm.Word),
+		asm.LSh.Imm(asm.R1, 9),
+		asm.StoreMem(asm.RFP, startOff+offsetOf(blockIOStart, "bytes"), asm.R1, asm.Word),
+	)
+	issueInsns = append(issueInsns, classifyRWBS(issueFields["rwbs"])...)
+	issueInsns = append(issueInsns,
+		asm.StoreMem(asm.RFP, startOff+offsetOf(blockIOStart, "class"), asm.R7, asm.Word),
+		asm.LoadMapPtr(asm.R1, 0).WithReference("start"),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, -16),
+		asm.Mov.Reg(asm.R3, asm.RFP),
+		asm.Add.Imm(asm.R3, startOff),
+		asm.Mov.Imm(asm.R4, int32(ebpf.UpdateAny)),
+		asm.FnMapUpdateElem.Call(),
+	)
+	issueInsns = append(issueInsns, programExit()...)
+
+	// The completion keeps the issued request in R7, its latency at -24
+	// and the time at -96.
+	const classOff, totalsOff, slotOff, countOff = -32, -64, -80, -88
+	completeKey, err := storeBlockRequestKey(complete)
+	if err != nil {
+		return nil, err
+	}
+	completeInsns := append(asm.Instructions{asm.Mov.Reg(asm.R6, asm.R1)}, completeKey...)
+	completeInsns = append(completeInsns,
+		asm.LoadMapPtr(asm.R1, 0).WithReference("start"),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, -16),
+		asm.FnMapLookupElem.Call(),
+		asm.JEq.Imm(asm.R0, 0, "out"),
+		asm.Mov.Reg(asm.R7, asm.R0),
+		asm.FnKtimeGetNs.Call(),
+		asm.StoreMem(asm.RFP, -96, asm.R0, asm.DWord),
+		asm.LoadMem(asm.R1, asm.R7, offsetOf(blockIOStart, "ts"), asm.DWord),
+		asm.Sub.Reg(asm.R0, asm.R1),
+		asm.StoreMem(asm.RFP, -24, asm.R0, asm.DWord),
+
+		asm.LoadMem(asm.R1, asm.RFP, -16+offsetOf(blockRequest, "dev"), asm.Word),
+		asm.StoreMem(asm.RFP, classOff+offsetOf(blockIOClass, "dev"), asm.R1, asm.Word),
+		asm.StoreMem(asm.RFP, slotOff+offsetOf(blockIOSlot, "dev"), asm.R1, asm.Word),
+		asm.LoadMem(asm.R1, asm.R7, offsetOf(blockIOStart, "class"), asm.Word),
+		asm.StoreMem(asm.RFP, classOff+offsetOf(blockIOClass, "class"), asm.R1, asm.Word),
+		asm.StoreMem(asm.RFP, slotOff+offsetOf(blockIOSlot, "class"), asm.R1, asm.Word),
+	)
+	completeInsns = append(completeInsns, lookupOrInit("totals", classOff, totalsOff, blockIOTotals.Size, "forget")...)
+	completeInsns = append(completeInsns, asm.Mov.Imm(asm.R1, 1))
+	completeInsns = append(completeInsns, addTo(offsetOf(blockIOTotals, "count"), asm.R1)...)
+	completeInsns = append(completeInsns, asm.LoadMem(asm.R1, asm.R7, offsetOf(blockIOStart, "bytes"), asm.Word))
+	completeInsns = append(completeInsns, addTo(offsetOf(blockIOTotals, "bytes"), asm.R1)...)
+	completeInsns = append(completeInsns, asm.LoadMem(asm.R1, asm.RFP, -24, asm.DWord))
+	completeInsns = append(completeInsns, addTo(offsetOf(blockIOTotals, "latency_ns"), asm.R1)...)
+	completeInsns = append(completeInsns,
+		asm.LoadMem(asm.R1, asm.R6, int16(completeError.Offset), asm.Word),
+		asm.JEq.Imm(asm.R1, 0, "histogram"),
+		asm.Mov.Imm(asm.R1, 1),
+	)
+	completeInsns = append(completeInsns, addTo(offsetOf(blockIOTotals, "errors"), asm.R1)...)
+
+	completeInsns = append(completeInsns,
+		asm.LoadMem(asm.R1, asm.RFP, -24, asm.DWord).WithSymbol("histogram"),
+		asm.Div.Imm(asm.R1, divisor),
+	)
+	completeInsns = append(completeInsns, log2Slot(asm.R8, asm.R1, "log2")...)
+	completeInsns = append(completeInsns, asm.StoreMem(asm.RFP, slotOff+offsetOf(blockIOSlot, "slot"), asm.R8, asm.Word))
+	completeInsns = append(completeInsns, lookupOrInit("hist", slotOff, countOff, 8, "forget")...)
+	completeInsns = append(completeInsns,
+		asm.Mov.Imm(asm.R1, 1),
+		asm.StoreXAdd(asm.R0, asm.R1, asm.DWord),
+	)
+
+	if events {
+		// A full ringbuf is counted in lost rather than jumping out,
+		// so the request is still forgotten.
+		completeInsns = append(completeInsns,
+			asm.LoadMapPtr(asm.R1, 0).WithReference(builtinEventsMap),
+			asm.Mov.Imm(asm.R2, int32(blockIORecord.Size)),
+			asm.Mov.Imm(asm.R3, 0),
+			asm.FnRingbufReserve.Call(),
+			asm.JNE.Imm(asm.R0, 0, "reserved"),
+			asm.StoreImm(asm.RFP, -40, 0, asm.Word),
+			asm.LoadMapPtr(asm.R1, 0).WithReference("lost"),
+			asm.Mov.Reg(asm.R2, asm.RFP),
+			asm.Add.Imm(asm.R2, -40),
+			asm.FnMapLookupElem.Call(),
+			asm.JEq.Imm(asm.R0, 0, "forget"),
+			asm.Mov.Imm(asm.R1, 1),
+			asm.StoreXAdd(asm.R0, asm.R1, asm.DWord),
+			asm.Ja.Label("forget"),
+
+			asm.Mov.Reg(asm.R9, asm.R0).WithSymbol("reserved"),
+			asm.LoadMem(asm.R1, asm.RFP, -96, asm.DWord),
+			asm.StoreMem(asm.R9, offsetOf(blockIORecord, "ktime_ns"), asm.R1, asm.DWord),
+			asm.LoadMem(asm.R1, asm.RFP, -24, asm.DWord),
+			asm.StoreMem(asm.R9, offsetOf(blockIORecord, "latency_ns"), asm.R1, asm.DWord),
+			asm.LoadMem(asm.R1, asm.RFP, -16+offsetOf(blockRequest, "sector"), asm.DWord),
+			asm.StoreMem(asm.R9, offsetOf(blockIORecord, "sector"), asm.R1, asm.DWord),
+			asm.LoadMem(asm.R1, asm.RFP, -16+offsetOf(blockRequest, "dev"), asm.Word),
+			asm.StoreMem(asm.R9, offsetOf(blockIORecord, "dev"), asm.R1, asm.Word),
+		)
+		for _, f := range []string{"bytes", "class", "pid"} {
+			completeInsns = append(completeInsns,
+				asm.LoadMem(asm.R1, asm.R7, offsetOf(blockIOStart, f), asm.Word),
+				asm.StoreMem(asm.R9, offsetOf(blockIORecord, f), asm.R1, asm.Word),
+			)
+		}
+		for half := int16(0); half < taskCommLen; half += 8 {
+			completeInsns = append(completeInsns,
+				asm.LoadMem(asm.R1, asm.R7, offsetOf(blockIOStart, "comm")+half, asm.DWord),
+				asm.StoreMem(asm.R9, offsetOf(blockIORecord, "comm")+half, asm.R1, asm.DWord),
+			)
+		}
+		completeInsns = append(completeInsns, copyCtxField(completeError, offsetOf(blockIORecord, "error"), asm.Word)...)
+		completeInsns = append(completeInsns, submitRecord()...)
+	}
+	completeInsns = append(completeInsns,
+		asm.LoadMapPtr(asm.R1, 0).WithReference("start").WithSymbol("forget"),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, -16),
+		asm.FnMapDeleteElem.Call(),
+	)
+	completeInsns = append(completeInsns, programExit()...)
+
+	spec := &ebpf.CollectionSpec{
+		Maps: map[string]*ebpf.MapSpec{
+			"start": {
+				Name:       "blkio_start",
+				Type:       ebpf.Hash,
+				KeySize:    blockRequest.Size,
+				ValueSize:  blockIOStart.Size,
+				MaxEntries: builtinTrackedEntries,
+				Key:        blockRequest,
+				Value:      blockIOStart,
+			},
+			"totals": {
+				Name:       "blkio_totals",
+				Type:       ebpf.Hash,
+				KeySize:    blockIOClass.Size,
+				ValueSize:  blockIOTotals.Size,
+				MaxEntries: maxBlockDevices * blockIOClasses,
+				Key:        blockIOClass,
+				Value:      blockIOTotals,
+			},
+			"hist": {
+				Name:       "blkio_hist",
+				Type:       ebpf.Hash,
+				KeySize:    blockIOSlot.Size,
+				ValueSize:  8,
+				MaxEntries: maxHistogramSlots,
+				Key:        blockIOSlot,
+				Value:      btfU64,
+			},
+			"lost": {
+				Name:       "blkio_lost",
+				Type:       ebpf.Array,
+				KeySize:    4,
+				ValueSize:  8,
+				MaxEntries: 1,
+			},
+		},
+		Programs: map[string]*ebpf.ProgramSpec{
+			"block_io_issue":    tracepointProgram("block_io_issue", issueInsns),
+			"block_io_complete": tracepointProgram("block_io_complete", completeInsns),
+		},
+	}
+	if devFilter > 0 {
+		spec.Maps["devs"] = &ebpf.MapSpec{
+			Name:       "blkio_devs",
+			Type:       ebpf.Hash,
+			KeySize:    4,
+			ValueSize:  1,
+			MaxEntries: uint32(devFilter),
+		}
+	}
+	if events {
+		spec.Maps[builtinEventsMap] = eventsMapSpec()
+	}
+	return spec, nil
+}
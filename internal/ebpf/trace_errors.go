@@ -1,52 +1,540 @@
 package ebpf
 
 import (
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/cilium/ebpf"
 	"github.com/cilium/ebpf/asm"
 	"github.com/cilium/ebpf/link"
 	"github.com/cilium/ebpf/rlimit"
+	"github.com/sameehj/ebpf-mcp/pkg/types"
+	"golang.org/x/sys/unix"
 )
 
+const (
+	defaultTraceDuration = 2 * time.Second
+	maxTraceDuration     = 60 * time.Second
+	defaultTraceSamples  = 10
+	maxTraceSamples      = 100
+	defaultTraceTop      = 20
+	maxTracePids         = 1024
+	traceRingbufSize     = 1 << 20
+	taskCommLen          = 16
+
+	// syscallErrorRecordSize is the size of the records the program
+	// submits: pid_tgid, syscall number and return value as u64s, then
+	// the task comm.
+	syscallErrorRecordSize = 8 + 8 + 8 + taskCommLen
+)
+
+// Slots of the trace_errors counters map.
+const (
+	// traceErrFiltered counts failures the comm and errno filters skipped.
+	traceErrFiltered = iota
+	// traceErrDropped counts failures lost to a full ring buffer.
+	traceErrDropped
+	traceErrCounters
+)
+
+type TraceErrorsArgs struct {
+	DurationMs int      `json:"duration_ms,omitempty"`
+	Pids       []int    `json:"pids,omitempty"`
+	Comm       string   `json:"comm,omitempty"`
+	Errnos     []string `json:"errnos,omitempty"`
+	MaxSamples int      `json:"max_samples,omitempty"`
+	Top        int      `json:"top,omitempty"`
+}
+
 type TraceResult struct {
-	Status   string   `json:"status"`
-	Traced   int      `json:"traced_events"`
-	Warnings []string `json:"warnings,omitempty"`
+	Success     bool                `json:"success"`
+	ToolVersion string              `json:"tool_version"`
+	Status      string              `json:"status"`
+	Traced      int                 `json:"traced_events"`
+	DurationMs  int64               `json:"duration_ms"`
+	Filtered    int                 `json:"events_filtered"`
+	Dropped     int                 `json:"events_dropped"`
+	Counts      []SyscallErrorCount `json:"counts"`
+	Samples     []SyscallError      `json:"samples"`
+	Warnings    []string            `json:"warnings,omitempty"`
+	Error       string              `json:"error,omitempty"`
+}
+
+// SyscallErrorCount counts the failures of one system call with one errno.
+type SyscallErrorCount struct {
+	Syscall   string         `json:"syscall"`
+	ErrnoName string         `json:"errno_name"`
+	Errno     int            `json:"errno"`
+	Count     int            `json:"count"`
+	Processes map[string]int `json:"processes"`
 }
 
-func RunTraceErrors() (*TraceResult, error) {
+// SyscallError is one failed system call.
+type SyscallError struct {
+	TimestampNs int64  `json:"timestamp_ns"`
+	Pid         uint32 `json:"pid"`
+	Tid         uint32 `json:"tid"`
+	Comm        string `json:"comm"`
+	Syscall     string `json:"syscall"`
+	SyscallNr   int64  `json:"syscall_nr"`
+	Ret         int64  `json:"ret"`
+	Errno       int    `json:"errno"`
+	ErrnoName   string `json:"errno_name"`
+}
+
+func ParseTraceErrorsArgs(input map[string]interface{}) (*TraceErrorsArgs, error) {
+	var args TraceErrorsArgs
+	if input == nil {
+		return &args, nil
+	}
+	if err := types.StrictUnmarshal(input, &args); err != nil {
+		return nil, fmt.Errorf("failed to parse trace errors args: %w", err)
+	}
+	return &args, nil
+}
+
+func traceErrorsFailure(err error) (*TraceResult, error) {
+	return &TraceResult{
+		Success:     false,
+		ToolVersion: "v1",
+		Status:      "failed",
+		Error:       err.Error(),
+	}, err
+}
+
+// RunTraceErrors attaches to raw_syscalls:sys_exit for the requested
+// duration, or until ctx is cancelled, and reports the system calls that
+// failed. The program, link and maps are released either way.
+func RunTraceErrors(ctx context.Context, args *TraceErrorsArgs) (*TraceResult, error) {
+	if args == nil {
+		return traceErrorsFailure(errors.New("args cannot be nil"))
+	}
+
+	duration := time.Duration(args.DurationMs) * time.Millisecond
+	if duration == 0 {
+		duration = defaultTraceDuration
+	}
+	if duration < 0 || duration > maxTraceDuration {
+		return traceErrorsFailure(fmt.Errorf("duration_ms must be between 1 and %d", maxTraceDuration.Milliseconds()))
+	}
+	maxSamples := args.MaxSamples
+	if maxSamples == 0 {
+		maxSamples = defaultTraceSamples
+	}
+	if maxSamples < 0 || maxSamples > maxTraceSamples {
+		return traceErrorsFailure(fmt.Errorf("max_samples must be between 1 and %d", maxTraceSamples))
+	}
+	top := args.Top
+	if top == 0 {
+		top = defaultTraceTop
+	}
+	if top < 0 {
+		return traceErrorsFailure(errors.New("top cannot be negative"))
+	}
+	if len(args.Pids) > maxTracePids {
+		return traceErrorsFailure(fmt.Errorf("at most %d pids can be traced", maxTracePids))
+	}
+	if len(args.Comm) >= taskCommLen {
+		return traceErrorsFailure(fmt.Errorf("comm %q is longer than the %d bytes of a command name", args.Comm, taskCommLen-1))
+	}
+	errnos, err := parseErrnos(args.Errnos)
+	if err != nil {
+		return traceErrorsFailure(err)
+	}
+	tf, err := loadTracepointFormat("raw_syscalls", "sys_exit")
+	if err != nil {
+		return traceErrorsFailure(err)
+	}
+	fields, err := tf.fieldsOf(map[string]int{"id": 8, "ret": 8})
+	if err != nil {
+		return traceErrorsFailure(err)
+	}
+
 	if err := rlimit.RemoveMemlock(); err != nil {
-		return nil, fmt.Errorf("rlimit error: %v", err)
+		return traceErrorsFailure(fmt.Errorf("rlimit error: %v", err))
+	}
+
+	events, err := ebpf.NewMap(&ebpf.MapSpec{
+		Name:       "trace_errors",
+		Type:       ebpf.RingBuf,
+		MaxEntries: traceRingbufSize,
+	})
+	if err != nil {
+		return traceErrorsFailure(fmt.Errorf("failed to create ringbuf: %v", err))
+	}
+	defer events.Close()
+
+	var pids *ebpf.Map
+	if len(args.Pids) > 0 {
+		pids, err = ebpf.NewMap(&ebpf.MapSpec{
+			Name:       "trace_err_pids",
+			Type:       ebpf.Hash,
+			KeySize:    4,
+			ValueSize:  1,
+			MaxEntries: uint32(len(args.Pids)),
+		})
+		if err != nil {
+			return traceErrorsFailure(fmt.Errorf("failed to create pid filter: %v", err))
+		}
+		defer pids.Close()
+		for _, pid := range args.Pids {
+			if pid <= 0 {
+				return traceErrorsFailure(fmt.Errorf("invalid pid %d", pid))
+			}
+			if err := pids.Put(uint32(pid), uint8(1)); err != nil {
+				return traceErrorsFailure(fmt.Errorf("failed to add pid %d to filter: %v", pid, err))
+			}
+		}
+	}
+
+	var errnoSet *ebpf.Map
+	if errnos != nil {
+		errnoSet, err = ebpf.NewMap(&ebpf.MapSpec{
+			Name:       "trace_err_errnos",
+			Type:       ebpf.Hash,
+			KeySize:    4,
+			ValueSize:  1,
+			MaxEntries: uint32(len(errnos)),
+		})
+		if err != nil {
+			return traceErrorsFailure(fmt.Errorf("failed to create errno filter: %v", err))
+		}
+		defer errnoSet.Close()
+		for errno := range errnos {
+			if err := errnoSet.Put(uint32(errno), uint8(1)); err != nil {
+				return traceErrorsFailure(fmt.Errorf("failed to add errno %d to filter: %v", errno, err))
+			}
+		}
+	}
+
+	counters, err := ebpf.NewMap(&ebpf.MapSpec{
+		Name:       "trace_err_counts",
+		Type:       ebpf.Array,
+		KeySize:    4,
+		ValueSize:  8,
+		MaxEntries: traceErrCounters,
+	})
+	if err != nil {
+		return traceErrorsFailure(fmt.Errorf("failed to create counters: %v", err))
 	}
+	defer counters.Close()
 
-	progSpec := &ebpf.ProgramSpec{
-		Name:    "trace_exit",
+	prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+		Name:    "trace_errors",
 		Type:    ebpf.TracePoint,
 		License: "GPL",
-		Instructions: asm.Instructions{
-			asm.Mov.Imm(asm.R0, 0),
-			asm.Return(),
-		},
+		Instructions: syscallErrorInstructions(syscallErrorProgram{
+			id:       fields["id"],
+			ret:      fields["ret"],
+			events:   events,
+			pids:     pids,
+			errnos:   errnoSet,
+			counters: counters,
+			comm:     args.Comm,
+			self:     os.Getpid(),
+		}),
+	})
+	if err != nil {
+		return traceErrorsFailure(fmt.Errorf("failed to load program: %v", err))
 	}
+	defer prog.Close()
 
-	prog, err := ebpf.NewProgram(progSpec)
+	rd, err := newEventReader(events, SourceRingbuf)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load program: %v", err)
+		return traceErrorsFailure(err)
 	}
-	defer prog.Close()
+	defer rd.Close()
 
-	tp, err := link.Tracepoint("sched", "sched_switch", prog, nil)
+	tp, err := link.Tracepoint("raw_syscalls", "sys_exit", prog, nil)
 	if err != nil {
-		return nil, fmt.Errorf("tracepoint attach failed: %v", err)
+		return traceErrorsFailure(fmt.Errorf("tracepoint attach failed: %v", err))
 	}
 	defer tp.Close()
 
-	time.Sleep(2 * time.Second)
+	stop := context.AfterFunc(ctx, func() { rd.Close() })
+	defer stop()
 
-	return &TraceResult{
-		Status: "Tracepoint attached and ran for 2s",
-		Traced: 0,
-	}, nil
+	start := time.Now()
+	rd.SetDeadline(start.Add(duration))
+
+	result := &TraceResult{
+		Success:     true,
+		ToolVersion: "v1",
+		Samples:     []SyscallError{},
+	}
+	counts := make(map[[2]int64]*SyscallErrorCount)
+	for {
+		rec, err := rd.Read()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			break
+		}
+		if ctx.Err() != nil {
+			return traceErrorsFailure(fmt.Errorf("trace cancelled: %w", ctx.Err()))
+		}
+		if err != nil {
+			return traceErrorsFailure(fmt.Errorf("read events: %w", err))
+		}
+
+		ev, ok := decodeSyscallError(rec.Data)
+		if !ok {
+			continue
+		}
+
+		result.Traced++
+		key := [2]int64{ev.SyscallNr, int64(ev.Errno)}
+		c, ok := counts[key]
+		if !ok {
+			c = &SyscallErrorCount{
+				Syscall:   ev.Syscall,
+				Errno:     ev.Errno,
+				ErrnoName: ev.ErrnoName,
+				Processes: make(map[string]int),
+			}
+			counts[key] = c
+		}
+		c.Count++
+		c.Processes[ev.Comm]++
+		if len(result.Samples) < maxSamples {
+			result.Samples = append(result.Samples, ev)
+		}
+	}
+	result.DurationMs = time.Since(start).Milliseconds()
+
+	var filtered, dropped uint64
+	if err := counters.Lookup(uint32(traceErrFiltered), &filtered); err != nil {
+		return traceErrorsFailure(fmt.Errorf("read counters: %w", err))
+	}
+	if err := counters.Lookup(uint32(traceErrDropped), &dropped); err != nil {
+		return traceErrorsFailure(fmt.Errorf("read counters: %w", err))
+	}
+	result.Filtered, result.Dropped = int(filtered), int(dropped)
+	if dropped > 0 {
+		result.Warnings = append(result.Warnings,
+			fmt.Sprintf("%d failed syscalls were lost because the ring buffer was full", dropped))
+	}
+
+	result.Counts = make([]SyscallErrorCount, 0, len(counts))
+	for _, c := range counts {
+		result.Counts = append(result.Counts, *c)
+	}
+	sort.Slice(result.Counts, func(i, j int) bool {
+		a, b := result.Counts[i], result.Counts[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		if a.Syscall != b.Syscall {
+			return a.Syscall < b.Syscall
+		}
+		return a.Errno < b.Errno
+	})
+	if len(result.Counts) > top {
+		result.Warnings = append(result.Warnings,
+			fmt.Sprintf("showing the top %d of %d syscall/errno pairs", top, len(result.Counts)))
+		result.Counts = result.Counts[:top]
+	}
+
+	result.Status = fmt.Sprintf("Traced %d failed syscalls on raw_syscalls:sys_exit for %dms", result.Traced, result.DurationMs)
+	return result, nil
+}
+
+// syscallErrorProgram configures the sys_exit program.
+type syscallErrorProgram struct {
+	// id and ret are the sys_exit context fields.
+	id, ret tracepointField
+	events  *ebpf.Map
+	// pids and errnos, when set, hold the only pids and errnos to report.
+	pids, errnos *ebpf.Map
+	counters     *ebpf.Map
+	// comm, when set, is the only command name to report.
+	comm string
+	self int
+}
+
+// syscallErrorInstructions builds the sys_exit program. It submits a
+// record for every failing system call, skipping the server's own process
+// and, with a pid map, processes not in it. Failures the errno and comm
+// filters skip, and records the ring buffer has no room for, are counted.
+func syscallErrorInstructions(p syscallErrorProgram) asm.Instructions {
+	// Offsets into the record built on the stack, and of map keys.
+	const (
+		recPidTgid = -48
+		recID      = -40
+		recRet     = -32
+		recComm    = -24
+		pidKey     = -52
+		errnoKey   = -56
+		counterKey = -60
+	)
+
+	insns := asm.Instructions{
+		asm.Mov.Reg(asm.R6, asm.R1),
+		asm.LoadMem(asm.R7, asm.R6, int16(p.ret.Offset), asm.DWord),
+		asm.JSGE.Imm(asm.R7, 0, "out"),
+		asm.JSLT.Imm(asm.R7, -4095, "out"),
+		asm.FnGetCurrentPidTgid.Call(),
+		asm.Mov.Reg(asm.R8, asm.R0),
+		asm.Mov.Reg(asm.R9, asm.R0),
+		asm.RSh.Imm(asm.R9, 32),
+		asm.JEq.Imm(asm.R9, int32(p.self), "out"),
+	}
+	if p.pids != nil {
+		insns = append(insns,
+			asm.StoreMem(asm.RFP, pidKey, asm.R9, asm.Word),
+			asm.LoadMapPtr(asm.R1, p.pids.FD()),
+			asm.Mov.Reg(asm.R2, asm.RFP),
+			asm.Add.Imm(asm.R2, pidKey),
+			asm.FnMapLookupElem.Call(),
+			asm.JEq.Imm(asm.R0, 0, "out"),
+		)
+	}
+	if p.errnos != nil {
+		insns = append(insns,
+			asm.Mov.Imm(asm.R1, 0),
+			asm.Sub.Reg(asm.R1, asm.R7),
+			asm.StoreMem(asm.RFP, errnoKey, asm.R1, asm.Word),
+			asm.LoadMapPtr(asm.R1, p.errnos.FD()),
+			asm.Mov.Reg(asm.R2, asm.RFP),
+			asm.Add.Imm(asm.R2, errnoKey),
+			asm.FnMapLookupElem.Call(),
+			asm.JEq.Imm(asm.R0, 0, "filtered"),
+		)
+	}
+	insns = append(insns,
+		asm.Mov.Reg(asm.R1, asm.RFP),
+		asm.Add.Imm(asm.R1, recComm),
+		asm.Mov.Imm(asm.R2, taskCommLen),
+		asm.FnGetCurrentComm.Call(),
+	)
+	if p.comm != "" {
+		// The helper pads the name with zeros, so it is compared as two
+		// u64s.
+		var want [taskCommLen]byte
+		copy(want[:], p.comm)
+		for off := 0; off < taskCommLen; off += 8 {
+			insns = append(insns,
+				asm.LoadMem(asm.R1, asm.RFP, recComm+int16(off), asm.DWord),
+				asm.LoadImm(asm.R2, int64(binary.NativeEndian.Uint64(want[off:])), asm.DWord),
+				asm.JNE.Reg(asm.R1, asm.R2, "filtered"),
+			)
+		}
+	}
+	insns = append(insns,
+		asm.StoreMem(asm.RFP, recPidTgid, asm.R8, asm.DWord),
+		asm.LoadMem(asm.R1, asm.R6, int16(p.id.Offset), asm.DWord),
+		asm.StoreMem(asm.RFP, recID, asm.R1, asm.DWord),
+		asm.StoreMem(asm.RFP, recRet, asm.R7, asm.DWord),
+		asm.LoadMapPtr(asm.R1, p.events.FD()),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, recPidTgid),
+		asm.Mov.Imm(asm.R3, syscallErrorRecordSize),
+		asm.Mov.Imm(asm.R4, 0),
+		asm.FnRingbufOutput.Call(),
+		asm.JEq.Imm(asm.R0, 0, "out"),
+		asm.Mov.Imm(asm.R1, traceErrDropped),
+	)
+	if p.errnos != nil || p.comm != "" {
+		// The verifier rejects the block when no filter jumps to it.
+		insns = append(insns,
+			asm.Ja.Label("count"),
+			asm.Mov.Imm(asm.R1, traceErrFiltered).WithSymbol("filtered"),
+		)
+	}
+	return append(insns,
+		asm.StoreMem(asm.RFP, counterKey, asm.R1, asm.Word).WithSymbol("count"),
+		asm.LoadMapPtr(asm.R1, p.counters.FD()),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, counterKey),
+		asm.FnMapLookupElem.Call(),
+		asm.JEq.Imm(asm.R0, 0, "out"),
+		asm.Mov.Imm(asm.R1, 1),
+		asm.StoreXAdd(asm.R0, asm.R1, asm.DWord),
+		asm.Mov.Imm(asm.R0, 0).WithSymbol("out"),
+		asm.Return(),
+	)
+}
+
+func decodeSyscallError(data []byte) (SyscallError, bool) {
+	if len(data) < syscallErrorRecordSize {
+		return SyscallError{}, false
+	}
+	pidTgid := binary.NativeEndian.Uint64(data[0:])
+	nr := int64(binary.NativeEndian.Uint64(data[8:]))
+	ret := int64(binary.NativeEndian.Uint64(data[16:]))
+	comm := data[24 : 24+taskCommLen]
+	if i := strings.IndexByte(string(comm), 0); i >= 0 {
+		comm = comm[:i]
+	}
+
+	errno := int(-ret)
+	return SyscallError{
+		TimestampNs: time.Now().UnixNano(),
+		Pid:         uint32(pidTgid >> 32),
+		Tid:         uint32(pidTgid),
+		Comm:        string(comm),
+		Syscall:     syscallName(nr),
+		SyscallNr:   nr,
+		Ret:         ret,
+		Errno:       errno,
+		ErrnoName:   errnoName(errno),
+	}, true
+}
+
+func syscallName(nr int64) string {
+	if name, ok := syscallNames[nr]; ok {
+		return name
+	}
+	return fmt.Sprintf("syscall_%d", nr)
+}
+
+// errnoName names an errno. Kernel-internal codes such as ERESTARTSYS
+// never reach user space and have no name.
+func errnoName(errno int) string {
+	if name := unix.ErrnoName(syscall.Errno(errno)); name != "" {
+		return name
+	}
+	return fmt.Sprintf("errno_%d", errno)
+}
+
+var (
+	errnoValuesOnce sync.Once
+	errnoValues     map[string]int
+)
+
+// parseErrnos turns errno names ("ENOENT") or numbers into a set. A nil set
+// matches every errno.
+func parseErrnos(names []string) (map[int]bool, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	errnoValuesOnce.Do(func() {
+		errnoValues = make(map[string]int)
+		for i := 1; i < 4096; i++ {
+			if name := unix.ErrnoName(syscall.Errno(i)); name != "" {
+				errnoValues[name] = i
+			}
+		}
+	})
+
+	set := make(map[int]bool, len(names))
+	for _, name := range names {
+		if n, err := strconv.Atoi(name); err == nil && n > 0 && n < 4096 {
+			set[n] = true
+			continue
+		}
+		n, ok := errnoValues[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown errno %q", name)
+		}
+		set[n] = true
+	}
+	return set, nil
 }
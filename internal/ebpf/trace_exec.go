@@ -0,0 +1,585 @@
+package ebpf
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/link"
+	"github.com/cilium/ebpf/rlimit"
+	"github.com/sameehj/ebpf-mcp/pkg/types"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	defaultExecDuration  = 5 * time.Second
+	defaultExecEvents    = 100
+	maxExecEvents        = 10000
+	execRingbufSize      = 4 << 20
+	execArgs             = 20
+	execArgLen           = 128
+	cgroupFSRoot         = "/sys/fs/cgroup"
+	execRecordExec       = 0
+	execRecordReturn     = 1
+	execRecordExit       = 2
+	execTrackedProcesses = 10240
+)
+
+// execRecord is what the trace_exec programs submit. Return and exit
+// records stop at argc.
+var execRecord = newStruct("exec_record",
+	structField{"kind", btfU32},
+	structField{"pid", btfU32},
+	structField{"tid", btfU32},
+	structField{"ppid", btfU32},
+	structField{"uid", btfU32},
+	structField{"ret", btfS32},
+	structField{"cgroup_id", btfU64},
+	structField{"ktime_ns", btfU64},
+	structField{"comm", btfArray(btfChar, taskCommLen)},
+	structField{"argc", btfU32},
+	structField{"argv_truncated", btfU32},
+	structField{"filename", btfArray(btfChar, builtinPathLen)},
+	structField{"argv", btfArray(btfArray(btfChar, execArgLen), execArgs)},
+)
+
+var execHeaderSize = uint32(offsetOf(execRecord, "argc"))
+
+type TraceExecArgs struct {
+	DurationMs int    `json:"duration_ms,omitempty"`
+	MaxEvents  int    `json:"max_events,omitempty"`
+	Pids       []int  `json:"pids,omitempty"`
+	Uids       []int  `json:"uids,omitempty"`
+	Cgroup     string `json:"cgroup,omitempty"`
+}
+
+// TraceExecResult has the shape of a stream_events result, so clients can
+// handle both alike.
+type TraceExecResult struct {
+	Success     bool                     `json:"success"`
+	ToolVersion string                   `json:"tool_version"`
+	Status      string                   `json:"status"`
+	Events      []map[string]interface{} `json:"events"`
+	Stats       map[string]interface{}   `json:"stats"`
+	Complete    bool                     `json:"complete"`
+	Warnings    []string                 `json:"warnings,omitempty"`
+	Error       string                   `json:"error,omitempty"`
+}
+
+func ParseTraceExecArgs(input map[string]interface{}) (*TraceExecArgs, error) {
+	var args TraceExecArgs
+	if input == nil {
+		return &args, nil
+	}
+	if err := types.StrictUnmarshal(input, &args); err != nil {
+		return nil, fmt.Errorf("failed to parse trace exec args: %w", err)
+	}
+	return &args, nil
+}
+
+func traceExecFailure(err error) (*TraceExecResult, error) {
+	return &TraceExecResult{
+		Success:     false,
+		ToolVersion: "v1",
+		Status:      "failed",
+		Error:       err.Error(),
+	}, err
+}
+
+// RunTraceExec records the processes executed for the requested duration,
+// or until ctx is cancelled. Executions are captured on execve entry, with
+// the result of the call and, for processes that exit before the trace
+// ends, their exit status.
+func RunTraceExec(ctx context.Context, args *TraceExecArgs) (*TraceExecResult, error) {
+	if args == nil {
+		return traceExecFailure(errors.New("args cannot be nil"))
+	}
+
+	duration := time.Duration(args.DurationMs) * time.Millisecond
+	if duration == 0 {
+		duration = defaultExecDuration
+	}
+	if duration < 0 || duration > maxTraceDuration {
+		return traceExecFailure(fmt.Errorf("duration_ms must be between 1 and %d", maxTraceDuration.Milliseconds()))
+	}
+	maxEvents := args.MaxEvents
+	if maxEvents == 0 {
+		maxEvents = defaultExecEvents
+	}
+	if maxEvents < 0 || maxEvents > maxExecEvents {
+		return traceExecFailure(fmt.Errorf("max_events must be between 1 and %d", maxExecEvents))
+	}
+	pids := make(map[uint32]bool, len(args.Pids))
+	for _, pid := range args.Pids {
+		if pid <= 0 {
+			return traceExecFailure(fmt.Errorf("invalid pid %d", pid))
+		}
+		pids[uint32(pid)] = true
+	}
+	uids := make(map[uint32]bool, len(args.Uids))
+	for _, uid := range args.Uids {
+		if uid < 0 {
+			return traceExecFailure(fmt.Errorf("invalid uid %d", uid))
+		}
+		uids[uint32(uid)] = true
+	}
+
+	var cgroup *os.File
+	if args.Cgroup != "" {
+		path := args.Cgroup
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(cgroupFSRoot, path)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return traceExecFailure(fmt.Errorf("cgroup: %w", err))
+		}
+		defer f.Close()
+		cgroup = f
+	}
+
+	if err := rlimit.RemoveMemlock(); err != nil {
+		return traceExecFailure(fmt.Errorf("rlimit error: %v", err))
+	}
+
+	spec, err := execTraceSpec(cgroup != nil)
+	if err != nil {
+		return traceExecFailure(err)
+	}
+	coll, err := ebpf.NewCollection(spec)
+	if err != nil {
+		return traceExecFailure(fmt.Errorf("failed to load programs: %v", err))
+	}
+	defer coll.Close()
+	if cgroup != nil {
+		if err := coll.Maps["cgroup"].Put(uint32(0), uint32(cgroup.Fd())); err != nil {
+			return traceExecFailure(fmt.Errorf("failed to set cgroup filter (is %s a cgroup v2 directory?): %v", cgroup.Name(), err))
+		}
+	}
+
+	events := coll.Maps[builtinEventsMap]
+	rd, err := newEventReader(events, SourceRingbuf)
+	if err != nil {
+		return traceExecFailure(err)
+	}
+	defer rd.Close()
+
+	// Exits are attached first so no process exec'd during the trace is
+	// missed.
+	for _, h := range []struct{ group, name, prog string }{
+		{"sched", "sched_process_exit", "exec_exit"},
+		{"syscalls", "sys_exit_execve", "exec_return"},
+		{"syscalls", "sys_enter_execve", "exec_enter"},
+	} {
+		tp, err := link.Tracepoint(h.group, h.name, coll.Programs[h.prog], nil)
+		if err != nil {
+			return traceExecFailure(fmt.Errorf("tracepoint %s:%s attach failed: %v", h.group, h.name, err))
+		}
+		defer tp.Close()
+	}
+
+	stop := context.AfterFunc(ctx, func() { rd.Close() })
+	defer stop()
+
+	start := time.Now()
+	rd.SetDeadline(start.Add(duration))
+
+	mapID := 0
+	if info, err := events.Info(); err == nil {
+		id, _ := info.ID()
+		mapID = int(id)
+	}
+	result := &TraceExecResult{
+		Success:     true,
+		ToolVersion: "v1",
+		Events:      []map[string]interface{}{},
+	}
+	var received, filtered, failed, exited, dropped int
+	// latest maps a process to its most recent execution, which its
+	// execve return and exit are attributed to.
+	latest := make(map[uint32]map[string]interface{})
+	for {
+		rec, err := rd.Read()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			break
+		}
+		if ctx.Err() != nil {
+			return traceExecFailure(fmt.Errorf("trace cancelled: %w", ctx.Err()))
+		}
+		if err != nil {
+			return traceExecFailure(fmt.Errorf("read events: %w", err))
+		}
+
+		r, ok := decodeExecRecord(rec.Data)
+		if !ok {
+			continue
+		}
+		switch r.kind {
+		case execRecordExec:
+			received++
+			if (len(pids) > 0 && !pids[r.pid] && !pids[r.ppid]) || (len(uids) > 0 && !uids[r.uid]) {
+				filtered++
+				delete(latest, r.pid)
+				continue
+			}
+			if len(result.Events) >= maxEvents {
+				dropped++
+				delete(latest, r.pid)
+				continue
+			}
+			data := map[string]interface{}{
+				"pid":            r.pid,
+				"tid":            r.tid,
+				"ppid":           r.ppid,
+				"uid":            r.uid,
+				"cgroup_id":      r.cgroupID,
+				"comm":           r.comm,
+				"filename":       r.filename,
+				"argv":           r.argv,
+				"argv_truncated": r.truncated,
+			}
+			event := newStreamEvent(rec, mapID, "json", data, nil)
+			event["ktime_ns"] = r.ktime
+			result.Events = append(result.Events, event)
+			latest[r.pid] = event
+		case execRecordReturn:
+			event, ok := latest[r.pid]
+			if !ok {
+				continue
+			}
+			data := event["data"].(map[string]interface{})
+			data["ret"] = r.ret
+			if r.ret < 0 {
+				failed++
+				data["errno"] = -r.ret
+				data["errno_name"] = errnoName(int(-r.ret))
+				delete(latest, r.pid)
+			} else {
+				// The command name changes to the new program's on
+				// success.
+				data["caller_comm"] = data["comm"]
+				data["comm"] = r.comm
+			}
+		case execRecordExit:
+			event, ok := latest[r.pid]
+			if !ok {
+				continue
+			}
+			delete(latest, r.pid)
+			exited++
+			data := event["data"].(map[string]interface{})
+			status := syscall.WaitStatus(uint32(r.ret))
+			data["exited"] = true
+			if status.Signaled() {
+				data["exit_signal"] = unix.SignalName(status.Signal())
+				data["core_dumped"] = status.CoreDump()
+			} else {
+				data["exit_code"] = status.ExitStatus()
+			}
+			data["runtime_ns"] = r.ktime - event["ktime_ns"].(uint64)
+		}
+	}
+	elapsed := time.Since(start)
+	for _, event := range result.Events {
+		delete(event, "ktime_ns")
+	}
+
+	if dropped > 0 {
+		result.Warnings = append(result.Warnings,
+			fmt.Sprintf("max_events reached: %d further executions were not returned", dropped))
+	}
+	result.Stats = map[string]interface{}{
+		"duration_ms":       elapsed.Milliseconds(),
+		"events_received":   received,
+		"events_filtered":   filtered,
+		"events_dropped":    dropped,
+		"events_per_second": float64(received) / elapsed.Seconds(),
+		"failed_execs":      failed,
+		"exited":            exited,
+	}
+	result.Complete = true
+	result.Status = fmt.Sprintf("Traced %d process executions for %dms", len(result.Events), elapsed.Milliseconds())
+	return result, nil
+}
+
+// execTraceSpec assembles the programs of trace_exec. With cgroupFilter,
+// they only fire for tasks under the cgroup in slot 0 of the cgroup map.
+func execTraceSpec(cgroupFilter bool) (*ebpf.CollectionSpec, error) {
+	enter, err := loadTracepointFormat("syscalls", "sys_enter_execve")
+	if err != nil {
+		return nil, err
+	}
+	filename, err := enter.field("filename", 8)
+	if err != nil {
+		return nil, err
+	}
+	argv, err := enter.field("argv", 8)
+	if err != nil {
+		return nil, err
+	}
+	exit, err := loadTracepointFormat("syscalls", "sys_exit_execve")
+	if err != nil {
+		return nil, err
+	}
+	ret, err := exit.field("ret", 8)
+	if err != nil {
+		return nil, err
+	}
+	procExit, err := loadTracepointFormat("sched", "sched_process_exit")
+	if err != nil {
+		return nil, err
+	}
+	ko, err := loadKernelOffsets()
+	if err != nil {
+		return nil, err
+	}
+	realParent, err := ko.offset("task_struct", "real_parent")
+	if err != nil {
+		return nil, err
+	}
+	tgid, err := ko.offset("task_struct", "tgid")
+	if err != nil {
+		return nil, err
+	}
+	exitCode, err := ko.offset("task_struct", "exit_code")
+	if err != nil {
+		return nil, err
+	}
+
+	prologue := asm.Instructions{asm.Mov.Reg(asm.R6, asm.R1)}
+	if cgroupFilter {
+		prologue = append(prologue,
+			asm.LoadMapPtr(asm.R1, 0).WithReference("cgroup"),
+			asm.Mov.Imm(asm.R2, 0),
+			asm.FnCurrentTaskUnderCgroup.Call(),
+			asm.JNE.Imm(asm.R0, 1, "out"),
+		)
+	}
+	header := func(kind int32) asm.Instructions {
+		insns := asm.Instructions{asm.StoreImm(asm.R9, offsetOf(execRecord, "kind"), int64(kind), asm.Word)}
+		insns = append(insns, storePidTgid(offsetOf(execRecord, "pid"), offsetOf(execRecord, "tid"))...)
+		insns = append(insns, storeUID(offsetOf(execRecord, "uid"))...)
+		insns = append(insns, storeParentTgid(offsetOf(execRecord, "ppid"), realParent, tgid)...)
+		insns = append(insns,
+			asm.FnGetCurrentCgroupId.Call(),
+			asm.StoreMem(asm.R9, offsetOf(execRecord, "cgroup_id"), asm.R0, asm.DWord),
+			asm.FnKtimeGetNs.Call(),
+			asm.StoreMem(asm.R9, offsetOf(execRecord, "ktime_ns"), asm.R0, asm.DWord),
+		)
+		return append(insns, storeComm(offsetOf(execRecord, "comm"))...)
+	}
+	// trackedProcess leaves the current tgid at -16 and jumps to out
+	// unless it is in the execs map.
+	trackedProcess := asm.Instructions{
+		asm.FnGetCurrentPidTgid.Call(),
+		asm.RSh.Imm(asm.R0, 32),
+		asm.StoreMem(asm.RFP, -16, asm.R0, asm.Word),
+		asm.LoadMapPtr(asm.R1, 0).WithReference("execs"),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, -16),
+		asm.FnMapLookupElem.Call(),
+		asm.JEq.Imm(asm.R0, 0, "out"),
+	}
+
+	// execve entry: the full record, including the arguments.
+	enterInsns := append(asm.Instructions{}, prologue...)
+	enterInsns = append(enterInsns, reserveRecord(execRecord.Size)...)
+	enterInsns = append(enterInsns, header(execRecordExec)...)
+	enterInsns = append(enterInsns,
+		asm.StoreImm(asm.R9, offsetOf(execRecord, "ret"), 0, asm.Word),
+		asm.StoreImm(asm.R9, offsetOf(execRecord, "argc"), 0, asm.Word),
+		asm.StoreImm(asm.R9, offsetOf(execRecord, "argv_truncated"), 0, asm.Word),
+		asm.Mov.Reg(asm.R1, asm.R9),
+		asm.Add.Imm(asm.R1, int32(offsetOf(execRecord, "filename"))),
+		asm.Mov.Imm(asm.R2, builtinPathLen),
+		asm.LoadMem(asm.R3, asm.R6, int16(filename.Offset), asm.DWord),
+		asm.FnProbeReadUserStr.Call(),
+		asm.LoadMem(asm.R7, asm.R6, int16(argv.Offset), asm.DWord),
+	)
+	// readArgPointer loads argv[i] into R3, jumping to argv_done at the
+	// terminating NULL.
+	readArgPointer := func(i int32) asm.Instructions {
+		return asm.Instructions{
+			asm.Mov.Reg(asm.R1, asm.RFP),
+			asm.Add.Imm(asm.R1, -8),
+			asm.Mov.Imm(asm.R2, 8),
+			asm.Mov.Reg(asm.R3, asm.R7),
+			asm.Add.Imm(asm.R3, i*8),
+			asm.FnProbeReadUser.Call(),
+			asm.JNE.Imm(asm.R0, 0, "argv_done"),
+			asm.LoadMem(asm.R3, asm.RFP, -8, asm.DWord),
+			asm.JEq.Imm(asm.R3, 0, "argv_done"),
+		}
+	}
+	for i := int32(0); i < execArgs; i++ {
+		enterInsns = append(enterInsns, readArgPointer(i)...)
+		enterInsns = append(enterInsns,
+			asm.Mov.Reg(asm.R1, asm.R9),
+			asm.Add.Imm(asm.R1, int32(offsetOf(execRecord, "argv"))+i*execArgLen),
+			asm.Mov.Imm(asm.R2, execArgLen),
+			asm.FnProbeReadUserStr.Call(),
+			asm.StoreImm(asm.R9, offsetOf(execRecord, "argc"), int64(i+1), asm.Word),
+		)
+	}
+	enterInsns = append(enterInsns, readArgPointer(execArgs)...)
+	enterInsns = append(enterInsns,
+		asm.StoreImm(asm.R9, offsetOf(execRecord, "argv_truncated"), 1, asm.Word),
+		asm.FnGetCurrentPidTgid.Call().WithSymbol("argv_done"),
+		asm.RSh.Imm(asm.R0, 32),
+		asm.StoreMem(asm.RFP, -16, asm.R0, asm.Word),
+		asm.StoreImm(asm.RFP, -24, 1, asm.DWord),
+		asm.LoadMapPtr(asm.R1, 0).WithReference("execs"),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, -16),
+		asm.Mov.Reg(asm.R3, asm.RFP),
+		asm.Add.Imm(asm.R3, -24),
+		asm.Mov.Imm(asm.R4, int32(ebpf.UpdateAny)),
+		asm.FnMapUpdateElem.Call(),
+	)
+	enterInsns = append(enterInsns, submitRecord()...)
+	enterInsns = append(enterInsns, programExit()...)
+
+	// execve return: the result, for processes seen entering it.
+	returnInsns := append(asm.Instructions{}, prologue...)
+	returnInsns = append(returnInsns, trackedProcess...)
+	returnInsns = append(returnInsns, reserveRecord(execHeaderSize)...)
+	returnInsns = append(returnInsns, header(execRecordReturn)...)
+	returnInsns = append(returnInsns, copyCtxField(ret, offsetOf(execRecord, "ret"), asm.Word)...)
+	returnInsns = append(returnInsns, submitRecord()...)
+	returnInsns = append(returnInsns, programExit()...)
+
+	// Process exit: the exit status of processes seen exec'ing, once the
+	// whole thread group is gone.
+	exitInsns := asm.Instructions{asm.Mov.Reg(asm.R6, asm.R1)}
+	if groupDead, ok := procExit.fields["group_dead"]; ok {
+		exitInsns = append(exitInsns,
+			asm.LoadMem(asm.R1, asm.R6, int16(groupDead.Offset), sizeOf(groupDead.Size)),
+			asm.JEq.Imm(asm.R1, 0, "out"),
+		)
+	} else {
+		// Older kernels: report the exit of the thread group leader.
+		exitInsns = append(exitInsns,
+			asm.FnGetCurrentPidTgid.Call(),
+			asm.Mov.Reg(asm.R1, asm.R0),
+			asm.RSh.Imm(asm.R1, 32),
+			asm.LSh.Imm(asm.R0, 32),
+			asm.RSh.Imm(asm.R0, 32),
+			asm.JNE.Reg(asm.R0, asm.R1, "out"),
+		)
+	}
+	exitInsns = append(exitInsns, trackedProcess...)
+	exitInsns = append(exitInsns,
+		asm.LoadMapPtr(asm.R1, 0).WithReference("execs"),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, -16),
+		asm.FnMapDeleteElem.Call(),
+	)
+	exitInsns = append(exitInsns, reserveRecord(execHeaderSize)...)
+	exitInsns = append(exitInsns, header(execRecordExit)...)
+	exitInsns = append(exitInsns,
+		asm.FnGetCurrentTask.Call(),
+		asm.Mov.Reg(asm.R3, asm.R0),
+		asm.Add.Imm(asm.R3, exitCode),
+		asm.Mov.Reg(asm.R1, asm.R9),
+		asm.Add.Imm(asm.R1, int32(offsetOf(execRecord, "ret"))),
+		asm.Mov.Imm(asm.R2, 4),
+		asm.FnProbeReadKernel.Call(),
+	)
+	exitInsns = append(exitInsns, submitRecord()...)
+	exitInsns = append(exitInsns, programExit()...)
+
+	spec := &ebpf.CollectionSpec{
+		Maps: map[string]*ebpf.MapSpec{
+			builtinEventsMap: {
+				Name:       "trace_exec",
+				Type:       ebpf.RingBuf,
+				MaxEntries: execRingbufSize,
+			},
+			"execs": {
+				Name:       "trace_exec_pids",
+				Type:       ebpf.Hash,
+				KeySize:    4,
+				ValueSize:  8,
+				MaxEntries: execTrackedProcesses,
+			},
+		},
+		Programs: map[string]*ebpf.ProgramSpec{
+			"exec_enter":  tracepointProgram("exec_enter", enterInsns),
+			"exec_return": tracepointProgram("exec_return", returnInsns),
+			"exec_exit":   tracepointProgram("exec_exit", exitInsns),
+		},
+	}
+	if cgroupFilter {
+		spec.Maps["cgroup"] = &ebpf.MapSpec{
+			Name:       "trace_exec_cg",
+			Type:       ebpf.CGroupArray,
+			KeySize:    4,
+			ValueSize:  4,
+			MaxEntries: 1,
+		}
+	}
+	return spec, nil
+}
+
+// execTrace is a decoded exec_record.
+type execTrace struct {
+	kind, pid, tid, ppid, uid uint32
+	ret                       int32
+	cgroupID, ktime           uint64
+	comm, filename            string
+	argv                      []string
+	truncated                 bool
+}
+
+func decodeExecRecord(data []byte) (execTrace, bool) {
+	if len(data) < int(execHeaderSize) {
+		return execTrace{}, false
+	}
+	u32 := func(name string) uint32 {
+		return binary.NativeEndian.Uint32(data[offsetOf(execRecord, name):])
+	}
+	u64 := func(name string) uint64 {
+		return binary.NativeEndian.Uint64(data[offsetOf(execRecord, name):])
+	}
+	str := func(off, size int) string {
+		b := data[off : off+size]
+		if i := bytes.IndexByte(b, 0); i >= 0 {
+			b = b[:i]
+		}
+		return string(b)
+	}
+
+	r := execTrace{
+		kind:     u32("kind"),
+		pid:      u32("pid"),
+		tid:      u32("tid"),
+		ppid:     u32("ppid"),
+		uid:      u32("uid"),
+		ret:      int32(u32("ret")),
+		cgroupID: u64("cgroup_id"),
+		ktime:    u64("ktime_ns"),
+		comm:     str(int(offsetOf(execRecord, "comm")), taskCommLen),
+	}
+	if r.kind != execRecordExec {
+		return r, true
+	}
+	if len(data) < int(execRecord.Size) {
+		return execTrace{}, false
+	}
+	r.filename = str(int(offsetOf(execRecord, "filename")), builtinPathLen)
+	r.truncated = u32("argv_truncated") != 0
+	argc := min(int(u32("argc")), execArgs)
+	r.argv = make([]string, argc)
+	for i := range r.argv {
+		r.argv[i] = str(int(offsetOf(execRecord, "argv"))+i*execArgLen, execArgLen)
+	}
+	return r, true
+}
@@ -0,0 +1,699 @@
+package ebpf
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/btf"
+	"github.com/cilium/ebpf/link"
+	"github.com/cilium/ebpf/rlimit"
+	"github.com/sameehj/ebpf-mcp/pkg/types"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	defaultTCPDuration  = 5 * time.Second
+	defaultTCPEvents    = 200
+	maxTCPEvents        = 10000
+	maxTCPConnections   = 1000
+	tcpRingbufSize      = 1 << 20
+	tcpRecordState      = 0
+	tcpRecordRetransmit = 1
+	tcpRecordAccept     = 2
+
+	tcpEstablished = 1
+	tcpSynSent     = 2
+	tcpSynRecv     = 3
+	tcpClose       = 7
+	tcpListen      = 10
+)
+
+// tcpRecord is what the trace_tcp programs submit. Byte counts are only
+// read when a socket closes.
+var tcpRecord = newStruct("tcp_record",
+	structField{"kind", btfU32},
+	structField{"pid", btfU32},
+	structField{"oldstate", tcpState},
+	structField{"newstate", tcpState},
+	structField{"sport", btfU16},
+	structField{"dport", btfU16},
+	structField{"family", btfU16},
+	structField{"skaddr", btfU64},
+	structField{"ktime_ns", btfU64},
+	structField{"rx_bytes", btfU64},
+	structField{"tx_bytes", btfU64},
+	structField{"saddr", btfArray(btfU8, ipAddrBytes)},
+	structField{"daddr", btfArray(btfU8, ipAddrBytes)},
+	structField{"comm", btfArray(btfChar, taskCommLen)},
+)
+
+type TraceTCPArgs struct {
+	DurationMs int   `json:"duration_ms,omitempty"`
+	MaxEvents  int   `json:"max_events,omitempty"`
+	Pids       []int `json:"pids,omitempty"`
+	Ports      []int `json:"ports,omitempty"`
+}
+
+type TraceTCPResult struct {
+	Success     bool                     `json:"success"`
+	ToolVersion string                   `json:"tool_version"`
+	Status      string                   `json:"status"`
+	Events      []map[string]interface{} `json:"events"`
+	Connections []TCPConnection          `json:"connections"`
+	Stats       map[string]interface{}   `json:"stats"`
+	Complete    bool                     `json:"complete"`
+	Warnings    []string                 `json:"warnings,omitempty"`
+	Error       string                   `json:"error,omitempty"`
+}
+
+// TCPConnection summarises a connection seen during a trace. Connections
+// opened before the trace started have no direction and, unless they are
+// accepted during it, no process.
+type TCPConnection struct {
+	Direction   string  `json:"direction,omitempty"`
+	Family      string  `json:"family"`
+	LocalAddr   string  `json:"local_addr"`
+	LocalPort   uint16  `json:"local_port"`
+	RemoteAddr  string  `json:"remote_addr"`
+	RemotePort  uint16  `json:"remote_port"`
+	Pid         uint32  `json:"pid,omitempty"`
+	Comm        string  `json:"comm,omitempty"`
+	State       string  `json:"state"`
+	Open        bool    `json:"open"`
+	DurationMs  float64 `json:"duration_ms,omitempty"`
+	RxBytes     uint64  `json:"rx_bytes,omitempty"`
+	TxBytes     uint64  `json:"tx_bytes,omitempty"`
+	Retransmits int     `json:"retransmits"`
+}
+
+func ParseTraceTCPArgs(input map[string]interface{}) (*TraceTCPArgs, error) {
+	var args TraceTCPArgs
+	if input == nil {
+		return &args, nil
+	}
+	if err := types.StrictUnmarshal(input, &args); err != nil {
+		return nil, fmt.Errorf("failed to parse trace tcp args: %w", err)
+	}
+	return &args, nil
+}
+
+func traceTCPFailure(err error) (*TraceTCPResult, error) {
+	return &TraceTCPResult{
+		Success:     false,
+		ToolVersion: "v1",
+		Status:      "failed",
+		Error:       err.Error(),
+	}, err
+}
+
+// tcpConn tracks a socket by its kernel address.
+type tcpConn struct {
+	TCPConnection
+	family           uint16
+	saddr, daddr     [ipAddrBytes]byte
+	startNs, lastNs  uint64
+	state            int32
+	startedInTrace   bool
+	closed, accepted bool
+}
+
+func (c *tcpConn) update(r tcpTrace) {
+	c.family = r.family
+	c.saddr, c.daddr = r.saddr, r.daddr
+	if r.sport != 0 {
+		c.LocalPort = r.sport
+	}
+	c.RemotePort = r.dport
+	c.lastNs = r.ktime
+}
+
+// summary fills in the exported view of the connection.
+func (c *tcpConn) summary() TCPConnection {
+	s := c.TCPConnection
+	s.Family, s.LocalAddr, s.RemoteAddr = "ipv4", ipString(c.family, c.saddr), ipString(c.family, c.daddr)
+	if c.family == afInet6 {
+		s.Family = "ipv6"
+	}
+	s.State = tcpStateName(c.state)
+	s.Open = !c.closed
+	if c.startedInTrace {
+		s.DurationMs = float64(c.lastNs-c.startNs) / float64(time.Millisecond)
+	}
+	return s
+}
+
+func (c *tcpConn) matches(pids map[uint32]bool, ports map[uint16]bool) bool {
+	if len(pids) > 0 && !pids[c.Pid] {
+		return false
+	}
+	return len(ports) == 0 || ports[c.LocalPort] || ports[c.RemotePort]
+}
+
+// RunTraceTCP records TCP connects, accepts, closes and retransmits for
+// the requested duration, or until ctx is cancelled, and summarises the
+// connections involved. Connection state comes from tracepoints;
+// attributing accepts to a process needs fexit or kretprobes.
+func RunTraceTCP(ctx context.Context, args *TraceTCPArgs) (*TraceTCPResult, error) {
+	if args == nil {
+		return traceTCPFailure(errors.New("args cannot be nil"))
+	}
+
+	duration := time.Duration(args.DurationMs) * time.Millisecond
+	if duration == 0 {
+		duration = defaultTCPDuration
+	}
+	if duration < 0 || duration > maxTraceDuration {
+		return traceTCPFailure(fmt.Errorf("duration_ms must be between 1 and %d", maxTraceDuration.Milliseconds()))
+	}
+	maxEvents := args.MaxEvents
+	if maxEvents == 0 {
+		maxEvents = defaultTCPEvents
+	}
+	if maxEvents < 0 || maxEvents > maxTCPEvents {
+		return traceTCPFailure(fmt.Errorf("max_events must be between 1 and %d", maxTCPEvents))
+	}
+	pids := make(map[uint32]bool, len(args.Pids))
+	for _, pid := range args.Pids {
+		if pid <= 0 {
+			return traceTCPFailure(fmt.Errorf("invalid pid %d", pid))
+		}
+		pids[uint32(pid)] = true
+	}
+	ports := make(map[uint16]bool, len(args.Ports))
+	for _, port := range args.Ports {
+		if port <= 0 || port > 65535 {
+			return traceTCPFailure(fmt.Errorf("invalid port %d", port))
+		}
+		ports[uint16(port)] = true
+	}
+
+	if err := rlimit.RemoveMemlock(); err != nil {
+		return traceTCPFailure(fmt.Errorf("rlimit error: %v", err))
+	}
+
+	spec, err := tcpTraceSpec()
+	if err != nil {
+		return traceTCPFailure(err)
+	}
+	coll, err := ebpf.NewCollection(spec)
+	if err != nil {
+		return traceTCPFailure(fmt.Errorf("failed to load programs: %v", err))
+	}
+	defer coll.Close()
+
+	events := coll.Maps[builtinEventsMap]
+	rd, err := newEventReader(events, SourceRingbuf)
+	if err != nil {
+		return traceTCPFailure(err)
+	}
+	defer rd.Close()
+
+	for _, h := range []struct{ group, name, prog string }{
+		{"sock", "inet_sock_set_state", "tcp_state"},
+		{"tcp", "tcp_retransmit_skb", "tcp_retransmit"},
+	} {
+		tp, err := link.Tracepoint(h.group, h.name, coll.Programs[h.prog], nil)
+		if err != nil {
+			return traceTCPFailure(fmt.Errorf("tracepoint %s:%s attach failed: %v", h.group, h.name, err))
+		}
+		defer tp.Close()
+	}
+	var warnings []string
+	if accept, err := attachTCPAccept(events, spec.Maps[builtinEventsMap]); err != nil {
+		warnings = append(warnings, fmt.Sprintf("accepted connections are not attributed to processes: %v", err))
+	} else {
+		defer accept.Close()
+	}
+
+	stop := context.AfterFunc(ctx, func() { rd.Close() })
+	defer stop()
+
+	start := time.Now()
+	rd.SetDeadline(start.Add(duration))
+
+	mapID := 0
+	if info, err := events.Info(); err == nil {
+		id, _ := info.ID()
+		mapID = int(id)
+	}
+	result := &TraceTCPResult{
+		Success:     true,
+		ToolVersion: "v1",
+		Events:      []map[string]interface{}{},
+		Connections: []TCPConnection{},
+		Warnings:    warnings,
+	}
+	var received, filtered, dropped int
+	counts := make(map[string]int)
+	active := make(map[uint64]*tcpConn)
+	var conns []*tcpConn
+
+	emit := func(rec eventRecord, c *tcpConn, kind string, extra map[string]interface{}) {
+		received++
+		counts[kind]++
+		if !c.matches(pids, ports) {
+			filtered++
+			return
+		}
+		if len(result.Events) >= maxEvents {
+			dropped++
+			return
+		}
+		s := c.summary()
+		data := map[string]interface{}{
+			"event":       kind,
+			"family":      s.Family,
+			"local_addr":  s.LocalAddr,
+			"local_port":  s.LocalPort,
+			"remote_addr": s.RemoteAddr,
+			"remote_port": s.RemotePort,
+			"pid":         s.Pid,
+			"comm":        s.Comm,
+		}
+		for k, v := range extra {
+			data[k] = v
+		}
+		result.Events = append(result.Events, newStreamEvent(rec, mapID, "json", data, nil))
+	}
+
+	for {
+		rec, err := rd.Read()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			break
+		}
+		if ctx.Err() != nil {
+			return traceTCPFailure(fmt.Errorf("trace cancelled: %w", ctx.Err()))
+		}
+		if err != nil {
+			return traceTCPFailure(fmt.Errorf("read events: %w", err))
+		}
+
+		r, ok := decodeTCPRecord(rec.Data)
+		if !ok {
+			continue
+		}
+		c := active[r.skaddr]
+		if c == nil {
+			if r.kind == tcpRecordAccept {
+				// Accepted before any state change was seen: the
+				// connection is not known.
+				continue
+			}
+			c = &tcpConn{startNs: r.ktime}
+			// Connections start with connect() or, on the passive side,
+			// with the handshake completing.
+			if r.kind == tcpRecordState && (r.newstate == tcpSynSent || r.oldstate == tcpSynRecv) {
+				c.startedInTrace = true
+			}
+			active[r.skaddr] = c
+			conns = append(conns, c)
+		}
+
+		switch r.kind {
+		case tcpRecordState:
+			c.update(r)
+			c.state = r.newstate
+			switch {
+			case r.oldstate == tcpClose && r.newstate == tcpSynSent:
+				// connect() runs in the connecting process.
+				c.Direction, c.Pid, c.Comm = "connect", r.pid, r.comm
+			case r.oldstate == tcpSynRecv && r.newstate == tcpEstablished:
+				c.Direction = "accept"
+			case r.oldstate == tcpSynSent && r.newstate == tcpEstablished:
+				emit(rec, c, "connect", map[string]interface{}{
+					"latency_us": float64(r.ktime-c.startNs) / float64(time.Microsecond),
+				})
+			case r.oldstate == tcpSynSent && r.newstate == tcpClose:
+				c.closed = true
+				delete(active, r.skaddr)
+				emit(rec, c, "connect_failed", map[string]interface{}{
+					"latency_us": float64(r.ktime-c.startNs) / float64(time.Microsecond),
+				})
+			case r.newstate == tcpClose:
+				c.closed = true
+				c.RxBytes, c.TxBytes = r.rxBytes, r.txBytes
+				delete(active, r.skaddr)
+				extra := map[string]interface{}{
+					"old_state":   tcpStateName(r.oldstate),
+					"rx_bytes":    r.rxBytes,
+					"tx_bytes":    r.txBytes,
+					"retransmits": c.Retransmits,
+				}
+				if c.startedInTrace {
+					extra["duration_ms"] = float64(r.ktime-c.startNs) / float64(time.Millisecond)
+				}
+				emit(rec, c, "close", extra)
+			}
+		case tcpRecordRetransmit:
+			c.update(r)
+			c.Retransmits++
+			emit(rec, c, "retransmit", map[string]interface{}{"state": tcpStateName(r.newstate)})
+		case tcpRecordAccept:
+			if c.accepted {
+				continue
+			}
+			c.accepted = true
+			c.Direction, c.Pid, c.Comm = "accept", r.pid, r.comm
+			emit(rec, c, "accept", nil)
+		}
+	}
+	elapsed := time.Since(start)
+
+	// Open connections have lasted until now; bpf_ktime_get_ns is
+	// CLOCK_MONOTONIC.
+	var now unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &now); err != nil {
+		return traceTCPFailure(fmt.Errorf("clock: %w", err))
+	}
+	last := uint64(now.Nano())
+	var durations []float64
+	for _, c := range conns {
+		if !c.closed {
+			c.lastNs = last
+		}
+		if !c.matches(pids, ports) {
+			continue
+		}
+		s := c.summary()
+		if c.closed && c.startedInTrace {
+			durations = append(durations, s.DurationMs)
+		}
+		result.Connections = append(result.Connections, s)
+	}
+	if len(result.Connections) > maxTCPConnections {
+		result.Warnings = append(result.Warnings,
+			fmt.Sprintf("showing the first %d of %d connections", maxTCPConnections, len(result.Connections)))
+		result.Connections = result.Connections[:maxTCPConnections]
+	}
+	if dropped > 0 {
+		result.Warnings = append(result.Warnings,
+			fmt.Sprintf("max_events reached: %d further events were not returned", dropped))
+	}
+
+	result.Stats = map[string]interface{}{
+		"duration_ms":       elapsed.Milliseconds(),
+		"events_received":   received,
+		"events_filtered":   filtered,
+		"events_dropped":    dropped,
+		"events_per_second": rate(received, elapsed.Seconds()),
+		"connects":          counts["connect"],
+		"failed_connects":   counts["connect_failed"],
+		"accepts":           counts["accept"],
+		"closes":            counts["close"],
+		"retransmits":       counts["retransmit"],
+	}
+	if len(durations) > 0 {
+		sort.Float64s(durations)
+		var sum float64
+		for _, d := range durations {
+			sum += d
+		}
+		result.Stats["connection_duration_ms"] = map[string]interface{}{
+			"count": len(durations),
+			"min":   durations[0],
+			"max":   durations[len(durations)-1],
+			"avg":   sum / float64(len(durations)),
+			"p50":   percentile(durations, 0.50),
+			"p99":   percentile(durations, 0.99),
+		}
+	}
+	result.Complete = true
+	result.Status = fmt.Sprintf("Traced %d TCP connections for %dms", len(result.Connections), elapsed.Milliseconds())
+	return result, nil
+}
+
+// tcpTraceSpec assembles the tracepoint programs of trace_tcp: one on
+// state changes and one on retransmits.
+func tcpTraceSpec() (*ebpf.CollectionSpec, error) {
+	tf, err := loadTracepointFormat("sock", "inet_sock_set_state")
+	if err != nil {
+		return nil, err
+	}
+	state, err := tf.fieldsOf(sockStateFields)
+	if err != nil {
+		return nil, err
+	}
+	tf, err = loadTracepointFormat("tcp", "tcp_retransmit_skb")
+	if err != nil {
+		return nil, err
+	}
+	retransmit, err := tf.fieldsOf(map[string]int{
+		"skaddr": 8, "state": 4, "sport": 2, "dport": 2, "family": 2,
+		"saddr": 4, "daddr": 4, "saddr_v6": 16, "daddr_v6": 16,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ko, err := loadKernelOffsets()
+	if err != nil {
+		return nil, err
+	}
+	bytesReceived, err := ko.offset("tcp_sock", "bytes_received")
+	if err != nil {
+		return nil, err
+	}
+	bytesAcked, err := ko.offset("tcp_sock", "bytes_acked")
+	if err != nil {
+		return nil, err
+	}
+	// readSockCounter copies a u64 of the tcp_sock in R7 to the record.
+	readSockCounter := func(sockOff int32, recOff int16) asm.Instructions {
+		return asm.Instructions{
+			asm.Mov.Reg(asm.R1, asm.R9),
+			asm.Add.Imm(asm.R1, int32(recOff)),
+			asm.Mov.Imm(asm.R2, 8),
+			asm.Mov.Reg(asm.R3, asm.R7),
+			asm.Add.Imm(asm.R3, sockOff),
+			asm.FnProbeReadKernel.Call(),
+		}
+	}
+
+	stateInsns := asm.Instructions{
+		asm.Mov.Reg(asm.R6, asm.R1),
+		asm.LoadMem(asm.R1, asm.R6, int16(state["protocol"].Offset), asm.Half),
+		asm.JNE.Imm(asm.R1, ipprotoTCP, "out"),
+		// Listening sockets are not connections.
+		asm.LoadMem(asm.R1, asm.R6, int16(state["oldstate"].Offset), asm.Word),
+		asm.JEq.Imm(asm.R1, tcpListen, "out"),
+		asm.LoadMem(asm.R1, asm.R6, int16(state["newstate"].Offset), asm.Word),
+		asm.JEq.Imm(asm.R1, tcpListen, "out"),
+	}
+	stateInsns = append(stateInsns, reserveRecord(tcpRecord.Size)...)
+	stateInsns = append(stateInsns, tcpRecordHeader(tcpRecordState)...)
+	stateInsns = append(stateInsns, copyCtxField(state["skaddr"], offsetOf(tcpRecord, "skaddr"), asm.DWord)...)
+	stateInsns = append(stateInsns, copyCtxField(state["oldstate"], offsetOf(tcpRecord, "oldstate"), asm.Word)...)
+	stateInsns = append(stateInsns, copyCtxField(state["newstate"], offsetOf(tcpRecord, "newstate"), asm.Word)...)
+	stateInsns = append(stateInsns, copyCtxField(state["sport"], offsetOf(tcpRecord, "sport"), asm.Half)...)
+	stateInsns = append(stateInsns, copyCtxField(state["dport"], offsetOf(tcpRecord, "dport"), asm.Half)...)
+	stateInsns = append(stateInsns, copyCtxField(state["family"], offsetOf(tcpRecord, "family"), asm.Half)...)
+	stateInsns = append(stateInsns, copySockAddrs(state, offsetOf(tcpRecord, "saddr"), offsetOf(tcpRecord, "daddr"))...)
+	stateInsns = append(stateInsns,
+		asm.LoadMem(asm.R1, asm.R6, int16(state["newstate"].Offset), asm.Word),
+		asm.JNE.Imm(asm.R1, tcpClose, "submit"),
+		asm.LoadMem(asm.R7, asm.R6, int16(state["skaddr"].Offset), asm.DWord),
+	)
+	stateInsns = append(stateInsns, readSockCounter(bytesReceived, offsetOf(tcpRecord, "rx_bytes"))...)
+	stateInsns = append(stateInsns, readSockCounter(bytesAcked, offsetOf(tcpRecord, "tx_bytes"))...)
+	submit := submitRecord()
+	submit[0] = submit[0].WithSymbol("submit")
+	stateInsns = append(stateInsns, submit...)
+	stateInsns = append(stateInsns, programExit()...)
+
+	retransmitInsns := asm.Instructions{asm.Mov.Reg(asm.R6, asm.R1)}
+	retransmitInsns = append(retransmitInsns, reserveRecord(tcpRecord.Size)...)
+	retransmitInsns = append(retransmitInsns, tcpRecordHeader(tcpRecordRetransmit)...)
+	retransmitInsns = append(retransmitInsns, copyCtxField(retransmit["skaddr"], offsetOf(tcpRecord, "skaddr"), asm.DWord)...)
+	retransmitInsns = append(retransmitInsns, copyCtxField(retransmit["state"], offsetOf(tcpRecord, "oldstate"), asm.Word)...)
+	retransmitInsns = append(retransmitInsns, copyCtxField(retransmit["state"], offsetOf(tcpRecord, "newstate"), asm.Word)...)
+	retransmitInsns = append(retransmitInsns, copyCtxField(retransmit["sport"], offsetOf(tcpRecord, "sport"), asm.Half)...)
+	retransmitInsns = append(retransmitInsns, copyCtxField(retransmit["dport"], offsetOf(tcpRecord, "dport"), asm.Half)...)
+	retransmitInsns = append(retransmitInsns, copyCtxField(retransmit["family"], offsetOf(tcpRecord, "family"), asm.Half)...)
+	retransmitInsns = append(retransmitInsns, copySockAddrs(retransmit, offsetOf(tcpRecord, "saddr"), offsetOf(tcpRecord, "daddr"))...)
+	retransmitInsns = append(retransmitInsns, submitRecord()...)
+	retransmitInsns = append(retransmitInsns, programExit()...)
+
+	return &ebpf.CollectionSpec{
+		Maps: map[string]*ebpf.MapSpec{
+			builtinEventsMap: {
+				Name:       "trace_tcp",
+				Type:       ebpf.RingBuf,
+				MaxEntries: tcpRingbufSize,
+			},
+		},
+		Programs: map[string]*ebpf.ProgramSpec{
+			"tcp_state":      tracepointProgram("tcp_state", stateInsns),
+			"tcp_retransmit": tracepointProgram("tcp_retransmit", retransmitInsns),
+		},
+	}, nil
+}
+
+// tcpRecordHeader starts a record of the given kind in R9 with the
+// current task and time.
+func tcpRecordHeader(kind int32) asm.Instructions {
+	insns := asm.Instructions{
+		asm.StoreImm(asm.R9, offsetOf(tcpRecord, "kind"), int64(kind), asm.Word),
+		asm.StoreImm(asm.R9, offsetOf(tcpRecord, "rx_bytes"), 0, asm.DWord),
+		asm.StoreImm(asm.R9, offsetOf(tcpRecord, "tx_bytes"), 0, asm.DWord),
+		asm.FnGetCurrentPidTgid.Call(),
+		asm.RSh.Imm(asm.R0, 32),
+		asm.StoreMem(asm.R9, offsetOf(tcpRecord, "pid"), asm.R0, asm.Word),
+		asm.FnKtimeGetNs.Call(),
+		asm.StoreMem(asm.R9, offsetOf(tcpRecord, "ktime_ns"), asm.R0, asm.DWord),
+	}
+	return append(insns, storeComm(offsetOf(tcpRecord, "comm"))...)
+}
+
+// attachTCPAccept hooks the return of inet_csk_accept to attribute
+// accepted connections to the accepting process, with fexit where BPF
+// trampolines are available and a kretprobe otherwise. The program
+// submits to events, which was created from eventsSpec.
+func attachTCPAccept(events *ebpf.Map, eventsSpec *ebpf.MapSpec) (io.Closer, error) {
+	ko, err := loadKernelOffsets()
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	for _, kind := range []string{"fexit", "kretprobe"} {
+		prog, err := tcpAcceptProgram(ko, kind)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", kind, err))
+			continue
+		}
+		coll, err := ebpf.NewCollectionWithOptions(&ebpf.CollectionSpec{
+			Maps:     map[string]*ebpf.MapSpec{builtinEventsMap: eventsSpec},
+			Programs: map[string]*ebpf.ProgramSpec{"tcp_accept": prog},
+		}, ebpf.CollectionOptions{MapReplacements: map[string]*ebpf.Map{builtinEventsMap: events}})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", kind, err))
+			continue
+		}
+		var l link.Link
+		if kind == "fexit" {
+			l, err = link.AttachTracing(link.TracingOptions{Program: coll.Programs["tcp_accept"]})
+		} else {
+			l, err = link.Kretprobe("inet_csk_accept", coll.Programs["tcp_accept"], nil)
+		}
+		coll.Close()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", kind, err))
+			continue
+		}
+		return l, nil
+	}
+	return nil, errors.Join(errs...)
+}
+
+// tcpAcceptProgram builds the accept program for fexit or kretprobe; they
+// differ in where the returned socket is found.
+func tcpAcceptProgram(ko *kernelOffsets, kind string) (*ebpf.ProgramSpec, error) {
+	var fn *btf.Func
+	if err := ko.spec.TypeByName("inet_csk_accept", &fn); err != nil {
+		return nil, fmt.Errorf("inet_csk_accept: %w", err)
+	}
+	spec := &ebpf.ProgramSpec{Name: "tcp_accept", License: "GPL"}
+	var ret int32
+	switch kind {
+	case "fexit":
+		// fexit programs get the arguments as u64s, then the return
+		// value.
+		proto, ok := fn.Type.(*btf.FuncProto)
+		if !ok {
+			return nil, fmt.Errorf("inet_csk_accept has no prototype")
+		}
+		ret = int32(8 * len(proto.Params))
+		spec.Type, spec.AttachType, spec.AttachTo = ebpf.Tracing, ebpf.AttachTraceFExit, "inet_csk_accept"
+	default:
+		off, err := ko.offset("pt_regs", "ax")
+		if err != nil {
+			if off, err = ko.offset("pt_regs", "regs"); err != nil {
+				return nil, fmt.Errorf("return register: %w", err)
+			}
+		}
+		ret = off
+		spec.Type = ebpf.Kprobe
+	}
+
+	insns := asm.Instructions{
+		asm.Mov.Reg(asm.R6, asm.R1),
+		asm.LoadMem(asm.R7, asm.R6, int16(ret), asm.DWord),
+		asm.JEq.Imm(asm.R7, 0, "out"),
+	}
+	insns = append(insns, reserveRecord(tcpRecord.Size)...)
+	insns = append(insns, tcpRecordHeader(tcpRecordAccept)...)
+	insns = append(insns, asm.StoreMem(asm.R9, offsetOf(tcpRecord, "skaddr"), asm.R7, asm.DWord))
+	insns = append(insns, submitRecord()...)
+	spec.Instructions = append(insns, programExit()...)
+	return spec, nil
+}
+
+// tcpTrace is a decoded tcp_record.
+type tcpTrace struct {
+	kind, pid            uint32
+	oldstate, newstate   int32
+	sport, dport, family uint16
+	skaddr, ktime        uint64
+	rxBytes, txBytes     uint64
+	saddr, daddr         [ipAddrBytes]byte
+	comm                 string
+}
+
+func decodeTCPRecord(data []byte) (tcpTrace, bool) {
+	if len(data) < int(tcpRecord.Size) {
+		return tcpTrace{}, false
+	}
+	field := func(name string) []byte { return data[offsetOf(tcpRecord, name):] }
+	u16 := func(name string) uint16 { return binary.NativeEndian.Uint16(field(name)) }
+	u32 := func(name string) uint32 { return binary.NativeEndian.Uint32(field(name)) }
+	u64 := func(name string) uint64 { return binary.NativeEndian.Uint64(field(name)) }
+
+	r := tcpTrace{
+		kind:     u32("kind"),
+		pid:      u32("pid"),
+		oldstate: int32(u32("oldstate")),
+		newstate: int32(u32("newstate")),
+		sport:    u16("sport"),
+		dport:    u16("dport"),
+		family:   u16("family"),
+		skaddr:   u64("skaddr"),
+		ktime:    u64("ktime_ns"),
+		rxBytes:  u64("rx_bytes"),
+		txBytes:  u64("tx_bytes"),
+	}
+	copy(r.saddr[:], field("saddr"))
+	copy(r.daddr[:], field("daddr"))
+	comm := field("comm")[:taskCommLen]
+	if i := bytes.IndexByte(comm, 0); i >= 0 {
+		comm = comm[:i]
+	}
+	r.comm = string(comm)
+	return r, true
+}
+
+func ipString(family uint16, addr [ipAddrBytes]byte) string {
+	if family == afInet6 {
+		return net.IP(addr[:]).String()
+	}
+	return net.IP(addr[:4]).String()
+}
+
+// tcpStateName names a TCP state as the kernel does, less the TCP_ prefix.
+func tcpStateName(state int32) string {
+	for _, v := range tcpState.Values {
+		if int64(v.Value) == int64(state) {
+			return strings.TrimPrefix(v.Name, "TCP_")
+		}
+	}
+	return fmt.Sprintf("STATE_%d", state)
+}
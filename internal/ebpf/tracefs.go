@@ -0,0 +1,121 @@
+// internal/ebpf/tracefs.go
+package ebpf
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// tracefsRoots are tried in order; older systems only mount tracefs under
+// debugfs.
+var tracefsRoots = []string{"/sys/kernel/tracing", "/sys/kernel/debug/tracing"}
+
+// tracepointField is a field of a tracepoint's context as described by its
+// format file.
+type tracepointField struct {
+	Offset int
+	Size   int
+	Signed bool
+	// DataLoc fields hold a u32 whose low 16 bits are the offset of
+	// variable length data in the context and high 16 bits its length.
+	DataLoc bool
+}
+
+// tracepointFormat is the layout of a tracepoint's context, keyed by field
+// name. Builtin programs read it at load time rather than hard coding
+// offsets, which differ between kernels.
+type tracepointFormat struct {
+	group, name string
+	fields      map[string]tracepointField
+}
+
+func loadTracepointFormat(group, name string) (*tracepointFormat, error) {
+	var f *os.File
+	var err error
+	for _, root := range tracefsRoots {
+		f, err = os.Open(filepath.Join(root, "events", group, name, "format"))
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("tracepoint %s:%s not found (is tracefs mounted?)", group, name)
+		}
+		return nil, fmt.Errorf("tracepoint %s:%s format: %w", group, name, err)
+	}
+	defer f.Close()
+
+	tf := &tracepointFormat{group: group, name: name, fields: make(map[string]tracepointField)}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "field:") {
+			continue
+		}
+
+		// field:unsigned int nr_sector;	offset:24;	size:4;	signed:0;
+		var decl string
+		var field tracepointField
+		for _, part := range strings.Split(line, ";") {
+			key, value, ok := strings.Cut(strings.TrimSpace(part), ":")
+			if !ok {
+				continue
+			}
+			switch key {
+			case "field":
+				decl = value
+			case "offset":
+				field.Offset, _ = strconv.Atoi(value)
+			case "size":
+				field.Size, _ = strconv.Atoi(value)
+			case "signed":
+				field.Signed = value == "1"
+			}
+		}
+
+		field.DataLoc = strings.HasPrefix(decl, "__data_loc ")
+		// The name is the last word, less any array suffix.
+		name := decl[strings.LastIndexAny(decl, " *")+1:]
+		if i := strings.IndexByte(name, '['); i >= 0 {
+			name = name[:i]
+		}
+		tf.fields[name] = field
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("tracepoint %s:%s format: %w", group, name, err)
+	}
+	return tf, nil
+}
+
+// field returns a field's layout, failing if the kernel's tracepoint lacks
+// it or it is not of the expected size. A size of 0 accepts any.
+func (tf *tracepointFormat) field(name string, size int) (tracepointField, error) {
+	f, ok := tf.fields[name]
+	if !ok {
+		return f, fmt.Errorf("tracepoint %s:%s has no field %q", tf.group, tf.name, name)
+	}
+	if size != 0 && f.Size != size {
+		return f, fmt.Errorf("tracepoint %s:%s field %q is %d bytes, expected %d", tf.group, tf.name, name, f.Size, size)
+	}
+	return f, nil
+}
+
+// fieldsOf returns the layouts of several fields, keyed by name, with
+// their expected sizes.
+func (tf *tracepointFormat) fieldsOf(sizes map[string]int) (map[string]tracepointField, error) {
+	fields := make(map[string]tracepointField, len(sizes))
+	for name, size := range sizes {
+		f, err := tf.field(name, size)
+		if err != nil {
+			return nil, err
+		}
+		fields[name] = f
+	}
+	return fields, nil
+}
@@ -0,0 +1,540 @@
+// internal/ebpf/unload_program.go
+package ebpf
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+)
+
+// unloadSettleTimeout bounds how long UnloadProgram waits for the kernel to
+// free released objects before reporting them as still held.
+const unloadSettleTimeout = 500 * time.Millisecond
+
+type UnloadProgramArgs struct {
+	ProgramID int    `json:"program_id,omitempty"`
+	Handle    string `json:"handle,omitempty"`
+	Cascade   bool   `json:"cascade,omitempty"`
+	Force     bool   `json:"force,omitempty"`
+}
+
+// UnloadedObject describes a program or map removed by unload_program.
+type UnloadedObject struct {
+	ID      int    `json:"id"`
+	Name    string `json:"name,omitempty"`
+	Type    string `json:"type,omitempty"`
+	Memlock uint64 `json:"memlock_bytes,omitempty"`
+	Freed   bool   `json:"freed"`
+
+	progType ebpf.ProgramType
+}
+
+type UnloadProgramResult struct {
+	Success       bool             `json:"success"`
+	ToolVersion   string           `json:"tool_version"`
+	Programs      []UnloadedObject `json:"programs,omitempty"`
+	Maps          []UnloadedObject `json:"maps,omitempty"`
+	DetachedLinks []int            `json:"detached_links,omitempty"`
+	Detached      []Attachment     `json:"detached_attachments,omitempty"`
+	Unpinned      []string         `json:"unpinned,omitempty"`
+	Released      []ObjectRef      `json:"released,omitempty"`
+	MemoryFreed   uint64           `json:"memory_freed_bytes"`
+	Warnings      []string         `json:"warnings,omitempty"`
+	Message       string           `json:"message,omitempty"`
+	Error         string           `json:"error,omitempty"`
+}
+
+func unloadFailure(err error) (*UnloadProgramResult, error) {
+	return &UnloadProgramResult{
+		Success:     false,
+		ToolVersion: "v1",
+		Error:       err.Error(),
+	}, err
+}
+
+// unloadTarget is the set of kernel objects unload_program removes.
+type unloadTarget struct {
+	// handle is the registry root holding the objects, empty if the server
+	// holds none of them.
+	handle string
+	// loaded is set when handle is a collection the server loaded, whose
+	// load reference unloading drops.
+	loaded   bool
+	programs map[int]*UnloadedObject
+	maps     map[int]*UnloadedObject
+}
+
+// UnloadProgram releases a program together with the maps it owns. Programs
+// loaded as part of a collection are unloaded with the whole collection.
+// Links and non-link attachments (cgroup, tcx, XDP and tc) still running the
+// programs make the call fail unless Cascade is set, in which case they are
+// detached first. Objects the server did not create are left alone unless
+// Force is set: links and attachments made by others are only detached, and
+// pins of the unloaded objects only removed, with Force.
+func UnloadProgram(args *UnloadProgramArgs) (*UnloadProgramResult, error) {
+	if args == nil {
+		return unloadFailure(errors.New("args cannot be nil"))
+	}
+
+	target, err := resolveUnloadTarget(args.ProgramID, args.Handle)
+	if err != nil {
+		return unloadFailure(err)
+	}
+
+	result := &UnloadProgramResult{
+		Success:     true,
+		ToolVersion: "v1",
+	}
+
+	shared, err := sharedMaps(target)
+	if err != nil {
+		return unloadFailure(err)
+	}
+	for id, users := range shared {
+		result.Warnings = append(result.Warnings,
+			fmt.Sprintf("map %d is also used by programs %v and was left in place", id, users))
+		delete(target.maps, id)
+	}
+
+	links, err := dependentLinks(target)
+	if err != nil {
+		return unloadFailure(err)
+	}
+	attached, err := nonLinkAttachments(target)
+	if err != nil {
+		return unloadFailure(err)
+	}
+	// Server links whose kernel link is gone, e.g. detached by another
+	// process, still hold the programs open.
+	var stale []string
+	if target.handle != "" {
+		for _, h := range objects.Holders(target.handle) {
+			if !slices.Contains(links, h.ID) {
+				stale = append(stale, h.Handle)
+			}
+		}
+	}
+	if !args.Cascade {
+		var deps []string
+		if len(links) > 0 {
+			deps = append(deps, fmt.Sprintf("links %v", links))
+		}
+		for _, a := range attached {
+			deps = append(deps, a.String())
+		}
+		if len(stale) > 0 {
+			deps = append(deps, fmt.Sprintf("server links %v", stale))
+		}
+		if len(deps) > 0 {
+			return unloadFailure(fmt.Errorf("programs are still attached through %s; detach them or set cascade", strings.Join(deps, ", ")))
+		}
+	}
+	if !args.Force {
+		var deps []string
+		var foreign []int
+		for _, id := range links {
+			if _, ok := objects.HandleFor(KindLink, id); !ok {
+				foreign = append(foreign, id)
+			}
+		}
+		if len(foreign) > 0 {
+			deps = append(deps, fmt.Sprintf("links %v", foreign))
+		}
+		for _, a := range attached {
+			deps = append(deps, a.String())
+		}
+		if len(deps) > 0 {
+			return unloadFailure(fmt.Errorf("programs are attached through %s, which this server did not create; detach them or set force", strings.Join(deps, ", ")))
+		}
+	}
+
+	pins, err := scanPins(bpffsRoot)
+	if err != nil {
+		log.Printf("[DEBUG] UnloadProgram: scanning %s: %v", bpffsRoot, err)
+		pins = &pinIndex{}
+	}
+
+	for _, id := range links {
+		if err := cascadeDetach(id, pins.Links[id], args.Force, result); err != nil {
+			return unloadFailure(fmt.Errorf("detach link %d: %w", id, err))
+		}
+		result.DetachedLinks = append(result.DetachedLinks, id)
+	}
+	for _, a := range attached {
+		if err := a.detach(); err != nil {
+			return unloadFailure(fmt.Errorf("detach %s: %w", a, err))
+		}
+		result.Detached = append(result.Detached, a)
+	}
+	for _, h := range stale {
+		released, err := objects.Release(h)
+		result.Released = append(result.Released, released...)
+		if err != nil && !errors.Is(err, ErrObjectNotFound) {
+			return unloadFailure(fmt.Errorf("release %s: %w", h, err))
+		}
+	}
+
+	// The server never pins programs and maps, so their pins were made by
+	// someone else and are only removed with Force.
+	var paths []string
+	for id := range target.programs {
+		paths = append(paths, pins.Programs[id]...)
+	}
+	for id := range target.maps {
+		paths = append(paths, pins.Maps[id]...)
+	}
+	sort.Strings(paths)
+	if args.Force {
+		for _, p := range paths {
+			if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return unloadFailure(fmt.Errorf("unpin %s: %w", p, err))
+			}
+			result.Unpinned = append(result.Unpinned, p)
+		}
+	} else if len(paths) > 0 {
+		result.Warnings = append(result.Warnings,
+			fmt.Sprintf("pins %v were not created by this server and keep their objects loaded; set force to remove them", paths))
+	}
+
+	switch {
+	case target.loaded:
+		released, err := objects.Release(target.handle)
+		result.Released = append(result.Released, released...)
+		if err != nil {
+			result.Success = false
+			result.Error = err.Error()
+			return result, err
+		}
+		if len(released) == 0 {
+			result.Warnings = append(result.Warnings,
+				fmt.Sprintf("%s is still referenced by another server operation", target.handle))
+		}
+	case target.handle != "":
+		// Programs opened by ID are held by the links attached to them,
+		// released above, and by operations in progress.
+		if _, _, ok := objects.Get(target.handle); ok {
+			result.Warnings = append(result.Warnings,
+				fmt.Sprintf("%s is still referenced by another server operation", target.handle))
+		}
+	}
+
+	// The kernel frees an object once the last file descriptor, pin and
+	// link referencing it is gone. Programs drop their map references from
+	// a deferred work item, so give the kernel a moment before reporting
+	// anything still visible by ID as held by someone else.
+	deadline := time.Now().Add(unloadSettleTimeout)
+	for _, id := range sortedIDs(target.programs) {
+		obj := target.programs[id]
+		obj.Freed = waitGone(deadline, func() error {
+			prog, err := ebpf.NewProgramFromID(ebpf.ProgramID(id))
+			if err == nil {
+				prog.Close()
+			}
+			return err
+		})
+		if obj.Freed {
+			result.MemoryFreed += obj.Memlock
+		} else {
+			result.Warnings = append(result.Warnings,
+				fmt.Sprintf("program %d is still held by another process", id))
+		}
+		result.Programs = append(result.Programs, *obj)
+	}
+	for _, id := range sortedIDs(target.maps) {
+		obj := target.maps[id]
+		obj.Freed = waitGone(deadline, func() error {
+			m, err := ebpf.NewMapFromID(ebpf.MapID(id))
+			if err == nil {
+				m.Close()
+			}
+			return err
+		})
+		if obj.Freed {
+			result.MemoryFreed += obj.Memlock
+		} else {
+			result.Warnings = append(result.Warnings,
+				fmt.Sprintf("map %d is still held by another process", id))
+		}
+		result.Maps = append(result.Maps, *obj)
+	}
+
+	result.Message = fmt.Sprintf("Unloaded %d programs and %d maps", len(result.Programs), len(result.Maps))
+	if len(result.DetachedLinks) > 0 {
+		result.Message += fmt.Sprintf(", detached %d links", len(result.DetachedLinks))
+	}
+	if len(result.Detached) > 0 {
+		result.Message += fmt.Sprintf(", detached %d non-link attachments", len(result.Detached))
+	}
+	if result.MemoryFreed > 0 {
+		result.Message += fmt.Sprintf(", freed %d bytes", result.MemoryFreed)
+	}
+	return result, nil
+}
+
+// resolveUnloadTarget collects the programs and maps to remove. Objects held
+// by the registry are unloaded with their root; anything else is described
+// from the kernel, with the maps the program references.
+func resolveUnloadTarget(programID int, handle string) (*unloadTarget, error) {
+	if handle == "" && programID != 0 {
+		handle, _ = objects.HandleFor(KindProgram, programID)
+	}
+
+	target := &unloadTarget{
+		programs: make(map[int]*UnloadedObject),
+		maps:     make(map[int]*UnloadedObject),
+	}
+
+	if handle != "" {
+		ref, _, ok := objects.Get(handle)
+		if !ok {
+			return nil, fmt.Errorf("handle %s: %w", handle, ErrObjectNotFound)
+		}
+		if ref.Kind != KindProgram && ref.Kind != KindCollection {
+			return nil, fmt.Errorf("handle %s is a %s, not a program or collection", handle, ref.Kind)
+		}
+
+		root, members, err := objects.Group(handle)
+		if err != nil {
+			return nil, err
+		}
+		target.handle = root.Handle
+		target.loaded = root.Kind == KindCollection
+		if !target.loaded {
+			members = append(members, root)
+		}
+		for _, m := range members {
+			switch m.Kind {
+			case KindProgram:
+				if err := target.addProgram(m.ID); err != nil {
+					return nil, err
+				}
+			case KindMap:
+				if err := target.addMap(m.ID); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return target, nil
+	}
+
+	if programID == 0 {
+		return nil, errors.New("must specify program_id or handle")
+	}
+	if err := target.addProgram(programID); err != nil {
+		return nil, err
+	}
+	return target, nil
+}
+
+// addProgram records a program and the maps it references.
+func (t *unloadTarget) addProgram(id int) error {
+	prog, err := ebpf.NewProgramFromID(ebpf.ProgramID(id))
+	if err != nil {
+		return fmt.Errorf("program %d: %w", id, err)
+	}
+	defer prog.Close()
+
+	info, err := prog.Info()
+	if err != nil {
+		return fmt.Errorf("program %d info: %w", id, err)
+	}
+	t.programs[id] = &UnloadedObject{
+		ID:      id,
+		Name:    info.Name,
+		Type:    info.Type.String(),
+		Memlock: fdinfoMemlock(prog.FD()),
+
+		progType: info.Type,
+	}
+
+	mapIDs, _ := info.MapIDs()
+	for _, mid := range mapIDs {
+		if _, ok := t.maps[int(mid)]; ok {
+			continue
+		}
+		if err := t.addMap(int(mid)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *unloadTarget) addMap(id int) error {
+	m, err := ebpf.NewMapFromID(ebpf.MapID(id))
+	if err != nil {
+		return fmt.Errorf("map %d: %w", id, err)
+	}
+	defer m.Close()
+
+	info, err := m.Info()
+	if err != nil {
+		return fmt.Errorf("map %d info: %w", id, err)
+	}
+	memlock, _ := info.Memlock()
+	t.maps[id] = &UnloadedObject{
+		ID:      id,
+		Name:    info.Name,
+		Type:    info.Type.String(),
+		Memlock: memlock,
+	}
+	return nil
+}
+
+// sharedMaps returns the target maps that programs outside the target also
+// use, keyed by map ID.
+func sharedMaps(t *unloadTarget) (map[int][]int, error) {
+	shared := make(map[int][]int)
+	var id ebpf.ProgramID
+	for {
+		next, err := ebpf.ProgramGetNextID(id)
+		if errors.Is(err, os.ErrNotExist) {
+			return shared, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("enumerate programs: %w", err)
+		}
+		id = next
+
+		if _, ok := t.programs[int(id)]; ok {
+			continue
+		}
+		prog, err := ebpf.NewProgramFromID(id)
+		if err != nil {
+			// Unloaded while we were iterating.
+			continue
+		}
+		info, err := prog.Info()
+		prog.Close()
+		if err != nil {
+			continue
+		}
+		mapIDs, _ := info.MapIDs()
+		for _, mid := range mapIDs {
+			if _, ok := t.maps[int(mid)]; ok {
+				shared[int(mid)] = append(shared[int(mid)], int(id))
+			}
+		}
+	}
+}
+
+// dependentLinks returns the IDs of kernel links running a target program.
+func dependentLinks(t *unloadTarget) ([]int, error) {
+	var ids []int
+	it := new(link.Iterator)
+	defer it.Close()
+	for it.Next() {
+		info, err := it.Link.Info()
+		if err != nil {
+			continue
+		}
+		if _, ok := t.programs[int(info.Program)]; ok {
+			ids = append(ids, int(it.ID))
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, fmt.Errorf("enumerate links: %w", err)
+	}
+	return ids, nil
+}
+
+// cascadeDetach removes a link standing in the way of an unload. Links the
+// server does not hold are force-detached, since closing our descriptor
+// alone would leave them attached; the caller only passes them with force.
+// Pins the server did not create are removed with force too.
+func cascadeDetach(id int, pins []string, force bool, result *UnloadProgramResult) error {
+	rl, err := resolveLink(id, "", "")
+	if err != nil {
+		return err
+	}
+
+	var foreign []string
+	for _, p := range pins {
+		if p != rl.pinPath {
+			foreign = append(foreign, p)
+		}
+	}
+	if force {
+		for _, p := range foreign {
+			if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+				rl.close()
+				return fmt.Errorf("unpin %s: %w", p, err)
+			}
+			result.Unpinned = append(result.Unpinned, p)
+		}
+	} else if len(foreign) > 0 {
+		result.Warnings = append(result.Warnings,
+			fmt.Sprintf("link %d stays attached through pins %v not created by this server; set force to remove them", id, foreign))
+	}
+
+	if rl.handle == "" {
+		if err := forceDetachLink(rl.link); err != nil {
+			result.Warnings = append(result.Warnings,
+				fmt.Sprintf("link %d could not be force-detached (%v); it stays attached while other holders keep it open", id, err))
+		}
+	}
+
+	detached, err := detachResolvedLink(rl, false)
+	if err != nil {
+		return err
+	}
+	result.Unpinned = append(result.Unpinned, detached.Unpinned...)
+	result.Released = append(result.Released, detached.Released...)
+	return nil
+}
+
+// fdinfoMemlock reads the memlock accounting the kernel reports for a BPF
+// file descriptor.
+func fdinfoMemlock(fd int) uint64 {
+	f, err := os.Open(fmt.Sprintf("/proc/self/fdinfo/%d", fd))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok || key != "memlock" {
+			continue
+		}
+		n, err := strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			return 0
+		}
+		return n
+	}
+	return 0
+}
+
+// waitGone polls open until the object no longer exists or the deadline
+// passes, and reports whether it is gone.
+func waitGone(deadline time.Time, open func() error) bool {
+	for {
+		if err := open(); errors.Is(err, os.ErrNotExist) {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func sortedIDs(m map[int]*UnloadedObject) []int {
+	ids := make([]int, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
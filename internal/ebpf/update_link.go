@@ -0,0 +1,110 @@
+// internal/ebpf/update_link.go
+package ebpf
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/cilium/ebpf/link"
+)
+
+type UpdateLinkArgs struct {
+	LinkID       int    `json:"link_id,omitempty"`
+	PinPath      string `json:"pin_path,omitempty"`
+	Handle       string `json:"handle,omitempty"`
+	ProgramID    int    `json:"program_id"`
+	OldProgramID int    `json:"old_program_id,omitempty"`
+}
+
+type UpdateLinkResult struct {
+	Success      bool        `json:"success"`
+	ToolVersion  string      `json:"tool_version"`
+	LinkID       int         `json:"link_id,omitempty"`
+	Handle       string      `json:"handle,omitempty"`
+	OldProgramID int         `json:"old_program_id,omitempty"`
+	NewProgramID int         `json:"new_program_id,omitempty"`
+	Released     []ObjectRef `json:"released,omitempty"`
+	Message      string      `json:"message,omitempty"`
+	Error        string      `json:"error,omitempty"`
+}
+
+func updateLinkFailure(err error) (*UpdateLinkResult, error) {
+	return &UpdateLinkResult{
+		Success:     false,
+		ToolVersion: "v1",
+		Error:       err.Error(),
+	}, err
+}
+
+// UpdateLink atomically replaces the program behind an existing link, so
+// XDP or cgroup programs can be swapped without a window where nothing is
+// attached. If OldProgramID is set the update only succeeds while the link
+// still runs that program.
+func UpdateLink(args *UpdateLinkArgs) (*UpdateLinkResult, error) {
+	if args == nil {
+		return updateLinkFailure(errors.New("args cannot be nil"))
+	}
+	if args.ProgramID == 0 {
+		return updateLinkFailure(errors.New("program_id is required"))
+	}
+
+	rl, err := resolveLink(args.LinkID, args.PinPath, args.Handle)
+	if err != nil {
+		return updateLinkFailure(err)
+	}
+	defer rl.close()
+
+	info, err := rl.link.Info()
+	if err != nil {
+		return updateLinkFailure(fmt.Errorf("link info: %w", err))
+	}
+	oldProgramID := int(info.Program)
+
+	prog, progHandle, err := objects.OpenProgram(args.ProgramID)
+	if err != nil {
+		return updateLinkFailure(err)
+	}
+	defer objects.Release(progHandle)
+
+	if args.OldProgramID != 0 {
+		raw, ok := rl.link.(interface {
+			UpdateArgs(link.RawLinkUpdateOptions) error
+		})
+		if !ok {
+			return updateLinkFailure(fmt.Errorf("link %d does not support conditional updates", rl.id))
+		}
+		old, oldHandle, err := objects.OpenProgram(args.OldProgramID)
+		if err != nil {
+			return updateLinkFailure(err)
+		}
+		defer objects.Release(oldHandle)
+
+		const bpfFReplace = 1 << 2
+		err = raw.UpdateArgs(link.RawLinkUpdateOptions{New: prog, Old: old, Flags: bpfFReplace})
+		if err != nil {
+			return updateLinkFailure(fmt.Errorf("update link %d: %w", rl.id, err))
+		}
+		oldProgramID = args.OldProgramID
+	} else if err := rl.link.Update(prog); err != nil {
+		return updateLinkFailure(fmt.Errorf("update link %d: %w", rl.id, err))
+	}
+
+	result := &UpdateLinkResult{
+		Success:      true,
+		ToolVersion:  "v1",
+		LinkID:       rl.id,
+		Handle:       rl.handle,
+		OldProgramID: oldProgramID,
+		NewProgramID: args.ProgramID,
+		Message:      fmt.Sprintf("Link %d now runs program %d (was %d)", rl.id, args.ProgramID, oldProgramID),
+	}
+
+	if rl.handle != "" {
+		released, err := objects.Rebind(rl.handle, progHandle)
+		result.Released = released
+		if err != nil {
+			result.Error = err.Error()
+		}
+	}
+	return result, nil
+}
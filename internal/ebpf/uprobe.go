@@ -0,0 +1,502 @@
+package ebpf
+
+import (
+	"bytes"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+)
+
+// libraryDirs are searched for shared libraries given by name when no
+// process is given to resolve them through.
+var libraryDirs = []string{
+	"/lib", "/usr/lib", "/lib64", "/usr/lib64",
+	"/lib/x86_64-linux-gnu", "/usr/lib/x86_64-linux-gnu",
+	"/lib/aarch64-linux-gnu", "/usr/lib/aarch64-linux-gnu",
+}
+
+// USDTProbe describes the locations of a USDT probe a program was attached
+// to, and how to read the probe's arguments at each of them.
+type USDTProbe struct {
+	Provider  string         `json:"provider"`
+	Name      string         `json:"name"`
+	Semaphore bool           `json:"semaphore"`
+	Locations []USDTLocation `json:"locations"`
+}
+
+type USDTLocation struct {
+	// Offset is the file offset the uprobe is placed at.
+	Offset    uint64         `json:"offset"`
+	Arguments []USDTArgument `json:"arguments"`
+}
+
+// USDTArgument is an argument spec of a stapsdt note, such as "-4@%edi",
+// "8@-16(%rbp)" or "8@[sp, 16]". The argument is in a register, in memory
+// at a register plus offset, or a constant.
+type USDTArgument struct {
+	Spec     string `json:"spec"`
+	Size     int    `json:"size"`
+	Signed   bool   `json:"signed"`
+	Kind     string `json:"kind"`
+	Register string `json:"register,omitempty"`
+	Offset   int64  `json:"offset,omitempty"`
+	Value    int64  `json:"value,omitempty"`
+}
+
+// usdtNote is a probe location from .note.stapsdt, with addresses already
+// converted to file offsets.
+type usdtNote struct {
+	provider, name string
+	offset         uint64
+	semaphore      uint64
+	args           string
+}
+
+// resolveUprobeTarget finds the file to place uprobes in. An empty target
+// is the executable of pid. With a pid, bare library names such as "libc"
+// or "libssl.so.3" are looked up in its mappings and reached through its
+// root, so libraries of containers are found; without one they are looked
+// up in PATH and the usual library directories. It returns the path to
+// open and the path to report.
+func resolveUprobeTarget(target string, pid int) (string, string, error) {
+	if target == "" {
+		if pid <= 0 {
+			return "", "", errors.New("target binary or options.pid required")
+		}
+		exe := fmt.Sprintf("/proc/%d/exe", pid)
+		path, err := os.Readlink(exe)
+		if err != nil {
+			return "", "", fmt.Errorf("process %d: %w", pid, err)
+		}
+		return exe, path, nil
+	}
+
+	if strings.Contains(target, "/") {
+		path, err := filepath.Abs(target)
+		if err != nil {
+			return "", "", err
+		}
+		if pid > 0 {
+			if root := fmt.Sprintf("/proc/%d/root%s", pid, path); fileExists(root) {
+				return root, path, nil
+			}
+		}
+		if !fileExists(path) {
+			return "", "", fmt.Errorf("binary %s: %w", path, os.ErrNotExist)
+		}
+		return path, path, nil
+	}
+
+	if pid > 0 {
+		maps, err := readProcMaps(pid)
+		if err != nil {
+			return "", "", fmt.Errorf("process %d: %w", pid, err)
+		}
+		for _, m := range maps {
+			if m.path != "" && libraryMatches(filepath.Base(m.path), target) {
+				return fmt.Sprintf("/proc/%d/root%s", pid, m.path), m.path, nil
+			}
+		}
+		return "", "", fmt.Errorf("%q is not mapped by process %d", target, pid)
+	}
+
+	if path, err := resolveBinary(target); err == nil {
+		return path, path, nil
+	}
+	for _, dir := range libraryDirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			// Skip linker scripts such as libc.so.
+			path := filepath.Join(dir, e.Name())
+			if libraryMatches(e.Name(), target) && isELF(path) {
+				return path, path, nil
+			}
+		}
+	}
+	return "", "", fmt.Errorf("binary or library %q not found (give a path, or options.pid to resolve it through a process)", target)
+}
+
+// libraryMatches reports whether a file name is the library name, allowing
+// the "lib" prefix and version suffixes to be left out: "c", "libc" and
+// "libc.so.6" all match "libc.so.6".
+func libraryMatches(file, name string) bool {
+	for _, n := range []string{name, "lib" + name} {
+		if file == n || strings.HasPrefix(file, n+".so") || strings.HasPrefix(file, n+"-") {
+			return true
+		}
+	}
+	return false
+}
+
+func isELF(path string) bool {
+	f, err := elf.Open(path)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// isGoBinary reports whether an ELF file was built by the Go toolchain.
+func isGoBinary(f *elf.File) bool {
+	return f.Section(".go.buildinfo") != nil || f.Section(".gopclntab") != nil
+}
+
+// attachUprobe attaches a uprobe or uretprobe to a symbol, optionally plus
+// an offset, or to a file offset given as options.address, of a binary or
+// shared library.
+func attachUprobe(prog *ebpf.Program, args *AttachProgramArgs) (link.Link, string, error) {
+	pid := intOption(args.Options, "pid")
+	symbol, _ := args.Options["symbol"].(string)
+	address := uint64(intOption(args.Options, "address"))
+	if symbol == "" && address == 0 {
+		return nil, "", fmt.Errorf("options.symbol or options.address required for %s attachment", args.AttachType)
+	}
+
+	path, display, err := resolveUprobeTarget(args.Target, pid)
+	if err != nil {
+		return nil, "", err
+	}
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("open %s: %w", display, err)
+	}
+	goBinary := isGoBinary(f)
+	f.Close()
+	if goBinary && args.AttachType == "uretprobe" {
+		return nil, "", fmt.Errorf("%s is a Go binary: uretprobes corrupt the stacks of Go programs when they grow, attach uprobes to the function's return instructions instead", display)
+	}
+
+	ex, err := link.OpenExecutable(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("open %s: %w", display, err)
+	}
+	opts := &link.UprobeOptions{
+		Address: address,
+		Offset:  uint64(intOption(args.Options, "offset")),
+		PID:     pid,
+		Cookie:  uint64(intOption(args.Options, "cookie")),
+	}
+	if symbol == "" {
+		symbol = fmt.Sprintf("0x%x", address)
+	}
+
+	attach := ex.Uprobe
+	if args.AttachType == "uretprobe" {
+		attach = ex.Uretprobe
+	}
+	l, err := attach(symbol, prog, opts)
+	if errors.Is(err, link.ErrNoSymbol) {
+		// Symbols only in MiniDebugInfo are not seen by the library.
+		if off, ok := symbolFileOffset(path, symbol); ok {
+			opts.Address = off
+			l, err = attach(symbol, prog, opts)
+		}
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("attach %s to %s in %s: %w", args.AttachType, symbol, display, err)
+	}
+
+	target := display + ":" + symbol
+	if opts.Offset != 0 {
+		target += fmt.Sprintf("+0x%x", opts.Offset)
+	}
+	if pid > 0 {
+		target += fmt.Sprintf(" (pid %d)", pid)
+	}
+	return l, target, nil
+}
+
+// symbolFileOffset finds a function symbol with loadELFSymbols and returns
+// its file offset.
+func symbolFileOffset(path, symbol string) (uint64, bool) {
+	syms, err := loadELFSymbols(path)
+	if err != nil {
+		return 0, false
+	}
+	for i, name := range syms.names {
+		if name != symbol {
+			continue
+		}
+		for _, p := range syms.loads {
+			if addr := syms.addrs[i]; addr >= p.Vaddr && addr < p.Vaddr+p.Memsz {
+				return addr - p.Vaddr + p.Off, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// attachUSDT attaches a program to every location of a USDT probe, given
+// as options.probe "provider:name" or just "name", letting the kernel
+// manage the probe's semaphore.
+func attachUSDT(prog *ebpf.Program, args *AttachProgramArgs) ([]link.Link, string, *USDTProbe, error) {
+	pid := intOption(args.Options, "pid")
+	probe, _ := args.Options["probe"].(string)
+	if probe == "" {
+		return nil, "", nil, errors.New("options.probe required for usdt attachment")
+	}
+	provider, name, ok := strings.Cut(probe, ":")
+	if !ok {
+		provider, name = "", probe
+	}
+
+	path, display, err := resolveUprobeTarget(args.Target, pid)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	notes, err := readUSDTNotes(path)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("read USDT probes of %s: %w", display, err)
+	}
+
+	var matched []usdtNote
+	providers := make(map[string]bool)
+	for _, n := range notes {
+		if n.name == name && (provider == "" || n.provider == provider) {
+			matched = append(matched, n)
+			providers[n.provider] = true
+		}
+	}
+	switch {
+	case len(matched) == 0:
+		return nil, "", nil, fmt.Errorf("USDT probe %q not found in %s (%d probes)", probe, display, len(notes))
+	case len(providers) > 1:
+		return nil, "", nil, fmt.Errorf("USDT probe %q is ambiguous in %s, give options.probe as provider:name", name, display)
+	}
+
+	ex, err := link.OpenExecutable(path)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("open %s: %w", display, err)
+	}
+	info := &USDTProbe{Provider: matched[0].provider, Name: name, Semaphore: matched[0].semaphore != 0}
+	var links []link.Link
+	for _, n := range matched {
+		l, err := ex.Uprobe(n.provider+":"+n.name, prog, &link.UprobeOptions{
+			Address:      n.offset,
+			PID:          pid,
+			RefCtrOffset: n.semaphore,
+			Cookie:       uint64(intOption(args.Options, "cookie")),
+		})
+		if err != nil {
+			for _, l := range links {
+				l.Close()
+			}
+			return nil, "", nil, fmt.Errorf("attach usdt %s:%s at 0x%x in %s: %w", n.provider, n.name, n.offset, display, err)
+		}
+		links = append(links, l)
+		info.Locations = append(info.Locations, USDTLocation{Offset: n.offset, Arguments: parseUSDTArgs(n.args)})
+	}
+
+	target := fmt.Sprintf("%s:%s:%s", display, info.Provider, name)
+	if pid > 0 {
+		target += fmt.Sprintf(" (pid %d)", pid)
+	}
+	return links, target, info, nil
+}
+
+// readUSDTNotes parses the stapsdt notes of an ELF file. Each note holds
+// the probe's address, the link time address of .stapsdt.base, the
+// semaphore's address, and the provider, name and argument specs.
+func readUSDTNotes(path string) ([]usdtNote, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sec := f.Section(".note.stapsdt")
+	if sec == nil {
+		return nil, errors.New("no .note.stapsdt section")
+	}
+	data, err := sec.Data()
+	if err != nil {
+		return nil, err
+	}
+	var baseAddr uint64
+	if base := f.Section(".stapsdt.base"); base != nil {
+		baseAddr = base.Addr
+	}
+	addrSize := 8
+	if f.Class == elf.ELFCLASS32 {
+		addrSize = 4
+	}
+	addr := func(b []byte) uint64 {
+		if addrSize == 4 {
+			return uint64(f.ByteOrder.Uint32(b))
+		}
+		return f.ByteOrder.Uint64(b)
+	}
+	align4 := func(n uint32) uint32 { return (n + 3) &^ 3 }
+
+	var notes []usdtNote
+	for len(data) >= 12 {
+		nameSize := f.ByteOrder.Uint32(data[0:])
+		descSize := f.ByteOrder.Uint32(data[4:])
+		typ := f.ByteOrder.Uint32(data[8:])
+		data = data[12:]
+		if uint64(align4(nameSize))+uint64(align4(descSize)) > uint64(len(data)) {
+			return nil, errors.New("truncated note")
+		}
+		owner := string(bytes.TrimRight(data[:nameSize], "\x00"))
+		desc := data[align4(nameSize):][:descSize]
+		data = data[align4(nameSize)+align4(descSize):]
+		if owner != "stapsdt" || typ != 3 || len(desc) < 3*addrSize {
+			continue
+		}
+
+		pc, base, semaphore := addr(desc), addr(desc[addrSize:]), addr(desc[2*addrSize:])
+		strs := strings.SplitN(string(desc[3*addrSize:]), "\x00", 4)
+		if len(strs) < 3 {
+			continue
+		}
+		// Prelinking moves the probes with .stapsdt.base.
+		if baseAddr != 0 && base != 0 {
+			pc += baseAddr - base
+		}
+		n := usdtNote{provider: strs[0], name: strs[1], args: strs[2]}
+		var ok bool
+		if n.offset, ok = fileOffset(f, pc, true); !ok {
+			continue
+		}
+		if semaphore != 0 {
+			if n.semaphore, ok = fileOffset(f, semaphore, false); !ok {
+				continue
+			}
+		}
+		notes = append(notes, n)
+	}
+	return notes, nil
+}
+
+// fileOffset converts a virtual address to the offset in the file it is
+// loaded from, looking only at executable segments with exec.
+func fileOffset(f *elf.File, addr uint64, exec bool) (uint64, bool) {
+	for _, p := range f.Progs {
+		if p.Type != elf.PT_LOAD || (exec && p.Flags&elf.PF_X == 0) {
+			continue
+		}
+		if addr >= p.Vaddr && addr < p.Vaddr+p.Filesz {
+			return addr - p.Vaddr + p.Off, true
+		}
+	}
+	return 0, false
+}
+
+// parseUSDTArgs parses space separated argument specs. Each is
+// [-]size@location, a negative size meaning a signed argument.
+func parseUSDTArgs(specs string) []USDTArgument {
+	args := []USDTArgument{}
+	for _, spec := range splitUSDTArgs(specs) {
+		arg := USDTArgument{Spec: spec, Kind: "unknown"}
+		size, loc, ok := strings.Cut(spec, "@")
+		if !ok {
+			args = append(args, arg)
+			continue
+		}
+		n, err := strconv.Atoi(size)
+		if err == nil {
+			arg.Size, arg.Signed = n, n < 0
+			if n < 0 {
+				arg.Size = -n
+			}
+		}
+		parseUSDTLocation(&arg, loc)
+		args = append(args, arg)
+	}
+	return args
+}
+
+// splitUSDTArgs splits specs on spaces outside brackets, since arm64
+// memory operands look like "[sp, 16]".
+func splitUSDTArgs(specs string) []string {
+	var out []string
+	depth, start := 0, 0
+	for i, c := range specs {
+		switch c {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ' ':
+			if depth == 0 {
+				if i > start {
+					out = append(out, specs[start:i])
+				}
+				start = i + 1
+			}
+		}
+	}
+	if start < len(specs) {
+		out = append(out, specs[start:])
+	}
+	return out
+}
+
+// parseUSDTLocation understands x86 AT&T operands ("%rdi", "-8(%rbp)",
+// "$5") and arm64 ones ("x0", "[sp, 16]", "[x1]", "5").
+func parseUSDTLocation(arg *USDTArgument, loc string) {
+	switch {
+	case strings.HasPrefix(loc, "$"):
+		if v, err := strconv.ParseInt(loc[1:], 0, 64); err == nil {
+			arg.Kind, arg.Value = "constant", v
+		}
+	case strings.HasPrefix(loc, "%"):
+		arg.Kind, arg.Register = "register", loc[1:]
+	case strings.HasSuffix(loc, ")"):
+		open := strings.IndexByte(loc, '(')
+		if open < 0 {
+			return
+		}
+		inner := strings.Split(loc[open+1:len(loc)-1], ",")
+		if open > 0 {
+			v, err := strconv.ParseInt(loc[:open], 0, 64)
+			if err != nil {
+				return
+			}
+			arg.Offset = v
+		}
+		// Indexed operands are left as unknown.
+		if len(inner) != 1 || !strings.HasPrefix(inner[0], "%") {
+			return
+		}
+		arg.Kind, arg.Register = "memory", inner[0][1:]
+	case strings.HasPrefix(loc, "[") && strings.HasSuffix(loc, "]"):
+		reg, off, hasOff := strings.Cut(loc[1:len(loc)-1], ",")
+		if hasOff {
+			v, err := strconv.ParseInt(strings.TrimSpace(off), 0, 64)
+			if err != nil {
+				return
+			}
+			arg.Offset = v
+		}
+		arg.Kind, arg.Register = "memory", strings.TrimSpace(reg)
+	default:
+		if v, err := strconv.ParseInt(loc, 0, 64); err == nil {
+			arg.Kind, arg.Value = "constant", v
+		} else if loc != "" {
+			arg.Kind, arg.Register = "register", loc
+		}
+	}
+}
+
+// intOption reads an integer option, which arrives as a JSON number.
+func intOption(options map[string]interface{}, name string) int {
+	v, _ := options[name].(float64)
+	return int(v)
+}
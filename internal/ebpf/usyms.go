@@ -0,0 +1,222 @@
+package ebpf
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// procMapping is an executable mapping of /proc/<pid>/maps.
+type procMapping struct {
+	start, end, offset uint64
+	path               string
+}
+
+// readProcMaps returns the executable mappings of a process.
+func readProcMaps(pid int) ([]procMapping, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/maps", pid))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var maps []procMapping
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Format: <start>-<end> <perms> <offset> <dev> <inode> [<path>]
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || !strings.Contains(fields[1], "x") {
+			continue
+		}
+		start, end, ok := strings.Cut(fields[0], "-")
+		if !ok {
+			continue
+		}
+		m := procMapping{}
+		if m.start, err = strconv.ParseUint(start, 16, 64); err != nil {
+			continue
+		}
+		if m.end, err = strconv.ParseUint(end, 16, 64); err != nil {
+			continue
+		}
+		if m.offset, err = strconv.ParseUint(fields[2], 16, 64); err != nil {
+			continue
+		}
+		if len(fields) > 5 {
+			m.path = strings.Join(fields[5:], " ")
+		}
+		maps = append(maps, m)
+	}
+	return maps, scanner.Err()
+}
+
+// elfSymbols resolves addresses of an ELF file to function symbols.
+type elfSymbols struct {
+	addrs []uint64
+	sizes []uint64
+	names []string
+	loads []elf.ProgHeader
+}
+
+// loadELFSymbols reads the function symbols of an ELF file from .symtab,
+// the MiniDebugInfo in .gnu_debugdata and, if neither has any, .dynsym.
+func loadELFSymbols(path string) (*elfSymbols, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	t := &elfSymbols{}
+	for _, p := range f.Progs {
+		if p.Type == elf.PT_LOAD && p.Flags&elf.PF_X != 0 {
+			t.loads = append(t.loads, p.ProgHeader)
+		}
+	}
+
+	syms, _ := f.Symbols()
+	if s := f.Section(".gnu_debugdata"); s != nil {
+		if data, err := s.Data(); err == nil {
+			if mini, err := miniDebugInfoSymbols(data); err == nil {
+				syms = append(syms, mini...)
+			}
+		}
+	}
+	if len(syms) == 0 {
+		syms, _ = f.DynamicSymbols()
+	}
+
+	type sym struct {
+		addr, size uint64
+		name       string
+	}
+	var funcs []sym
+	for _, s := range syms {
+		typ := elf.ST_TYPE(s.Info)
+		if (typ != elf.STT_FUNC && typ != elf.STT_GNU_IFUNC) || s.Value == 0 {
+			continue
+		}
+		funcs = append(funcs, sym{s.Value, s.Size, s.Name})
+	}
+	sort.Slice(funcs, func(i, j int) bool { return funcs[i].addr < funcs[j].addr })
+	for _, s := range funcs {
+		t.addrs = append(t.addrs, s.addr)
+		t.sizes = append(t.sizes, s.size)
+		t.names = append(t.names, s.name)
+	}
+	return t, nil
+}
+
+// miniDebugInfoSymbols reads the symbols of the xz-compressed ELF file in
+// a .gnu_debugdata section.
+func miniDebugInfoSymbols(data []byte) ([]elf.Symbol, error) {
+	raw, err := xzDecompress(data, maxMiniDebugInfo)
+	if err != nil {
+		return nil, err
+	}
+	f, err := elf.NewFile(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	return f.Symbols()
+}
+
+// vaddr converts a file offset to the virtual address it is loaded at.
+func (t *elfSymbols) vaddr(off uint64) (uint64, bool) {
+	for _, p := range t.loads {
+		if off >= p.Off && off < p.Off+p.Filesz {
+			return off - p.Off + p.Vaddr, true
+		}
+	}
+	return 0, false
+}
+
+// lookup returns the function containing the virtual address addr.
+// Symbols without a size are assumed to extend to the next symbol.
+func (t *elfSymbols) lookup(addr uint64) (string, bool) {
+	i := sort.Search(len(t.addrs), func(i int) bool { return t.addrs[i] > addr }) - 1
+	if i < 0 {
+		return "", false
+	}
+	if t.sizes[i] != 0 && addr >= t.addrs[i]+t.sizes[i] {
+		return "", false
+	}
+	return t.names[i], true
+}
+
+// userSymbolizer resolves user space addresses of processes, caching
+// mappings per process and symbols per file.
+type userSymbolizer struct {
+	maps  map[int][]procMapping
+	files map[string]*elfSymbols
+	// exited are processes whose mappings could not be read.
+	exited map[int]bool
+}
+
+func newUserSymbolizer() *userSymbolizer {
+	return &userSymbolizer{
+		maps:   make(map[int][]procMapping),
+		files:  make(map[string]*elfSymbols),
+		exited: make(map[int]bool),
+	}
+}
+
+// resolve returns the function containing addr in process pid and the
+// base name of the file it belongs to. Addresses without a symbol resolve
+// to the file name in brackets, or to "[unknown]".
+func (u *userSymbolizer) resolve(pid int, addr uint64) (string, string) {
+	maps, ok := u.maps[pid]
+	if !ok {
+		var err error
+		if maps, err = readProcMaps(pid); err != nil {
+			u.exited[pid] = true
+		}
+		u.maps[pid] = maps
+	}
+
+	for _, m := range maps {
+		if addr < m.start || addr >= m.end {
+			continue
+		}
+		switch {
+		case m.path == "":
+			return "[anon]", ""
+		case strings.HasPrefix(m.path, "["):
+			return m.path, ""
+		}
+		module := filepath.Base(m.path)
+		syms := u.symbols(pid, m.path)
+		if syms == nil {
+			return "[" + module + "]", module
+		}
+		vaddr, ok := syms.vaddr(addr - m.start + m.offset)
+		if !ok {
+			return "[" + module + "]", module
+		}
+		if name, ok := syms.lookup(vaddr); ok {
+			return name, module
+		}
+		return "[" + module + "]", module
+	}
+	return "[unknown]", ""
+}
+
+// symbols loads the symbols of a mapped file, through the root of the
+// process so files of containers are found.
+func (u *userSymbolizer) symbols(pid int, path string) *elfSymbols {
+	if t, ok := u.files[path]; ok {
+		return t
+	}
+	t, err := loadELFSymbols(fmt.Sprintf("/proc/%d/root%s", pid, path))
+	if err != nil {
+		t, _ = loadELFSymbols(path)
+	}
+	u.files[path] = t
+	return t
+}
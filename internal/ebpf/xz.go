@@ -0,0 +1,35 @@
+package ebpf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ulikunitz/xz"
+)
+
+// maxMiniDebugInfo bounds what a MiniDebugInfo (.gnu_debugdata) section
+// may decompress to, so a corrupt or hostile binary can't exhaust memory.
+const maxMiniDebugInfo = 256 << 20
+
+// xzDecompress decodes an xz file held in memory, checking its integrity.
+// Files that decompress to more than limit bytes are an error.
+func xzDecompress(data []byte, limit int) ([]byte, error) {
+	r, err := xz.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	out, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > limit {
+		return nil, fmt.Errorf("xz: decompresses to more than %d bytes", limit)
+	}
+	// The reader takes a stream header alone for an empty stream.
+	if len(out) == 0 {
+		return nil, errors.New("xz: no data")
+	}
+	return out, nil
+}
@@ -0,0 +1,169 @@
+package ebpf
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/hex"
+	"os"
+	"strings"
+	"testing"
+)
+
+// testdata/minidebuginfo is testdata/minidebuginfo.c built and stripped
+// following the MiniDebugInfo recipe of the gdb manual: its function
+// symbols are only in the xz-compressed ELF file in .gnu_debugdata. The
+// .xz files hold the same ELF file with other checks and block sizes.
+
+// miniDebugInfoSHA256 is the digest of the ELF file in .gnu_debugdata.
+const miniDebugInfoSHA256 = "533277ebe7815703a4c422f58865f784f9f167bb4b8892a297341cff51b212be"
+
+func readGnuDebugdata(t testing.TB) []byte {
+	t.Helper()
+	f, err := elf.Open("testdata/minidebuginfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	s := f.Section(".gnu_debugdata")
+	if s == nil {
+		t.Fatal("no .gnu_debugdata section")
+	}
+	data, err := s.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func readTestdata(t testing.TB, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestXZDecompress(t *testing.T) {
+	blobs := map[string][]byte{
+		".gnu_debugdata (crc64)":  readGnuDebugdata(t),
+		"sha256, 1KiB blocks":     readTestdata(t, "minidebuginfo-sha256-blocks.xz"),
+		"no check":                readTestdata(t, "minidebuginfo-none.xz"),
+		"trailing stream padding": append(readGnuDebugdata(t), 0, 0, 0, 0),
+	}
+	for name, data := range blobs {
+		out, err := xzDecompress(data, maxMiniDebugInfo)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		sum := sha256.Sum256(out)
+		if got := hex.EncodeToString(sum[:]); got != miniDebugInfoSHA256 {
+			t.Errorf("%s: decoded to sha256 %s, want %s", name, got, miniDebugInfoSHA256)
+		}
+	}
+}
+
+func TestXZDecompressCorrupt(t *testing.T) {
+	good := readGnuDebugdata(t)
+	flip := func(i int) []byte {
+		data := bytes.Clone(good)
+		data[i] ^= 0x40
+		return data
+	}
+
+	tests := map[string][]byte{
+		"empty":             nil,
+		"bad magic":         flip(0),
+		"header checksum":   flip(8),
+		"compressed data":   flip(len(good) / 2),
+		"block check":       flip(len(good) - 40),
+		"truncated":         good[:len(good)/2],
+		"truncated footer":  good[:len(good)-4],
+		"trailing garbage":  append(bytes.Clone(good), 'x'),
+		"not xz":            []byte("\x7fELF"),
+		"header only":       good[:12],
+		"gzip":              {0x1f, 0x8b, 0x08, 0, 0, 0, 0, 0, 0, 0},
+		"lzma alone format": {0x5d, 0, 0, 0x80, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+	}
+	for name, data := range tests {
+		if _, err := xzDecompress(data, maxMiniDebugInfo); err == nil {
+			t.Errorf("%s: decoded without error", name)
+		}
+	}
+
+	// The section decompresses to 3640 bytes.
+	if _, err := xzDecompress(good, 3639); err == nil || !strings.Contains(err.Error(), "more than 3639 bytes") {
+		t.Errorf("decoding past the limit: got %v", err)
+	}
+	if _, err := xzDecompress(good, 3640); err != nil {
+		t.Errorf("decoding up to the limit: %v", err)
+	}
+}
+
+func TestMiniDebugInfoSymbols(t *testing.T) {
+	syms, err := miniDebugInfoSymbols(readGnuDebugdata(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[string]bool{}
+	for _, s := range syms {
+		found[s.Name] = true
+	}
+	for _, name := range []string{"main", "mdi_global_func", "mdi_static_helper"} {
+		if !found[name] {
+			t.Errorf("%s not in MiniDebugInfo symbols", name)
+		}
+	}
+}
+
+func TestLoadELFSymbolsMiniDebugInfo(t *testing.T) {
+	f, err := elf.Open("testdata/minidebuginfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Symbols(); err == nil {
+		t.Fatal("testdata/minidebuginfo has a .symtab; it must only have MiniDebugInfo")
+	}
+	f.Close()
+
+	syms, err := loadELFSymbols("testdata/minidebuginfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"mdi_global_func", "mdi_static_helper"} {
+		i := indexOf(syms.names, name)
+		if i < 0 {
+			t.Errorf("%s not loaded", name)
+			continue
+		}
+		// Addresses inside the function resolve to it.
+		if got, ok := syms.lookup(syms.addrs[i] + 1); !ok || got != name {
+			t.Errorf("lookup(%#x) = %q, %v; want %s", syms.addrs[i]+1, got, ok, name)
+		}
+	}
+}
+
+func indexOf(names []string, name string) int {
+	for i, n := range names {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func FuzzXZDecompress(f *testing.F) {
+	f.Add(readGnuDebugdata(f))
+	f.Add(readTestdata(f, "minidebuginfo-sha256-blocks.xz"))
+	f.Add(readTestdata(f, "minidebuginfo-none.xz"))
+	// A small limit keeps inputs that decompress to a lot fast.
+	const limit = 1 << 20
+	f.Fuzz(func(t *testing.T, data []byte) {
+		out, err := xzDecompress(data, limit)
+		if err == nil && len(out) > limit {
+			t.Fatalf("decoded %d bytes, more than the limit", len(out))
+		}
+	})
+}
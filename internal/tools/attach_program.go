@@ -2,13 +2,14 @@
 package tools
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/sameehj/ebpf-mcp/internal/ebpf"
 	"github.com/sameehj/ebpf-mcp/pkg/types"
 )
 
-func AttachProgramTool(input map[string]interface{}) (interface{}, error) {
+func AttachProgramTool(ctx context.Context, input map[string]interface{}) (interface{}, error) {
 	// Add debug logging
 	fmt.Printf("[DEBUG] AttachProgram input: %+v\n", input)
 
@@ -88,7 +89,7 @@ func init() {
 	RegisterTool(types.Tool{
 		ID:          "attach_program",
 		Title:       "Attach eBPF Program",
-		Description: "Attaches a loaded eBPF program to a kernel hook point.",
+		Description: "Attaches a loaded eBPF program to a kernel hook point, or to a function or USDT probe of a user space binary or shared library.",
 		InputSchema: map[string]interface{}{
 			"type":     "object",
 			"required": []string{"program_id", "attach_type"},
@@ -99,12 +100,12 @@ func init() {
 				},
 				"attach_type": map[string]interface{}{
 					"type":        "string",
-					"enum":        []string{"xdp", "kprobe", "kretprobe", "tracepoint", "cgroup"},
-					"description": "Type of attachment point",
+					"enum":        []string{"xdp", "kprobe", "kretprobe", "uprobe", "uretprobe", "usdt", "tracepoint", "raw_tracepoint", "tp_btf", "fentry", "fexit", "fmod_ret", "lsm", "iter", "cgroup"},
+					"description": "Type of attachment point. fentry, fexit, fmod_ret, tp_btf, lsm and iter programs attach to the target they were loaded against (see load_program attach_to)",
 				},
 				"target": map[string]interface{}{
 					"type":        "string",
-					"description": "Target interface, function, or cgroup path",
+					"description": "Target interface (name or index), kernel function, binary or shared library (path, or name such as \"libc\" resolved through options.pid) for uprobes and USDT, tracepoint (group:name, or name for raw_tracepoint), or cgroup path. Optional for BTF based types, where it is checked against the loaded target",
 				},
 				"pin_path": map[string]interface{}{
 					"type":        "string",
@@ -115,11 +116,53 @@ func init() {
 					"description": "Additional attachment options",
 					"properties": map[string]interface{}{
 						"flags": map[string]interface{}{
-							"type": "integer",
+							"type":        "integer",
+							"description": "Raw XDP attach flags",
 						},
 						"priority": map[string]interface{}{
 							"type": "integer",
 						},
+						"mode": map[string]interface{}{
+							"type":        "string",
+							"enum":        []string{"generic", "driver", "offload"},
+							"description": "XDP attach mode",
+						},
+						"attach_type": map[string]interface{}{
+							"type":        "string",
+							"description": "Cgroup hook, e.g. ingress, egress, sock_create, connect4, sysctl",
+						},
+						"offset": map[string]interface{}{
+							"type":        "integer",
+							"description": "Offset into the kprobe or uprobe target function",
+						},
+						"cookie": map[string]interface{}{
+							"type":        "integer",
+							"description": "BPF cookie for kprobes, uprobes, USDT probes, fentry, fexit, fmod_ret, tp_btf and lsm",
+						},
+						"max_active": map[string]interface{}{
+							"type":        "integer",
+							"description": "Maximum concurrent kretprobe instances",
+						},
+						"symbol": map[string]interface{}{
+							"type":        "string",
+							"description": "Function to place a uprobe on, including Go functions such as main.main",
+						},
+						"address": map[string]interface{}{
+							"type":        "integer",
+							"description": "File offset to place a uprobe at, instead of a symbol",
+						},
+						"pid": map[string]interface{}{
+							"type":        "integer",
+							"description": "Only fire uprobes and USDT probes in this process; with no target, probe its executable",
+						},
+						"map_id": map[string]interface{}{
+							"type":        "integer",
+							"description": "Map to iterate, for bpf_map_elem and sockmap iterators",
+						},
+						"probe": map[string]interface{}{
+							"type":        "string",
+							"description": "USDT probe as provider:name, or name if unambiguous",
+						},
 					},
 				},
 			},
@@ -131,8 +174,19 @@ func init() {
 				"success":      map[string]interface{}{"type": "boolean"},
 				"tool_version": map[string]interface{}{"type": "string"},
 				"link_id":      map[string]interface{}{"type": "integer"},
+				"handle":       map[string]interface{}{"type": "string"},
 				"pin_path":     map[string]interface{}{"type": "string"},
-				"message":      map[string]interface{}{"type": "string"},
+				"link_info":    map[string]interface{}{"type": "object"},
+				"extra_links": map[string]interface{}{
+					"type":        "array",
+					"description": "Links to the further locations of a USDT probe, each with its own handle",
+					"items":       map[string]interface{}{"type": "object"},
+				},
+				"usdt": map[string]interface{}{
+					"type":        "object",
+					"description": "The USDT probe's provider, name, whether it has a semaphore, and per location the file offset and argument specs with their size, signedness and register, memory or constant location",
+				},
+				"message": map[string]interface{}{"type": "string"},
 				"error": map[string]interface{}{
 					"$ref": "https://ebpf-mcp.dev/schemas/error.schema.json#/definitions/Error",
 				},
@@ -0,0 +1,136 @@
+// internal/tools/detach_program.go
+package tools
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sameehj/ebpf-mcp/internal/ebpf"
+	"github.com/sameehj/ebpf-mcp/pkg/types"
+)
+
+func DetachProgramTool(ctx context.Context, input map[string]interface{}) (interface{}, error) {
+	if input == nil {
+		return &ebpf.DetachProgramResult{
+			Success:     false,
+			ToolVersion: "v1",
+			Error:       "input is nil",
+		}, fmt.Errorf("input is nil")
+	}
+
+	args, err := parseLinkSelector(input)
+	if err != nil {
+		return &ebpf.DetachProgramResult{
+			Success:     false,
+			ToolVersion: "v1",
+			Error:       fmt.Sprintf("parsing error: %v", err),
+		}, err
+	}
+
+	detachArgs := &ebpf.DetachProgramArgs{
+		LinkID:  args.LinkID,
+		PinPath: args.PinPath,
+		Handle:  args.Handle,
+	}
+	if forceRaw, exists := input["force"]; exists && forceRaw != nil {
+		force, ok := forceRaw.(bool)
+		if !ok {
+			return nil, fmt.Errorf("force must be a boolean")
+		}
+		detachArgs.Force = force
+	}
+
+	return ebpf.DetachProgram(detachArgs)
+}
+
+// linkSelector identifies a link by kernel ID, pin path or server handle.
+type linkSelector struct {
+	LinkID  int
+	PinPath string
+	Handle  string
+}
+
+func parseLinkSelector(input map[string]interface{}) (*linkSelector, error) {
+	var sel linkSelector
+
+	if linkIDRaw, exists := input["link_id"]; exists && linkIDRaw != nil {
+		linkID, ok := linkIDRaw.(float64)
+		if !ok {
+			return nil, fmt.Errorf("link_id must be a number")
+		}
+		sel.LinkID = int(linkID)
+	}
+
+	if pinPathRaw, exists := input["pin_path"]; exists && pinPathRaw != nil {
+		pinPath, ok := pinPathRaw.(string)
+		if !ok {
+			return nil, fmt.Errorf("pin_path must be a string")
+		}
+		sel.PinPath = pinPath
+	}
+
+	if handleRaw, exists := input["handle"]; exists && handleRaw != nil {
+		handle, ok := handleRaw.(string)
+		if !ok {
+			return nil, fmt.Errorf("handle must be a string")
+		}
+		sel.Handle = handle
+	}
+
+	if sel.LinkID == 0 && sel.PinPath == "" && sel.Handle == "" {
+		return nil, fmt.Errorf("one of link_id, pin_path or handle is required")
+	}
+
+	return &sel, nil
+}
+
+func init() {
+	RegisterTool(types.Tool{
+		ID:          "detach_program",
+		Title:       "Detach eBPF Program",
+		Description: "Detaches an attached eBPF program by closing its link, removing any pin.",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"link_id": map[string]interface{}{
+					"type":        "integer",
+					"description": "Kernel ID of the link returned by attach_program",
+				},
+				"pin_path": map[string]interface{}{
+					"type":        "string",
+					"description": "Path the link is pinned at under /sys/fs/bpf; not allowed with handle, which removes the pin recorded at attach time",
+				},
+				"handle": map[string]interface{}{
+					"type":        "string",
+					"description": "Server handle of the link returned by attach_program",
+				},
+				"force": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Break the link even if other processes hold it open",
+					"default":     false,
+				},
+			},
+		},
+		OutputSchema: map[string]interface{}{
+			"type":     "object",
+			"required": []string{"success", "tool_version"},
+			"properties": map[string]interface{}{
+				"success":      map[string]interface{}{"type": "boolean"},
+				"tool_version": map[string]interface{}{"type": "string"},
+				"link_id":      map[string]interface{}{"type": "integer"},
+				"program_id":   map[string]interface{}{"type": "integer"},
+				"unpinned":     map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+				"released":     map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "object"}},
+				"message":      map[string]interface{}{"type": "string"},
+				"error":        map[string]interface{}{"type": "string"},
+			},
+		},
+		Annotations: map[string]interface{}{
+			"title":           "Detach Program",
+			"idempotentHint":  false,
+			"readOnlyHint":    false,
+			"destructiveHint": true,
+		},
+		Call: DetachProgramTool,
+	})
+}
@@ -0,0 +1,109 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sameehj/ebpf-mcp/internal/ebpf"
+	"github.com/sameehj/ebpf-mcp/pkg/types"
+)
+
+func FuncLatencyTool(ctx context.Context, input map[string]interface{}) (interface{}, error) {
+	args, err := ebpf.ParseFuncLatencyArgs(input)
+	if err != nil {
+		return &ebpf.FuncLatencyResult{
+			Success:     false,
+			ToolVersion: "v1",
+			Error:       fmt.Sprintf("parsing error: %v", err),
+		}, err
+	}
+
+	return ebpf.RunFuncLatency(ctx, args)
+}
+
+func init() {
+	RegisterTool(types.Tool{
+		ID:          "func_latency",
+		Title:       "Function Latency Histogram",
+		Description: "Measures how long calls to a kernel function take for a while, with fentry/fexit or a kprobe/kretprobe pair, or to a function of a user binary or library with uprobes. Returns a log2 histogram of latencies with the call count and estimated percentiles. Kernel functions must be listed in /proc/kallsyms.",
+		InputSchema: map[string]interface{}{
+			"type":     "object",
+			"required": []string{"function"},
+			"properties": map[string]interface{}{
+				"function": map[string]interface{}{
+					"type":        "string",
+					"description": "Kernel function, or symbol of the binary when binary is set",
+				},
+				"binary": map[string]interface{}{
+					"type":        "string",
+					"description": "User binary or shared library to trace with uprobes: a path, or a bare name looked up in PATH and the library directories, or in the mappings of pid when it is set. Go binaries are refused, as uretprobes corrupt their stacks",
+				},
+				"pid": map[string]interface{}{
+					"type":        "integer",
+					"description": "Only measure calls made by this process",
+				},
+				"duration_ms": map[string]interface{}{
+					"type":        "integer",
+					"description": "How long to measure for",
+					"default":     5000,
+					"minimum":     1,
+					"maximum":     60000,
+				},
+				"unit": map[string]interface{}{
+					"type":        "string",
+					"description": "Unit of the histogram and statistics",
+					"enum":        []string{"ns", "us", "ms"},
+					"default":     "us",
+				},
+			},
+		},
+		OutputSchema: map[string]interface{}{
+			"type":     "object",
+			"required": []string{"success", "tool_version", "histogram"},
+			"properties": map[string]interface{}{
+				"success":      map[string]interface{}{"type": "boolean"},
+				"tool_version": map[string]interface{}{"type": "string"},
+				"status":       map[string]interface{}{"type": "string"},
+				"function":     map[string]interface{}{"type": "string"},
+				"binary":       map[string]interface{}{"type": "string"},
+				"attach_mode":  map[string]interface{}{"type": "string", "enum": []string{"fentry", "kprobe", "uprobe"}},
+				"unit":         map[string]interface{}{"type": "string"},
+				"count":        map[string]interface{}{"type": "integer"},
+				"histogram": map[string]interface{}{
+					"type":        "array",
+					"description": "Calls per latency bucket [low, high), from the first to the last non-empty bucket",
+					"items": map[string]interface{}{
+						"type": "object",
+						"properties": map[string]interface{}{
+							"low":   map[string]interface{}{"type": "integer"},
+							"high":  map[string]interface{}{"type": "integer"},
+							"count": map[string]interface{}{"type": "integer"},
+						},
+					},
+				},
+				"stats": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"duration_ms":      map[string]interface{}{"type": "integer"},
+						"calls_per_second": map[string]interface{}{"type": "number"},
+						"in_flight":        map[string]interface{}{"type": "integer"},
+						"avg":              map[string]interface{}{"type": "number"},
+						"p50":              map[string]interface{}{"type": "number", "description": "Estimated from the histogram"},
+						"p90":              map[string]interface{}{"type": "number", "description": "Estimated from the histogram"},
+						"p99":              map[string]interface{}{"type": "number", "description": "Estimated from the histogram"},
+					},
+				},
+				"complete": map[string]interface{}{"type": "boolean"},
+				"warnings": map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+				"error":    map[string]interface{}{"type": "string"},
+			},
+		},
+		Annotations: map[string]interface{}{
+			"title":          "Function Latency (funclatency)",
+			"readOnlyHint":   false,
+			"idempotentHint": false,
+			"openWorldHint":  false,
+		},
+		Call: FuncLatencyTool,
+	})
+}
@@ -1,6 +1,7 @@
 package tools
 
 import (
+	"context"
 	"github.com/sameehj/ebpf-mcp/internal/ebpf"
 	"github.com/sameehj/ebpf-mcp/pkg/types"
 )
@@ -20,7 +21,7 @@ func init() {
 			"idempotentHint": true,
 			"openWorldHint":  false,
 		},
-		Call: func(input map[string]interface{}) (interface{}, error) {
+		Call: func(ctx context.Context, input map[string]interface{}) (interface{}, error) {
 			return ebpf.InspectSystemInfo()
 		},
 	})
@@ -2,27 +2,21 @@
 package tools
 
 import (
-	"runtime"
+	"context"
+	"sort"
 
+	"github.com/sameehj/ebpf-mcp/internal/ebpf"
 	"github.com/sameehj/ebpf-mcp/pkg/types"
 )
 
 type InspectStateInput struct {
-	Fields  []string               `json:"fields"`
-	Filters map[string]interface{} `json:"filters"`
+	Fields  []string            `json:"fields"`
+	Filters ebpf.InspectFilters `json:"filters"`
+	Limit   int                 `json:"limit"`
+	Cursor  string              `json:"cursor"`
 }
 
-type InspectStateOutput struct {
-	Success     bool               `json:"success"`
-	ToolVersion string             `json:"tool_version"`
-	Programs    []map[string]any   `json:"programs,omitempty"`
-	Maps        []map[string]any   `json:"maps,omitempty"`
-	Links       []map[string]any   `json:"links,omitempty"`
-	System      map[string]any     `json:"system,omitempty"`
-	Error       *types.ErrorDetail `json:"error,omitempty"`
-}
-
-func InspectState(input map[string]interface{}) (interface{}, error) {
+func InspectState(ctx context.Context, input map[string]interface{}) (interface{}, error) {
 	var args InspectStateInput
 	if err := types.StrictUnmarshal(input, &args); err != nil {
 		return nil, err
@@ -32,45 +26,44 @@ func InspectState(input map[string]interface{}) (interface{}, error) {
 		args.Fields = []string{"programs", "maps", "links", "system"}
 	}
 
-	out := InspectStateOutput{
-		Success:     true,
-		ToolVersion: "v1",
+	result, err := ebpf.InspectState(&ebpf.InspectStateArgs{
+		Fields:  args.Fields,
+		Filters: args.Filters,
+		Limit:   args.Limit,
+		Cursor:  args.Cursor,
+	})
+	if err != nil {
+		return result, err
 	}
 
 	for _, field := range args.Fields {
-		switch field {
-		case "system":
-			out.System = map[string]any{
-				"kernel_version":          runtime.GOARCH, // TODO: replace with actual version
-				"btf_enabled":             true,
-				"total_programs":          0,
-				"total_maps":              0,
-				"memory_usage_kb":         0,
-				"supported_program_types": []string{"XDP", "KPROBE", "TRACEPOINT", "CGROUP_SKB"},
-			}
-		case "programs":
-			out.Programs = append(out.Programs, map[string]any{
-				"id":   123,
-				"type": "XDP",
-				"name": "demo_prog",
-			})
-		case "maps":
-			out.Maps = append(out.Maps, map[string]any{
-				"id":   1,
-				"name": "demo_map",
-				"type": "hash",
-			})
-		case "links":
-			out.Links = append(out.Links, map[string]any{
-				"id":         7,
-				"program_id": 123,
-				"type":       "xdp",
-				"target":     "eth0",
-			})
+		if field == "tools" {
+			result.Tools = toolMetadata()
 		}
 	}
+	return result, nil
+}
 
-	return out, nil
+// toolMetadata describes the registered tools, sorted by name.
+func toolMetadata() []ebpf.InspectToolMeta {
+	all := GetAllTools()
+	ids := make([]string, 0, len(all))
+	for id := range all {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	meta := make([]ebpf.InspectToolMeta, 0, len(ids))
+	for _, id := range ids {
+		meta = append(meta, ebpf.InspectToolMeta{
+			Name:         id,
+			Version:      "v1",
+			Description:  all[id].Description,
+			InputSchema:  "https://ebpf-mcp.dev/schemas/" + id + "_input.json",
+			OutputSchema: "https://ebpf-mcp.dev/schemas/" + id + "_output.json",
+		})
+	}
+	return meta
 }
 
 func init() {
@@ -85,21 +78,48 @@ func init() {
 					"type": "array",
 					"items": map[string]any{
 						"type": "string",
-						"enum": []string{"programs", "maps", "links", "system"},
+						"enum": []string{"programs", "maps", "links", "system", "tools"},
 					},
 					"default": []string{"programs", "maps", "links", "system"},
 				},
 				"filters": map[string]any{
 					"type": "object",
 					"properties": map[string]any{
-						"program_type": map[string]any{"type": "string"},
-						"interface":    map[string]any{"type": "string"},
-						"name_pattern": map[string]any{"type": "string"},
-						"program_id":   map[string]any{"type": "integer"},
-						"map_id":       map[string]any{"type": "integer"},
-						"pinned_only":  map[string]any{"type": "boolean"},
+						"program_type": map[string]any{
+							"type":        "string",
+							"description": "Program type, e.g. XDP, KPROBE, TRACEPOINT or CGROUP_SKB",
+						},
+						"interface": map[string]any{
+							"type":        "string",
+							"description": "Network interface name or index; matches programs attached through XDP, TCX or netkit links",
+						},
+						"name_pattern": map[string]any{
+							"type":        "string",
+							"description": "Pattern matched against program and map names",
+						},
+						"name_match": map[string]any{
+							"type":        "string",
+							"enum":        []string{"glob", "regex"},
+							"default":     "glob",
+							"description": "How name_pattern is interpreted",
+						},
+						"program_id": map[string]any{"type": "integer"},
+						"map_id":     map[string]any{"type": "integer"},
+						"pinned_only": map[string]any{
+							"type":        "boolean",
+							"description": "Only return objects pinned under /sys/fs/bpf",
+						},
 					},
 				},
+				"limit": map[string]any{
+					"type":        "integer",
+					"minimum":     0,
+					"description": "Maximum number of programs, maps and links to return per page, counted per kind. 0 returns everything",
+				},
+				"cursor": map[string]any{
+					"type":        "string",
+					"description": "next_cursor from a previous call, to fetch the following page",
+				},
 			},
 		},
 		OutputSchema: map[string]any{
@@ -112,6 +132,8 @@ func init() {
 				"maps":         map[string]any{"type": "array", "items": map[string]any{"type": "object"}},
 				"links":        map[string]any{"type": "array", "items": map[string]any{"type": "object"}},
 				"system":       map[string]any{"type": "object"},
+				"tools":        map[string]any{"type": "array", "items": map[string]any{"type": "object"}},
+				"next_cursor":  map[string]any{"type": "string"},
 				"error": map[string]any{
 					"$ref": "https://ebpf-mcp.dev/schemas/error.schema.json#/definitions/Error",
 				},
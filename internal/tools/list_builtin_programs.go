@@ -0,0 +1,90 @@
+package tools
+
+import (
+	"context"
+
+	"github.com/sameehj/ebpf-mcp/internal/ebpf"
+	"github.com/sameehj/ebpf-mcp/pkg/types"
+)
+
+func init() {
+	fieldSchema := map[string]interface{}{
+		"type": "array",
+		"items": map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"name":   map[string]interface{}{"type": "string"},
+				"type":   map[string]interface{}{"type": "string"},
+				"offset": map[string]interface{}{"type": "integer"},
+				"size":   map[string]interface{}{"type": "integer"},
+				"values": map[string]interface{}{"type": "string", "description": "Names of an enum field's values"},
+			},
+		},
+	}
+
+	RegisterTool(types.Tool{
+		ID:          "list_builtin_programs",
+		Title:       "List Builtin Programs",
+		Description: "Lists the tracing programs built into the server, such as execsnoop and tcpstates, with where to attach them and the layout of their events and maps. Load one with load_program and source {\"type\": \"builtin\", \"name\": ...}; stream_events decodes builtin events without a struct_type.",
+		InputSchema: map[string]interface{}{
+			"type":       "object",
+			"properties": map[string]interface{}{},
+		},
+		OutputSchema: map[string]interface{}{
+			"type":     "object",
+			"required": []string{"success", "tool_version", "programs"},
+			"properties": map[string]interface{}{
+				"success":      map[string]interface{}{"type": "boolean"},
+				"tool_version": map[string]interface{}{"type": "string"},
+				"programs": map[string]interface{}{
+					"type": "array",
+					"items": map[string]interface{}{
+						"type": "object",
+						"properties": map[string]interface{}{
+							"name":        map[string]interface{}{"type": "string"},
+							"description": map[string]interface{}{"type": "string"},
+							"programs": map[string]interface{}{
+								"type":        "array",
+								"description": "Programs to attach with attach_program, in order",
+								"items": map[string]interface{}{
+									"type": "object",
+									"properties": map[string]interface{}{
+										"program":     map[string]interface{}{"type": "string"},
+										"attach_type": map[string]interface{}{"type": "string"},
+										"target":      map[string]interface{}{"type": "string"},
+									},
+								},
+							},
+							"maps": map[string]interface{}{
+								"type": "array",
+								"items": map[string]interface{}{
+									"type": "object",
+									"properties": map[string]interface{}{
+										"name":         map[string]interface{}{"type": "string"},
+										"type":         map[string]interface{}{"type": "string"},
+										"key":          fieldSchema,
+										"value":        fieldSchema,
+										"event_type":   map[string]interface{}{"type": "string"},
+										"event_fields": fieldSchema,
+									},
+								},
+							},
+							"available":          map[string]interface{}{"type": "boolean"},
+							"unavailable_reason": map[string]interface{}{"type": "string"},
+						},
+					},
+				},
+				"error": map[string]interface{}{"type": "string"},
+			},
+		},
+		Annotations: map[string]interface{}{
+			"title":          "Builtin Program Catalog",
+			"readOnlyHint":   true,
+			"idempotentHint": true,
+			"openWorldHint":  false,
+		},
+		Call: func(ctx context.Context, input map[string]interface{}) (interface{}, error) {
+			return ebpf.ListBuiltinPrograms()
+		},
+	})
+}
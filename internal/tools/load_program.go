@@ -2,6 +2,7 @@
 package tools
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -10,7 +11,7 @@ import (
 	"github.com/sameehj/ebpf-mcp/pkg/types"
 )
 
-func LoadProgramTool(input map[string]interface{}) (interface{}, error) {
+func LoadProgramTool(ctx context.Context, input map[string]interface{}) (interface{}, error) {
 	// Enhanced debug logging
 	log.Printf("[DEBUG] ==> LoadProgram called")
 	log.Printf("[DEBUG] LoadProgram raw input: %+v", input)
@@ -187,6 +188,17 @@ func parseLoadProgramInputRobust(input map[string]interface{}) (ebpf.LoadProgram
 		} else {
 			return args, fmt.Errorf("source.url is required for url source")
 		}
+	case "builtin":
+		if nameRaw, exists := source["name"]; exists && nameRaw != nil {
+			if name, ok := nameRaw.(string); ok {
+				args.Source.Name = name
+				log.Printf("[DEBUG] Source builtin: %s", name)
+			} else {
+				return args, fmt.Errorf("source.name must be a string, got %T", nameRaw)
+			}
+		} else {
+			return args, fmt.Errorf("source.name is required for builtin source (see list_builtin_programs)")
+		}
 	default:
 		return args, fmt.Errorf("unsupported source type: %s", sourceType)
 	}
@@ -222,6 +234,12 @@ func parseLoadProgramInputRobust(input map[string]interface{}) (ebpf.LoadProgram
 		}
 	}
 
+	if attachToRaw, exists := input["attach_to"]; exists && attachToRaw != nil {
+		if attachTo, ok := attachToRaw.(string); ok {
+			args.AttachTo = attachTo
+		}
+	}
+
 	if btfPathRaw, exists := input["btf_path"]; exists && btfPathRaw != nil {
 		if btfPath, ok := btfPathRaw.(string); ok {
 			args.BTFPath = btfPath
@@ -263,7 +281,7 @@ func init() {
 	RegisterTool(types.Tool{
 		ID:          "load_program",
 		Title:       "Load eBPF Program",
-		Description: "Loads a raw eBPF object from file or base64 blob into the kernel.",
+		Description: "Loads a raw eBPF object from file or base64 blob into the kernel, or one of the server's builtin tracing programs by name (see list_builtin_programs). Every program of the object is returned with its ID and handle.",
 		InputSchema: map[string]interface{}{
 			"type": "object",
 			"properties": map[string]interface{}{
@@ -272,7 +290,11 @@ func init() {
 					"properties": map[string]interface{}{
 						"type": map[string]interface{}{
 							"type": "string",
-							"enum": []string{"file", "data", "url"},
+							"enum": []string{"file", "data", "url", "builtin"},
+						},
+						"name": map[string]interface{}{
+							"type":        "string",
+							"description": "Builtin program name, for builtin sources; program_type is ignored",
 						},
 						"path": map[string]interface{}{
 							"type": "string",
@@ -291,11 +313,17 @@ func init() {
 					},
 				},
 				"program_type": map[string]interface{}{
-					"type": "string",
-					"enum": []string{"XDP", "KPROBE", "TRACEPOINT", "CGROUP_SKB"},
+					"type":        "string",
+					"enum":        []string{"XDP", "KPROBE", "TRACEPOINT", "CGROUP_SKB", "FENTRY", "FEXIT", "FMOD_RET", "LSM", "RAW_TRACEPOINT", "TP_BTF", "ITER"},
+					"description": "FENTRY, FEXIT, FMOD_RET, LSM, TP_BTF and ITER programs are bound to their target at load time, taken from attach_to or the section name (e.g. fentry/do_unlinkat)",
 				},
 				"section": map[string]interface{}{
-					"type": "string",
+					"type":        "string",
+					"description": "Only apply program_type and attach_to to the program in this section",
+				},
+				"attach_to": map[string]interface{}{
+					"type":        "string",
+					"description": "Kernel function, LSM hook, tracepoint or iterator to load BTF based programs against, looked up in vmlinux and module BTF",
 				},
 				"btf_path": map[string]interface{}{
 					"type": "string",
@@ -0,0 +1,79 @@
+// internal/tools/map_delete.go
+package tools
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sameehj/ebpf-mcp/internal/ebpf"
+	"github.com/sameehj/ebpf-mcp/pkg/types"
+)
+
+func MapDeleteTool(ctx context.Context, input map[string]interface{}) (interface{}, error) {
+	if input == nil {
+		return &ebpf.MapDeleteResult{
+			Success:     false,
+			ToolVersion: "v1",
+			Error:       "input is nil",
+		}, fmt.Errorf("input is nil")
+	}
+
+	args, err := parseMapDeleteInput(input)
+	if err != nil {
+		return &ebpf.MapDeleteResult{
+			Success:     false,
+			ToolVersion: "v1",
+			Error:       fmt.Sprintf("parsing error: %v", err),
+		}, err
+	}
+
+	return ebpf.MapDelete(args)
+}
+
+func parseMapDeleteInput(input map[string]interface{}) (*ebpf.MapDeleteArgs, error) {
+	sel, err := parseMapSelector(input)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := parseMapKeys(input)
+	if err != nil {
+		return nil, err
+	}
+	format, err := parseMapFormat(input)
+	if err != nil {
+		return nil, err
+	}
+	return &ebpf.MapDeleteArgs{MapSelector: *sel, Keys: keys, Format: format}, nil
+}
+
+func init() {
+	RegisterTool(types.Tool{
+		ID:          "map_delete",
+		Title:       "Delete eBPF Map Entries",
+		Description: "Deletes one or more keys from a BPF map, using a batch delete where the kernel supports it. Keys that don't exist are listed in not_found.",
+		InputSchema: map[string]interface{}{
+			"type":       "object",
+			"properties": mapKeyProperties(),
+		},
+		OutputSchema: map[string]interface{}{
+			"type":     "object",
+			"required": []string{"success", "tool_version", "deleted"},
+			"properties": map[string]interface{}{
+				"success":      map[string]interface{}{"type": "boolean"},
+				"tool_version": map[string]interface{}{"type": "string"},
+				"map":          map[string]interface{}{"type": "object"},
+				"deleted":      map[string]interface{}{"type": "integer"},
+				"not_found":    map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+				"message":      map[string]interface{}{"type": "string"},
+				"error":        map[string]interface{}{"type": "string"},
+			},
+		},
+		Annotations: map[string]interface{}{
+			"title":           "Map Delete",
+			"destructiveHint": true,
+			"idempotentHint":  true,
+			"readOnlyHint":    false,
+		},
+		Call: MapDeleteTool,
+	})
+}
@@ -0,0 +1,146 @@
+// internal/tools/map_dump.go
+package tools
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sameehj/ebpf-mcp/internal/ebpf"
+	"github.com/sameehj/ebpf-mcp/pkg/types"
+)
+
+func MapDumpTool(ctx context.Context, input map[string]interface{}) (interface{}, error) {
+	if input == nil {
+		return &ebpf.MapDumpResult{
+			Success:     false,
+			ToolVersion: "v1",
+			Error:       "input is nil",
+		}, fmt.Errorf("input is nil")
+	}
+
+	sel, err := parseMapSelector(input)
+	if err != nil {
+		return &ebpf.MapDumpResult{
+			Success:     false,
+			ToolVersion: "v1",
+			Error:       fmt.Sprintf("parsing error: %v", err),
+		}, err
+	}
+
+	args := &ebpf.MapDumpArgs{MapSelector: *sel}
+	if maxRaw, exists := input["max_entries"]; exists && maxRaw != nil {
+		max, ok := maxRaw.(float64)
+		if !ok {
+			return nil, fmt.Errorf("max_entries must be a number")
+		}
+		args.MaxEntries = int(max)
+	}
+
+	return ebpf.MapDump(args)
+}
+
+func parseMapSelector(input map[string]interface{}) (*ebpf.MapSelector, error) {
+	var sel ebpf.MapSelector
+
+	if mapIDRaw, exists := input["map_id"]; exists && mapIDRaw != nil {
+		mapID, ok := mapIDRaw.(float64)
+		if !ok {
+			return nil, fmt.Errorf("map_id must be a number")
+		}
+		sel.MapID = int(mapID)
+	}
+
+	if pinPathRaw, exists := input["pin_path"]; exists && pinPathRaw != nil {
+		pinPath, ok := pinPathRaw.(string)
+		if !ok {
+			return nil, fmt.Errorf("pin_path must be a string")
+		}
+		sel.PinPath = pinPath
+	}
+
+	if nameRaw, exists := input["map_name"]; exists && nameRaw != nil {
+		name, ok := nameRaw.(string)
+		if !ok {
+			return nil, fmt.Errorf("map_name must be a string")
+		}
+		sel.MapName = name
+	}
+
+	if sel.MapID == 0 && sel.PinPath == "" && sel.MapName == "" {
+		return nil, fmt.Errorf("one of map_id, pin_path or map_name is required")
+	}
+
+	return &sel, nil
+}
+
+// mapSelectorProperties are the input schema properties shared by the map
+// tools.
+func mapSelectorProperties() map[string]interface{} {
+	return map[string]interface{}{
+		"map_name": map[string]interface{}{
+			"type":        "string",
+			"description": "Name of the map; must match exactly one map",
+		},
+		"map_id": map[string]interface{}{
+			"type":        "integer",
+			"description": "Kernel ID of the map",
+		},
+		"pin_path": map[string]interface{}{
+			"type":        "string",
+			"description": "Path the map is pinned at under /sys/fs/bpf",
+		},
+	}
+}
+
+func init() {
+	inputProps := mapSelectorProperties()
+	inputProps["max_entries"] = map[string]interface{}{
+		"type":        "integer",
+		"description": "Maximum number of entries to return",
+		"default":     100,
+	}
+
+	RegisterTool(types.Tool{
+		ID:          "map_dump",
+		Title:       "Dump eBPF Map",
+		Description: "Returns the contents of a BPF map as hex, decoded through BTF when the map has type information. Per-CPU maps are expanded per CPU.",
+		InputSchema: map[string]interface{}{
+			"type":       "object",
+			"properties": inputProps,
+		},
+		OutputSchema: map[string]interface{}{
+			"type":     "object",
+			"required": []string{"success", "tool_version", "entries"},
+			"properties": map[string]interface{}{
+				"success":      map[string]interface{}{"type": "boolean"},
+				"tool_version": map[string]interface{}{"type": "string"},
+				"map":          map[string]interface{}{"type": "object"},
+				"entries": map[string]interface{}{
+					"type": "array",
+					"items": map[string]interface{}{
+						"type": "object",
+						"properties": map[string]interface{}{
+							"key":            map[string]interface{}{"type": "string"},
+							"value":          map[string]interface{}{"type": "string"},
+							"values":         map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+							"decoded_key":    map[string]interface{}{},
+							"decoded_value":  map[string]interface{}{},
+							"decoded_values": map[string]interface{}{"type": "array"},
+						},
+					},
+				},
+				"count":     map[string]interface{}{"type": "integer"},
+				"truncated": map[string]interface{}{"type": "boolean"},
+				"method":    map[string]interface{}{"type": "string", "enum": []string{"batch", "iterate"}},
+				"message":   map[string]interface{}{"type": "string"},
+				"error":     map[string]interface{}{"type": "string"},
+			},
+		},
+		Annotations: map[string]interface{}{
+			"title":          "Map Dump",
+			"idempotentHint": true,
+			"readOnlyHint":   true,
+		},
+		Call: MapDumpTool,
+	})
+}
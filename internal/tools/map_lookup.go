@@ -0,0 +1,145 @@
+// internal/tools/map_lookup.go
+package tools
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sameehj/ebpf-mcp/internal/ebpf"
+	"github.com/sameehj/ebpf-mcp/pkg/types"
+)
+
+func MapLookupTool(ctx context.Context, input map[string]interface{}) (interface{}, error) {
+	if input == nil {
+		return &ebpf.MapLookupResult{
+			Success:     false,
+			ToolVersion: "v1",
+			Entries:     []ebpf.MapLookupEntry{},
+			Error:       "input is nil",
+		}, fmt.Errorf("input is nil")
+	}
+
+	args, err := parseMapLookupInput(input)
+	if err != nil {
+		return &ebpf.MapLookupResult{
+			Success:     false,
+			ToolVersion: "v1",
+			Entries:     []ebpf.MapLookupEntry{},
+			Error:       fmt.Sprintf("parsing error: %v", err),
+		}, err
+	}
+
+	return ebpf.MapLookup(args)
+}
+
+func parseMapLookupInput(input map[string]interface{}) (*ebpf.MapLookupArgs, error) {
+	sel, err := parseMapSelector(input)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := parseMapKeys(input)
+	if err != nil {
+		return nil, err
+	}
+	format, err := parseMapFormat(input)
+	if err != nil {
+		return nil, err
+	}
+	return &ebpf.MapLookupArgs{MapSelector: *sel, Keys: keys, Format: format}, nil
+}
+
+// parseMapKeys accepts either a single "key" or a "keys" array.
+func parseMapKeys(input map[string]interface{}) ([]interface{}, error) {
+	var keys []interface{}
+	if key, exists := input["key"]; exists && key != nil {
+		keys = append(keys, key)
+	}
+	if keysRaw, exists := input["keys"]; exists && keysRaw != nil {
+		list, ok := keysRaw.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("keys must be an array")
+		}
+		keys = append(keys, list...)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("key or keys is required")
+	}
+	return keys, nil
+}
+
+func parseMapFormat(input map[string]interface{}) (string, error) {
+	formatRaw, exists := input["format"]
+	if !exists || formatRaw == nil {
+		return "", nil
+	}
+	format, ok := formatRaw.(string)
+	if !ok {
+		return "", fmt.Errorf("format must be a string")
+	}
+	return format, nil
+}
+
+// mapKeyProperties are the input schema properties for tools that take map
+// keys, on top of mapSelectorProperties.
+func mapKeyProperties() map[string]interface{} {
+	props := mapSelectorProperties()
+	props["key"] = map[string]interface{}{
+		"description": "Key as a hex or base64 string, or a JSON value encoded through the map's BTF key type",
+	}
+	props["keys"] = map[string]interface{}{
+		"type":        "array",
+		"description": "Several keys, each in the same forms as key",
+	}
+	props["format"] = map[string]interface{}{
+		"type":        "string",
+		"enum":        []string{"hex", "base64", "json"},
+		"default":     "hex",
+		"description": "How string keys and values are interpreted; json encodes strings through BTF as well",
+	}
+	return props
+}
+
+func init() {
+	RegisterTool(types.Tool{
+		ID:          "map_lookup",
+		Title:       "Look Up eBPF Map Entries",
+		Description: "Looks up one or more keys in a BPF map. Values are returned as hex and, when the map has BTF, decoded JSON. Missing keys are reported with found=false.",
+		InputSchema: map[string]interface{}{
+			"type":       "object",
+			"properties": mapKeyProperties(),
+		},
+		OutputSchema: map[string]interface{}{
+			"type":     "object",
+			"required": []string{"success", "tool_version", "entries"},
+			"properties": map[string]interface{}{
+				"success":      map[string]interface{}{"type": "boolean"},
+				"tool_version": map[string]interface{}{"type": "string"},
+				"map":          map[string]interface{}{"type": "object"},
+				"entries": map[string]interface{}{
+					"type": "array",
+					"items": map[string]interface{}{
+						"type": "object",
+						"properties": map[string]interface{}{
+							"found":          map[string]interface{}{"type": "boolean"},
+							"key":            map[string]interface{}{"type": "string"},
+							"value":          map[string]interface{}{"type": "string"},
+							"values":         map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+							"decoded_key":    map[string]interface{}{},
+							"decoded_value":  map[string]interface{}{},
+							"decoded_values": map[string]interface{}{"type": "array"},
+						},
+					},
+				},
+				"found":   map[string]interface{}{"type": "integer"},
+				"message": map[string]interface{}{"type": "string"},
+				"error":   map[string]interface{}{"type": "string"},
+			},
+		},
+		Annotations: map[string]interface{}{
+			"title":          "Map Lookup",
+			"idempotentHint": true,
+			"readOnlyHint":   true,
+		},
+		Call: MapLookupTool,
+	})
+}
@@ -0,0 +1,164 @@
+// internal/tools/map_update.go
+package tools
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sameehj/ebpf-mcp/internal/ebpf"
+	"github.com/sameehj/ebpf-mcp/pkg/types"
+)
+
+func MapUpdateTool(ctx context.Context, input map[string]interface{}) (interface{}, error) {
+	if input == nil {
+		return &ebpf.MapUpdateResult{
+			Success:     false,
+			ToolVersion: "v1",
+			Error:       "input is nil",
+		}, fmt.Errorf("input is nil")
+	}
+
+	args, err := parseMapUpdateInput(input)
+	if err != nil {
+		return &ebpf.MapUpdateResult{
+			Success:     false,
+			ToolVersion: "v1",
+			Error:       fmt.Sprintf("parsing error: %v", err),
+		}, err
+	}
+
+	return ebpf.MapUpdate(args)
+}
+
+func parseMapUpdateInput(input map[string]interface{}) (*ebpf.MapUpdateArgs, error) {
+	sel, err := parseMapSelector(input)
+	if err != nil {
+		return nil, err
+	}
+	args := &ebpf.MapUpdateArgs{MapSelector: *sel}
+
+	if args.Format, err = parseMapFormat(input); err != nil {
+		return nil, err
+	}
+
+	if flagsRaw, exists := input["flags"]; exists && flagsRaw != nil {
+		flags, ok := flagsRaw.(string)
+		if !ok {
+			return nil, fmt.Errorf("flags must be a string")
+		}
+		args.Flags = flags
+	}
+
+	// A single entry can be given inline as key/value(s).
+	if key, exists := input["key"]; exists && key != nil {
+		entry, err := parseMapUpdateEntry(input)
+		if err != nil {
+			return nil, err
+		}
+		args.Entries = append(args.Entries, *entry)
+	}
+
+	if entriesRaw, exists := input["entries"]; exists && entriesRaw != nil {
+		list, ok := entriesRaw.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("entries must be an array")
+		}
+		for i, raw := range list {
+			obj, ok := raw.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("entries[%d] must be an object", i)
+			}
+			entry, err := parseMapUpdateEntry(obj)
+			if err != nil {
+				return nil, fmt.Errorf("entries[%d]: %w", i, err)
+			}
+			args.Entries = append(args.Entries, *entry)
+		}
+	}
+
+	if len(args.Entries) == 0 {
+		return nil, fmt.Errorf("key and value, or entries, is required")
+	}
+	return args, nil
+}
+
+func parseMapUpdateEntry(obj map[string]interface{}) (*ebpf.MapUpdateEntry, error) {
+	entry := &ebpf.MapUpdateEntry{Key: obj["key"], Value: obj["value"]}
+	if entry.Key == nil {
+		return nil, fmt.Errorf("key is required")
+	}
+	if valuesRaw, exists := obj["values"]; exists && valuesRaw != nil {
+		values, ok := valuesRaw.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("values must be an array")
+		}
+		entry.Values = values
+	}
+	if entry.Value == nil && entry.Values == nil {
+		return nil, fmt.Errorf("value or values is required")
+	}
+	return entry, nil
+}
+
+func init() {
+	inputProps := mapSelectorProperties()
+	inputProps["key"] = map[string]interface{}{
+		"description": "Key as a hex or base64 string, or a JSON value encoded through the map's BTF key type",
+	}
+	inputProps["value"] = map[string]interface{}{
+		"description": "Value in the same forms as key; stored on every CPU for per-CPU maps",
+	}
+	inputProps["values"] = map[string]interface{}{
+		"type":        "array",
+		"description": "One value per possible CPU, for per-CPU maps",
+	}
+	inputProps["entries"] = map[string]interface{}{
+		"type":        "array",
+		"description": "Several entries to write in one batch",
+		"items": map[string]interface{}{
+			"type":     "object",
+			"required": []string{"key"},
+			"properties": map[string]interface{}{
+				"key":    map[string]interface{}{},
+				"value":  map[string]interface{}{},
+				"values": map[string]interface{}{"type": "array"},
+			},
+		},
+	}
+	inputProps["flags"] = map[string]interface{}{
+		"type":        "string",
+		"enum":        []string{"any", "noexist", "exist"},
+		"default":     "any",
+		"description": "BPF_ANY creates or replaces, BPF_NOEXIST only creates, BPF_EXIST only replaces",
+	}
+	inputProps["format"] = mapKeyProperties()["format"]
+
+	RegisterTool(types.Tool{
+		ID:          "map_update",
+		Title:       "Update eBPF Map Entries",
+		Description: "Writes one or more entries to a BPF map. Keys and values are hex or base64 strings, or JSON encoded through the map's BTF types. Several entries are written with a single batch update where the kernel supports it and flags is any.",
+		InputSchema: map[string]interface{}{
+			"type":       "object",
+			"properties": inputProps,
+		},
+		OutputSchema: map[string]interface{}{
+			"type":     "object",
+			"required": []string{"success", "tool_version", "updated"},
+			"properties": map[string]interface{}{
+				"success":      map[string]interface{}{"type": "boolean"},
+				"tool_version": map[string]interface{}{"type": "string"},
+				"map":          map[string]interface{}{"type": "object"},
+				"updated":      map[string]interface{}{"type": "integer"},
+				"message":      map[string]interface{}{"type": "string"},
+				"error":        map[string]interface{}{"type": "string"},
+			},
+		},
+		Annotations: map[string]interface{}{
+			"title":           "Map Update",
+			"destructiveHint": true,
+			"idempotentHint":  false,
+			"readOnlyHint":    false,
+		},
+		Call: MapUpdateTool,
+	})
+}
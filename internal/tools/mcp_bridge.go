@@ -35,7 +35,7 @@ func RegisterAllWithMCP(s *server.MCPServer) {
 
 		// Register with MCP server - note: AddTool expects mcp.Tool, not *mcp.Tool
 		s.AddTool(mcpTool, func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
-			return handleToolCall(toolCopy, request)
+			return handleToolCall(ctx, toolCopy, request)
 		})
 
 		log.Printf("[DEBUG] Tool %s registered successfully", tool.ID)
@@ -197,7 +197,7 @@ func convertPropertyToMCPOptions(propName string, propDef map[string]interface{}
 // Replace your existing handleToolCall function with these:
 
 // handleToolCall handles the actual tool execution with streaming support
-func handleToolCall(tool types.Tool, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+func handleToolCall(ctx context.Context, tool types.Tool, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
 	log.Printf("[DEBUG] ==> Tool %s called", tool.ID)
 
 	// Get all arguments as a map
@@ -226,15 +226,19 @@ func handleToolCall(tool types.Tool, request mcp.CallToolRequest) (*mcp.CallTool
 
 	// Check if this is a streaming tool
 	if tool.Stream != nil {
-		return handleStreamingTool(tool, input)
+		var progressToken mcp.ProgressToken
+		if request.Params.Meta != nil {
+			progressToken = request.Params.Meta.ProgressToken
+		}
+		return handleStreamingTool(ctx, tool, input, progressToken)
 	}
 
 	// Handle regular (non-streaming) tools
-	return handleRegularTool(tool, input)
+	return handleRegularTool(ctx, tool, input)
 }
 
 // handleRegularTool handles non-streaming tools
-func handleRegularTool(tool types.Tool, input map[string]interface{}) (*mcp.CallToolResult, error) {
+func handleRegularTool(ctx context.Context, tool types.Tool, input map[string]interface{}) (*mcp.CallToolResult, error) {
 	// Call your existing tool with error recovery
 	var result interface{}
 	var err error
@@ -247,7 +251,7 @@ func handleRegularTool(tool types.Tool, input map[string]interface{}) (*mcp.Call
 			}
 		}()
 
-		result, err = tool.Call(input)
+		result, err = tool.Call(ctx, input)
 	}()
 
 	if err != nil {
@@ -288,8 +292,59 @@ func handleRegularTool(tool types.Tool, input map[string]interface{}) (*mcp.Call
 	}
 }
 
-// handleStreamingTool handles tools that support streaming (like stream_events)
-func handleStreamingTool(tool types.Tool, input map[string]interface{}) (*mcp.CallToolResult, error) {
+// streamNotifier forwards streamed data to the client as it is emitted.
+// With a progress token each item becomes a notifications/progress message,
+// otherwise a notifications/message log entry. Sending fails when the
+// transport has no session or the client is not keeping up; the caller then
+// keeps the item for the final result instead.
+type streamNotifier struct {
+	ctx    context.Context
+	srv    *server.MCPServer
+	tool   string
+	token  mcp.ProgressToken
+	sent   int
+	failed bool
+}
+
+func (n *streamNotifier) send(data interface{}) error {
+	if n.srv == nil {
+		return server.ErrNotificationNotInitialized
+	}
+
+	var err error
+	if n.token != nil {
+		var msg []byte
+		if msg, err = json.Marshal(data); err != nil {
+			return err
+		}
+		err = n.srv.SendNotificationToClient(n.ctx, "notifications/progress", map[string]any{
+			"progressToken": n.token,
+			"progress":      n.sent + 1,
+			"message":       string(msg),
+		})
+	} else {
+		err = n.srv.SendNotificationToClient(n.ctx, "notifications/message", map[string]any{
+			"level":  mcp.LoggingLevelInfo,
+			"logger": n.tool,
+			"data":   data,
+		})
+	}
+	if err != nil {
+		if !n.failed {
+			log.Printf("[WARN] Stream %s: notification failed, buffering into the result: %v", n.tool, err)
+			n.failed = true
+		}
+		return err
+	}
+	n.sent++
+	return nil
+}
+
+// handleStreamingTool handles tools that support streaming (like stream_events).
+// Events and status updates are pushed to the client as notifications while
+// the tool runs; the final result carries the summary, plus any events that
+// could not be delivered as notifications.
+func handleStreamingTool(ctx context.Context, tool types.Tool, input map[string]interface{}, progressToken mcp.ProgressToken) (*mcp.CallToolResult, error) {
 	log.Printf("[DEBUG] Handling streaming tool %s", tool.ID)
 
 	// Validate inputs
@@ -297,13 +352,21 @@ func handleStreamingTool(tool types.Tool, input map[string]interface{}) (*mcp.Ca
 		return mcp.NewToolResultError("input cannot be nil"), nil
 	}
 
-	// Create a buffer to collect streaming results
+	notifier := &streamNotifier{
+		ctx:   ctx,
+		srv:   server.ServerFromContext(ctx),
+		tool:  tool.ID,
+		token: progressToken,
+	}
+
+	// Events that could not be sent as notifications
 	var results []interface{}
+	var notified int
 	var finalResult interface{}
 	var mu sync.Mutex
 	var streamErr error
 
-	// Create the emit function that collects streaming data
+	// Create the emit function that forwards streaming data
 	emit := func(data interface{}) {
 		mu.Lock()
 		defer mu.Unlock()
@@ -319,21 +382,20 @@ func handleStreamingTool(tool types.Tool, input map[string]interface{}) (*mcp.Ca
 				return
 			}
 
-			if eventType, exists := dataMap["type"]; exists {
-				if eventType == "event" {
-					// This is an individual event
-					results = append(results, data)
-					return
-				} else if eventType == "status" {
-					// This is a status message
-					log.Printf("[DEBUG] Stream status: %v", dataMap["message"])
-					return
-				}
+			if eventType, exists := dataMap["type"]; exists && (eventType == "status" || eventType == "window") {
+				// Status messages are only worth sending live, and
+				// aggregation windows are repeated in the final result
+				log.Printf("[DEBUG] Stream status: %v", dataMap["message"])
+				notifier.send(data)
+				return
 			}
 		}
 
-		// Default: treat as event data
-		results = append(results, data)
+		if notifier.send(data) != nil {
+			results = append(results, data)
+			return
+		}
+		notified++
 	}
 
 	// Call the streaming tool with panic recovery
@@ -345,34 +407,32 @@ func handleStreamingTool(tool types.Tool, input map[string]interface{}) (*mcp.Ca
 			}
 		}()
 
-		streamErr = tool.Stream(input, emit)
+		streamErr = tool.Stream(ctx, input, emit)
 	}()
 
 	// Handle streaming errors
 	if streamErr != nil {
 		log.Printf("[ERROR] Streaming tool %s failed: %v", tool.ID, streamErr)
-		return mcp.NewToolResultError(fmt.Sprintf("stream_events failed: %v", streamErr)), nil
+		return mcp.NewToolResultError(fmt.Sprintf("%s failed: %v", tool.ID, streamErr)), nil
 	}
 
 	// Prepare the final response
 	mu.Lock()
 	defer mu.Unlock()
 
-	var response interface{}
-
-	if finalResult != nil {
-		// Use the final result if available
-		response = finalResult
-	} else {
-		// Create a response with collected events
+	response, ok := finalResult.(map[string]interface{})
+	if !ok {
 		response = map[string]interface{}{
 			"success":      true,
 			"tool_version": "1.0.0",
-			"events":       results,
-			"message":      fmt.Sprintf("Collected %d events", len(results)),
+			"message":      fmt.Sprintf("Collected %d events", notified+len(results)),
 			"complete":     true,
 		}
 	}
+	response["events_notified"] = notified
+	if len(results) > 0 {
+		response["events"] = results
+	}
 
 	// Convert to JSON and return
 	if jsonBytes, err := json.MarshalIndent(response, "", "  "); err == nil {
@@ -0,0 +1,122 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sameehj/ebpf-mcp/internal/ebpf"
+	"github.com/sameehj/ebpf-mcp/pkg/types"
+)
+
+func ProfileCPUTool(ctx context.Context, input map[string]interface{}) (interface{}, error) {
+	args, err := ebpf.ParseProfileCPUArgs(input)
+	if err != nil {
+		return &ebpf.ProfileCPUResult{
+			Success:     false,
+			ToolVersion: "v1",
+			Error:       fmt.Sprintf("parsing error: %v", err),
+		}, err
+	}
+
+	return ebpf.RunProfileCPU(ctx, args)
+}
+
+func init() {
+	RegisterTool(types.Tool{
+		ID:          "profile_cpu",
+		Title:       "Profile CPU",
+		Description: "Samples the kernel and user stacks of whatever is running on every CPU at a fixed frequency for a while, and returns the symbolized stacks in folded format (for flame graphs) and the hottest functions. Answers \"why is this box hot\". User stacks need frame pointers to be complete.",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"duration_ms": map[string]interface{}{
+					"type":        "integer",
+					"description": "How long to sample for",
+					"default":     5000,
+					"minimum":     1,
+					"maximum":     60000,
+				},
+				"frequency_hz": map[string]interface{}{
+					"type":        "integer",
+					"description": "Samples per second on each CPU",
+					"default":     49,
+					"minimum":     1,
+					"maximum":     1000,
+				},
+				"pids": map[string]interface{}{
+					"type":        "array",
+					"items":       map[string]interface{}{"type": "integer"},
+					"description": "Only sample these processes",
+				},
+				"cgroup": map[string]interface{}{
+					"type":        "string",
+					"description": "Only sample tasks in this cgroup v2 directory or its descendants; relative paths are under /sys/fs/cgroup",
+				},
+				"comm": map[string]interface{}{
+					"type":        "string",
+					"description": "Only sample tasks with this command name (at most 15 bytes)",
+				},
+				"top": map[string]interface{}{
+					"type":        "integer",
+					"description": "Number of hot functions to return",
+					"default":     20,
+					"minimum":     1,
+					"maximum":     200,
+				},
+				"max_stacks": map[string]interface{}{
+					"type":        "integer",
+					"description": "Maximum number of folded stacks to return, hottest first",
+					"default":     200,
+					"minimum":     1,
+					"maximum":     10000,
+				},
+			},
+		},
+		OutputSchema: map[string]interface{}{
+			"type":     "object",
+			"required": []string{"success", "tool_version", "samples", "folded", "top_functions"},
+			"properties": map[string]interface{}{
+				"success":      map[string]interface{}{"type": "boolean"},
+				"tool_version": map[string]interface{}{"type": "string"},
+				"status":       map[string]interface{}{"type": "string"},
+				"samples":      map[string]interface{}{"type": "integer"},
+				"folded": map[string]interface{}{
+					"type":        "array",
+					"description": "Stacks as \"comm;outermost;...;leaf\" with kernel frames suffixed _[k], hottest first",
+					"items": map[string]interface{}{
+						"type": "object",
+						"properties": map[string]interface{}{
+							"stack": map[string]interface{}{"type": "string"},
+							"count": map[string]interface{}{"type": "integer"},
+						},
+					},
+				},
+				"top_functions": map[string]interface{}{
+					"type": "array",
+					"items": map[string]interface{}{
+						"type": "object",
+						"properties": map[string]interface{}{
+							"function":      map[string]interface{}{"type": "string"},
+							"module":        map[string]interface{}{"type": "string", "description": "\"kernel\" or the binary or library"},
+							"self":          map[string]interface{}{"type": "integer", "description": "Samples running in the function"},
+							"total":         map[string]interface{}{"type": "integer", "description": "Samples with the function on the stack"},
+							"self_percent":  map[string]interface{}{"type": "number"},
+							"total_percent": map[string]interface{}{"type": "number"},
+						},
+					},
+				},
+				"stats":    map[string]interface{}{"type": "object"},
+				"complete": map[string]interface{}{"type": "boolean"},
+				"warnings": map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+				"error":    map[string]interface{}{"type": "string"},
+			},
+		},
+		Annotations: map[string]interface{}{
+			"title":          "CPU Profile (perf_event)",
+			"readOnlyHint":   true,
+			"idempotentHint": false,
+			"openWorldHint":  false,
+		},
+		Call: ProfileCPUTool,
+	})
+}
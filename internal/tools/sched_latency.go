@@ -0,0 +1,144 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sameehj/ebpf-mcp/internal/ebpf"
+	"github.com/sameehj/ebpf-mcp/pkg/types"
+)
+
+func SchedLatencyTool(ctx context.Context, input map[string]interface{}) (interface{}, error) {
+	args, err := ebpf.ParseSchedLatencyArgs(input)
+	if err != nil {
+		return &ebpf.SchedLatencyResult{
+			Success:     false,
+			ToolVersion: "v1",
+			Error:       fmt.Sprintf("parsing error: %v", err),
+		}, err
+	}
+
+	return ebpf.RunSchedLatency(ctx, args)
+}
+
+func init() {
+	latencySummary := func(extra map[string]interface{}) map[string]interface{} {
+		properties := map[string]interface{}{
+			"count": map[string]interface{}{"type": "integer"},
+			"p50":   map[string]interface{}{"type": "number", "description": "Estimated from the histogram"},
+			"p90":   map[string]interface{}{"type": "number", "description": "Estimated from the histogram"},
+			"p99":   map[string]interface{}{"type": "number", "description": "Estimated from the histogram"},
+			"histogram": map[string]interface{}{
+				"type":        "array",
+				"description": "Waits per latency bucket [low, high), from the first to the last non-empty bucket",
+				"items": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"low":   map[string]interface{}{"type": "integer"},
+						"high":  map[string]interface{}{"type": "integer"},
+						"count": map[string]interface{}{"type": "integer"},
+					},
+				},
+			},
+		}
+		for name, schema := range extra {
+			properties[name] = schema
+		}
+		return map[string]interface{}{"type": "object", "properties": properties}
+	}
+
+	RegisterTool(types.Tool{
+		ID:          "sched_latency",
+		Title:       "Scheduler Latency",
+		Description: "Measures run queue latency, the time tasks wait between being woken and running, for a while using the sched_wakeup, sched_wakeup_new and sched_switch tracepoints. Returns log2 histograms overall, per CPU and for the processes with the worst tail latency. With off_cpu it also reports how long tasks were blocked, by the kernel and user stack they blocked in, in folded format.",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"duration_ms": map[string]interface{}{
+					"type":        "integer",
+					"description": "How long to measure for",
+					"default":     5000,
+					"minimum":     1,
+					"maximum":     60000,
+				},
+				"pids": map[string]interface{}{
+					"type":        "array",
+					"items":       map[string]interface{}{"type": "integer"},
+					"description": "Only measure these processes, and the threads and children they create during the trace",
+				},
+				"unit": map[string]interface{}{
+					"type":        "string",
+					"description": "Unit of the histograms, statistics and off-CPU totals",
+					"enum":        []string{"ns", "us", "ms"},
+					"default":     "us",
+				},
+				"top": map[string]interface{}{
+					"type":        "integer",
+					"description": "Number of processes to return, worst p99 first",
+					"default":     20,
+					"minimum":     1,
+					"maximum":     200,
+				},
+				"off_cpu": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Also measure time spent blocked, by blocking stack",
+					"default":     false,
+				},
+				"max_stacks": map[string]interface{}{
+					"type":        "integer",
+					"description": "Maximum number of off-CPU stacks to return, longest first",
+					"default":     50,
+					"minimum":     1,
+					"maximum":     10000,
+				},
+			},
+		},
+		OutputSchema: map[string]interface{}{
+			"type":     "object",
+			"required": []string{"success", "tool_version", "run_queue", "per_cpu", "per_process"},
+			"properties": map[string]interface{}{
+				"success":      map[string]interface{}{"type": "boolean"},
+				"tool_version": map[string]interface{}{"type": "string"},
+				"status":       map[string]interface{}{"type": "string"},
+				"unit":         map[string]interface{}{"type": "string"},
+				"run_queue":    latencySummary(nil),
+				"per_cpu": map[string]interface{}{
+					"type": "array",
+					"items": latencySummary(map[string]interface{}{
+						"cpu": map[string]interface{}{"type": "integer"},
+					}),
+				},
+				"per_process": map[string]interface{}{
+					"type": "array",
+					"items": latencySummary(map[string]interface{}{
+						"pid":  map[string]interface{}{"type": "integer"},
+						"comm": map[string]interface{}{"type": "string"},
+					}),
+				},
+				"off_cpu": map[string]interface{}{
+					"type":        "array",
+					"description": "Stacks as \"comm;outermost;...;leaf\" with kernel frames suffixed _[k], longest total first",
+					"items": map[string]interface{}{
+						"type": "object",
+						"properties": map[string]interface{}{
+							"stack": map[string]interface{}{"type": "string"},
+							"count": map[string]interface{}{"type": "integer", "description": "Times a task blocked here"},
+							"total": map[string]interface{}{"type": "number", "description": "Time blocked here, in unit"},
+						},
+					},
+				},
+				"stats":    map[string]interface{}{"type": "object"},
+				"complete": map[string]interface{}{"type": "boolean"},
+				"warnings": map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+				"error":    map[string]interface{}{"type": "string"},
+			},
+		},
+		Annotations: map[string]interface{}{
+			"title":          "Scheduler Latency (runqlat/offcputime)",
+			"readOnlyHint":   true,
+			"idempotentHint": false,
+			"openWorldHint":  false,
+		},
+		Call: SchedLatencyTool,
+	})
+}
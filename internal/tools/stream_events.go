@@ -1,6 +1,7 @@
 package tools
 
 import (
+	"context"
 	"fmt"
 	"log"
 
@@ -8,7 +9,7 @@ import (
 	"github.com/sameehj/ebpf-mcp/pkg/types"
 )
 
-func StreamEvents(input map[string]interface{}, emit func(interface{})) error {
+func StreamEvents(ctx context.Context, input map[string]interface{}, emit func(interface{})) error {
 	// Add defensive programming and logging
 	log.Printf("[DEBUG] StreamEvents called with input: %+v", input)
 
@@ -30,7 +31,7 @@ func StreamEvents(input map[string]interface{}, emit func(interface{})) error {
 	log.Printf("[DEBUG] Parsed args: %+v", args)
 
 	// Call the streaming function with proper error handling
-	if err := ebpf.StreamEvents(args, emit); err != nil {
+	if err := ebpf.StreamEvents(ctx, args, emit); err != nil {
 		log.Printf("[ERROR] StreamEvents failed: %v", err)
 		return fmt.Errorf("streaming failed: %w", err)
 	}
@@ -42,7 +43,7 @@ func init() {
 	RegisterTool(types.Tool{
 		ID:          "stream_events",
 		Title:       "Stream Kernel Events",
-		Description: "Streams real-time eBPF events using perf or ringbuf.",
+		Description: "Streams real-time eBPF events from a ringbuf or perf event array, decoding records through BTF.",
 		InputSchema: map[string]interface{}{
 			"type":     "object",
 			"required": []string{"source"},
@@ -52,11 +53,11 @@ func init() {
 					"properties": map[string]interface{}{
 						"program_id": map[string]interface{}{
 							"type":        "integer",
-							"description": "ID of the eBPF program to stream from",
+							"description": "ID of the eBPF program to stream from; its only ringbuf or perf event array map is used",
 						},
 						"link_id": map[string]interface{}{
 							"type":        "integer",
-							"description": "ID of the attached link to stream from",
+							"description": "ID of the attached link to stream from, resolved through its program",
 						},
 						"map_id": map[string]interface{}{
 							"type":        "integer",
@@ -65,8 +66,7 @@ func init() {
 						"type": map[string]interface{}{
 							"type":        "string",
 							"enum":        []string{"ringbuf", "perfbuf"},
-							"default":     "ringbuf",
-							"description": "Type of buffer to stream from",
+							"description": "Type of buffer to stream from; inferred from the map, and narrows the choice when a program uses both",
 						},
 					},
 					"anyOf": []map[string]interface{}{
@@ -99,17 +99,48 @@ func init() {
 					"type":        "string",
 					"enum":        []string{"json", "raw", "base64"},
 					"default":     "json",
-					"description": "Output format for events",
+					"description": "Output format for events: json decodes records through BTF, raw returns hex, base64 returns base64",
 				},
-				"filters": map[string]interface{}{
+				"struct_type": map[string]interface{}{
+					"type":        "string",
+					"description": "Name of the BTF struct records are decoded as (e.g. \"struct event\"); looked up in the program's BTF, then the kernel's. Defaults to the map's value type",
+				},
+				"filter": map[string]interface{}{
+					"type":        "string",
+					"description": "Filter expression over decoded event fields, e.g. pid in (1, 2) && comm =~ \"nginx.*\" && ret < 0. Supports ==, !=, <, <=, >, >=, =~, !~, in (...), &&, || and !; fields are checked against the event's BTF type",
+				},
+				"aggregate": map[string]interface{}{
 					"type":        "object",
-					"description": "Event filtering options",
+					"description": "Summarise events instead of returning them: group decoded events over tumbling windows and report the top groups. max_events only applies when set",
 					"properties": map[string]interface{}{
-						"event_types": map[string]interface{}{
+						"group_by": map[string]interface{}{
+							"type":        "array",
+							"items":       map[string]interface{}{"type": "string"},
+							"description": "Fields to group events by, e.g. [\"comm\", \"errno\"]; without any, all events form one group",
+						},
+						"fields": map[string]interface{}{
 							"type":        "array",
 							"items":       map[string]interface{}{"type": "string"},
-							"description": "Filter by event types (e.g., kprobe, tracepoint)",
+							"description": "Numeric fields to report min, max, avg, p50 and p99 of per group",
+						},
+						"window_ms": map[string]interface{}{
+							"type":        "integer",
+							"description": "Length of each tumbling window; defaults to the whole duration",
+							"minimum":     100,
+						},
+						"top": map[string]interface{}{
+							"type":        "integer",
+							"description": "Number of groups to report per window, by event count; the rest are summed in other_count",
+							"default":     10,
+							"minimum":     1,
+							"maximum":     1000,
 						},
+					},
+				},
+				"filters": map[string]interface{}{
+					"type":        "object",
+					"description": "Event filtering options",
+					"properties": map[string]interface{}{
 						"target_pids": map[string]interface{}{
 							"type":        "array",
 							"items":       map[string]interface{}{"type": "integer"},
@@ -148,7 +179,11 @@ func init() {
 				"events": map[string]interface{}{
 					"type":        "array",
 					"items":       map[string]interface{}{"type": "object"},
-					"description": "Array of captured events",
+					"description": "Captured events that could not be delivered as progress or log notifications",
+				},
+				"events_notified": map[string]interface{}{
+					"type":        "integer",
+					"description": "Number of events pushed to the client as notifications while streaming",
 				},
 				"stats": map[string]interface{}{
 					"type":        "object",
@@ -156,10 +191,40 @@ func init() {
 					"properties": map[string]interface{}{
 						"events_received":   map[string]interface{}{"type": "integer"},
 						"events_dropped":    map[string]interface{}{"type": "integer"},
+						"events_filtered":   map[string]interface{}{"type": "integer"},
+						"windows":           map[string]interface{}{"type": "integer"},
 						"duration_ms":       map[string]interface{}{"type": "integer"},
 						"events_per_second": map[string]interface{}{"type": "number"},
 					},
 				},
+				"aggregation": map[string]interface{}{
+					"type":        "object",
+					"description": "Per-window summaries when aggregate was set; windows without events are omitted",
+					"properties": map[string]interface{}{
+						"group_by":  map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+						"fields":    map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+						"window_ms": map[string]interface{}{"type": "integer"},
+						"windows": map[string]interface{}{
+							"type": "array",
+							"items": map[string]interface{}{
+								"type": "object",
+								"properties": map[string]interface{}{
+									"window_start_ns": map[string]interface{}{"type": "integer"},
+									"window_end_ns":   map[string]interface{}{"type": "integer"},
+									"events":          map[string]interface{}{"type": "integer"},
+									"rate":            map[string]interface{}{"type": "number"},
+									"groups":          map[string]interface{}{"type": "integer"},
+									"top": map[string]interface{}{
+										"type":        "array",
+										"items":       map[string]interface{}{"type": "object"},
+										"description": "Groups with their key, count, rate and field summaries",
+									},
+									"other_count": map[string]interface{}{"type": "integer"},
+								},
+							},
+						},
+					},
+				},
 				"complete": map[string]interface{}{
 					"type":        "boolean",
 					"description": "Whether the stream completed successfully",
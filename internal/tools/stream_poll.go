@@ -0,0 +1,125 @@
+// internal/tools/stream_poll.go
+package tools
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sameehj/ebpf-mcp/internal/ebpf"
+	"github.com/sameehj/ebpf-mcp/pkg/types"
+)
+
+func StreamPollTool(ctx context.Context, input map[string]interface{}) (interface{}, error) {
+	if input == nil {
+		return &ebpf.StreamPollResult{
+			Success:     false,
+			ToolVersion: "v1",
+			Events:      []map[string]interface{}{},
+			Error:       "input is nil",
+		}, fmt.Errorf("input is nil")
+	}
+
+	args, err := parseStreamPollInput(input)
+	if err != nil {
+		return &ebpf.StreamPollResult{
+			Success:     false,
+			ToolVersion: "v1",
+			Events:      []map[string]interface{}{},
+			Error:       fmt.Sprintf("parsing error: %v", err),
+		}, err
+	}
+
+	return ebpf.StreamPoll(ctx, args)
+}
+
+func parseStreamPollInput(input map[string]interface{}) (*ebpf.StreamPollArgs, error) {
+	sessionID, err := types.SafeStringFromInterface(input["session_id"], "session_id")
+	if err != nil {
+		return nil, err
+	}
+	args := &ebpf.StreamPollArgs{SessionID: sessionID}
+
+	for name, dst := range map[string]*int{
+		"cursor":     &args.Cursor,
+		"max_events": &args.MaxEvents,
+		"wait_ms":    &args.WaitMs,
+	} {
+		raw, exists := input[name]
+		if !exists || raw == nil {
+			continue
+		}
+		n, ok := raw.(float64)
+		if !ok {
+			return nil, fmt.Errorf("%s must be a number", name)
+		}
+		*dst = int(n)
+	}
+	return args, nil
+}
+
+// streamSessionIDProperty is the session_id input shared by the session tools.
+func streamSessionIDProperty() map[string]interface{} {
+	return map[string]interface{}{
+		"type":        "string",
+		"description": "Session ID returned by stream_start",
+	}
+}
+
+func init() {
+	RegisterTool(types.Tool{
+		ID:          "stream_poll",
+		Title:       "Poll Event Stream Session",
+		Description: "Returns events buffered by a stream_start session since a cursor. Pass the returned next_cursor to the next poll to continue where this one stopped.",
+		InputSchema: map[string]interface{}{
+			"type":     "object",
+			"required": []string{"session_id"},
+			"properties": map[string]interface{}{
+				"session_id": streamSessionIDProperty(),
+				"cursor": map[string]interface{}{
+					"type":        "integer",
+					"description": "Sequence number of the first event to return, from a previous next_cursor; a cursor past the next event is an error",
+					"default":     0,
+					"minimum":     0,
+				},
+				"max_events": map[string]interface{}{
+					"type":        "integer",
+					"description": "Maximum number of events to return",
+					"default":     100,
+					"minimum":     1,
+				},
+				"wait_ms": map[string]interface{}{
+					"type":        "integer",
+					"description": "Wait up to this long for an event when none is buffered past the cursor",
+					"minimum":     0,
+					"maximum":     30000,
+				},
+			},
+		},
+		OutputSchema: map[string]interface{}{
+			"type":     "object",
+			"required": []string{"success", "tool_version", "events", "next_cursor"},
+			"properties": map[string]interface{}{
+				"success":      map[string]interface{}{"type": "boolean"},
+				"tool_version": map[string]interface{}{"type": "string"},
+				"session_id":   map[string]interface{}{"type": "string"},
+				"events": map[string]interface{}{
+					"type":  "array",
+					"items": map[string]interface{}{"type": "object"},
+				},
+				"next_cursor":  map[string]interface{}{"type": "integer"},
+				"missed":       map[string]interface{}{"type": "integer", "description": "Events past the cursor overwritten before this poll"},
+				"active":       map[string]interface{}{"type": "boolean", "description": "Whether the session is still reading"},
+				"stream_error": map[string]interface{}{"type": "string"},
+				"stats":        streamStatsSchema(),
+				"message":      map[string]interface{}{"type": "string"},
+				"error":        map[string]interface{}{"type": "string"},
+			},
+		},
+		Annotations: map[string]interface{}{
+			"title":          "Stream Poll",
+			"idempotentHint": true,
+			"readOnlyHint":   true,
+		},
+		Call: StreamPollTool,
+	})
+}
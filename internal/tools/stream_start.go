@@ -0,0 +1,119 @@
+// internal/tools/stream_start.go
+package tools
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sameehj/ebpf-mcp/internal/ebpf"
+	"github.com/sameehj/ebpf-mcp/pkg/types"
+)
+
+func StreamStartTool(ctx context.Context, input map[string]interface{}) (interface{}, error) {
+	if input == nil {
+		return &ebpf.StreamStartResult{
+			Success:     false,
+			ToolVersion: "v1",
+			Error:       "input is nil",
+		}, fmt.Errorf("input is nil")
+	}
+
+	args, err := ebpf.ParseStreamStartArgs(input)
+	if err != nil {
+		return &ebpf.StreamStartResult{
+			Success:     false,
+			ToolVersion: "v1",
+			Error:       fmt.Sprintf("parsing error: %v", err),
+		}, err
+	}
+
+	return ebpf.StreamStart(args)
+}
+
+func init() {
+	RegisterTool(types.Tool{
+		ID:          "stream_start",
+		Title:       "Start Event Stream Session",
+		Description: "Starts reading events from a ringbuf or perf event array in the background and returns a session ID immediately. Fetch events with stream_poll and end the session with stream_stop.",
+		InputSchema: map[string]interface{}{
+			"type":     "object",
+			"required": []string{"source"},
+			"properties": map[string]interface{}{
+				"source": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"program_id": map[string]interface{}{
+							"type":        "integer",
+							"description": "ID of the eBPF program to stream from; its only ringbuf or perf event array map is used",
+						},
+						"link_id": map[string]interface{}{
+							"type":        "integer",
+							"description": "ID of the attached link to stream from, resolved through its program",
+						},
+						"map_id": map[string]interface{}{
+							"type":        "integer",
+							"description": "Direct map ID to stream from",
+						},
+						"type": map[string]interface{}{
+							"type":        "string",
+							"enum":        []string{"ringbuf", "perfbuf"},
+							"description": "Type of buffer to stream from; inferred from the map, and narrows the choice when a program uses both",
+						},
+					},
+				},
+				"duration_ms": map[string]interface{}{
+					"type":        "integer",
+					"description": "Stop reading after this many milliseconds; by default the session reads until stopped",
+					"minimum":     100,
+				},
+				"buffer_size": map[string]interface{}{
+					"type":        "integer",
+					"description": "Number of events kept for polling; the oldest are overwritten when full",
+					"default":     1000,
+					"minimum":     1,
+					"maximum":     100000,
+				},
+				"format": map[string]interface{}{
+					"type":        "string",
+					"enum":        []string{"json", "raw", "base64"},
+					"default":     "json",
+					"description": "Output format for events: json decodes records through BTF, raw returns hex, base64 returns base64",
+				},
+				"struct_type": map[string]interface{}{
+					"type":        "string",
+					"description": "Name of the BTF struct records are decoded as; defaults to the map's value type",
+				},
+				"filter": map[string]interface{}{
+					"type":        "string",
+					"description": "Filter expression over decoded event fields, as for stream_events",
+				},
+				"filters": map[string]interface{}{
+					"type":        "object",
+					"description": "Event filtering options, as for stream_events",
+				},
+			},
+		},
+		OutputSchema: map[string]interface{}{
+			"type":     "object",
+			"required": []string{"success", "tool_version"},
+			"properties": map[string]interface{}{
+				"success":      map[string]interface{}{"type": "boolean"},
+				"tool_version": map[string]interface{}{"type": "string"},
+				"session_id":   map[string]interface{}{"type": "string"},
+				"source":       map[string]interface{}{"type": "string"},
+				"map_id":       map[string]interface{}{"type": "integer"},
+				"map_type":     map[string]interface{}{"type": "string"},
+				"struct_type":  map[string]interface{}{"type": "string"},
+				"buffer_size":  map[string]interface{}{"type": "integer"},
+				"message":      map[string]interface{}{"type": "string"},
+				"error":        map[string]interface{}{"type": "string"},
+			},
+		},
+		Annotations: map[string]interface{}{
+			"title":          "Stream Start",
+			"idempotentHint": false,
+			"readOnlyHint":   false,
+		},
+		Call: StreamStartTool,
+	})
+}
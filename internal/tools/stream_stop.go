@@ -0,0 +1,81 @@
+// internal/tools/stream_stop.go
+package tools
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sameehj/ebpf-mcp/internal/ebpf"
+	"github.com/sameehj/ebpf-mcp/pkg/types"
+)
+
+func StreamStopTool(ctx context.Context, input map[string]interface{}) (interface{}, error) {
+	if input == nil {
+		return &ebpf.StreamStopResult{
+			Success:     false,
+			ToolVersion: "v1",
+			Error:       "input is nil",
+		}, fmt.Errorf("input is nil")
+	}
+
+	sessionID, err := types.SafeStringFromInterface(input["session_id"], "session_id")
+	if err != nil {
+		return &ebpf.StreamStopResult{
+			Success:     false,
+			ToolVersion: "v1",
+			Error:       fmt.Sprintf("parsing error: %v", err),
+		}, err
+	}
+
+	return ebpf.StreamStop(&ebpf.StreamStopArgs{SessionID: sessionID})
+}
+
+// streamStatsSchema describes the stats object of the session tools.
+func streamStatsSchema() map[string]interface{} {
+	return map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"events_received":    map[string]interface{}{"type": "integer"},
+			"events_dropped":     map[string]interface{}{"type": "integer"},
+			"events_filtered":    map[string]interface{}{"type": "integer"},
+			"events_overwritten": map[string]interface{}{"type": "integer"},
+			"buffered":           map[string]interface{}{"type": "integer"},
+			"duration_ms":        map[string]interface{}{"type": "integer"},
+			"events_per_second":  map[string]interface{}{"type": "number"},
+		},
+	}
+}
+
+func init() {
+	RegisterTool(types.Tool{
+		ID:          "stream_stop",
+		Title:       "Stop Event Stream Session",
+		Description: "Stops a stream_start session, releases its event map and returns the final statistics.",
+		InputSchema: map[string]interface{}{
+			"type":     "object",
+			"required": []string{"session_id"},
+			"properties": map[string]interface{}{
+				"session_id": streamSessionIDProperty(),
+			},
+		},
+		OutputSchema: map[string]interface{}{
+			"type":     "object",
+			"required": []string{"success", "tool_version"},
+			"properties": map[string]interface{}{
+				"success":      map[string]interface{}{"type": "boolean"},
+				"tool_version": map[string]interface{}{"type": "string"},
+				"session_id":   map[string]interface{}{"type": "string"},
+				"unread":       map[string]interface{}{"type": "integer", "description": "Buffered events that were never polled"},
+				"stats":        streamStatsSchema(),
+				"message":      map[string]interface{}{"type": "string"},
+				"error":        map[string]interface{}{"type": "string"},
+			},
+		},
+		Annotations: map[string]interface{}{
+			"title":          "Stream Stop",
+			"idempotentHint": false,
+			"readOnlyHint":   false,
+		},
+		Call: StreamStopTool,
+	})
+}
@@ -2,6 +2,7 @@
 package tools
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -107,7 +108,7 @@ func List(id interface{}) types.RPCResponse {
 	return types.NewSuccessResponse(id, map[string]interface{}{"tools": tools})
 }
 
-func Call(req types.RPCRequest) types.RPCResponse {
+func Call(ctx context.Context, req types.RPCRequest) types.RPCResponse {
 	mu.RLock()
 	defer mu.RUnlock()
 
@@ -131,7 +132,7 @@ func Call(req types.RPCRequest) types.RPCResponse {
 	}
 
 	input, _ := req.Params["input"].(map[string]interface{})
-	result, err := tool.Call(input)
+	result, err := tool.Call(ctx, input)
 	if err != nil {
 		return types.NewErrorResponse(req.ID, fmt.Sprintf("%s failed: %v", toolID, err))
 	}
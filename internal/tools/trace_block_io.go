@@ -0,0 +1,147 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sameehj/ebpf-mcp/internal/ebpf"
+	"github.com/sameehj/ebpf-mcp/pkg/types"
+)
+
+func TraceBlockIOTool(ctx context.Context, input map[string]interface{}) (interface{}, error) {
+	args, err := ebpf.ParseTraceBlockIOArgs(input)
+	if err != nil {
+		return &ebpf.TraceBlockIOResult{
+			Success:     false,
+			ToolVersion: "v1",
+			Error:       fmt.Sprintf("parsing error: %v", err),
+		}, err
+	}
+
+	return ebpf.RunTraceBlockIO(ctx, args)
+}
+
+func init() {
+	histogram := map[string]interface{}{
+		"type":        "array",
+		"description": "Requests per latency bucket [low, high), from the first to the last non-empty bucket",
+		"items": map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"low":   map[string]interface{}{"type": "integer"},
+				"high":  map[string]interface{}{"type": "integer"},
+				"count": map[string]interface{}{"type": "integer"},
+			},
+		},
+	}
+
+	RegisterTool(types.Tool{
+		ID:          "trace_block_io",
+		Title:       "Trace Block I/O",
+		Description: "Measures block device requests from issue to completion for a while using the block_rq_issue and block_rq_complete tracepoints. Returns per-device latency histograms with percentiles, IOPS, throughput, average queue depth and errors, split into reads, writes, discards and other requests, sync or async. Optionally returns completed requests one by one with the issuing pid and command, sector and size.",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"duration_ms": map[string]interface{}{
+					"type":        "integer",
+					"description": "How long to trace for",
+					"default":     5000,
+					"minimum":     1,
+					"maximum":     60000,
+				},
+				"devices": map[string]interface{}{
+					"type":        "array",
+					"items":       map[string]interface{}{"type": "string"},
+					"description": "Only trace these devices, by name (\"nvme0n1\", \"/dev/sda\") or major:minor",
+				},
+				"unit": map[string]interface{}{
+					"type":        "string",
+					"description": "Unit of latencies",
+					"enum":        []string{"ns", "us", "ms"},
+					"default":     "us",
+				},
+				"events": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Also return completed requests one by one",
+					"default":     false,
+				},
+				"max_events": map[string]interface{}{
+					"type":        "integer",
+					"description": "Maximum number of requests to return with events",
+					"default":     100,
+					"minimum":     1,
+					"maximum":     10000,
+				},
+			},
+		},
+		OutputSchema: map[string]interface{}{
+			"type":     "object",
+			"required": []string{"success", "tool_version", "devices"},
+			"properties": map[string]interface{}{
+				"success":      map[string]interface{}{"type": "boolean"},
+				"tool_version": map[string]interface{}{"type": "string"},
+				"status":       map[string]interface{}{"type": "string"},
+				"unit":         map[string]interface{}{"type": "string"},
+				"devices": map[string]interface{}{
+					"type":        "array",
+					"description": "Devices with completed requests, busiest first",
+					"items": map[string]interface{}{
+						"type": "object",
+						"properties": map[string]interface{}{
+							"device":           map[string]interface{}{"type": "string"},
+							"dev":              map[string]interface{}{"type": "string", "description": "major:minor"},
+							"count":            map[string]interface{}{"type": "integer"},
+							"iops":             map[string]interface{}{"type": "number"},
+							"bytes":            map[string]interface{}{"type": "integer"},
+							"bytes_per_second": map[string]interface{}{"type": "number"},
+							"avg_latency":      map[string]interface{}{"type": "number"},
+							"avg_queue_depth":  map[string]interface{}{"type": "number", "description": "Mean requests in flight, from total latency over the trace"},
+							"in_flight":        map[string]interface{}{"type": "integer", "description": "Requests still in flight at the end, not counted"},
+							"errors":           map[string]interface{}{"type": "integer"},
+							"p50":              map[string]interface{}{"type": "number", "description": "Estimated from the histogram"},
+							"p90":              map[string]interface{}{"type": "number", "description": "Estimated from the histogram"},
+							"p99":              map[string]interface{}{"type": "number", "description": "Estimated from the histogram"},
+							"histogram":        histogram,
+							"classes": map[string]interface{}{
+								"type": "array",
+								"items": map[string]interface{}{
+									"type": "object",
+									"properties": map[string]interface{}{
+										"op":               map[string]interface{}{"type": "string", "enum": []string{"read", "write", "discard", "other"}},
+										"sync":             map[string]interface{}{"type": "boolean"},
+										"count":            map[string]interface{}{"type": "integer"},
+										"iops":             map[string]interface{}{"type": "number"},
+										"bytes":            map[string]interface{}{"type": "integer"},
+										"bytes_per_second": map[string]interface{}{"type": "number"},
+										"avg_latency":      map[string]interface{}{"type": "number"},
+										"errors":           map[string]interface{}{"type": "integer"},
+										"p50":              map[string]interface{}{"type": "number"},
+										"p90":              map[string]interface{}{"type": "number"},
+										"p99":              map[string]interface{}{"type": "number"},
+										"histogram":        histogram,
+									},
+								},
+							},
+						},
+					},
+				},
+				"events": map[string]interface{}{
+					"type":        "array",
+					"description": "Completed requests, with data holding device, dev, op, sync, sector, bytes, latency, pid, comm, ktime_ns and error for failed requests",
+					"items":       map[string]interface{}{"type": "object"},
+				},
+				"stats":    map[string]interface{}{"type": "object"},
+				"complete": map[string]interface{}{"type": "boolean"},
+				"warnings": map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+				"error":    map[string]interface{}{"type": "string"},
+			},
+		},
+		Annotations: map[string]interface{}{
+			"title":          "Block I/O (biolatency/biosnoop)",
+			"readOnlyHint":   true,
+			"idempotentHint": false,
+			"openWorldHint":  false,
+		},
+		Call: TraceBlockIOTool,
+	})
+}
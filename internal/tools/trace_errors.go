@@ -1,27 +1,125 @@
 package tools
 
 import (
+	"context"
+	"fmt"
+
 	"github.com/sameehj/ebpf-mcp/internal/ebpf"
 	"github.com/sameehj/ebpf-mcp/pkg/types"
 )
 
+func TraceErrorsTool(ctx context.Context, input map[string]interface{}) (interface{}, error) {
+	args, err := ebpf.ParseTraceErrorsArgs(input)
+	if err != nil {
+		return &ebpf.TraceResult{
+			Success:     false,
+			ToolVersion: "v1",
+			Error:       fmt.Sprintf("parsing error: %v", err),
+		}, err
+	}
+
+	return ebpf.RunTraceErrors(ctx, args)
+}
+
 func init() {
 	RegisterTool(types.Tool{
 		ID:          "trace_errors",
 		Title:       "Trace Syscall Errors",
-		Description: "Attaches to sched_switch to simulate an eBPF trace for 2s",
+		Description: "Attaches to raw_syscalls:sys_exit for a while and reports the system calls that failed, counted per syscall and errno, with sample events.",
 		InputSchema: map[string]interface{}{
-			"type":       "object",
-			"properties": map[string]interface{}{},
+			"type": "object",
+			"properties": map[string]interface{}{
+				"duration_ms": map[string]interface{}{
+					"type":        "integer",
+					"description": "How long to trace for",
+					"default":     2000,
+					"minimum":     1,
+					"maximum":     60000,
+				},
+				"pids": map[string]interface{}{
+					"type":        "array",
+					"items":       map[string]interface{}{"type": "integer"},
+					"description": "Only trace these processes (thread group IDs); filtered in the kernel",
+				},
+				"comm": map[string]interface{}{
+					"type":        "string",
+					"description": "Only report failures of threads with this exact command name",
+				},
+				"errnos": map[string]interface{}{
+					"type":        "array",
+					"items":       map[string]interface{}{"type": "string"},
+					"description": "Only report these errors, by name (\"ENOENT\") or number (\"2\")",
+				},
+				"max_samples": map[string]interface{}{
+					"type":        "integer",
+					"description": "Number of individual failures to return",
+					"default":     10,
+					"minimum":     1,
+					"maximum":     100,
+				},
+				"top": map[string]interface{}{
+					"type":        "integer",
+					"description": "Number of syscall/errno pairs to return, most frequent first",
+					"default":     20,
+					"minimum":     1,
+				},
+			},
+		},
+		OutputSchema: map[string]interface{}{
+			"type":     "object",
+			"required": []string{"success", "tool_version", "traced_events"},
+			"properties": map[string]interface{}{
+				"success":         map[string]interface{}{"type": "boolean"},
+				"tool_version":    map[string]interface{}{"type": "string"},
+				"status":          map[string]interface{}{"type": "string"},
+				"traced_events":   map[string]interface{}{"type": "integer", "description": "Failed syscalls matching the filters"},
+				"events_filtered": map[string]interface{}{"type": "integer", "description": "Failed syscalls skipped by the comm and errno filters"},
+				"events_dropped":  map[string]interface{}{"type": "integer", "description": "Failed syscalls lost because the ring buffer was full"},
+				"duration_ms":     map[string]interface{}{"type": "integer"},
+				"counts": map[string]interface{}{
+					"type": "array",
+					"items": map[string]interface{}{
+						"type": "object",
+						"properties": map[string]interface{}{
+							"syscall":    map[string]interface{}{"type": "string"},
+							"errno":      map[string]interface{}{"type": "integer"},
+							"errno_name": map[string]interface{}{"type": "string"},
+							"count":      map[string]interface{}{"type": "integer"},
+							"processes": map[string]interface{}{
+								"type":                 "object",
+								"additionalProperties": map[string]interface{}{"type": "integer"},
+								"description":          "Failures per command name",
+							},
+						},
+					},
+				},
+				"samples": map[string]interface{}{
+					"type": "array",
+					"items": map[string]interface{}{
+						"type": "object",
+						"properties": map[string]interface{}{
+							"timestamp_ns": map[string]interface{}{"type": "integer"},
+							"pid":          map[string]interface{}{"type": "integer"},
+							"tid":          map[string]interface{}{"type": "integer"},
+							"comm":         map[string]interface{}{"type": "string"},
+							"syscall":      map[string]interface{}{"type": "string"},
+							"syscall_nr":   map[string]interface{}{"type": "integer"},
+							"ret":          map[string]interface{}{"type": "integer"},
+							"errno":        map[string]interface{}{"type": "integer"},
+							"errno_name":   map[string]interface{}{"type": "string"},
+						},
+					},
+				},
+				"warnings": map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+				"error":    map[string]interface{}{"type": "string"},
+			},
 		},
 		Annotations: map[string]interface{}{
-			"title":          "Trace Errors (sched_switch)",
+			"title":          "Trace Errors (raw_syscalls:sys_exit)",
 			"readOnlyHint":   true,
-			"idempotentHint": true,
+			"idempotentHint": false,
 			"openWorldHint":  false,
 		},
-		Call: func(input map[string]interface{}) (interface{}, error) {
-			return ebpf.RunTraceErrors()
-		},
+		Call: TraceErrorsTool,
 	})
 }
@@ -0,0 +1,117 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sameehj/ebpf-mcp/internal/ebpf"
+	"github.com/sameehj/ebpf-mcp/pkg/types"
+)
+
+func TraceExecTool(ctx context.Context, input map[string]interface{}) (interface{}, error) {
+	args, err := ebpf.ParseTraceExecArgs(input)
+	if err != nil {
+		return &ebpf.TraceExecResult{
+			Success:     false,
+			ToolVersion: "v1",
+			Error:       fmt.Sprintf("parsing error: %v", err),
+		}, err
+	}
+
+	return ebpf.RunTraceExec(ctx, args)
+}
+
+func init() {
+	RegisterTool(types.Tool{
+		ID:          "trace_exec",
+		Title:       "Trace Process Executions",
+		Description: "Records the processes started for a while: pid, parent pid, uid, cgroup, command, file and arguments of every execve, whether it failed, and the exit status of processes that exit before the trace ends. Events have the shape of stream_events events.",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"duration_ms": map[string]interface{}{
+					"type":        "integer",
+					"description": "How long to trace for",
+					"default":     5000,
+					"minimum":     1,
+					"maximum":     60000,
+				},
+				"max_events": map[string]interface{}{
+					"type":        "integer",
+					"description": "Maximum number of executions to return",
+					"default":     100,
+					"minimum":     1,
+					"maximum":     10000,
+				},
+				"pids": map[string]interface{}{
+					"type":        "array",
+					"items":       map[string]interface{}{"type": "integer"},
+					"description": "Only report executions by or started from these processes (matching pid or ppid)",
+				},
+				"uids": map[string]interface{}{
+					"type":        "array",
+					"items":       map[string]interface{}{"type": "integer"},
+					"description": "Only report executions by these users",
+				},
+				"cgroup": map[string]interface{}{
+					"type":        "string",
+					"description": "Only trace tasks in this cgroup v2 directory or its descendants; relative paths are under /sys/fs/cgroup. Filtered in the kernel",
+				},
+			},
+		},
+		OutputSchema: map[string]interface{}{
+			"type":     "object",
+			"required": []string{"success", "tool_version", "events"},
+			"properties": map[string]interface{}{
+				"success":      map[string]interface{}{"type": "boolean"},
+				"tool_version": map[string]interface{}{"type": "string"},
+				"status":       map[string]interface{}{"type": "string"},
+				"events": map[string]interface{}{
+					"type": "array",
+					"items": map[string]interface{}{
+						"type": "object",
+						"properties": map[string]interface{}{
+							"timestamp_ns": map[string]interface{}{"type": "integer"},
+							"map_id":       map[string]interface{}{"type": "integer"},
+							"size":         map[string]interface{}{"type": "integer"},
+							"data": map[string]interface{}{
+								"type": "object",
+								"properties": map[string]interface{}{
+									"pid":            map[string]interface{}{"type": "integer"},
+									"tid":            map[string]interface{}{"type": "integer"},
+									"ppid":           map[string]interface{}{"type": "integer"},
+									"uid":            map[string]interface{}{"type": "integer"},
+									"cgroup_id":      map[string]interface{}{"type": "integer"},
+									"comm":           map[string]interface{}{"type": "string", "description": "Command name, of the new program once execve succeeded"},
+									"caller_comm":    map[string]interface{}{"type": "string", "description": "Command name before a successful execve"},
+									"filename":       map[string]interface{}{"type": "string"},
+									"argv":           map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+									"argv_truncated": map[string]interface{}{"type": "boolean", "description": "Only the first 20 arguments were captured; each is cut at 127 bytes"},
+									"ret":            map[string]interface{}{"type": "integer", "description": "execve return value"},
+									"errno":          map[string]interface{}{"type": "integer"},
+									"errno_name":     map[string]interface{}{"type": "string"},
+									"exited":         map[string]interface{}{"type": "boolean"},
+									"exit_code":      map[string]interface{}{"type": "integer"},
+									"exit_signal":    map[string]interface{}{"type": "string"},
+									"core_dumped":    map[string]interface{}{"type": "boolean"},
+									"runtime_ns":     map[string]interface{}{"type": "integer", "description": "Time from execve to exit"},
+								},
+							},
+						},
+					},
+				},
+				"stats":    map[string]interface{}{"type": "object"},
+				"complete": map[string]interface{}{"type": "boolean"},
+				"warnings": map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+				"error":    map[string]interface{}{"type": "string"},
+			},
+		},
+		Annotations: map[string]interface{}{
+			"title":          "Trace Exec (sys_enter_execve)",
+			"readOnlyHint":   true,
+			"idempotentHint": false,
+			"openWorldHint":  false,
+		},
+		Call: TraceExecTool,
+	})
+}
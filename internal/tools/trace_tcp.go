@@ -0,0 +1,135 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sameehj/ebpf-mcp/internal/ebpf"
+	"github.com/sameehj/ebpf-mcp/pkg/types"
+)
+
+func TraceTCPTool(ctx context.Context, input map[string]interface{}) (interface{}, error) {
+	args, err := ebpf.ParseTraceTCPArgs(input)
+	if err != nil {
+		return &ebpf.TraceTCPResult{
+			Success:     false,
+			ToolVersion: "v1",
+			Error:       fmt.Sprintf("parsing error: %v", err),
+		}, err
+	}
+
+	return ebpf.RunTraceTCP(ctx, args)
+}
+
+func init() {
+	RegisterTool(types.Tool{
+		ID:          "trace_tcp",
+		Title:       "Trace TCP Connections",
+		Description: "Records TCP connects, accepts, closes and retransmits for IPv4 and IPv6 for a while, with addresses, ports, process, duration and bytes transferred, and summarises each connection seen. Answers questions like \"who is connecting to port 5432 and how long do connections last\".",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"duration_ms": map[string]interface{}{
+					"type":        "integer",
+					"description": "How long to trace for",
+					"default":     5000,
+					"minimum":     1,
+					"maximum":     60000,
+				},
+				"max_events": map[string]interface{}{
+					"type":        "integer",
+					"description": "Maximum number of events to return; connections are summarised regardless",
+					"default":     200,
+					"minimum":     1,
+					"maximum":     10000,
+				},
+				"pids": map[string]interface{}{
+					"type":        "array",
+					"items":       map[string]interface{}{"type": "integer"},
+					"description": "Only report connections of these processes",
+				},
+				"ports": map[string]interface{}{
+					"type":        "array",
+					"items":       map[string]interface{}{"type": "integer"},
+					"description": "Only report connections with one of these local or remote ports",
+				},
+			},
+		},
+		OutputSchema: map[string]interface{}{
+			"type":     "object",
+			"required": []string{"success", "tool_version", "events", "connections"},
+			"properties": map[string]interface{}{
+				"success":      map[string]interface{}{"type": "boolean"},
+				"tool_version": map[string]interface{}{"type": "string"},
+				"status":       map[string]interface{}{"type": "string"},
+				"events": map[string]interface{}{
+					"type": "array",
+					"items": map[string]interface{}{
+						"type": "object",
+						"properties": map[string]interface{}{
+							"timestamp_ns": map[string]interface{}{"type": "integer"},
+							"map_id":       map[string]interface{}{"type": "integer"},
+							"size":         map[string]interface{}{"type": "integer"},
+							"data": map[string]interface{}{
+								"type": "object",
+								"properties": map[string]interface{}{
+									"event": map[string]interface{}{
+										"type": "string",
+										"enum": []string{"connect", "connect_failed", "accept", "close", "retransmit"},
+									},
+									"family":      map[string]interface{}{"type": "string", "enum": []string{"ipv4", "ipv6"}},
+									"local_addr":  map[string]interface{}{"type": "string"},
+									"local_port":  map[string]interface{}{"type": "integer"},
+									"remote_addr": map[string]interface{}{"type": "string"},
+									"remote_port": map[string]interface{}{"type": "integer"},
+									"pid":         map[string]interface{}{"type": "integer"},
+									"comm":        map[string]interface{}{"type": "string"},
+									"latency_us":  map[string]interface{}{"type": "number", "description": "Handshake time of connects"},
+									"duration_ms": map[string]interface{}{"type": "number", "description": "Connection lifetime, on close of connections opened during the trace"},
+									"old_state":   map[string]interface{}{"type": "string"},
+									"state":       map[string]interface{}{"type": "string"},
+									"rx_bytes":    map[string]interface{}{"type": "integer"},
+									"tx_bytes":    map[string]interface{}{"type": "integer"},
+									"retransmits": map[string]interface{}{"type": "integer"},
+								},
+							},
+						},
+					},
+				},
+				"connections": map[string]interface{}{
+					"type": "array",
+					"items": map[string]interface{}{
+						"type": "object",
+						"properties": map[string]interface{}{
+							"direction":   map[string]interface{}{"type": "string", "enum": []string{"connect", "accept"}},
+							"family":      map[string]interface{}{"type": "string"},
+							"local_addr":  map[string]interface{}{"type": "string"},
+							"local_port":  map[string]interface{}{"type": "integer"},
+							"remote_addr": map[string]interface{}{"type": "string"},
+							"remote_port": map[string]interface{}{"type": "integer"},
+							"pid":         map[string]interface{}{"type": "integer"},
+							"comm":        map[string]interface{}{"type": "string"},
+							"state":       map[string]interface{}{"type": "string"},
+							"open":        map[string]interface{}{"type": "boolean"},
+							"duration_ms": map[string]interface{}{"type": "number"},
+							"rx_bytes":    map[string]interface{}{"type": "integer"},
+							"tx_bytes":    map[string]interface{}{"type": "integer"},
+							"retransmits": map[string]interface{}{"type": "integer"},
+						},
+					},
+				},
+				"stats":    map[string]interface{}{"type": "object"},
+				"complete": map[string]interface{}{"type": "boolean"},
+				"warnings": map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+				"error":    map[string]interface{}{"type": "string"},
+			},
+		},
+		Annotations: map[string]interface{}{
+			"title":          "Trace TCP (sock:inet_sock_set_state)",
+			"readOnlyHint":   true,
+			"idempotentHint": false,
+			"openWorldHint":  false,
+		},
+		Call: TraceTCPTool,
+	})
+}
@@ -0,0 +1,137 @@
+// internal/tools/unload_program.go
+package tools
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sameehj/ebpf-mcp/internal/ebpf"
+	"github.com/sameehj/ebpf-mcp/pkg/types"
+)
+
+func UnloadProgramTool(ctx context.Context, input map[string]interface{}) (interface{}, error) {
+	if input == nil {
+		return &ebpf.UnloadProgramResult{
+			Success:     false,
+			ToolVersion: "v1",
+			Error:       "input is nil",
+		}, fmt.Errorf("input is nil")
+	}
+
+	args := &ebpf.UnloadProgramArgs{}
+
+	if programIDRaw, exists := input["program_id"]; exists && programIDRaw != nil {
+		programID, ok := programIDRaw.(float64)
+		if !ok {
+			return nil, fmt.Errorf("program_id must be a number")
+		}
+		args.ProgramID = int(programID)
+	}
+
+	if handleRaw, exists := input["handle"]; exists && handleRaw != nil {
+		handle, ok := handleRaw.(string)
+		if !ok {
+			return nil, fmt.Errorf("handle must be a string")
+		}
+		args.Handle = handle
+	}
+
+	if args.ProgramID == 0 && args.Handle == "" {
+		return nil, fmt.Errorf("one of program_id or handle is required")
+	}
+
+	if cascadeRaw, exists := input["cascade"]; exists && cascadeRaw != nil {
+		cascade, ok := cascadeRaw.(bool)
+		if !ok {
+			return nil, fmt.Errorf("cascade must be a boolean")
+		}
+		args.Cascade = cascade
+	}
+
+	if forceRaw, exists := input["force"]; exists && forceRaw != nil {
+		force, ok := forceRaw.(bool)
+		if !ok {
+			return nil, fmt.Errorf("force must be a boolean")
+		}
+		args.Force = force
+	}
+
+	return ebpf.UnloadProgram(args)
+}
+
+func init() {
+	unloadedObject := map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"id":            map[string]interface{}{"type": "integer"},
+			"name":          map[string]interface{}{"type": "string"},
+			"type":          map[string]interface{}{"type": "string"},
+			"memlock_bytes": map[string]interface{}{"type": "integer"},
+			"freed":         map[string]interface{}{"type": "boolean"},
+		},
+	}
+
+	RegisterTool(types.Tool{
+		ID:          "unload_program",
+		Title:       "Unload eBPF Program",
+		Description: "Unloads a program and the maps it owns. Programs loaded together by load_program are unloaded as one collection. Pins, links and attachments made outside this server are left in place unless force is set.",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"program_id": map[string]interface{}{
+					"type":        "integer",
+					"description": "Kernel ID of the program to unload",
+				},
+				"handle": map[string]interface{}{
+					"type":        "string",
+					"description": "Server handle of the program or collection returned by load_program",
+				},
+				"cascade": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Detach links and non-link attachments (cgroup, tcx, XDP, tc) still running the program instead of refusing to unload; those not created by this server also need force",
+					"default":     false,
+				},
+				"force": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Also act on objects this server did not create: detach other tools' links and attachments with cascade, and remove pins of the unloaded programs and maps",
+					"default":     false,
+				},
+			},
+		},
+		OutputSchema: map[string]interface{}{
+			"type":     "object",
+			"required": []string{"success", "tool_version"},
+			"properties": map[string]interface{}{
+				"success":        map[string]interface{}{"type": "boolean"},
+				"tool_version":   map[string]interface{}{"type": "string"},
+				"programs":       map[string]interface{}{"type": "array", "items": unloadedObject},
+				"maps":           map[string]interface{}{"type": "array", "items": unloadedObject},
+				"detached_links": map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "integer"}},
+				"detached_attachments": map[string]interface{}{
+					"type": "array",
+					"items": map[string]interface{}{
+						"type": "object",
+						"properties": map[string]interface{}{
+							"program_id": map[string]interface{}{"type": "integer"},
+							"hook":       map[string]interface{}{"type": "string"},
+							"target":     map[string]interface{}{"type": "string"},
+						},
+					},
+				},
+				"unpinned":           map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+				"released":           map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "object"}},
+				"memory_freed_bytes": map[string]interface{}{"type": "integer"},
+				"warnings":           map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+				"message":            map[string]interface{}{"type": "string"},
+				"error":              map[string]interface{}{"type": "string"},
+			},
+		},
+		Annotations: map[string]interface{}{
+			"title":           "Unload Program",
+			"idempotentHint":  false,
+			"readOnlyHint":    false,
+			"destructiveHint": true,
+		},
+		Call: UnloadProgramTool,
+	})
+}
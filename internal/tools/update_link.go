@@ -0,0 +1,110 @@
+// internal/tools/update_link.go
+package tools
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sameehj/ebpf-mcp/internal/ebpf"
+	"github.com/sameehj/ebpf-mcp/pkg/types"
+)
+
+func UpdateLinkTool(ctx context.Context, input map[string]interface{}) (interface{}, error) {
+	if input == nil {
+		return &ebpf.UpdateLinkResult{
+			Success:     false,
+			ToolVersion: "v1",
+			Error:       "input is nil",
+		}, fmt.Errorf("input is nil")
+	}
+
+	sel, err := parseLinkSelector(input)
+	if err != nil {
+		return &ebpf.UpdateLinkResult{
+			Success:     false,
+			ToolVersion: "v1",
+			Error:       fmt.Sprintf("parsing error: %v", err),
+		}, err
+	}
+
+	args := &ebpf.UpdateLinkArgs{
+		LinkID:  sel.LinkID,
+		PinPath: sel.PinPath,
+		Handle:  sel.Handle,
+	}
+
+	if programIDRaw, exists := input["program_id"]; exists && programIDRaw != nil {
+		programID, ok := programIDRaw.(float64)
+		if !ok {
+			return nil, fmt.Errorf("program_id must be a number")
+		}
+		args.ProgramID = int(programID)
+	} else {
+		return nil, fmt.Errorf("program_id is required")
+	}
+
+	if oldRaw, exists := input["old_program_id"]; exists && oldRaw != nil {
+		old, ok := oldRaw.(float64)
+		if !ok {
+			return nil, fmt.Errorf("old_program_id must be a number")
+		}
+		args.OldProgramID = int(old)
+	}
+
+	return ebpf.UpdateLink(args)
+}
+
+func init() {
+	RegisterTool(types.Tool{
+		ID:          "update_link",
+		Title:       "Update eBPF Link",
+		Description: "Atomically replaces the program behind an existing link without detaching it.",
+		InputSchema: map[string]interface{}{
+			"type":     "object",
+			"required": []string{"program_id"},
+			"properties": map[string]interface{}{
+				"link_id": map[string]interface{}{
+					"type":        "integer",
+					"description": "Kernel ID of the link to update",
+				},
+				"pin_path": map[string]interface{}{
+					"type":        "string",
+					"description": "Path the link is pinned at under /sys/fs/bpf",
+				},
+				"handle": map[string]interface{}{
+					"type":        "string",
+					"description": "Server handle of the link",
+				},
+				"program_id": map[string]interface{}{
+					"type":        "integer",
+					"description": "ID of the program the link should run",
+				},
+				"old_program_id": map[string]interface{}{
+					"type":        "integer",
+					"description": "Only update if the link still runs this program",
+				},
+			},
+		},
+		OutputSchema: map[string]interface{}{
+			"type":     "object",
+			"required": []string{"success", "tool_version"},
+			"properties": map[string]interface{}{
+				"success":        map[string]interface{}{"type": "boolean"},
+				"tool_version":   map[string]interface{}{"type": "string"},
+				"link_id":        map[string]interface{}{"type": "integer"},
+				"handle":         map[string]interface{}{"type": "string"},
+				"old_program_id": map[string]interface{}{"type": "integer"},
+				"new_program_id": map[string]interface{}{"type": "integer"},
+				"released":       map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "object"}},
+				"message":        map[string]interface{}{"type": "string"},
+				"error":          map[string]interface{}{"type": "string"},
+			},
+		},
+		Annotations: map[string]interface{}{
+			"title":          "Update Link",
+			"idempotentHint": true,
+			"readOnlyHint":   false,
+		},
+		Call: UpdateLinkTool,
+	})
+}
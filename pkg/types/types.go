@@ -1,5 +1,7 @@
 package types
 
+import "context"
+
 type RPCRequest struct {
 	JSONRPC string                 `json:"jsonrpc"`
 	Method  string                 `json:"method"`
@@ -41,14 +43,14 @@ func NewErrorResponseWithCode(id interface{}, code int, message string) RPCRespo
 }
 
 type Tool struct {
-	ID           string                                                `json:"id"`
-	Title        string                                                `json:"title"`
-	Description  string                                                `json:"description"`
-	InputSchema  map[string]interface{}                                `json:"input_schema"`
-	OutputSchema map[string]interface{}                                `json:"output_schema"`
-	Annotations  map[string]interface{}                                `json:"annotations,omitempty"`
-	Call         func(map[string]interface{}) (interface{}, error)     `json:"-"`
-	Stream       func(map[string]interface{}, func(interface{})) error `json:"-"` // 👈 add this
+	ID           string                                                                 `json:"id"`
+	Title        string                                                                 `json:"title"`
+	Description  string                                                                 `json:"description"`
+	InputSchema  map[string]interface{}                                                 `json:"input_schema"`
+	OutputSchema map[string]interface{}                                                 `json:"output_schema"`
+	Annotations  map[string]interface{}                                                 `json:"annotations,omitempty"`
+	Call         func(context.Context, map[string]interface{}) (interface{}, error)     `json:"-"`
+	Stream       func(context.Context, map[string]interface{}, func(interface{})) error `json:"-"`
 }
 
 func (t Tool) Metadata() ToolMetadata {